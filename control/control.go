@@ -108,3 +108,28 @@ func PortReuseControl(network string, address string, c syscall.RawConn) error {
 func PortReuse(fd FdPtr) error {
 	return portReuse(fd)
 }
+
+// Transparent Set IP_TRANSPARENT (IPV6_TRANSPARENT) on fd, so it binds and accepts the addresses of others as iptables TPROXY needs.
+func Transparent(fd FdPtr) error {
+	return transparent(fd)
+}
+
+func IsTransparent(fd FdPtr) bool {
+	return isTransparent(fd)
+}
+
+// TransparentControl The Control of a net.ListenConfig for TPROXY: transparent and address reuse,
+// udp sockets also get the original destinations of the datagrams (see ParseOrigDstAddr).
+func TransparentControl(network string, address string, c syscall.RawConn) error {
+	return transparentControl(network, address, c)
+}
+
+// OriginalDst The destination of a tcp connection before iptables REDIRECT (SO_ORIGINAL_DST).
+func OriginalDst(fd FdPtr) (netip.AddrPort, error) {
+	return originalDst(fd)
+}
+
+// ParseOrigDstAddr The original destination of a udp datagram from its control messages (IP_RECVORIGDSTADDR).
+func ParseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	return parseOrigDstAddr(oob)
+}
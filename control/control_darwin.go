@@ -3,6 +3,7 @@
 package control
 
 import (
+	"errors"
 	"golang.org/x/sys/unix"
 	"net/netip"
 	"strings"
@@ -233,3 +234,23 @@ func addrToString(addr *sockaddr) string {
 	}
 	return netip.AddrPortFrom(ap, uint16(port)).String()
 }
+
+func transparent(fd FdPtr) error {
+	return errors.New("not supported")
+}
+
+func isTransparent(fd FdPtr) bool {
+	return false
+}
+
+func transparentControl(network string, address string, c syscall.RawConn) error {
+	return errors.New("not supported")
+}
+
+func originalDst(fd FdPtr) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not supported")
+}
+
+func parseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not supported")
+}
@@ -3,6 +3,8 @@
 package control
 
 import (
+	"encoding/binary"
+	"errors"
 	"golang.org/x/sys/unix"
 	"net/netip"
 	"strings"
@@ -233,3 +235,93 @@ func addrToString(addr *sockaddr) string {
 	}
 	return netip.AddrPortFrom(ap, uint16(port)).String()
 }
+
+// soOriginalDst SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv4.h and netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+func transparent(fd FdPtr) error {
+	if isV6(fd) {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
+
+func isTransparent(fd FdPtr) bool {
+	level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+	if isV6(fd) {
+		level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+	}
+	v, err := unix.GetsockoptInt(fd, level, opt)
+	return err == nil && v != 0
+}
+
+func transparentControl(network string, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = transparent(FdPtr(fd))
+		if err != nil {
+			return
+		}
+		err = unix.SetsockoptInt(FdPtr(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err != nil || parseNetworkToType(network) != unix.SOCK_DGRAM {
+			return
+		}
+		// a v6 socket also takes the datagrams of v4-mapped addresses
+		err = unix.SetsockoptInt(FdPtr(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		if err != nil || !isV6(FdPtr(fd)) {
+			return
+		}
+		err = unix.SetsockoptInt(FdPtr(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func originalDst(fd FdPtr) (netip.AddrPort, error) {
+	if isV6(fd) {
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+		return netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port), nil
+	}
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	// a sockaddr_in: family, port and address
+	b := mreq.Multiaddr
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4])), nil
+}
+
+func parseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, msg := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msg)
+		if err != nil {
+			continue
+		}
+		switch addr := sa.(type) {
+		case *unix.SockaddrInet4:
+			return netip.AddrPortFrom(netip.AddrFrom4(addr.Addr), uint16(addr.Port)), nil
+		case *unix.SockaddrInet6:
+			return netip.AddrPortFrom(netip.AddrFrom16(addr.Addr).Unmap(), uint16(addr.Port)), nil
+		}
+	}
+	return netip.AddrPort{}, errors.New("no original destination")
+}
+
+func isV6(fd FdPtr) bool {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return false
+	}
+	_, ok := sa.(*unix.SockaddrInet6)
+	return ok
+}
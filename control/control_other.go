@@ -4,6 +4,7 @@ package control
 
 import (
 	"errors"
+	"net/netip"
 	"strings"
 	"syscall"
 )
@@ -118,3 +119,23 @@ func parseNetworkToProto(network string) int {
 func addrToString(addr *sockaddr) string {
 	return ""
 }
+
+func transparent(fd FdPtr) error {
+	return errors.New("not supported")
+}
+
+func isTransparent(fd FdPtr) bool {
+	return false
+}
+
+func transparentControl(network string, address string, c syscall.RawConn) error {
+	return errors.New("not supported")
+}
+
+func originalDst(fd FdPtr) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not supported")
+}
+
+func parseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not supported")
+}
@@ -230,3 +230,23 @@ func addrToString(addr *sockaddr) string {
 	}
 	return netip.AddrPortFrom(ap, uint16(port)).String()
 }
+
+func transparent(fd FdPtr) error {
+	return errors.New("not support")
+}
+
+func isTransparent(fd FdPtr) bool {
+	return false
+}
+
+func transparentControl(network string, address string, c syscall.RawConn) error {
+	return errors.New("not support")
+}
+
+func originalDst(fd FdPtr) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not support")
+}
+
+func parseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not support")
+}
@@ -2,6 +2,7 @@ package ecdsa
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -136,6 +137,11 @@ func (e EcdsaCert) Verify(hashText []byte, sign []byte, key []byte) (ok bool, er
 }
 
 func (e EcdsaCert) GenEcdsaCert(c elliptic.Curve, template *x509.Certificate) (cert, key []byte, err error) {
+	return e.GenEcdsaCertWithParent(c, template, nil, nil)
+}
+
+// GenEcdsaCertWithParent Like GenEcdsaCert, the certificate is signed by parent and its private key parentKey, self-signed when parent is nil.
+func (e EcdsaCert) GenEcdsaCertWithParent(c elliptic.Curve, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (cert, key []byte, err error) {
 	if template == nil {
 		max := new(big.Int).Lsh(big.NewInt(1), 128)
 		serialNumber, err := rand.Int(rand.Reader, max)
@@ -151,7 +157,13 @@ func (e EcdsaCert) GenEcdsaCert(c elliptic.Curve, template *x509.Certificate) (c
 	if err != nil {
 		return nil, nil, err
 	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &pk.PublicKey, pk)
+	var signer crypto.Signer = pk
+	if parent == nil {
+		parent = template
+	} else {
+		signer = parentKey
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &pk.PublicKey, signer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -248,6 +248,11 @@ func (r RsaCert) Verify(hashText []byte, sign []byte, key []byte) (ok bool, err
 }
 
 func (r RsaCert) GenRsaCert(bits int, template *x509.Certificate) (cert, key []byte, err error) {
+	return r.GenRsaCertWithParent(bits, template, nil, nil)
+}
+
+// GenRsaCertWithParent Like GenRsaCert, the certificate is signed by parent and its private key parentKey, self-signed when parent is nil.
+func (r RsaCert) GenRsaCertWithParent(bits int, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (cert, key []byte, err error) {
 	if template == nil {
 		max := new(big.Int).Lsh(big.NewInt(1), 128)
 		serialNumber, err := rand.Int(rand.Reader, max)
@@ -262,7 +267,13 @@ func (r RsaCert) GenRsaCert(bits int, template *x509.Certificate) (cert, key []b
 	if err != nil {
 		return nil, nil, err
 	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &pk.PublicKey, pk)
+	var signer crypto.Signer = pk
+	if parent == nil {
+		parent = template
+	} else {
+		signer = parentKey
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &pk.PublicKey, signer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -44,12 +44,13 @@ func (p *GPool) worker() {
 }
 
 func (p *GPool) Do(task func()) bool {
+	p.twg.Add(1)
 	select {
 	case <-p.ctx.Done():
+		p.twg.Done()
 		task()
 		return false
 	case p.tasks <- task:
-		p.twg.Add(1)
 		return true
 	}
 }
@@ -3,6 +3,8 @@ package gpool
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,3 +44,20 @@ func TestEmpty(t *testing.T) {
 	gp.Stop()
 	gp.Wait()
 }
+
+func TestDoCountsBeforeHandOff(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	gp := NewGPool(context.Background(), 8)
+	defer gp.Stop()
+	var n atomic.Int64
+	for i := 0; i < 100000; i++ {
+		// a task done before Do counted it drove the wait group negative
+		gp.Do(func() {
+			n.Add(1)
+		})
+	}
+	gp.Wait()
+	if n.Load() != 100000 {
+		t.Fatal(n.Load())
+	}
+}
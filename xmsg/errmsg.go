@@ -10,4 +10,7 @@ var (
 	ErrDataOutputTypeInvalid     = xerror.New("unmarshal: output type invalid")
 	ErrDataOutputNotData         = xerror.New("unmarshal: not data")
 	ErrDataOutputError           = xerror.New("%v")
+
+	ErrSessionSuspended = xerror.New("session suspended")
+	ErrSessionClosed    = xerror.New("session closed")
 )
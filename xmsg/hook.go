@@ -0,0 +1,56 @@
+package xmsg
+
+// Direction Which way an XMsg is travelling when it is seen by a Hook.
+type Direction uint8
+
+const (
+	DirectionRead Direction = iota
+	DirectionWrite
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionRead:
+		return "read"
+	case DirectionWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// Hook
+//
+//	Called with every decrypted XMsg read from or written to a RawSession, including the session's own ping and pong.
+//	The returned XMsg replaces the original one, returning nil drops it silently,
+//	and returning an error aborts the read or write with that error.
+type Hook func(rs *RawSession, dir Direction, xMsg *XMsg) (*XMsg, error)
+
+// NewXMsg Build a message the same way a launcher does, mostly useful to rewrite messages inside a Hook.
+func NewXMsg(header string, flag flagEnum, id uint32, opt OptType, data any) (*XMsg, error) {
+	return newXMsg(header, flag, id, opt, data)
+}
+
+// Payload The marshaled data of the message, including its leading data type byte.
+func (x *XMsg) Payload() []byte {
+	if x == nil {
+		return nil
+	}
+	return x.data
+}
+
+// SetPayload Replace the marshaled data of the message, b must come from Payload.
+func (x *XMsg) SetPayload(b []byte) {
+	x.data = b
+}
+
+func (x *XMsg) Clone() *XMsg {
+	if x == nil {
+		return nil
+	}
+	c := *x
+	if x.data != nil {
+		c.data = append([]byte(nil), x.data...)
+	}
+	return &c
+}
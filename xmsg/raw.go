@@ -97,6 +97,7 @@ func NewXWriteLauncher(writer io.Writer, cp protocol.Protocol, flag flagEnum) XW
 		writer: writer,
 		cp:     cp,
 		flag:   flag,
+		id:     new(uint32),
 	}
 }
 
@@ -104,7 +105,7 @@ type xWriteLauncher struct {
 	writer io.Writer
 	cp     protocol.Protocol
 	flag   flagEnum
-	id     uint32
+	id     *uint32
 }
 
 func (x *xWriteLauncher) SendXMsg(header string, id uint32, opt OptType, data any) (xid uint32, n int, err error) {
@@ -115,16 +116,7 @@ func (x *xWriteLauncher) SendXMsg(header string, id uint32, opt OptType, data an
 	if err != nil {
 		return 0, 0, err
 	}
-	b, err := xMsg.marshal()
-	if err != nil {
-		return 0, 0, err
-	}
-	l := len(b)
-	if wc, ok := x.writer.(bio.FlowWriter); ok {
-		l = 0
-		defer wc.Count(&l)()
-	}
-	err = x.cp.Encode(x.writer, b)
+	l, err := x.writeXMsg(xMsg)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -139,24 +131,29 @@ func (x *xWriteLauncher) RecvXMsg(header string, id uint32, opt OptType, data an
 	if err != nil {
 		return 0, 0, err
 	}
-	b, err := xMsg.marshal()
+	l, err := x.writeXMsg(xMsg)
 	if err != nil {
 		return 0, 0, err
 	}
+	return id, l, nil
+}
+
+func (x *xWriteLauncher) writeXMsg(xMsg *XMsg) (int, error) {
+	b, err := xMsg.marshal()
+	if err != nil {
+		return 0, err
+	}
 	l := len(b)
 	if wc, ok := x.writer.(bio.FlowWriter); ok {
 		l = 0
 		defer wc.Count(&l)()
 	}
 	err = x.cp.Encode(x.writer, b)
-	if err != nil {
-		return 0, 0, err
-	}
-	return id, l, nil
+	return l, err
 }
 
 func (x *xWriteLauncher) getId() uint32 {
-	for id := atomic.AddUint32(&x.id, 1); ; {
+	for id := atomic.AddUint32(x.id, 1); ; {
 		if id != 0 {
 			return id
 		}
@@ -2,6 +2,7 @@ package xmsg
 
 import (
 	"context"
+	"errors"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/protocol"
 	"github.com/peakedshout/go-pandorasbox/protocol/jsonprotocol"
@@ -19,6 +20,11 @@ type SessionConfig struct {
 	KeepLive time.Duration
 	Ctx      context.Context
 	Flag     flagEnum
+	Hook     Hook
+	// ResumeTime keeps the session alive for that long after its RWC fails, waiting for Reattach.
+	ResumeTime time.Duration
+	// OnSuspend is called in its own goroutine every time the session loses its RWC.
+	OnSuspend func(rs *RawSession)
 }
 
 type RawSession struct {
@@ -31,6 +37,14 @@ type RawSession struct {
 	closer   sync.Once
 	launcher XLauncher
 	monitor  xnetutil.Monitor
+	flag     flagEnum
+	hook     Hook
+
+	mux        sync.Mutex
+	resumeTime time.Duration
+	onSuspend  func(rs *RawSession)
+	attached   chan struct{} // closed while rwc is usable
+	gen        uint64
 }
 
 func NewSession(cfg SessionConfig) *RawSession {
@@ -42,17 +56,24 @@ func NewSession(cfg SessionConfig) *RawSession {
 		rwc:     cfg.RWC,
 		cp:      cfg.Protocol,
 		monitor: xnetutil.NewMonitor(),
+		flag:    cfg.Flag,
+		hook:    cfg.Hook,
+
+		resumeTime: cfg.ResumeTime,
+		onSuspend:  cfg.OnSuspend,
+		attached:   make(chan struct{}),
 	}
+	close(s.attached)
 	if s.cp == nil {
 		s.cp = &jsonprotocol.JsonProtocol{}
 	}
 	s.launcher = NewXLauncher(cfg.RWC, cfg.Protocol, cfg.Flag)
 	ctx, cancel := context.WithCancel(cfg.Ctx)
 	s.ctx, s.cl = ctx, cancel
+	s.delay = ticker.NewTicker(s.ctx)
 	ctxtool.GWaitFunc(s.ctx, func() {
 		_ = s.Close()
 	})
-	s.delay = ticker.NewTicker(s.ctx)
 	if cfg.KeepLive != 0 {
 		go s.keepLive(cfg.KeepLive)
 	}
@@ -69,7 +90,10 @@ func (rs *RawSession) Close() error {
 		rs.delay.Stop()
 		rs.monitor.Dead()
 	})
-	return rs.rwc.Close()
+	rs.mux.Lock()
+	rwc := rs.rwc
+	rs.mux.Unlock()
+	return rwc.Close()
 }
 
 func (rs *RawSession) Context() context.Context {
@@ -79,11 +103,29 @@ func (rs *RawSession) Context() context.Context {
 func (rs *RawSession) ReadXMsg() (xMsg *XMsg, n int, err error) {
 	xMsg = new(XMsg)
 	for r := true; r; {
-		xMsg, n, err = rs.launcher.ReadXMsg()
+		launcher, rwc, attached := rs.state()
+		select {
+		case <-attached:
+		case <-rs.ctx.Done():
+			return nil, 0, ErrSessionClosed
+		}
+		xMsg, n, err = launcher.ReadXMsg()
 		if err != nil {
+			if rs.suspend(rwc) {
+				continue
+			}
 			return nil, 0, err
 		}
 		rs.monitor.AddCount(n, 0)
+		if rs.hook != nil {
+			xMsg, err = rs.hook(rs, DirectionRead, xMsg)
+			if err != nil {
+				return nil, 0, err
+			}
+			if xMsg == nil {
+				continue
+			}
+		}
 		r, err = rs.preHandle(xMsg)
 		if err != nil {
 			return nil, 0, err
@@ -93,20 +135,142 @@ func (rs *RawSession) ReadXMsg() (xMsg *XMsg, n int, err error) {
 }
 
 func (rs *RawSession) SendXMsg(header string, id uint32, opt OptType, data any) (xid uint32, n int, err error) {
-	xid, n, err = rs.launcher.SendXMsg(header, id, opt, data)
-	rs.monitor.AddCount(0, n)
-	return xid, n, err
+	return rs.write(header, id, rs.flag, opt, data)
 }
 
 func (rs *RawSession) RecvXMsg(header string, id uint32, opt OptType, data any) (xid uint32, n int, err error) {
-	xid, n, err = rs.launcher.RecvXMsg(header, id, opt, data)
-	rs.monitor.AddCount(0, n)
-	return xid, n, err
+	return rs.write(header, id, rs.flag^1, opt, data)
 }
 
 func (rs *RawSession) GetXMsgId() uint32 {
-	i := rs.launcher.(*xLauncher)
-	return i.XWriteLauncher.(*xWriteLauncher).getId()
+	launcher, _, _ := rs.state()
+	return writeLauncher(launcher).getId()
+}
+
+func writeLauncher(launcher XLauncher) *xWriteLauncher {
+	i := launcher.(*xLauncher)
+	return i.XWriteLauncher.(*xWriteLauncher)
+}
+
+func (rs *RawSession) write(header string, id uint32, flag flagEnum, opt OptType, data any) (uint32, int, error) {
+	launcher, rwc, attached := rs.state()
+	select {
+	case <-attached:
+	default:
+		return 0, 0, ErrSessionSuspended
+	}
+	wl := writeLauncher(launcher)
+	if id == 0 {
+		id = wl.getId()
+	}
+	xMsg, err := newXMsg(header, flag, id, opt, data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rs.hook != nil {
+		xMsg, err = rs.hook(rs, DirectionWrite, xMsg)
+		if err != nil {
+			return 0, 0, err
+		}
+		if xMsg == nil {
+			return id, 0, nil
+		}
+	}
+	n, err := wl.writeXMsg(xMsg)
+	rs.monitor.AddCount(0, n)
+	if err != nil {
+		if rs.suspend(rwc) {
+			return 0, 0, ErrSessionSuspended
+		}
+		return 0, 0, err
+	}
+	return id, n, nil
+}
+
+// Suspended Whether the session lost its RWC and waits for Reattach.
+func (rs *RawSession) Suspended() bool {
+	_, _, attached := rs.state()
+	select {
+	case <-attached:
+		return false
+	default:
+		return true
+	}
+}
+
+// Suspend Drop the current RWC as if it failed, the session must have a ResumeTime.
+func (rs *RawSession) Suspend() bool {
+	_, rwc, _ := rs.state()
+	return rs.suspend(rwc)
+}
+
+// Reattach
+//
+//	Bind a new RWC to the session, the current one is closed if the session was not suspended.
+//	Message ids keep growing from where they were, the protocol may differ from the previous one.
+func (rs *RawSession) Reattach(rwc io.ReadWriteCloser, cp protocol.Protocol) error {
+	rs.mux.Lock()
+	if rs.ctx.Err() != nil {
+		rs.mux.Unlock()
+		return ErrSessionClosed
+	}
+	old := rs.rwc
+	launcher := NewXLauncher(rwc, cp, rs.flag)
+	writeLauncher(launcher).id = writeLauncher(rs.launcher).id
+	rs.rwc, rs.cp, rs.launcher = rwc, cp, launcher
+	rs.gen++
+	select {
+	case <-rs.attached:
+	default:
+		close(rs.attached)
+	}
+	rs.mux.Unlock()
+	if old != rwc {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func (rs *RawSession) state() (XLauncher, io.ReadWriteCloser, chan struct{}) {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	return rs.launcher, rs.rwc, rs.attached
+}
+
+// suspend Detach rwc after it failed, false means the session can not be resumed.
+func (rs *RawSession) suspend(rwc io.ReadWriteCloser) bool {
+	if rs.resumeTime <= 0 || rs.ctx.Err() != nil {
+		return false
+	}
+	rs.mux.Lock()
+	if rs.rwc != rwc {
+		// already replaced
+		rs.mux.Unlock()
+		return true
+	}
+	select {
+	case <-rs.attached:
+	default:
+		rs.mux.Unlock()
+		return true
+	}
+	rs.attached = make(chan struct{})
+	rs.gen++
+	gen := rs.gen
+	rs.mux.Unlock()
+	_ = rwc.Close()
+	time.AfterFunc(rs.resumeTime, func() {
+		rs.mux.Lock()
+		expired := rs.gen == gen
+		rs.mux.Unlock()
+		if expired {
+			_ = rs.Close()
+		}
+	})
+	if rs.onSuspend != nil {
+		go rs.onSuspend(rs)
+	}
+	return true
 }
 
 func (rs *RawSession) GetDelay() time.Duration {
@@ -122,6 +286,9 @@ func (rs *RawSession) GetDelay() time.Duration {
 func (rs *RawSession) Delay(ctx context.Context) time.Duration {
 	return rs.delay.DelayOnce(ctx, func(id string) error {
 		_, _, err := rs.SendXMsg("", 0, optPing, id)
+		if errors.Is(err, ErrSessionSuspended) {
+			return nil
+		}
 		return err
 	})
 }
@@ -132,6 +299,9 @@ func (rs *RawSession) Delay(ctx context.Context) time.Duration {
 func (rs *RawSession) DelayTick(ctx context.Context, interval time.Duration) <-chan time.Duration {
 	return rs.delay.DelayTick(ctx, interval, func(id string) error {
 		_, _, err := rs.SendXMsg("", 0, optPing, id)
+		if errors.Is(err, ErrSessionSuspended) {
+			return nil
+		}
 		return err
 	})
 }
@@ -2,6 +2,7 @@ package xmsg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/pcrypto/aesgcm"
@@ -194,3 +195,56 @@ func TestDelay(t *testing.T) {
 	fmt.Println(s2.Delay(nil))
 	wg.Done()
 }
+
+func TestSessionReattach(t *testing.T) {
+	cp := cfcprotocol.CFCPlaintext
+	c1, c2 := net.Pipe()
+	suspended := make(chan struct{}, 1)
+	s1 := NewSession(SessionConfig{
+		RWC:        c1,
+		Protocol:   cp,
+		Flag:       FlagOne,
+		ResumeTime: 5 * time.Second,
+		OnSuspend: func(rs *RawSession) {
+			suspended <- struct{}{}
+		},
+	})
+	defer s1.Close()
+	s2 := NewSession(SessionConfig{RWC: c2, Protocol: cp, Flag: FlagOne})
+	defer s2.Close()
+	id := s1.GetXMsgId()
+	_ = c2.Close()
+	_, _, err := s1.SendXMsg("header", 0, OptMsg, "lost")
+	if !errors.Is(err, ErrSessionSuspended) {
+		t.Fatal(err)
+	}
+	<-suspended
+	if !s1.Suspended() {
+		t.Fatal()
+	}
+	c3, c4 := net.Pipe()
+	err = s1.Reattach(c3, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := NewSession(SessionConfig{RWC: c4, Protocol: cp, Flag: FlagOne})
+	defer s3.Close()
+	go func() {
+		_, _, _ = s1.SendXMsg("header", 0, OptMsg, "found")
+	}()
+	xMsg, _, err := s3.ReadXMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var str string
+	err = xMsg.Unmarshal(&str)
+	if err != nil || str != "found" {
+		t.Fatal(err, str)
+	}
+	if xMsg.Id() <= id {
+		t.Fatal(xMsg.Id(), id)
+	}
+	if s1.Suspended() || s1.Context().Err() != nil {
+		t.Fatal()
+	}
+}
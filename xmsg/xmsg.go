@@ -11,6 +11,9 @@ import (
 // NoBytes Use it to wrap raw json data instead of being wrapped into bytes for transmission.
 type NoBytes []byte
 
+// RawPayload Use it to send data that is already marshaled, such as XMsg.Payload, without touching it.
+type RawPayload []byte
+
 type OptType byte
 
 type flagEnum byte
@@ -90,6 +93,10 @@ func (x *XMsg) NilData() bool {
 
 // Unmarshal If the transmitted content is of type error, then it will not be filled out, but will be returned from the function.
 func (x *XMsg) Unmarshal(out any) (err error) {
+	if o, ok := out.(*RawPayload); ok {
+		*o = x.data
+		return nil
+	}
 	rv := reflect.ValueOf(out)
 	if len(x.data) == 0 {
 		return ErrDataOutputNotData
@@ -150,6 +157,10 @@ func (x *XMsg) Marshal(data any) error {
 		x.data = nil
 		return nil
 	}
+	if v, ok := data.(RawPayload); ok {
+		x.data = v
+		return nil
+	}
 	bs := new(bytes.Buffer)
 	switch v := data.(type) {
 	case []byte:
@@ -7,13 +7,63 @@ import (
 	"github.com/peakedshout/go-pandorasbox/ccw/closer"
 	"github.com/peakedshout/go-pandorasbox/tool/bio"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Config The disguise of a fake http conn, nil is the default of every field.
+type Config struct {
+	// Path The request path, "/" by default.
+	Path string
+	// Host The Host header (:authority), the remote address by default.
+	Host string
+	// Header The extra headers of the requests (client) or responses (server).
+	Header http.Header
+	// Padding Up to Padding random bytes are added to every write, 0 disables it.
+	// They are a header on http/1.1, the frame padding on h2 and reserved frames on h3.
+	Padding int
+}
+
+func (c *Config) path() string {
+	if c == nil || c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+func (c *Config) host(raddr net.Addr) string {
+	if c == nil || c.Host == "" {
+		return raddr.String()
+	}
+	return c.Host
+}
+
+// headerFields The lowercase name and value pairs of Header, as h2 and h3 carry them.
+func (c *Config) headerFields() []string {
+	if c == nil {
+		return nil
+	}
+	var kv []string
+	for k, vs := range c.Header {
+		for _, v := range vs {
+			kv = append(kv, strings.ToLower(k), v)
+		}
+	}
+	return kv
+}
+
+func (c *Config) padding() int {
+	if c == nil || c.Padding <= 0 {
+		return 0
+	}
+	return rand.Intn(c.Padding + 1)
+}
+
 type FakeHttpConn struct {
 	isClient bool
 	conn     net.Conn
@@ -26,24 +76,36 @@ type FakeHttpConn struct {
 	raddr    net.Addr
 	closer   closer.Closer
 
+	fhCfg          *Config
 	clientTemplate http.Request
 	serverTemplate http.Response
 }
 
 func Server(conn net.Conn, cfg *tls.Config) net.Conn {
-	return newFakeHttpConn(false, conn, cfg)
+	return newFakeHttpConn(false, conn, cfg, nil)
 }
 
 func Client(conn net.Conn, cfg *tls.Config) net.Conn {
-	return newFakeHttpConn(true, conn, cfg)
+	return newFakeHttpConn(true, conn, cfg, nil)
+}
+
+// ServerWithConfig Server with the path, host and padding of fhCfg.
+func ServerWithConfig(conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
+	return newFakeHttpConn(false, conn, cfg, fhCfg)
+}
+
+// ClientWithConfig Client with the path, host and padding of fhCfg.
+func ClientWithConfig(conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
+	return newFakeHttpConn(true, conn, cfg, fhCfg)
 }
 
-func newFakeHttpConn(isClient bool, conn net.Conn, cfg *tls.Config) net.Conn {
+func newFakeHttpConn(isClient bool, conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
 	fhc := &FakeHttpConn{
 		isClient: isClient,
 		conn:     conn,
 		cfg:      cfg,
 		closer:   closer.NewCloser(),
+		fhCfg:    fhCfg,
 	}
 	if fhc.cfg != nil {
 		if fhc.isClient {
@@ -163,6 +225,7 @@ func (fhc *FakeHttpConn) writeClient(b []byte) (n int, err error) {
 	l := len(b)
 	req.Body = bio.NewNoCloseBody(b)
 	req.ContentLength = int64(l)
+	req.Header = fhc.paddingHeader()
 	err = req.Write(fhc.conn)
 	if err != nil {
 		return 0, err
@@ -175,6 +238,7 @@ func (fhc *FakeHttpConn) writeServer(b []byte) (n int, err error) {
 	l := len(b)
 	resp.Body = bio.NewNoCloseBody(b)
 	resp.ContentLength = int64(l)
+	resp.Header = fhc.paddingHeader()
 	err = resp.Write(fhc.conn)
 	if err != nil {
 		return 0, err
@@ -182,14 +246,33 @@ func (fhc *FakeHttpConn) writeServer(b []byte) (n int, err error) {
 	return l, nil
 }
 
+func (fhc *FakeHttpConn) paddingHeader() http.Header {
+	var header http.Header
+	if fhc.fhCfg != nil {
+		header = fhc.fhCfg.Header.Clone()
+	}
+	n := fhc.fhCfg.padding()
+	if n == 0 {
+		return header
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("X-Padding", strings.Repeat("0", n))
+	return header
+}
+
 func (fhc *FakeHttpConn) makeTemplate() {
 	if fhc.isClient {
 		u, _ := url.Parse(fhc.raddr.Network() + "://" + fhc.raddr.String())
+		if ru, err := url.ParseRequestURI(fhc.fhCfg.path()); err == nil {
+			u.Path, u.RawPath, u.RawQuery = ru.Path, ru.RawPath, ru.RawQuery
+		}
 		fhc.clientTemplate = http.Request{
 			Method:        http.MethodGet,
 			URL:           u,
 			ContentLength: 0,
-			Host:          fhc.raddr.String(),
+			Host:          fhc.fhCfg.host(fhc.raddr),
 		}
 	} else {
 		fhc.serverTemplate = http.Response{
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,7 +31,7 @@ func TestFakeHttpConn1(t *testing.T) {
 			t.Error(err)
 		}
 		defer conn.Close()
-		hconn := newFakeHttpConn(false, conn, nil)
+		hconn := newFakeHttpConn(false, conn, nil, nil)
 		defer hconn.Close()
 		buf := make([]byte, len(data))
 		n, err := io.ReadFull(hconn, buf)
@@ -48,7 +50,7 @@ func TestFakeHttpConn1(t *testing.T) {
 		t.Error(err)
 	}
 	defer conn.Close()
-	hconn := newFakeHttpConn(true, conn, nil)
+	hconn := newFakeHttpConn(true, conn, nil, nil)
 	defer hconn.Close()
 	_, err = hconn.Write(data)
 	if err != nil {
@@ -78,7 +80,7 @@ func TestFakeHttpConn2(t *testing.T) {
 			t.Error(err)
 		}
 		defer conn.Close()
-		hconn := newFakeHttpConn(false, conn, nil)
+		hconn := newFakeHttpConn(false, conn, nil, nil)
 		defer hconn.Close()
 		buf := make([]byte, len(data))
 		n, err := io.ReadFull(hconn, buf)
@@ -139,7 +141,7 @@ func TestFakeHttpConn3(t *testing.T) {
 		t.Error(err)
 	}
 	defer conn.Close()
-	hconn := newFakeHttpConn(true, conn, nil)
+	hconn := newFakeHttpConn(true, conn, nil, nil)
 	defer hconn.Close()
 	_, err = hconn.Write(data)
 	if err != nil {
@@ -178,7 +180,7 @@ func TestFakeHttpConn4(t *testing.T) {
 			t.Error(err)
 		}
 		defer conn.Close()
-		hconn := newFakeHttpConn(false, conn, cfg)
+		hconn := newFakeHttpConn(false, conn, cfg, nil)
 		defer hconn.Close()
 		buf := make([]byte, len(data))
 		n, err := io.ReadFull(hconn, buf)
@@ -197,7 +199,7 @@ func TestFakeHttpConn4(t *testing.T) {
 		t.Error(err)
 	}
 	defer conn.Close()
-	hconn := newFakeHttpConn(true, conn, cfg)
+	hconn := newFakeHttpConn(true, conn, cfg, nil)
 	defer hconn.Close()
 	_, err = hconn.Write(data)
 	if err != nil {
@@ -237,7 +239,7 @@ func TestFakeHttpConn5(t *testing.T) {
 			t.Error(err)
 		}
 		defer conn.Close()
-		hconn := newFakeHttpConn(false, conn, cfg)
+		hconn := newFakeHttpConn(false, conn, cfg, nil)
 		defer hconn.Close()
 		buf := make([]byte, len(data))
 		n, err := io.ReadFull(hconn, buf)
@@ -311,7 +313,7 @@ func TestFakeHttpConn6(t *testing.T) {
 		t.Error(err)
 	}
 	defer conn.Close()
-	hconn := newFakeHttpConn(true, conn, cfg)
+	hconn := newFakeHttpConn(true, conn, cfg, nil)
 	defer hconn.Close()
 	_, err = hconn.Write(data)
 	if err != nil {
@@ -346,3 +348,233 @@ func (h *handle) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 }
+
+func testFakeHttpEcho(t *testing.T, server func(net.Conn) net.Conn, client func(net.Conn) net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hconn := server(conn)
+		defer hconn.Close()
+		_, _ = io.Copy(hconn, hconn)
+	}()
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hconn := client(conn)
+	defer hconn.Close()
+	for _, size := range []int{1, 1024, 100 * 1024} {
+		data := bytes.Repeat([]byte("12313123"), size)
+		_, err = hconn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(hconn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatal("data fatal")
+		}
+	}
+}
+
+func TestFakeHttpConfig(t *testing.T) {
+	fhCfg := &Config{Path: "/api/v1?x=1", Host: "example.com", Padding: 64}
+	testFakeHttpEcho(t, func(conn net.Conn) net.Conn {
+		return ServerWithConfig(conn, nil, fhCfg)
+	}, func(conn net.Conn) net.Conn {
+		return ClientWithConfig(conn, nil, fhCfg)
+	})
+}
+
+func TestFakeHttp2Conn(t *testing.T) {
+	cert, key, err := rsa.PCryptoRsaCert.GenRsaCert(1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{c}, InsecureSkipVerify: true}
+	fhCfg := &Config{Path: "/pb.Tunnel/Stream", Host: "example.com", Padding: 200}
+	testFakeHttpEcho(t, func(conn net.Conn) net.Conn {
+		return Http2Server(conn, cfg, fhCfg)
+	}, func(conn net.Conn) net.Conn {
+		return Http2Client(conn, cfg, fhCfg)
+	})
+}
+
+func TestFakeHttp2ConnStd(t *testing.T) {
+	// the client talks to the h2 server of net/http
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/pb.Tunnel/Stream" || r.Host != "example.com" || r.Header.Get("X-Token") != "t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", grpcContentType)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				_, _ = w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hconn := Http2Client(conn, &tls.Config{InsecureSkipVerify: true}, &Config{
+		Path:    "/pb.Tunnel/Stream",
+		Host:    "example.com",
+		Header:  http.Header{"X-Token": []string{"t"}},
+		Padding: 10,
+	})
+	defer hconn.Close()
+	// more than the 1MB windows of net/http, the writer has to wait for its window updates
+	data := bytes.Repeat([]byte("12313123"), 512*1024)
+	_, err = hconn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(hconn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data fatal")
+	}
+}
+
+func TestFakeHttp3Conn(t *testing.T) {
+	fhCfg := &Config{Path: "/stream", Host: "example.com", Padding: 64}
+	testFakeHttpEcho(t, func(conn net.Conn) net.Conn {
+		return Http3Server(conn, fhCfg)
+	}, func(conn net.Conn) net.Conn {
+		return Http3Client(conn, fhCfg)
+	})
+	fields, err := qpackDecode(qpackEncode(":path", strings.Repeat("/x", 100), "k", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields[":path"] != strings.Repeat("/x", 100) || fields["k"] != "" {
+		t.Fatal("qpack fatal")
+	}
+}
+
+func testFakeHttpDuplex(t *testing.T, server func(net.Conn) net.Conn, client func(net.Conn) net.Conn) {
+	// both sides write and read in bulk at once
+	const size = 64 << 20
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ch := make(chan net.Conn, 1)
+	var raw net.Conn
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			ch <- nil
+			return
+		}
+		raw = conn
+		ch <- server(conn)
+	}()
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconn := client(conn)
+	defer cconn.Close()
+	sconn := <-ch
+	if sconn == nil {
+		t.FailNow()
+	}
+	defer sconn.Close()
+	data := bytes.Repeat([]byte("12313123"), 4096)
+	errCh := make(chan error, 4)
+	for _, hconn := range []net.Conn{cconn, sconn} {
+		hconn := hconn
+		go func() {
+			for i := 0; i < size/len(data); i++ {
+				_, err := hconn.Write(data)
+				if err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+		go func() {
+			n, err := io.Copy(io.Discard, io.LimitReader(hconn, size))
+			if err == nil && n != size {
+				err = io.ErrUnexpectedEOF
+			}
+			errCh <- err
+		}()
+	}
+	timer := time.NewTimer(20 * time.Second)
+	defer timer.Stop()
+	for i := 0; i < 4; i++ {
+		select {
+		case err = <-errCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timer.C:
+			// unblock the writers, or the closes wait for them
+			conn.Close()
+			raw.Close()
+			t.Fatal("no progress")
+		}
+	}
+}
+
+func TestFakeHttpDuplex(t *testing.T) {
+	testFakeHttpDuplex(t, func(conn net.Conn) net.Conn {
+		return Server(conn, nil)
+	}, func(conn net.Conn) net.Conn {
+		return Client(conn, nil)
+	})
+}
+
+func TestFakeHttp2Duplex(t *testing.T) {
+	cert, key, err := rsa.PCryptoRsaCert.GenRsaCert(1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{c}, InsecureSkipVerify: true}
+	fhCfg := &Config{Padding: 200}
+	testFakeHttpDuplex(t, func(conn net.Conn) net.Conn {
+		return Http2Server(conn, cfg, fhCfg)
+	}, func(conn net.Conn) net.Conn {
+		return Http2Client(conn, cfg, fhCfg)
+	})
+}
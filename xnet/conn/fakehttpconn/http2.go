@@ -0,0 +1,470 @@
+package fakehttpconn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/closer"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	h2StreamID      = 1
+	h2Window        = 1 << 30
+	h2InitialWindow = 65535
+	h2MaxChunk      = 16384 - 256
+	grpcContentType = "application/grpc"
+	grpcUserAgent   = "grpc-go/1.64.0"
+)
+
+var ErrHttp2StreamReset = errors.New("http2 stream reset")
+var ErrHttp2BadPreface = errors.New("bad http2 client preface")
+
+// FakeHttp2Conn A byte stream as the messages of a long-lived grpc call, stream 1 of an h2 connection over tls.
+type FakeHttp2Conn struct {
+	isClient bool
+	conn     net.Conn
+	fhCfg    *Config
+	framer   *http2.Framer
+	closer   closer.Closer
+	laddr    net.Addr
+	raddr    net.Addr
+
+	once  sync.Once
+	herr  error
+	ready bool
+
+	smux    sync.Mutex // one message of Write at a time
+	wmux    sync.Mutex
+	wbuf    bytes.Buffer
+	henc    *hpack.Encoder
+	replied bool
+
+	rmux    sync.Mutex
+	pending []byte
+	left    int
+	eof     bool
+
+	// the acks and window updates of the reader, written by controlLoop
+	cmux        sync.Mutex
+	settingsAck int
+	pings       [][8]byte
+	window      uint32
+	csig        chan struct{}
+	done        chan struct{}
+
+	// the send windows the peer gives to the connection and stream 1, guarded by cmux
+	sendConn   int64
+	sendStream int64
+	sendInit   int64
+	wsig       chan struct{}
+}
+
+// Http2Server The server side of FakeHttp2Conn, cfg is required by the h2 over tls.
+func Http2Server(conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
+	return newFakeHttp2Conn(false, conn, cfg, fhCfg)
+}
+
+// Http2Client The client side of FakeHttp2Conn, cfg is required by the h2 over tls.
+func Http2Client(conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
+	return newFakeHttp2Conn(true, conn, cfg, fhCfg)
+}
+
+func newFakeHttp2Conn(isClient bool, conn net.Conn, cfg *tls.Config, fhCfg *Config) net.Conn {
+	fhc := &FakeHttp2Conn{
+		isClient: isClient,
+		conn:     conn,
+		fhCfg:    fhCfg,
+		closer:   closer.NewCloser(),
+		laddr:    conn.LocalAddr(),
+		raddr:    conn.RemoteAddr(),
+		csig:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+
+		sendConn:   h2InitialWindow,
+		sendStream: h2InitialWindow,
+		sendInit:   h2InitialWindow,
+		wsig:       make(chan struct{}, 1),
+	}
+	if cfg != nil {
+		cfg = cfg.Clone()
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{http2.NextProtoTLS}
+		}
+		if isClient {
+			fhc.conn = tls.Client(fhc.conn, cfg)
+		} else {
+			fhc.conn = tls.Server(fhc.conn, cfg)
+		}
+	}
+	fhc.framer = http2.NewFramer(fhc.conn, fhc.conn)
+	fhc.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fhc.henc = hpack.NewEncoder(&fhc.wbuf)
+	fhc.closer.AddCloseFn(func() {
+		close(fhc.done)
+	})
+	fhc.closer.AddCloseFn(func() {
+		fhc.wmux.Lock()
+		defer fhc.wmux.Unlock()
+		if fhc.ready {
+			// end the call as grpc does, the peer reads EOF
+			if fhc.isClient {
+				_ = fhc.framer.WriteData(h2StreamID, true, nil)
+			} else if fhc.replied {
+				_ = fhc.writeHeaders(true, "grpc-status", "0")
+			} else {
+				_ = fhc.writeHeaders(true, ":status", "200", "content-type", grpcContentType, "grpc-status", "0")
+			}
+		}
+		_ = fhc.conn.Close()
+	})
+	go fhc.controlLoop()
+	return fhc
+}
+
+func (fhc *FakeHttp2Conn) Read(b []byte) (n int, err error) {
+	err = fhc.handshake()
+	if err != nil {
+		return 0, err
+	}
+	fhc.rmux.Lock()
+	defer fhc.signalWindow()
+	defer fhc.rmux.Unlock()
+	for {
+		if fhc.left > 0 && len(fhc.pending) > 0 {
+			n = copy(b, fhc.pending[:min(fhc.left, len(fhc.pending))])
+			fhc.pending = fhc.pending[n:]
+			fhc.left -= n
+			return n, nil
+		}
+		if fhc.left == 0 && len(fhc.pending) >= 5 {
+			// grpc message: compressed flag + 4-byte length
+			fhc.left = int(binary.BigEndian.Uint32(fhc.pending[1:5]))
+			fhc.pending = fhc.pending[5:]
+			continue
+		}
+		if fhc.eof {
+			return 0, io.EOF
+		}
+		err = fhc.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (fhc *FakeHttp2Conn) Write(b []byte) (n int, err error) {
+	err = fhc.handshake()
+	if err != nil {
+		return 0, err
+	}
+	fhc.smux.Lock()
+	defer fhc.smux.Unlock()
+	err = fhc.writeReply()
+	if err != nil {
+		return 0, err
+	}
+	msg := make([]byte, 5+len(b))
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(b)))
+	copy(msg[5:], b)
+	for len(msg) > 0 {
+		var pad []byte
+		if l := min(fhc.fhCfg.padding(), 255); l > 0 {
+			pad = make([]byte, l)
+		}
+		// the padding and its length byte take the window as well
+		size := min(h2MaxChunk, len(msg))
+		if pad != nil {
+			size += len(pad) + 1
+		}
+		size, err = fhc.reserve(size)
+		if err != nil {
+			return 0, err
+		}
+		if pad != nil {
+			if size <= len(pad)+1 {
+				// too little window for the padding, send the data bare
+				pad = nil
+			} else {
+				size -= len(pad) + 1
+			}
+		}
+		if size > len(msg) {
+			fhc.cmux.Lock()
+			fhc.sendConn += int64(size - len(msg))
+			fhc.sendStream += int64(size - len(msg))
+			fhc.cmux.Unlock()
+			size = len(msg)
+		}
+		chunk := msg[:size]
+		msg = msg[size:]
+		fhc.wmux.Lock()
+		err = fhc.framer.WriteDataPadded(h2StreamID, false, chunk, pad)
+		fhc.wmux.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// writeReply The response headers of the server before its first message.
+func (fhc *FakeHttp2Conn) writeReply() error {
+	fhc.wmux.Lock()
+	defer fhc.wmux.Unlock()
+	if fhc.isClient || fhc.replied {
+		return nil
+	}
+	err := fhc.writeHeaders(false, append([]string{":status", "200", "content-type", grpcContentType}, fhc.fhCfg.headerFields()...)...)
+	if err != nil {
+		return err
+	}
+	fhc.replied = true
+	return nil
+}
+
+// reserve Take up to n bytes of the send windows, it waits until the peer opens them.
+// When no Read is running the frames are read here, or the window updates would never come.
+func (fhc *FakeHttp2Conn) reserve(n int) (int, error) {
+	for {
+		fhc.cmux.Lock()
+		avail := min(fhc.sendConn, fhc.sendStream, int64(n))
+		if avail > 0 {
+			fhc.sendConn -= avail
+			fhc.sendStream -= avail
+			fhc.cmux.Unlock()
+			return int(avail), nil
+		}
+		fhc.cmux.Unlock()
+		if fhc.rmux.TryLock() {
+			err := fhc.readFrame()
+			fhc.rmux.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		select {
+		case <-fhc.wsig:
+		case <-fhc.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// signalWindow Wake a Write waiting in reserve, after the windows change or a Read returns.
+func (fhc *FakeHttp2Conn) signalWindow() {
+	select {
+	case fhc.wsig <- struct{}{}:
+	default:
+	}
+}
+
+func (fhc *FakeHttp2Conn) Close() error {
+	return fhc.closer.Close()
+}
+
+func (fhc *FakeHttp2Conn) LocalAddr() net.Addr  { return fhc.laddr }
+func (fhc *FakeHttp2Conn) RemoteAddr() net.Addr { return fhc.raddr }
+
+func (fhc *FakeHttp2Conn) SetDeadline(t time.Time) error {
+	return fhc.conn.SetDeadline(t)
+}
+func (fhc *FakeHttp2Conn) SetReadDeadline(t time.Time) error {
+	return fhc.conn.SetReadDeadline(t)
+}
+func (fhc *FakeHttp2Conn) SetWriteDeadline(t time.Time) error {
+	return fhc.conn.SetWriteDeadline(t)
+}
+
+// handshake The connection preface and settings, and the request headers of the client.
+func (fhc *FakeHttp2Conn) handshake() error {
+	fhc.once.Do(func() {
+		fhc.wmux.Lock()
+		defer fhc.wmux.Unlock()
+		fhc.herr = fhc.handshakeHandle()
+		fhc.ready = fhc.herr == nil
+	})
+	return fhc.herr
+}
+
+func (fhc *FakeHttp2Conn) handshakeHandle() error {
+	if fhc.isClient {
+		_, err := io.WriteString(fhc.conn, http2.ClientPreface)
+		if err != nil {
+			return err
+		}
+	} else {
+		preface := make([]byte, len(http2.ClientPreface))
+		_, err := io.ReadFull(fhc.conn, preface)
+		if err != nil {
+			return err
+		}
+		if string(preface) != http2.ClientPreface {
+			return ErrHttp2BadPreface
+		}
+	}
+	err := fhc.framer.WriteSettings(
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2Window},
+		http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: 1 << 20},
+	)
+	if err != nil {
+		return err
+	}
+	err = fhc.framer.WriteWindowUpdate(0, h2Window-65535)
+	if err != nil {
+		return err
+	}
+	if !fhc.isClient {
+		return nil
+	}
+	return fhc.writeHeaders(false, append([]string{
+		":method", "POST",
+		":scheme", "https",
+		":authority", fhc.fhCfg.host(fhc.raddr),
+		":path", fhc.fhCfg.path(),
+		"content-type", grpcContentType,
+		"te", "trailers",
+		"user-agent", grpcUserAgent,
+	}, fhc.fhCfg.headerFields()...)...)
+}
+
+// writeHeaders The header pairs of kv in a HEADERS frame of stream 1.
+func (fhc *FakeHttp2Conn) writeHeaders(endStream bool, kv ...string) error {
+	fhc.wbuf.Reset()
+	for i := 0; i+1 < len(kv); i += 2 {
+		err := fhc.henc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+		if err != nil {
+			return err
+		}
+	}
+	return fhc.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamID,
+		BlockFragment: fhc.wbuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+// readFrame Handle a frame, the data of stream 1 is appended to pending.
+func (fhc *FakeHttp2Conn) readFrame() error {
+	frame, err := fhc.framer.ReadFrame()
+	if err != nil {
+		return err
+	}
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		if v, ok := f.Value(http2.SettingInitialWindowSize); ok {
+			// the change applies to the window stream 1 has left
+			fhc.cmux.Lock()
+			fhc.sendStream += int64(v) - fhc.sendInit
+			fhc.sendInit = int64(v)
+			fhc.cmux.Unlock()
+			fhc.signalWindow()
+		}
+		fhc.control(func() { fhc.settingsAck++ })
+	case *http2.WindowUpdateFrame:
+		fhc.cmux.Lock()
+		switch f.StreamID {
+		case 0:
+			fhc.sendConn += int64(f.Increment)
+		case h2StreamID:
+			fhc.sendStream += int64(f.Increment)
+		}
+		fhc.cmux.Unlock()
+		fhc.signalWindow()
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			fhc.control(func() { fhc.pings = append(fhc.pings, f.Data) })
+		}
+	case *http2.MetaHeadersFrame:
+		if f.StreamID == h2StreamID && f.StreamEnded() {
+			fhc.eof = true
+		}
+	case *http2.DataFrame:
+		if f.StreamID != h2StreamID {
+			return nil
+		}
+		fhc.pending = append(fhc.pending, f.Data()...)
+		if f.StreamEnded() {
+			fhc.eof = true
+		}
+		if l := f.Header().Length; l > 0 {
+			// keep both windows open, the padding counts as well
+			fhc.control(func() { fhc.window += l })
+		}
+	case *http2.RSTStreamFrame:
+		if f.StreamID == h2StreamID {
+			return ErrHttp2StreamReset
+		}
+	case *http2.GoAwayFrame:
+		fhc.eof = true
+	}
+	return nil
+}
+
+// control Queue a control frame for controlLoop, the reader never waits for wmux,
+// or both sides deadlock when their writers are blocked on full buffers.
+func (fhc *FakeHttp2Conn) control(fn func()) {
+	fhc.cmux.Lock()
+	fn()
+	fhc.cmux.Unlock()
+	select {
+	case fhc.csig <- struct{}{}:
+	default:
+	}
+}
+
+// controlLoop Write the queued control frames, the window updates are merged.
+func (fhc *FakeHttp2Conn) controlLoop() {
+	for {
+		select {
+		case <-fhc.done:
+			return
+		case <-fhc.csig:
+		}
+		fhc.cmux.Lock()
+		settingsAck, pings, window := fhc.settingsAck, fhc.pings, fhc.window
+		fhc.settingsAck, fhc.pings, fhc.window = 0, nil, 0
+		fhc.cmux.Unlock()
+		err := fhc.writeControl(settingsAck, pings, window)
+		if err != nil {
+			_ = fhc.closer.CloseErr(err)
+			return
+		}
+	}
+}
+
+func (fhc *FakeHttp2Conn) writeControl(settingsAck int, pings [][8]byte, window uint32) error {
+	fhc.wmux.Lock()
+	defer fhc.wmux.Unlock()
+	for i := 0; i < settingsAck; i++ {
+		err := fhc.framer.WriteSettingsAck()
+		if err != nil {
+			return err
+		}
+	}
+	for _, data := range pings {
+		err := fhc.framer.WritePing(true, data)
+		if err != nil {
+			return err
+		}
+	}
+	if window > 0 {
+		err := fhc.framer.WriteWindowUpdate(0, window)
+		if err != nil {
+			return err
+		}
+		return fhc.framer.WriteWindowUpdate(h2StreamID, window)
+	}
+	return nil
+}
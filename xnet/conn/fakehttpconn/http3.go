@@ -0,0 +1,281 @@
+package fakehttpconn
+
+import (
+	"bufio"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/closer"
+	"github.com/quic-go/quic-go/quicvarint"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	h3FrameData      = 0x00
+	h3FrameHeaders   = 0x01
+	h3MaxHeaders     = 64 << 10
+	h3ContentType    = "application/octet-stream"
+	h3ReservedFrames = 16
+)
+
+var ErrHttp3BadHeaders = errors.New("bad http3 headers")
+var ErrHttp3BadStatus = errors.New("bad http3 status")
+
+// FakeHttp3Conn A byte stream as the DATA frames of an h3 request stream,
+// conn is a quic stream (see xquic) whose tls offers the "h3" alpn.
+type FakeHttp3Conn struct {
+	isClient bool
+	conn     net.Conn
+	reader   *bufio.Reader
+	fhCfg    *Config
+	closer   closer.Closer
+
+	once sync.Once
+	herr error
+
+	wmux    sync.Mutex
+	replied bool
+
+	rmux    sync.Mutex
+	headers bool
+	left    uint64
+}
+
+// Http3Server The server side of FakeHttp3Conn.
+func Http3Server(conn net.Conn, fhCfg *Config) net.Conn {
+	return newFakeHttp3Conn(false, conn, fhCfg)
+}
+
+// Http3Client The client side of FakeHttp3Conn.
+func Http3Client(conn net.Conn, fhCfg *Config) net.Conn {
+	return newFakeHttp3Conn(true, conn, fhCfg)
+}
+
+func newFakeHttp3Conn(isClient bool, conn net.Conn, fhCfg *Config) net.Conn {
+	fhc := &FakeHttp3Conn{
+		isClient: isClient,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		fhCfg:    fhCfg,
+		closer:   closer.NewCloser(),
+	}
+	fhc.closer.AddCloseFn(func() {
+		fhc.conn.Close()
+	})
+	return fhc
+}
+
+func (fhc *FakeHttp3Conn) Read(b []byte) (n int, err error) {
+	err = fhc.handshake()
+	if err != nil {
+		return 0, err
+	}
+	fhc.rmux.Lock()
+	defer fhc.rmux.Unlock()
+	for fhc.left == 0 {
+		typ, err := quicvarint.Read(fhc.reader)
+		if err != nil {
+			return 0, err
+		}
+		l, err := quicvarint.Read(fhc.reader)
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case h3FrameData:
+			fhc.left = l
+		case h3FrameHeaders:
+			err = fhc.readHeaders(l)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			// unknown and reserved frames are ignored
+			_, err = io.CopyN(io.Discard, fhc.reader, int64(l))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if uint64(len(b)) > fhc.left {
+		b = b[:fhc.left]
+	}
+	n, err = fhc.reader.Read(b)
+	fhc.left -= uint64(n)
+	return n, err
+}
+
+func (fhc *FakeHttp3Conn) Write(b []byte) (n int, err error) {
+	err = fhc.handshake()
+	if err != nil {
+		return 0, err
+	}
+	fhc.wmux.Lock()
+	defer fhc.wmux.Unlock()
+	var buf []byte
+	if !fhc.isClient && !fhc.replied {
+		buf = appendH3Frame(buf, h3FrameHeaders, qpackEncode(append([]string{":status", "200", "content-type", h3ContentType}, fhc.fhCfg.headerFields()...)...))
+		fhc.replied = true
+	}
+	if l := fhc.fhCfg.padding(); l > 0 {
+		// a reserved frame type of RFC 9114 section 7.2.8
+		buf = appendH3Frame(buf, 0x1f*uint64(rand.Intn(h3ReservedFrames))+0x21, make([]byte, l))
+	}
+	buf = appendH3Frame(buf, h3FrameData, b)
+	_, err = fhc.conn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (fhc *FakeHttp3Conn) Close() error {
+	return fhc.closer.Close()
+}
+
+func (fhc *FakeHttp3Conn) LocalAddr() net.Addr  { return fhc.conn.LocalAddr() }
+func (fhc *FakeHttp3Conn) RemoteAddr() net.Addr { return fhc.conn.RemoteAddr() }
+
+func (fhc *FakeHttp3Conn) SetDeadline(t time.Time) error {
+	return fhc.conn.SetDeadline(t)
+}
+func (fhc *FakeHttp3Conn) SetReadDeadline(t time.Time) error {
+	return fhc.conn.SetReadDeadline(t)
+}
+func (fhc *FakeHttp3Conn) SetWriteDeadline(t time.Time) error {
+	return fhc.conn.SetWriteDeadline(t)
+}
+
+// handshake The request headers of the client.
+func (fhc *FakeHttp3Conn) handshake() error {
+	fhc.once.Do(func() {
+		if !fhc.isClient {
+			return
+		}
+		fhc.wmux.Lock()
+		defer fhc.wmux.Unlock()
+		_, fhc.herr = fhc.conn.Write(appendH3Frame(nil, h3FrameHeaders, qpackEncode(append([]string{
+			":method", "POST",
+			":scheme", "https",
+			":authority", fhc.fhCfg.host(fhc.conn.RemoteAddr()),
+			":path", fhc.fhCfg.path(),
+			"content-type", h3ContentType,
+		}, fhc.fhCfg.headerFields()...)...)))
+	})
+	return fhc.herr
+}
+
+// readHeaders The headers before the data are checked, the trailers after it are ignored.
+func (fhc *FakeHttp3Conn) readHeaders(l uint64) error {
+	if l > h3MaxHeaders {
+		return ErrHttp3BadHeaders
+	}
+	b := make([]byte, l)
+	_, err := io.ReadFull(fhc.reader, b)
+	if err != nil {
+		return err
+	}
+	if fhc.headers {
+		return nil
+	}
+	fields, err := qpackDecode(b)
+	if err != nil {
+		return err
+	}
+	if fhc.isClient && fields[":status"] != "200" {
+		return ErrHttp3BadStatus
+	}
+	fhc.headers = true
+	return nil
+}
+
+func appendH3Frame(b []byte, typ uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, typ)
+	b = quicvarint.Append(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// qpackEncode A field section of literal field lines with literal names (RFC 9204 section 4.5.6),
+// it needs neither the tables nor huffman.
+func qpackEncode(kv ...string) []byte {
+	// required insert count and base are 0
+	b := []byte{0x00, 0x00}
+	for i := 0; i+1 < len(kv); i += 2 {
+		b = appendQpackInt(b, 0x20, 3, uint64(len(kv[i])))
+		b = append(b, kv[i]...)
+		b = appendQpackInt(b, 0x00, 7, uint64(len(kv[i+1])))
+		b = append(b, kv[i+1]...)
+	}
+	return b
+}
+
+// qpackDecode The fields of a section qpackEncode makes.
+func qpackDecode(b []byte) (map[string]string, error) {
+	if len(b) < 2 || b[0] != 0x00 || b[1] != 0x00 {
+		return nil, ErrHttp3BadHeaders
+	}
+	b = b[2:]
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		// 001NHxxx without huffman
+		if b[0]&0xe0 != 0x20 || b[0]&0x08 != 0 {
+			return nil, ErrHttp3BadHeaders
+		}
+		name, rest, err := readQpackString(b, 3)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 || rest[0]&0x80 != 0 {
+			return nil, ErrHttp3BadHeaders
+		}
+		value, rest, err := readQpackString(rest, 7)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = value
+		b = rest
+	}
+	return fields, nil
+}
+
+// appendQpackInt A prefixed integer of RFC 7541 section 5.1, first holds the bits before the prefix.
+func appendQpackInt(b []byte, first byte, prefix uint, v uint64) []byte {
+	limit := uint64(1)<<prefix - 1
+	if v < limit {
+		return append(b, first|byte(v))
+	}
+	b = append(b, first|byte(limit))
+	v -= limit
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func readQpackString(b []byte, prefix uint) (string, []byte, error) {
+	limit := uint64(1)<<prefix - 1
+	l := uint64(b[0]) & limit
+	b = b[1:]
+	if l == limit {
+		var shift uint
+		for {
+			if len(b) == 0 || shift > 28 {
+				return "", nil, ErrHttp3BadHeaders
+			}
+			c := b[0]
+			b = b[1:]
+			l += uint64(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+	if uint64(len(b)) < l {
+		return "", nil, ErrHttp3BadHeaders
+	}
+	return string(b[:l]), b[l:], nil
+}
@@ -0,0 +1,225 @@
+package quicconn
+
+import (
+	"context"
+	"errors"
+	"github.com/quic-go/quic-go"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrDatagramsNotSupported = errors.New("quic datagrams not supported by the peer")
+
+// QuicSession
+//
+//	The QUIC connection of a QuicConn: besides its main stream, more streams can be opened and accepted on it,
+//	and the RFC 9221 datagrams are a net.PacketConn. Both sides must enable them (quic.Config.EnableDatagrams).
+//	The peer accepts a stream once something is written to it.
+type QuicSession struct {
+	main *QuicConn
+}
+
+// NewSession The session of a QUIC connection, its main stream is authenticated as QuicConn does.
+func NewSession(isClient bool, conn quic.Connection) *QuicSession {
+	return NewConn(isClient, conn).(*QuicConn).Session()
+}
+
+// Session The session the main stream of q belongs to.
+func (q *QuicConn) Session() *QuicSession {
+	return &QuicSession{main: q}
+}
+
+// Conn The main stream, the QuicConn of the session.
+func (qs *QuicSession) Conn() net.Conn {
+	return qs.main
+}
+
+// OpenStream Open a new stream after the main one is authenticated.
+func (qs *QuicSession) OpenStream(ctx context.Context) (net.Conn, error) {
+	err := qs.main.HandShakeHandle()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := qs.main.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QuicStreamConn{Stream: stream, conn: qs.main.conn}, nil
+}
+
+// AcceptStream Accept a stream the peer opened by OpenStream.
+func (qs *QuicSession) AcceptStream(ctx context.Context) (net.Conn, error) {
+	err := qs.main.HandShakeHandle()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := qs.main.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QuicStreamConn{Stream: stream, conn: qs.main.conn}, nil
+}
+
+// PacketConn The datagrams of the session, every datagram goes to the peer whatever the addr of WriteTo is.
+// A datagram has to fit in a QUIC packet (about 1200 bytes), or WriteTo returns a quic.DatagramTooLargeError.
+func (qs *QuicSession) PacketConn() (net.PacketConn, error) {
+	err := qs.main.HandShakeHandle()
+	if err != nil {
+		return nil, err
+	}
+	if !qs.main.conn.ConnectionState().SupportsDatagrams {
+		return nil, ErrDatagramsNotSupported
+	}
+	return &QuicDatagramConn{conn: qs.main.conn, rch: make(chan struct{})}, nil
+}
+
+func (qs *QuicSession) LocalAddr() net.Addr {
+	return qs.main.LocalAddr()
+}
+
+func (qs *QuicSession) RemoteAddr() net.Addr {
+	return qs.main.RemoteAddr()
+}
+
+// Close Close the QUIC connection with all of its streams.
+func (qs *QuicSession) Close() error {
+	return qs.main.Close()
+}
+
+// QuicStreamConn A stream of a QuicSession.
+type QuicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (qsc *QuicStreamConn) LocalAddr() net.Addr {
+	return qsc.conn.LocalAddr()
+}
+
+func (qsc *QuicStreamConn) RemoteAddr() net.Addr {
+	return qsc.conn.RemoteAddr()
+}
+
+// Close Close both directions, the quic.Stream only closes the write one.
+func (qsc *QuicStreamConn) Close() error {
+	qsc.Stream.CancelRead(0)
+	return qsc.Stream.Close()
+}
+
+// QuicDatagramConn The datagrams of a QuicSession.
+type QuicDatagramConn struct {
+	conn quic.Connection
+
+	mux    sync.Mutex
+	closed bool
+	rdl    time.Time
+	rch    chan struct{}
+}
+
+func (qdc *QuicDatagramConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		qdc.mux.Lock()
+		closed, dl, ch := qdc.closed, qdc.rdl, qdc.rch
+		qdc.mux.Unlock()
+		if closed {
+			return 0, nil, net.ErrClosed
+		}
+		b, err := qdc.receive(dl, ch)
+		if err == errDeadlineChanged {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(p, b), qdc.conn.RemoteAddr(), nil
+	}
+}
+
+var errDeadlineChanged = errors.New("deadline changed")
+
+// receive A datagram before dl, unless the deadline is changed (ch is closed) while waiting.
+func (qdc *QuicDatagramConn) receive(dl time.Time, ch chan struct{}) ([]byte, error) {
+	ctx := qdc.conn.Context()
+	if !dl.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, dl)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changed := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+			close(changed)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	b, err := qdc.conn.ReceiveDatagram(ctx)
+	if err != nil {
+		select {
+		case <-changed:
+			return nil, errDeadlineChanged
+		default:
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (qdc *QuicDatagramConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	qdc.mux.Lock()
+	closed := qdc.closed
+	qdc.mux.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	err = qdc.conn.SendDatagram(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close Only the datagrams are done with, the session is still open.
+func (qdc *QuicDatagramConn) Close() error {
+	qdc.mux.Lock()
+	defer qdc.mux.Unlock()
+	if qdc.closed {
+		return net.ErrClosed
+	}
+	qdc.closed = true
+	close(qdc.rch)
+	return nil
+}
+
+func (qdc *QuicDatagramConn) LocalAddr() net.Addr {
+	return qdc.conn.LocalAddr()
+}
+
+func (qdc *QuicDatagramConn) SetDeadline(t time.Time) error {
+	return qdc.SetReadDeadline(t)
+}
+
+func (qdc *QuicDatagramConn) SetReadDeadline(t time.Time) error {
+	qdc.mux.Lock()
+	defer qdc.mux.Unlock()
+	if qdc.closed {
+		return net.ErrClosed
+	}
+	qdc.rdl = t
+	close(qdc.rch)
+	qdc.rch = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline A datagram is never blocked.
+func (qdc *QuicDatagramConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,220 @@
+package websocketconn
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtension = "permessage-deflate"
+	deflateWindow    = 1 << 15
+)
+
+// deflateTail The sync flush marker stripped from every message, followed by an empty final block to end the reader.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// compression The permessage-deflate state of a WebsocketConn (RFC 7692), a takeover keeps the window across messages.
+type compression struct {
+	level         int
+	writeTakeover bool
+	readTakeover  bool
+
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+	fr   io.ReadCloser
+	dict []byte
+}
+
+func newCompression(level int, writeTakeover bool, readTakeover bool) *compression {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &compression{
+		level:         level,
+		writeTakeover: writeTakeover,
+		readTakeover:  readTakeover,
+	}
+}
+
+// compress The payload of a message, valid until the next call.
+func (c *compression) compress(p []byte) ([]byte, error) {
+	c.wbuf.Reset()
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.wbuf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.fw = fw
+	} else if !c.writeTakeover {
+		c.fw.Reset(&c.wbuf)
+	}
+	_, err := c.fw.Write(p)
+	if err != nil {
+		return nil, err
+	}
+	err = c.fw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(c.wbuf.Bytes(), deflateTail[:4]), nil
+}
+
+func (c *compression) decompress(p []byte, limit int) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail))
+	var dict []byte
+	if c.readTakeover {
+		dict = c.dict
+	}
+	if c.fr == nil {
+		c.fr = flate.NewReaderDict(r, dict)
+	} else {
+		err := c.fr.(flate.Resetter).Reset(r, dict)
+		if err != nil {
+			return nil, err
+		}
+	}
+	out, err := io.ReadAll(io.LimitReader(c.fr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	if c.readTakeover {
+		c.dict = append(c.dict, out...)
+		if len(c.dict) > deflateWindow {
+			c.dict = append([]byte(nil), c.dict[len(c.dict)-deflateWindow:]...)
+		}
+	}
+	return out, nil
+}
+
+// extension An item of Sec-WebSocket-Extensions, it is invalid with a repeated parameter.
+type extension struct {
+	name    string
+	params  map[string]string
+	invalid bool
+}
+
+func parseExtensions(header http.Header) []extension {
+	var list []extension
+	for _, value := range header.Values("Sec-Websocket-Extensions") {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.Split(item, ";")
+			ext := extension{
+				name:   strings.ToLower(strings.TrimSpace(parts[0])),
+				params: make(map[string]string),
+			}
+			if ext.name == "" {
+				continue
+			}
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(param, "=")
+				k = strings.ToLower(strings.TrimSpace(k))
+				if k == "" {
+					continue
+				}
+				if _, ok := ext.params[k]; ok {
+					ext.invalid = true
+				}
+				ext.params[k] = strings.Trim(strings.TrimSpace(v), `"`)
+			}
+			list = append(list, ext)
+		}
+	}
+	return list
+}
+
+func validWindowBits(v string) bool {
+	n, err := strconv.Atoi(v)
+	return err == nil && n >= 8 && n <= 15 && strconv.Itoa(n) == v
+}
+
+func offerDeflate(cfg *CompressionConfig) string {
+	offer := deflateExtension
+	if cfg.ServerNoContextTakeover {
+		offer += "; server_no_context_takeover"
+	}
+	if cfg.ClientNoContextTakeover {
+		offer += "; client_no_context_takeover"
+	}
+	return offer
+}
+
+// acceptDeflate The server side of the first permessage-deflate offer in header it can serve, the writer always
+// uses a 32KB window so a smaller server_max_window_bits declines the offer.
+func acceptDeflate(header http.Header, cfg *CompressionConfig) (*compression, string) {
+	for _, ext := range parseExtensions(header) {
+		if ext.name != deflateExtension || ext.invalid {
+			continue
+		}
+		serverNCT, clientNCT := cfg.ServerNoContextTakeover, cfg.ClientNoContextTakeover
+		valid := true
+		for k, v := range ext.params {
+			switch k {
+			case "server_no_context_takeover":
+				valid = valid && v == ""
+				serverNCT = true
+			case "client_no_context_takeover":
+				valid = valid && v == ""
+				clientNCT = true
+			case "server_max_window_bits":
+				valid = valid && v == "15"
+			case "client_max_window_bits":
+				valid = valid && (v == "" || validWindowBits(v))
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		resp := deflateExtension
+		if serverNCT {
+			resp += "; server_no_context_takeover"
+		}
+		if clientNCT {
+			resp += "; client_no_context_takeover"
+		}
+		return newCompression(cfg.Level, !serverNCT, !clientNCT), resp
+	}
+	return nil, ""
+}
+
+// clientDeflate The compression the server accepted in header, nil if it declined.
+func clientDeflate(header http.Header, cfg *CompressionConfig) (*compression, error) {
+	exts := parseExtensions(header)
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	if cfg == nil || len(exts) != 1 || exts[0].name != deflateExtension || exts[0].invalid {
+		return nil, ErrUnsupportedExtensions
+	}
+	writeTakeover, readTakeover := !cfg.ClientNoContextTakeover, true
+	for k, v := range exts[0].params {
+		switch k {
+		case "server_no_context_takeover":
+			if v != "" {
+				return nil, ErrUnsupportedExtensions
+			}
+			readTakeover = false
+		case "client_no_context_takeover":
+			if v != "" {
+				return nil, ErrUnsupportedExtensions
+			}
+			writeTakeover = false
+		case "server_max_window_bits":
+			if !validWindowBits(v) {
+				return nil, ErrUnsupportedExtensions
+			}
+		default:
+			// client_max_window_bits is never offered
+			return nil, ErrUnsupportedExtensions
+		}
+	}
+	return newCompression(cfg.Level, writeTakeover, readTakeover), nil
+}
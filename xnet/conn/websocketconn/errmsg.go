@@ -1,6 +1,10 @@
 package websocketconn
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var (
 	ErrBadProtocolVersion   = errors.New("bad protocol version")
@@ -17,4 +21,19 @@ var (
 	ErrNotWebSocket         = errors.New("not websocket protocol")
 	ErrBadRequestMethod     = errors.New("bad method")
 	ErrNotSupported         = errors.New("not supported")
+	ErrBadMessageType       = errors.New("bad message type")
+	ErrMessageTooLarge      = errors.New("message too large")
 )
+
+// PongTimeoutError Nothing is received from the peer within Wait after a ping, the conn is closed with it.
+type PongTimeoutError struct {
+	Wait time.Duration
+}
+
+func (e *PongTimeoutError) Error() string {
+	return fmt.Sprintf("websocket pong timeout: nothing received in %s", e.Wait)
+}
+
+func (e *PongTimeoutError) Timeout() bool { return true }
+
+func (e *PongTimeoutError) Temporary() bool { return false }
@@ -17,17 +17,17 @@ import (
 const (
 	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-	closeStatusNormal            = 1000
-	closeStatusGoingAway         = 1001
-	closeStatusProtocolError     = 1002
-	closeStatusUnsupportedData   = 1003
-	closeStatusFrameTooLarge     = 1004
-	closeStatusNoStatusRcvd      = 1005
-	closeStatusAbnormalClosure   = 1006
-	closeStatusBadMessageData    = 1007
-	closeStatusPolicyViolation   = 1008
-	closeStatusTooBigData        = 1009
-	closeStatusExtensionMismatch = 1010
+	CloseStatusNormal            = 1000
+	CloseStatusGoingAway         = 1001
+	CloseStatusProtocolError     = 1002
+	CloseStatusUnsupportedData   = 1003
+	CloseStatusFrameTooLarge     = 1004
+	CloseStatusNoStatusRcvd      = 1005
+	CloseStatusAbnormalClosure   = 1006
+	CloseStatusBadMessageData    = 1007
+	CloseStatusPolicyViolation   = 1008
+	CloseStatusTooBigData        = 1009
+	CloseStatusExtensionMismatch = 1010
 
 	maxControlFramePayloadLength = 125
 )
@@ -40,14 +40,15 @@ var (
 	ErrNotImplemented        = errors.New("not implemented")
 
 	handshakeHeader = map[string]bool{
-		"Host":                   true,
-		"Upgrade":                true,
-		"Connection":             true,
-		"Sec-Websocket-Key":      true,
-		"Sec-Websocket-Origin":   true,
-		"Sec-Websocket-Version":  true,
-		"Sec-Websocket-Protocol": true,
-		"Sec-Websocket-Accept":   true,
+		"Host":                     true,
+		"Upgrade":                  true,
+		"Connection":               true,
+		"Sec-Websocket-Key":        true,
+		"Sec-Websocket-Origin":     true,
+		"Sec-Websocket-Version":    true,
+		"Sec-Websocket-Protocol":   true,
+		"Sec-Websocket-Accept":     true,
+		"Sec-Websocket-Extensions": true,
 	}
 )
 
@@ -251,31 +252,79 @@ func (buf hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (frame frameW
 type hybiFrameHandler struct {
 	conn        *WebsocketConn
 	payloadType byte
+	fragmented  bool
+	closeSent   bool
+}
+
+// closeMessage The status of the close frame the peer sent.
+type closeMessage struct {
+	code   int
+	reason string
+}
+
+// validCloseStatus Whether a close frame may carry code (RFC 6455 section 7.4).
+func validCloseStatus(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
 }
 
 func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (frameReader, error) {
 	if !handler.conn.isClient {
 		// The client MUST mask all frames sent to the server.
 		if frame.(*hybiFrameReader).header.MaskingKey == nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(CloseStatusProtocolError)
 			return nil, io.EOF
 		}
 	} else {
 		// The server MUST NOT mask all frames.
 		if frame.(*hybiFrameReader).header.MaskingKey != nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(CloseStatusProtocolError)
 			return nil, io.EOF
 		}
 	}
+	if !handler.validFrame(&frame.(*hybiFrameReader).header) {
+		handler.WriteClose(CloseStatusProtocolError)
+		return nil, io.EOF
+	}
 	if header := frame.HeaderReader(); header != nil {
 		io.Copy(ioutil.Discard, header)
 	}
 	switch frame.PayloadType() {
 	case ContinuationFrame:
 		frame.(*hybiFrameReader).header.OpCode = handler.payloadType
+		handler.fragmented = !frame.(*hybiFrameReader).header.Fin
 	case TextFrame, BinaryFrame:
 		handler.payloadType = frame.PayloadType()
+		handler.fragmented = !frame.(*hybiFrameReader).header.Fin
 	case CloseFrame:
+		b := make([]byte, maxControlFramePayloadLength)
+		n, err := io.ReadFull(frame, b)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		msg := &closeMessage{code: CloseStatusNoStatusRcvd}
+		if n >= 2 {
+			msg.code = int(binary.BigEndian.Uint16(b))
+			msg.reason = string(b[2:n])
+		}
+		handler.conn.closeMsg.CompareAndSwap(nil, msg)
+		// echo the status as the closing handshake, a code that must not be sent is a protocol error
+		status := msg.code
+		switch {
+		case n == 0:
+			status = CloseStatusNormal
+		case n == 1 || !validCloseStatus(status):
+			status = CloseStatusProtocolError
+		}
+		handler.WriteClose(status)
 		return nil, io.EOF
 	case PingFrame, PongFrame:
 		b := make([]byte, maxControlFramePayloadLength)
@@ -294,9 +343,28 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (frameReader, er
 	return frame, nil
 }
 
+// validFrame RSV1 only marks the first frame of a compressed message, and a fragmented message is not interleaved.
+func (handler *hybiFrameHandler) validFrame(header *hybiFrameHeader) bool {
+	if header.Rsv[1] || header.Rsv[2] {
+		return false
+	}
+	switch header.OpCode {
+	case ContinuationFrame:
+		return handler.fragmented && !header.Rsv[0]
+	case TextFrame, BinaryFrame:
+		return !handler.fragmented && (!header.Rsv[0] || handler.conn.compress != nil)
+	default:
+		return !header.Rsv[0]
+	}
+}
+
 func (handler *hybiFrameHandler) WriteClose(status int) (err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
+	if handler.closeSent {
+		return nil
+	}
+	handler.closeSent = true
 	w, err := handler.conn.frameWriterFactory.NewFrameWriter(CloseFrame)
 	if err != nil {
 		return err
@@ -320,6 +388,18 @@ func (handler *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
 	return n, err
 }
 
+func (handler *hybiFrameHandler) WritePing(msg []byte) (n int, err error) {
+	handler.conn.wio.Lock()
+	defer handler.conn.wio.Unlock()
+	w, err := handler.conn.frameWriterFactory.NewFrameWriter(PingFrame)
+	if err != nil {
+		return 0, err
+	}
+	n, err = w.Write(msg)
+	w.Close()
+	return n, err
+}
+
 // generateMaskingKey generates a masking key for a frame.
 func generateMaskingKey() (maskingKey []byte, err error) {
 	maskingKey = make([]byte, 4)
@@ -32,12 +32,12 @@ func (wc *WebsocketConn) newConn() {
 		needMaskingKey: wc.isClient,
 	}
 	wc.payloadType = BinaryFrame
-	wc.defaultCloseStatus = closeStatusNormal
+	wc.defaultCloseStatus = CloseStatusNormal
 	wc.frameHandler = &hybiFrameHandler{conn: wc}
 }
 
 func (wc *WebsocketConn) handShakeHandle() error {
-	wc.reader = bufio.NewReader(wc.conn)
+	wc.reader = bufio.NewReader(liveReader{wc: wc})
 	wc.writer = bufio.NewWriter(wc.conn)
 	if wc.isClient {
 		err := wc.handShakeClient()
@@ -128,6 +128,10 @@ func (wc *WebsocketConn) readHandshake(req *http.Request) (code int, err error)
 			wc.protocol = append(wc.protocol, strings.TrimSpace(protocols[i]))
 		}
 	}
+	if wc.cfg != nil && wc.cfg.Compression != nil {
+		wc.compress, wc.extensions = acceptDeflate(req.Header, wc.cfg.Compression)
+	}
+	wc.peerHeader = req.Header
 	wc.accept, err = getNonceAccept([]byte(key))
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -136,7 +140,9 @@ func (wc *WebsocketConn) readHandshake(req *http.Request) (code int, err error)
 }
 
 func (wc *WebsocketConn) acceptHandshake() (err error) {
-	if len(wc.protocol) > 0 {
+	if wc.cfg != nil && wc.cfg.Protocols != nil {
+		wc.protocol = selectProtocol(wc.cfg.Protocols, wc.protocol)
+	} else if len(wc.protocol) > 0 {
 		if len(wc.protocol) != 1 {
 			return ErrBadWebSocketProtocol
 		}
@@ -148,6 +154,9 @@ func (wc *WebsocketConn) acceptHandshake() (err error) {
 	if len(wc.protocol) > 0 {
 		wc.writer.WriteString("Sec-WebSocket-Protocol: " + wc.protocol[0] + "\r\n")
 	}
+	if wc.extensions != "" {
+		wc.writer.WriteString("Sec-WebSocket-Extensions: " + wc.extensions + "\r\n")
+	}
 	if wc.header != nil {
 		err := wc.header.WriteSubset(wc.writer, handshakeHeader)
 		if err != nil {
@@ -179,6 +188,9 @@ func (wc *WebsocketConn) handShakeClient() (err error) {
 	if len(wc.protocol) > 0 {
 		wc.writer.WriteString("Sec-WebSocket-Protocol: " + strings.Join(wc.protocol, ", ") + "\r\n")
 	}
+	if wc.cfg != nil && wc.cfg.Compression != nil {
+		wc.writer.WriteString("Sec-WebSocket-Extensions: " + offerDeflate(wc.cfg.Compression) + "\r\n")
+	}
 	err = wc.header.WriteSubset(wc.writer, handshakeHeader)
 	if err != nil {
 		return err
@@ -207,8 +219,13 @@ func (wc *WebsocketConn) handShakeClient() (err error) {
 	if resp.Header.Get("Sec-WebSocket-Accept") != string(expectedAccept) {
 		return ErrChallengeResponse
 	}
-	if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
-		return ErrUnsupportedExtensions
+	var compressCfg *CompressionConfig
+	if wc.cfg != nil {
+		compressCfg = wc.cfg.Compression
+	}
+	wc.compress, err = clientDeflate(resp.Header, compressCfg)
+	if err != nil {
+		return err
 	}
 	offeredProtocol := resp.Header.Get("Sec-WebSocket-Protocol")
 	if offeredProtocol != "" {
@@ -223,11 +240,26 @@ func (wc *WebsocketConn) handShakeClient() (err error) {
 			return ErrBadWebSocketProtocol
 		}
 		wc.protocol = []string{offeredProtocol}
+	} else {
+		wc.protocol = nil
 	}
+	wc.peerHeader = resp.Header
 	wc.newConn()
 	return nil
 }
 
+// selectProtocol The first of supported the client offered.
+func selectProtocol(supported []string, offered []string) []string {
+	for _, p := range supported {
+		for _, o := range offered {
+			if p == o {
+				return []string{p}
+			}
+		}
+	}
+	return nil
+}
+
 func (wc *WebsocketConn) defaultClientCfg() {
 	scheme := "http://"
 	wscheme := "ws://"
@@ -239,3 +271,16 @@ func (wc *WebsocketConn) defaultClientCfg() {
 	wc.location, _ = url.ParseRequestURI(fmt.Sprintf("%s%s/", scheme, wc.raddr.String()))
 	wc.origin, _ = url.ParseRequestURI(fmt.Sprintf("%s%s/", wscheme, wc.raddr.String()))
 }
+
+// clientCfg The Host and Path of cfg in place of the defaults, the origin follows the Host.
+func (wc *WebsocketConn) clientCfg() {
+	if wc.cfg.Host != "" {
+		wc.location.Host = wc.cfg.Host
+		wc.origin.Host = wc.cfg.Host
+	}
+	if wc.cfg.Path != "" {
+		if u, err := url.ParseRequestURI(wc.cfg.Path); err == nil {
+			wc.location.Path, wc.location.RawPath, wc.location.RawQuery = u.Path, u.RawPath, u.RawQuery
+		}
+	}
+}
@@ -2,6 +2,7 @@ package websocketconn
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"github.com/peakedshout/go-pandorasbox/xnet/xtls"
 	"io"
@@ -10,9 +11,40 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+// Config The handshake options of a WebsocketConn, nil is the plain hybi13 handshake.
+type Config struct {
+	// Protocols The client offers them in order of preference, the server picks the first of them the client offered.
+	Protocols []string
+	// Header The extra headers of the handshake request (client) or response (server).
+	Header http.Header
+	// Host The Host header of the client, the remote address by default.
+	Host string
+	// Path The request path of the client, "/" by default.
+	Path string
+	// Compression Offer (client) or accept (server) permessage-deflate (RFC 7692), nil disables it.
+	Compression *CompressionConfig
+	// PingInterval Send a ping every interval after the handshake, 0 disables it.
+	// Only the frames Read sees count, so the conn must be read as a tunnel always is.
+	PingInterval time.Duration
+	// PongTimeout Close the conn with a PongTimeoutError if nothing is received within it after a ping, 0 is PingInterval.
+	PongTimeout time.Duration
+}
+
+// CompressionConfig The permessage-deflate options.
+type CompressionConfig struct {
+	// Level The flate level of the messages written, 0 is flate.DefaultCompression.
+	Level int
+	// ServerNoContextTakeover The server compresses every message on its own, less memory and ratio.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover The client compresses every message on its own, less memory and ratio.
+	ClientNoContextTakeover bool
+}
+
 type WebsocketConn struct {
 	isClient bool
 	conn     net.Conn
@@ -32,6 +64,18 @@ type WebsocketConn struct {
 	protocol      []string
 	header        http.Header
 	handshakeData map[string]string
+	cfg           *Config
+	peerHeader    http.Header
+	extensions    string
+	compress      *compression
+	rbuf          []byte
+
+	done     chan struct{}
+	doneOnce sync.Once
+	lastSeen atomic.Int64
+	reading  atomic.Bool
+	abortErr atomic.Pointer[PongTimeoutError]
+	closeMsg atomic.Pointer[closeMessage]
 
 	rio sync.Mutex
 	wio sync.Mutex
@@ -45,25 +89,34 @@ type WebsocketConn struct {
 }
 
 func (wc *WebsocketConn) Read(b []byte) (n int, err error) {
+	defer func() { err = wc.fault(err) }()
 	err = wc.HandShakeHandle()
 	if err != nil {
 		return 0, err
 	}
 	wc.rio.Lock()
 	defer wc.rio.Unlock()
+	defer wc.watchRead()()
 again:
+	if len(wc.rbuf) > 0 {
+		n = copy(b, wc.rbuf)
+		wc.rbuf = wc.rbuf[n:]
+		return n, nil
+	}
 	if wc.frameReader == nil {
-		frame, err := wc.frameReaderFactory.NewFrameReader()
+		frame, err := wc.nextFrame()
 		if err != nil {
 			return 0, err
 		}
-		wc.frameReader, err = wc.frameHandler.HandleFrame(frame)
-		if err != nil {
-			return 0, err
-		}
-		if wc.frameReader == nil {
+		if frame.(*hybiFrameReader).header.Rsv[0] {
+			// a compressed message is only readable as a whole
+			_, wc.rbuf, err = wc.readMessage(frame)
+			if err != nil {
+				return 0, err
+			}
 			goto again
 		}
+		wc.frameReader = frame
 	}
 	n, err = wc.frameReader.Read(b)
 	if err == io.EOF {
@@ -77,22 +130,172 @@ again:
 }
 
 func (wc *WebsocketConn) Write(b []byte) (n int, err error) {
+	defer func() { err = wc.fault(err) }()
 	err = wc.HandShakeHandle()
 	if err != nil {
 		return 0, err
 	}
+	err = wc.writeMessage(wc.payloadType, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadMessage Read the next whole message, its type is TextFrame or BinaryFrame.
+// The rest of a message partly consumed by Read comes first.
+func (wc *WebsocketConn) ReadMessage() (messageType byte, p []byte, err error) {
+	defer func() { err = wc.fault(err) }()
+	err = wc.HandShakeHandle()
+	if err != nil {
+		return 0, nil, err
+	}
+	wc.rio.Lock()
+	defer wc.rio.Unlock()
+	defer wc.watchRead()()
+	if len(wc.rbuf) > 0 {
+		p, wc.rbuf = wc.rbuf, nil
+		return wc.frameHandler.(*hybiFrameHandler).payloadType, p, nil
+	}
+	frame, whole := wc.frameReader, wc.frameReader == nil
+	wc.frameReader = nil
+	if whole {
+		frame, err = wc.nextFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	messageType, p, err = wc.readMessage(frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	if whole && messageType == TextFrame && !utf8.Valid(p) {
+		_ = wc.frameHandler.WriteClose(CloseStatusBadMessageData)
+		return 0, nil, ErrBadFrame
+	}
+	return messageType, p, nil
+}
+
+// WriteMessage Write p as a single message of messageType, TextFrame or BinaryFrame.
+func (wc *WebsocketConn) WriteMessage(messageType byte, p []byte) error {
+	if messageType != TextFrame && messageType != BinaryFrame {
+		return ErrBadMessageType
+	}
+	err := wc.HandShakeHandle()
+	if err != nil {
+		return wc.fault(err)
+	}
+	return wc.fault(wc.writeMessage(messageType, p))
+}
+
+// CloseStatus The close code and reason of the close frame the peer sent, ok is false before it is read.
+// The code is CloseStatusNoStatusRcvd if the frame has none.
+func (wc *WebsocketConn) CloseStatus() (code int, reason string, ok bool) {
+	msg := wc.closeMsg.Load()
+	if msg == nil {
+		return 0, "", false
+	}
+	return msg.code, msg.reason, true
+}
+
+// Subprotocol The negotiated subprotocol, empty if there is none.
+func (wc *WebsocketConn) Subprotocol() string {
+	if wc.HandShakeHandle() != nil || len(wc.protocol) != 1 {
+		return ""
+	}
+	return wc.protocol[0]
+}
+
+// Compressed Whether permessage-deflate is negotiated.
+func (wc *WebsocketConn) Compressed() bool {
+	return wc.HandShakeHandle() == nil && wc.compress != nil
+}
+
+// HandshakeHeader The handshake headers of the peer, the request on the server and the response on the client.
+func (wc *WebsocketConn) HandshakeHeader() http.Header {
+	if wc.HandShakeHandle() != nil {
+		return nil
+	}
+	return wc.peerHeader
+}
+
+// nextFrame The next data frame, the control frames before it are handled.
+func (wc *WebsocketConn) nextFrame() (frameReader, error) {
+	for {
+		frame, err := wc.frameReaderFactory.NewFrameReader()
+		if err != nil {
+			return nil, err
+		}
+		frame, err = wc.frameHandler.HandleFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		if frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+// readMessage Read the rest of the message frame belongs to, up to MaxPayloadBytes.
+func (wc *WebsocketConn) readMessage(frame frameReader) (byte, []byte, error) {
+	limit := wc.MaxPayloadBytes
+	if limit <= 0 {
+		limit = DefaultMaxPayloadBytes
+	}
+	messageType := frame.PayloadType()
+	compressed := frame.(*hybiFrameReader).header.Rsv[0]
+	var buf bytes.Buffer
+	for {
+		_, err := io.Copy(&buf, io.LimitReader(frame, int64(limit-buf.Len())+1))
+		if err != nil {
+			return 0, nil, err
+		}
+		if buf.Len() > limit {
+			_ = wc.frameHandler.WriteClose(CloseStatusTooBigData)
+			return 0, nil, ErrMessageTooLarge
+		}
+		if frame.(*hybiFrameReader).header.Fin {
+			break
+		}
+		frame, err = wc.nextFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if !compressed {
+		return messageType, buf.Bytes(), nil
+	}
+	p, err := wc.compress.decompress(buf.Bytes(), limit)
+	if err == ErrMessageTooLarge {
+		_ = wc.frameHandler.WriteClose(CloseStatusTooBigData)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageType, p, nil
+}
+
+func (wc *WebsocketConn) writeMessage(payloadType byte, b []byte) error {
 	wc.wio.Lock()
 	defer wc.wio.Unlock()
-	w, err := wc.frameWriterFactory.NewFrameWriter(wc.payloadType)
+	w, err := wc.frameWriterFactory.NewFrameWriter(payloadType)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	n, err = w.Write(b)
+	if wc.compress != nil {
+		b, err = wc.compress.compress(b)
+		if err != nil {
+			return err
+		}
+		w.(*hybiFrameWriter).header.Rsv[0] = true
+	}
+	_, err = w.Write(b)
 	w.Close()
-	return n, err
+	return err
 }
 
 func (wc *WebsocketConn) Close() (err error) {
+	wc.doneOnce.Do(func() { close(wc.done) })
 	wc.mux.Lock()
 	defer wc.mux.Unlock()
 	if wc.frameHandler != nil {
@@ -137,11 +340,87 @@ func (wc *WebsocketConn) HandShakeHandle() error {
 			}
 		}
 		err = wc.handShakeHandle()
+		if err == nil && wc.cfg != nil && wc.cfg.PingInterval > 0 {
+			timeout := wc.cfg.PongTimeout
+			if timeout <= 0 {
+				timeout = wc.cfg.PingInterval
+			}
+			go wc.keepalive(wc.cfg.PingInterval, timeout)
+		}
 	})
 	return err
 }
 
-func newConn(isClient bool, conn net.Conn, cfg *tls.Config) net.Conn {
+// keepalive Ping the peer every interval, and abort the conn if nothing comes back within timeout.
+func (wc *WebsocketConn) keepalive(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wc.done:
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now().UnixNano()
+		check := time.AfterFunc(timeout, func() {
+			// the pong is not read if nobody reads, that is not the fault of the peer
+			if wc.reading.Load() && wc.lastSeen.Load() < sent {
+				wc.abort(&PongTimeoutError{Wait: timeout})
+			}
+		})
+		_, err := wc.frameHandler.(*hybiFrameHandler).WritePing(nil)
+		if err != nil {
+			check.Stop()
+			return
+		}
+	}
+}
+
+// watchRead Let keepalive judge the peer while a read is waiting for it, the wait starts now.
+func (wc *WebsocketConn) watchRead() func() {
+	wc.lastSeen.Store(time.Now().UnixNano())
+	wc.reading.Store(true)
+	return func() {
+		wc.reading.Store(false)
+	}
+}
+
+// liveReader The reads of conn, every byte from the peer proves it is alive, not only a whole frame.
+type liveReader struct {
+	wc *WebsocketConn
+}
+
+func (lr liveReader) Read(b []byte) (int, error) {
+	n, err := lr.wc.conn.Read(b)
+	if n > 0 {
+		lr.wc.lastSeen.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (wc *WebsocketConn) abort(err *PongTimeoutError) {
+	select {
+	case <-wc.done:
+		return
+	default:
+	}
+	wc.abortErr.CompareAndSwap(nil, err)
+	wc.doneOnce.Do(func() { close(wc.done) })
+	_ = wc.conn.Close()
+}
+
+// fault The error of the abort instead of err it caused.
+func (wc *WebsocketConn) fault(err error) error {
+	if err == nil {
+		return nil
+	}
+	if aerr := wc.abortErr.Load(); aerr != nil {
+		return aerr
+	}
+	return err
+}
+
+func newConn(isClient bool, conn net.Conn, cfg *tls.Config, wsCfg *Config) net.Conn {
 	wc := &WebsocketConn{
 		isClient: isClient,
 		conn:     conn,
@@ -150,17 +429,36 @@ func newConn(isClient bool, conn net.Conn, cfg *tls.Config) net.Conn {
 		writer:   nil,
 		laddr:    conn.LocalAddr(),
 		raddr:    conn.RemoteAddr(),
+		cfg:      wsCfg,
+		done:     make(chan struct{}),
 	}
 	if isClient {
 		wc.defaultClientCfg()
 	}
+	if wsCfg != nil {
+		wc.header = wsCfg.Header.Clone()
+		if isClient {
+			wc.protocol = append([]string(nil), wsCfg.Protocols...)
+			wc.clientCfg()
+		}
+	}
 	return wc
 }
 
 func Server(conn net.Conn, cfg *tls.Config) net.Conn {
-	return newConn(false, conn, cfg)
+	return newConn(false, conn, cfg, nil)
 }
 
 func Client(conn net.Conn, cfg *tls.Config) net.Conn {
-	return newConn(true, conn, cfg)
+	return newConn(true, conn, cfg, nil)
+}
+
+// ServerWithConfig Server with the subprotocols, extra headers and permessage-deflate of wsCfg.
+func ServerWithConfig(conn net.Conn, cfg *tls.Config, wsCfg *Config) net.Conn {
+	return newConn(false, conn, cfg, wsCfg)
+}
+
+// ClientWithConfig Client with the subprotocols, extra headers and permessage-deflate of wsCfg.
+func ClientWithConfig(conn net.Conn, cfg *tls.Config, wsCfg *Config) net.Conn {
+	return newConn(true, conn, cfg, wsCfg)
 }
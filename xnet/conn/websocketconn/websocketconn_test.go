@@ -3,12 +3,16 @@ package websocketconn
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"golang.org/x/net/websocket"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewConn(t *testing.T) {
@@ -341,3 +345,463 @@ func TestServerTLS(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressionMessage(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		wsconn := ServerWithConfig(conn, nil, &Config{
+			Protocols:   []string{"b", "a"},
+			Header:      http.Header{"X-Server": []string{"s"}},
+			Compression: &CompressionConfig{},
+		}).(*WebsocketConn)
+		if wsconn.HandshakeHeader().Get("X-Client") != "c" {
+			t.Error("header fatal")
+			return
+		}
+		for {
+			typ, p, err := wsconn.ReadMessage()
+			if err != nil {
+				return
+			}
+			err = wsconn.WriteMessage(typ, p)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{
+		Protocols:   []string{"a", "b", "c"},
+		Header:      http.Header{"X-Client": []string{"c"}},
+		Compression: &CompressionConfig{ClientNoContextTakeover: true},
+	}).(*WebsocketConn)
+	if wsconn.Subprotocol() != "b" || !wsconn.Compressed() || wsconn.HandshakeHeader().Get("X-Server") != "s" {
+		t.Fatal("negotiation fatal")
+	}
+	if !strings.Contains(wsconn.HandshakeHeader().Get("Sec-WebSocket-Extensions"), "client_no_context_takeover") {
+		t.Fatal("extension fatal")
+	}
+	for i, typ := range []byte{TextFrame, BinaryFrame, TextFrame, BinaryFrame} {
+		data := []byte(strings.Repeat(uuid.NewIdn(64), 1<<i*64))
+		err = wsconn.WriteMessage(typ, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rtyp, p, err := wsconn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtyp != typ || !bytes.Equal(data, p) {
+			t.Fatal("data fatal")
+		}
+	}
+	data := []byte(uuid.NewIdn(1024))
+	_, err = wsconn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	var got []byte
+	for len(got) < len(data) {
+		n, err := wsconn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data fatal")
+	}
+	if wsconn.WriteMessage(CloseFrame, nil) != ErrBadMessageType {
+		t.Fatal("type fatal")
+	}
+}
+
+func TestCompressionDeclined(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = http.Serve(listen, websocket.Handler(func(conn *websocket.Conn) {
+			for {
+				var msg string
+				if websocket.Message.Receive(conn, &msg) != nil {
+					return
+				}
+				if websocket.Message.Send(conn, msg) != nil {
+					return
+				}
+			}
+		}))
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{
+		Protocols:   []string{"a"},
+		Compression: &CompressionConfig{},
+	}).(*WebsocketConn)
+	if wsconn.Compressed() || wsconn.Subprotocol() != "a" {
+		t.Fatal("negotiation fatal")
+	}
+	data := []byte(uuid.NewIdn(1024))
+	err = wsconn.WriteMessage(TextFrame, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, p, err := wsconn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != TextFrame || !bytes.Equal(data, p) {
+		t.Fatal("data fatal")
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		wsconn := ServerWithConfig(conn, nil, &Config{PingInterval: 20 * time.Millisecond})
+		buf := make([]byte, 1024)
+		for {
+			n, err := wsconn.Read(buf)
+			if err != nil {
+				return
+			}
+			_, err = wsconn.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{PingInterval: 20 * time.Millisecond})
+	data := []byte(uuid.NewIdn(1024))
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		_, err = wsconn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := wsconn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf[:n]) {
+			t.Fatal("data fatal")
+		}
+		// both sides answer the pings of each other while reading
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = wsconn.Write(data)
+		}()
+		n, err = wsconn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf[:n]) {
+			t.Fatal("data fatal")
+		}
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		// never read, so never pong
+		wsconn := Client(conn, nil).(*WebsocketConn)
+		_ = wsconn.HandShakeHandle()
+		time.Sleep(time.Second)
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ServerWithConfig(conn, nil, &Config{PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	_, err = wsconn.Read(make([]byte, 1024))
+	var perr *PongTimeoutError
+	if !errors.As(err, &perr) || perr.Wait != 50*time.Millisecond {
+		t.Fatal(err)
+	}
+	_, err = wsconn.Write([]byte("x"))
+	if !errors.As(err, &perr) {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseStatus(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		wsconn := Server(conn, nil).(*WebsocketConn)
+		_, err = wsconn.Read(make([]byte, 1024))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		wsconn.defaultCloseStatus = CloseStatusGoingAway
+		_ = wsconn.Close()
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := Client(conn, nil).(*WebsocketConn)
+	if _, _, ok := wsconn.CloseStatus(); ok {
+		t.Fatal("status fatal")
+	}
+	_, err = wsconn.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wsconn.Read(make([]byte, 1024))
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	code, _, ok := wsconn.CloseStatus()
+	if !ok || code != CloseStatusGoingAway {
+		t.Fatal("status fatal", code)
+	}
+}
+
+func TestClientHostPath(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = http.Serve(listen, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ws" || r.URL.Query().Get("x") != "1" || r.Host != "example.com" || r.Header.Get("X-Token") != "t" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			websocket.Server{Handler: func(conn *websocket.Conn) {
+				_, _ = io.Copy(conn, conn)
+			}}.ServeHTTP(w, r)
+		}))
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{
+		Header: http.Header{"X-Token": []string{"t"}},
+		Host:   "example.com",
+		Path:   "/ws?x=1",
+	})
+	data := []byte(uuid.NewIdn(1024))
+	_, err = wsconn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := wsconn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf[:n]) {
+		t.Fatal("data fatal")
+	}
+}
+
+// slowConn Write b in small pieces over a while.
+type slowConn struct {
+	net.Conn
+}
+
+func (sc slowConn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		l := min(len(b), 4096)
+		m, err := sc.Conn.Write(b[:l])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[l:]
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n, nil
+}
+
+func TestSlowFrame(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	data := []byte(uuid.NewIdn(64 * 1024))
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		// a single frame that takes longer than the pong timeout, the server is not reading meanwhile
+		wsconn := Server(slowConn{Conn: conn}, nil)
+		_, err = wsconn.Write(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = wsconn.Read(make([]byte, 1024))
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(wsconn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("data fatal")
+	}
+}
+
+func TestIdleReader(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		wsconn := Server(conn, nil)
+		_, _ = io.Copy(wsconn, wsconn)
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wsconn := ClientWithConfig(conn, nil, &Config{PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	data := []byte(uuid.NewIdn(1024))
+	_, err = wsconn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pongs wait in the buffer while nobody reads
+	time.Sleep(300 * time.Millisecond)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(wsconn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("data fatal")
+	}
+}
+
+func TestCloseStatusEcho(t *testing.T) {
+	for code, echo := range map[int]int{
+		CloseStatusGoingAway:       CloseStatusGoingAway,
+		4000:                       4000,
+		CloseStatusNoStatusRcvd:    CloseStatusProtocolError,
+		CloseStatusAbnormalClosure: CloseStatusProtocolError,
+		1015:                       CloseStatusProtocolError,
+		999:                        CloseStatusProtocolError,
+		2000:                       CloseStatusProtocolError,
+	} {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := listen.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, Server(conn, nil))
+		}()
+		conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		wsconn := Client(conn, nil).(*WebsocketConn)
+		err = wsconn.HandShakeHandle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = wsconn.frameHandler.(*hybiFrameHandler).WriteClose(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wsconn.Read(make([]byte, 1024))
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		got, _, ok := wsconn.CloseStatus()
+		if !ok || got != echo {
+			t.Fatal("status fatal", code, got)
+		}
+		conn.Close()
+		listen.Close()
+	}
+}
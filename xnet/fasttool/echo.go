@@ -1,11 +1,14 @@
 package fasttool
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
 func EchoUdpPacketListener(addr ...string) (net.PacketConn, error) {
@@ -32,6 +35,25 @@ func EchoHttpContext(ctx context.Context, addr ...string) (*http.Server, string,
 	return HttpContext(ctx, EchoHttpHandler, addr...)
 }
 
+// EchoCheck Write data to conn and read it back from an echo server within 3s.
+func EchoCheck(conn net.Conn, data string) error {
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	_, err := conn.Write([]byte(data))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, []byte(data)) {
+		return fmt.Errorf("echo mismatch: %q", buf)
+	}
+	return nil
+}
+
 var EchoConnHandler ConnHandler = func(ctx context.Context, conn net.Conn) error {
 	nctx, cl := context.WithCancel(ctx)
 	defer cl()
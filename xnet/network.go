@@ -24,18 +24,36 @@ const (
 	NetworkWss   = "wss"
 	NetworkHttp  = "http"
 	NetworkHttps = "https"
+	NetworkH2    = "h2"
+	NetworkH3    = "h3"
 )
 
 type MCallbackFunc func(index int, network string) (cfg *tls.Config, isClient bool, err error)
 
+// MOptionsCallbackFunc MCallbackFunc with the options of the tls, ws(s), http(s), h2 and h3 upgraders,
+// nil opts keeps their defaults.
+type MOptionsCallbackFunc func(index int, network string) (cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions, err error)
+
+// WithOptions The callback of MakeNetworkUpgraderWithOptions that gives opts to every network.
+func (fn MCallbackFunc) WithOptions(opts *xnetutil.UpgradeOptions) MOptionsCallbackFunc {
+	return func(index int, network string) (*tls.Config, bool, *xnetutil.UpgradeOptions, error) {
+		cfg, isClient, err := fn(index, network)
+		return cfg, isClient, opts, err
+	}
+}
+
 func MakeNetworkUpgrader(callback MCallbackFunc, networkList ...string) (xnetutil.Upgrader, error) {
+	return MakeNetworkUpgraderWithOptions(callback.WithOptions(nil), networkList...)
+}
+
+func MakeNetworkUpgraderWithOptions(callback MOptionsCallbackFunc, networkList ...string) (xnetutil.Upgrader, error) {
 	upgraderList := make([]xnetutil.Upgrader, 0, len(networkList))
 	for i, network := range networkList {
-		cfg, isClient, err := callback(i, network)
+		cfg, isClient, opts, err := callback(i, network)
 		if err != nil {
 			return nil, err
 		}
-		upgrader, err := makeNetworkUpgraderOnce(network, cfg, isClient)
+		upgrader, err := makeNetworkUpgraderOnce(network, cfg, isClient, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -44,7 +62,7 @@ func MakeNetworkUpgrader(callback MCallbackFunc, networkList ...string) (xnetuti
 	return xnetutil.NewWarpUpgrader(upgraderList...), nil
 }
 
-func makeNetworkUpgraderOnce(network string, cfg *tls.Config, isClient bool) (xnetutil.Upgrader, error) {
+func makeNetworkUpgraderOnce(network string, cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions) (xnetutil.Upgrader, error) {
 	switch network {
 	case NetworkTcp:
 		return xtcp.XUpgrader(cfg, isClient), nil
@@ -56,21 +74,28 @@ func makeNetworkUpgraderOnce(network string, cfg *tls.Config, isClient bool) (xn
 		if cfg == nil {
 			return nil, xneterr.ErrNilTlsConfig.Errorf(network)
 		}
-		return xtls.XUpgrader(cfg, isClient), nil
+		return xtls.TLSUpgraderWithOptions(cfg, isClient, opts)
 	case NetworkWs:
-		return xwebsocket.XUpgrader(cfg, isClient), nil
+		return xwebsocket.WebsocketUpgraderWithOptions(cfg, isClient, opts)
 	case NetworkWss:
 		if cfg == nil {
 			return nil, xneterr.ErrNilTlsConfig.Errorf(network)
 		}
-		return xwebsocket.XUpgrader(cfg, isClient), nil
+		return xwebsocket.WebsocketUpgraderWithOptions(cfg, isClient, opts)
 	case NetworkHttp:
-		return xfakehttp.XUpgrader(cfg, isClient), nil
+		return xfakehttp.FakeHttpUpgraderWithOptions(xfakehttp.CarrierHttp1, cfg, isClient, opts)
 	case NetworkHttps:
 		if cfg == nil {
 			return nil, xneterr.ErrNilTlsConfig.Errorf(network)
 		}
-		return xfakehttp.XUpgrader(cfg, isClient), nil
+		return xfakehttp.FakeHttpUpgraderWithOptions(xfakehttp.CarrierHttp1, cfg, isClient, opts)
+	case NetworkH2:
+		if cfg == nil {
+			return nil, xneterr.ErrNilTlsConfig.Errorf(network)
+		}
+		return xfakehttp.FakeHttpUpgraderWithOptions(xfakehttp.CarrierHttp2, cfg, isClient, opts)
+	case NetworkH3:
+		return xfakehttp.FakeHttpUpgraderWithOptions(xfakehttp.CarrierHttp3, nil, isClient, opts)
 	default:
 		return nil, xneterr.ErrNetworkIsInvalid.Errorf(network)
 	}
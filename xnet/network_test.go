@@ -0,0 +1,193 @@
+package xnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/peakedshout/go-pandorasbox/pcrypto"
+	"github.com/peakedshout/go-pandorasbox/xnet/conn/websocketconn"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xquic"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestMakeNetworkUpgraderWithOptions(t *testing.T) {
+	cfg := pcrypto.MustNewDefaultTlsConfig()
+	sni := make(chan string, 1)
+	scfg := cfg.Clone()
+	scfg.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- info.ServerName
+		return nil, nil
+	}
+	server, err := MakeNetworkUpgrader(func(index int, network string) (*tls.Config, bool, error) {
+		if network == NetworkWs {
+			return nil, false, nil
+		}
+		return scfg, false, nil
+	}, NetworkTLS, NetworkWs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &xnetutil.UpgradeOptions{
+		ServerName: "sni.example.com",
+		Host:       "example.com",
+		Path:       "/ws",
+		Header:     http.Header{"X-Token": []string{"t"}},
+	}
+	client, err := MakeNetworkUpgraderWithOptions(MCallbackFunc(func(index int, network string) (*tls.Config, bool, error) {
+		if network == NetworkWs {
+			return nil, true, nil
+		}
+		return cfg, true, nil
+	}).WithOptions(opts), NetworkTLS, NetworkWs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	header := make(chan http.Header, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		uconn, err := server.Upgrade(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer uconn.Close()
+		header <- uconn.(*websocketconn.WebsocketConn).HandshakeHeader()
+		_, _ = io.Copy(uconn, uconn)
+	}()
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uconn, err := client.Upgrade(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	data := []byte("12313123")
+	_, err = uconn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(uconn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("data fatal")
+	}
+	if s := <-sni; s != opts.ServerName {
+		t.Fatal("server name fatal:", s)
+	}
+	if h := <-header; h.Get("X-Token") != "t" {
+		t.Fatal("header fatal:", h)
+	}
+
+	for _, opts := range []*xnetutil.UpgradeOptions{{Path: "ws"}, {Padding: -1}} {
+		bad := MCallbackFunc(func(index int, network string) (*tls.Config, bool, error) {
+			return cfg, true, nil
+		}).WithOptions(opts)
+		for _, network := range []string{NetworkTLS, NetworkWs, NetworkWss, NetworkHttp, NetworkHttps, NetworkH2, NetworkH3} {
+			_, err = MakeNetworkUpgraderWithOptions(bad, network)
+			if err == nil {
+				t.Fatal("expected an error", network, opts)
+			}
+		}
+	}
+}
+
+func TestMakeNetworkUpgraderH3(t *testing.T) {
+	// h3 runs on a stream of an xquic session, and its padding comes from the options
+	cfg := pcrypto.MustNewDefaultTlsConfig()
+	cfg.NextProtos = []string{"h3"}
+	opts := &xnetutil.UpgradeOptions{Host: "example.com", Path: "/stream", Padding: 64}
+	callback := func(isClient bool) MOptionsCallbackFunc {
+		return MCallbackFunc(func(index int, network string) (*tls.Config, bool, error) {
+			return nil, isClient, nil
+		}).WithOptions(opts)
+	}
+	server, err := MakeNetworkUpgraderWithOptions(callback(false), NetworkH3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := MakeNetworkUpgraderWithOptions(callback(true), NetworkH3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := xquic.NewQuicListenConfig(nil, cfg).ListenSession(ctx, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		sess, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer sess.Close()
+		stream, err := sess.AcceptStream(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		uconn, err := server.Upgrade(stream)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer uconn.Close()
+		_, _ = io.Copy(uconn, uconn)
+	}()
+	sess, err := xquic.NewDialer(nil, cfg).DialSession(ctx, "udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stream, err := sess.OpenStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uconn, err := client.Upgrade(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	data := bytes.Repeat([]byte("12313123"), 64*1024)
+	go func() {
+		_, _ = uconn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(uconn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("data fatal")
+	}
+
+	conn, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = client.Upgrade(conn)
+	if err == nil {
+		t.Fatal("h3 upgraded a conn that is not quic")
+	}
+}
@@ -0,0 +1,220 @@
+package chain
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+)
+
+const (
+	HopSocks4  = "socks4"
+	HopSocks4a = "socks4a"
+	HopSocks5  = "socks5"
+	HopHTTP    = "http"
+	HopHTTPS   = "https"
+	HopRelay   = "relay"
+)
+
+var ErrEmptyChain = errors.New("empty proxy chain")
+
+var ErrNetworkNotSupport = errors.New("network not support")
+
+var ErrHopType = func(typ string) error { return fmt.Errorf("unknown hop type: %s", typ) }
+
+// ErrDestination Wraps the dial errors of a chain that come from the destination rather than the hops,
+// e.g. the last hop answered that the host is unreachable.
+var ErrDestination = errors.New("chain destination failed")
+
+// Hop
+//
+//	One proxy of a chain, reached through the hops before it.
+//	socks4 resolves domain names locally, socks4a, socks5, http and https pass them to the proxy.
+//	User is the socks4 user-id or the socks5 and http username, Password goes with it.
+//	relay is the protocol of socks.RelayServe, e.g. served on the streams of an xrpc session.
+type Hop struct {
+	Type     string `json:"type" yaml:"type"`
+	Network  string `json:"network" yaml:"network"` // default "tcp"
+	Address  string `json:"address" yaml:"address"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+	// TLS The tls config to the https proxy.
+	TLS *tls.Config `json:"-" yaml:"-"`
+	// Relay Opens the connection to the relay instead of dialing Address, it must be the first hop then.
+	Relay func(ctx context.Context) (net.Conn, error) `json:"-" yaml:"-"`
+}
+
+// Build The dialer through hops in order, the first hop is dialed directly.
+func Build(hops ...*Hop) (xnetutil.Dialer, error) {
+	return BuildWith(nil, hops...)
+}
+
+// BuildWith Like Build, the first hop is dialed through forward when it is not nil.
+func BuildWith(forward xnetutil.Dialer, hops ...*Hop) (xnetutil.Dialer, error) {
+	if len(hops) == 0 {
+		return nil, ErrEmptyChain
+	}
+	dr := forward
+	for i, hop := range hops {
+		if i == len(hops)-1 && dr != nil {
+			dr = hopDialer{dr}
+		}
+		next, err := hop.dialer(dr)
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d: %w", i, err)
+		}
+		dr = next
+	}
+	return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dr.DialContext(ctx, network, addr)
+		if err != nil && isDestinationErr(err) {
+			return nil, fmt.Errorf("%w: %w", ErrDestination, err)
+		}
+		return conn, err
+	}), nil
+}
+
+// hopError A dial error on the way to the last hop.
+type hopError struct {
+	err error
+}
+
+func (he *hopError) Error() string {
+	return he.err.Error()
+}
+
+func (he *hopError) Unwrap() error {
+	return he.err
+}
+
+// hopDialer Marks the errors of the hops before the last one, their replies are not about the destination.
+type hopDialer struct {
+	xnetutil.Dialer
+}
+
+func (hd hopDialer) Dial(network string, addr string) (net.Conn, error) {
+	return hd.DialContext(context.Background(), network, addr)
+}
+
+func (hd hopDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := hd.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &hopError{err: err}
+	}
+	return conn, nil
+}
+
+// resolveError The destination name of a socks4 hop does not resolve.
+type resolveError struct {
+	err error
+}
+
+func (re *resolveError) Error() string {
+	return re.err.Error()
+}
+
+func (re *resolveError) Unwrap() error {
+	return re.err
+}
+
+// isDestinationErr Whether the last hop failed to reach the destination, an error of the hops before is not.
+func isDestinationErr(err error) bool {
+	var he *hopError
+	if errors.As(err, &he) {
+		return false
+	}
+	var re *resolveError
+	if errors.As(err, &re) || socks.IsDestinationErr(err) {
+		return true
+	}
+	var ce *httpproxy.ConnectError
+	return errors.As(err, &ce) && ce.IsDestination()
+}
+
+func (h *Hop) dialer(forward xnetutil.Dialer) (xnetutil.Dialer, error) {
+	if h == nil {
+		return nil, errors.New("nil hop")
+	}
+	network := h.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if h.Address == "" && (h.Type != HopRelay || h.Relay == nil) {
+		return nil, errors.New("missing address")
+	}
+	switch h.Type {
+	case HopSocks4:
+		dr, err := socks.SOCKS4CONNECT(network, h.Address, socks.S4UserId(h.User), forward)
+		if err != nil {
+			return nil, err
+		}
+		return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			addr, err := resolve4(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return dr.DialContext(ctx, network, addr)
+		}), nil
+	case HopSocks4a:
+		return socks.SOCKS4CONNECT(network, h.Address, socks.S4UserId(h.User), forward)
+	case HopSocks5:
+		var auth *socks.S5AuthPassword
+		if h.User != "" {
+			auth = &socks.S5AuthPassword{User: h.User, Password: h.Password}
+		}
+		return socks.SOCKS5CONNECTP(network, h.Address, auth, forward)
+	case HopHTTP, HopHTTPS:
+		var auth *httpproxy.BasicAuth
+		if h.User != "" {
+			auth = &httpproxy.BasicAuth{Username: h.User, Password: h.Password}
+		}
+		if h.Type == HopHTTPS {
+			return httpproxy.HTTPSCONNECT(network, h.Address, auth, h.TLS, forward)
+		}
+		return httpproxy.HTTPCONNECT(network, h.Address, auth, forward)
+	case HopRelay:
+		open := h.Relay
+		if open != nil && forward != nil {
+			return nil, errors.New("relay with Relay must be the first hop")
+		}
+		if open == nil {
+			if forward == nil {
+				forward = &net.Dialer{}
+			}
+			open = func(ctx context.Context) (net.Conn, error) {
+				return forward.DialContext(ctx, network, h.Address)
+			}
+		}
+		handler := socks.RelayCMDCONNECTHandler(open)
+		return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			switch network {
+			case "tcp", "tcp4", "tcp6":
+			default:
+				return nil, ErrNetworkNotSupport
+			}
+			return handler(ctx, addr)
+		}), nil
+	default:
+		return nil, ErrHopType(h.Type)
+	}
+}
+
+// resolve4 The ipv4 address of addr, socks4 does not carry names.
+func resolve4(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return "", &resolveError{err: err}
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,321 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuild(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	s5 := testSocks(t, socks.S5AuthCb{
+		Socks5AuthPASSWORD: func(conn net.Conn, auth socks.S5AuthPassword) net.Conn {
+			return auth.IsEqual2(conn, "user", "pass")
+		},
+	})
+	defer s5.Close()
+	s4 := testSocks(t, socks.S5AuthCb{Socks5AuthNOAUTH: socks.DefaultAuthConnCb})
+	defer s4.Close()
+	hp := testHTTP(t)
+	defer hp.Close()
+	relay := testRelay(t)
+	defer relay.Close()
+
+	dr, err := Build(
+		&Hop{Type: HopSocks5, Address: s5.Addr().String(), User: "user", Password: "pass"},
+		&Hop{Type: HopHTTP, Address: hp.Addr().String(), User: "user", Password: "pass"},
+		&Hop{Type: HopSocks4a, Address: s4.Addr().String()},
+		&Hop{Type: HopRelay, Address: relay.Addr().String()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial("tcp", "localhost:"+echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fasttool.EchoCheck(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// socks4 resolves the name itself, relay opened by a callback
+	var opened atomic.Int32
+	dr, err = Build(
+		&Hop{Type: HopRelay, Relay: func(ctx context.Context) (net.Conn, error) {
+			opened.Add(1)
+			return new(net.Dialer).DialContext(ctx, "tcp", relay.Addr().String())
+		}},
+		&Hop{Type: HopSocks4, Address: s4.Addr().String(), User: "id"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dr.Dial("tcp", "localhost:"+echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fasttool.EchoCheck(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if opened.Load() != 1 {
+		t.Fatal(opened.Load())
+	}
+
+	// a wrong password of the second hop
+	dr, _ = Build(
+		&Hop{Type: HopHTTP, Address: hp.Addr().String(), User: "user", Password: "pass"},
+		&Hop{Type: HopSocks5, Address: s5.Addr().String(), User: "user", Password: "bad"},
+	)
+	_, err = dr.Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal()
+	}
+
+	invalid := [][]*Hop{
+		nil,
+		{{Type: "ftp", Address: "127.0.0.1:1"}},
+		{{Type: HopSocks5}},
+		{{Type: HopSocks5, Address: "127.0.0.1:1"}, {Type: HopRelay, Relay: func(ctx context.Context) (net.Conn, error) { return nil, nil }}},
+	}
+	for _, one := range invalid {
+		_, err = Build(one...)
+		if err == nil {
+			t.Fatal(one)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	var badUp atomic.Bool
+	dials := make(map[string]*atomic.Int32)
+	member := func(name string, delay time.Duration, up func() bool) *Member {
+		dials[name] = new(atomic.Int32)
+		return &Member{Name: name, Dialer: xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			dials[name].Add(1)
+			if up != nil && !up() {
+				return nil, errors.New("down")
+			}
+			time.Sleep(delay)
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		})}
+	}
+	members := []*Member{
+		member("bad", 0, badUp.Load),
+		member("slow", 50*time.Millisecond, nil),
+		member("fast", 0, nil),
+	}
+
+	g, err := NewGroup(&GroupConfig{Type: GroupTypeFailover}, members...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := g.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fasttool.EchoCheck(conn, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	// bad is down after its first failure and tried last
+	if dials["bad"].Load() != 1 || dials["slow"].Load() != 2 || dials["fast"].Load() != 0 {
+		t.Fatal(dials["bad"].Load(), dials["slow"].Load(), dials["fast"].Load())
+	}
+	if status := g.Status(); status[0].Alive || !status[1].Alive || status[0].Fails != 1 {
+		t.Fatal(status)
+	}
+
+	lg, err := NewGroup(&GroupConfig{
+		Type:          GroupTypeLatency,
+		ProbeAddr:     echo.Addr().String(),
+		ProbeInterval: time.Hour,
+	}, members...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lg.Close()
+	lg.Probe()
+	before := dials["fast"].Load()
+	conn, err := lg.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if dials["fast"].Load() != before+1 {
+		t.Fatal("fast not picked")
+	}
+	status := lg.Status()
+	if status[0].Alive || status[1].Latency <= status[2].Latency {
+		t.Fatal(status)
+	}
+	// bad comes back
+	badUp.Store(true)
+	lg.Probe()
+	if !lg.Status()[0].Alive {
+		t.Fatal()
+	}
+
+	// every member failing
+	down, _ := NewGroup(nil, member("down", 0, func() bool { return false }))
+	_, err = down.Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal()
+	}
+	_, err = NewGroup(nil)
+	if !errors.Is(err, ErrEmptyChain) {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupDestination(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	s5 := testSocks(t, socks.S5AuthCb{Socks5AuthNOAUTH: socks.DefaultAuthConnCb})
+	defer s5.Close()
+	hp := testHTTP(t)
+	defer hp.Close()
+	relay := testRelay(t)
+	defer relay.Close()
+
+	chains := [][]*Hop{
+		{{Type: HopSocks5, Address: s5.Addr().String()}},
+		{{Type: HopSocks4a, Address: s5.Addr().String()}},
+		{{Type: HopHTTP, Address: hp.Addr().String(), User: "user", Password: "pass"}},
+		{{Type: HopRelay, Address: relay.Addr().String()}},
+		{{Type: HopRelay, Address: relay.Addr().String()}, {Type: HopSocks5, Address: s5.Addr().String()}},
+	}
+	var members []*Member
+	for i, hops := range chains {
+		dr, err := Build(hops...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dr.Dial("tcp", deadAddr)
+		if !errors.Is(err, ErrDestination) {
+			t.Fatal(i, err)
+		}
+		members = append(members, &Member{Name: hops[0].Type, Dialer: dr})
+	}
+	g, err := NewGroup(nil, members...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for i := 0; i < 3; i++ {
+		_, err = g.Dial("tcp", deadAddr)
+		if err == nil {
+			t.Fatal()
+		}
+	}
+	for _, one := range g.Status() {
+		if !one.Alive || one.Fails != 0 {
+			t.Fatal(one)
+		}
+	}
+
+	// the first hop can not reach the second one, the chain is broken
+	dr, err := Build(
+		&Hop{Type: HopSocks5, Address: s5.Addr().String()},
+		&Hop{Type: HopSocks5, Address: deadAddr},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dr.Dial("tcp", s5.Addr().String())
+	if err == nil || errors.Is(err, ErrDestination) {
+		t.Fatal(err)
+	}
+	bg, err := NewGroup(nil, &Member{Name: "broken", Dialer: dr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bg.Close()
+	_, _ = bg.Dial("tcp", s5.Addr().String())
+	if bg.Status()[0].Alive {
+		t.Fatal(bg.Status())
+	}
+}
+
+func testSocks(t *testing.T, auth socks.S5AuthCb) net.Listener {
+	server, err := socks.NewServer(&socks.ServerConfig{
+		VersionSwitch: socks.DefaultSocksVersionSwitch,
+		CMDConfig:     socks.DefaultSocksCMDConfig,
+		Socks5AuthCb:  auth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer server.Close()
+		_ = server.Serve(ln)
+	}()
+	return ln
+}
+
+func testHTTP(t *testing.T) net.Listener {
+	server, err := httpproxy.NewServer(&httpproxy.ServerConfig{ReqAuthCb: httpproxy.UserInfoAuth("user", "pass")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer server.Close()
+		_ = server.Serve(ln)
+	}()
+	return ln
+}
+
+func testRelay(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go socks.RelayServe(conn)
+		}
+	}()
+	return ln
+}
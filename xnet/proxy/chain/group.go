@@ -0,0 +1,249 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"github.com/peakedshout/go-pandorasbox/tool/merror"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type GroupType uint8
+
+const (
+	// GroupTypeFailover The first alive member in order.
+	GroupTypeFailover = GroupType(iota)
+	// GroupTypeLatency The alive member with the lowest latency.
+	GroupTypeLatency
+)
+
+// GroupConfig
+//
+//	A member is down after MaxFails dials or probes failed in a row and up again after one succeeded.
+//	A dial failed by the destination (ErrDestination) is not held against the member.
+//	Down members are still tried, after the alive ones, when nothing else works.
+type GroupConfig struct {
+	Type GroupType
+	// ProbeAddr The host:port dialed through every member every ProbeInterval, no probing when empty.
+	ProbeAddr     string
+	ProbeInterval time.Duration // default 30s
+	ProbeTimeout  time.Duration // default 5s
+	MaxFails      int           // default 1
+}
+
+// Member A chain of a Group.
+type Member struct {
+	Name   string
+	Dialer xnetutil.Dialer
+}
+
+// MemberStatus The health of a member, Latency is zero until it was measured.
+type MemberStatus struct {
+	Name    string
+	Alive   bool
+	Latency time.Duration
+	Fails   int
+	Checked time.Time
+}
+
+// Group
+//
+//	A dialer over several proxy chains, like xmulti.MultiAddrDialer for proxy paths:
+//	each dial tries the members by GroupType until one connects,
+//	and the dials and probes keep the health and latency of every member.
+type Group struct {
+	cfg *GroupConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	members []*member
+}
+
+type member struct {
+	Member
+	mux    sync.Mutex
+	status MemberStatus
+}
+
+func NewGroup(cfg *GroupConfig, members ...*Member) (*Group, error) {
+	return NewGroupContext(context.Background(), cfg, members...)
+}
+
+func NewGroupContext(ctx context.Context, cfg *GroupConfig, members ...*Member) (*Group, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if cfg == nil {
+		cfg = &GroupConfig{}
+	}
+	if len(members) == 0 {
+		return nil, ErrEmptyChain
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 30 * time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 5 * time.Second
+	}
+	if cfg.MaxFails <= 0 {
+		cfg.MaxFails = 1
+	}
+	g := &Group{cfg: cfg}
+	for _, one := range members {
+		if one == nil || one.Dialer == nil {
+			return nil, errors.New("nil group member")
+		}
+		g.members = append(g.members, &member{
+			Member: *one,
+			status: MemberStatus{Name: one.Name, Alive: true},
+		})
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	if cfg.ProbeAddr != "" {
+		go g.probeLoop()
+	}
+	return g, nil
+}
+
+func (g *Group) Close() error {
+	g.cancel()
+	return nil
+}
+
+func (g *Group) Dial(network string, addr string) (net.Conn, error) {
+	return g.DialContext(context.Background(), network, addr)
+}
+
+func (g *Group) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	multiErr := merror.NewMultiErr("group dialer err")
+	for _, one := range g.order() {
+		start := time.Now()
+		conn, err := one.Dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			one.report(nil, time.Since(start), g.cfg.MaxFails)
+			return conn, nil
+		}
+		if ctxtool.Disable(ctx) {
+			return nil, err
+		}
+		// the chain worked, the destination did not
+		if !errors.Is(err, ErrDestination) {
+			one.report(err, 0, g.cfg.MaxFails)
+		}
+		multiErr.AddErr(one.Name, err)
+	}
+	return nil, multiErr
+}
+
+// Status The health of the members in order.
+func (g *Group) Status() []MemberStatus {
+	list := make([]MemberStatus, 0, len(g.members))
+	for _, one := range g.members {
+		list = append(list, one.get())
+	}
+	return list
+}
+
+// Probe Dial ProbeAddr through every member now.
+func (g *Group) Probe() {
+	if g.cfg.ProbeAddr == "" {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, one := range g.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			ctx, cl := context.WithTimeout(g.ctx, g.cfg.ProbeTimeout)
+			defer cl()
+			start := time.Now()
+			conn, err := m.Dialer.DialContext(ctx, "tcp", g.cfg.ProbeAddr)
+			if err != nil {
+				if g.ctx.Err() == nil {
+					m.report(err, 0, g.cfg.MaxFails)
+				}
+				return
+			}
+			_ = conn.Close()
+			m.report(nil, time.Since(start), g.cfg.MaxFails)
+		}(one)
+	}
+	wg.Wait()
+}
+
+func (g *Group) probeLoop() {
+	g.Probe()
+	ticker := time.NewTicker(g.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			g.Probe()
+		}
+	}
+}
+
+// order The members to try: the alive ones by GroupType, then the down ones.
+func (g *Group) order() []*member {
+	type unit struct {
+		m      *member
+		status MemberStatus
+	}
+	list := make([]unit, 0, len(g.members))
+	for _, one := range g.members {
+		list = append(list, unit{m: one, status: one.get()})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].status, list[j].status
+		if a.Alive != b.Alive {
+			return a.Alive
+		}
+		if g.cfg.Type == GroupTypeLatency && a.Latency != b.Latency {
+			// unmeasured members go after the measured ones
+			return b.Latency == 0 || (a.Latency != 0 && a.Latency < b.Latency)
+		}
+		return false
+	})
+	members := make([]*member, 0, len(list))
+	for _, one := range list {
+		members = append(members, one.m)
+	}
+	return members
+}
+
+func (m *member) get() MemberStatus {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.status
+}
+
+// report Record a dial, the latency is smoothed over the last ones.
+func (m *member) report(err error, latency time.Duration, maxFails int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.status.Checked = time.Now()
+	if err != nil {
+		m.status.Fails++
+		if m.status.Fails >= maxFails {
+			m.status.Alive = false
+		}
+		return
+	}
+	m.status.Fails = 0
+	m.status.Alive = true
+	if m.status.Latency == 0 {
+		m.status.Latency = latency
+	} else {
+		m.status.Latency = (m.status.Latency*3 + latency) / 4
+	}
+}
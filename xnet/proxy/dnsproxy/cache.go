@@ -0,0 +1,124 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"golang.org/x/net/dns/dnsmessage"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+func newCacheKey(q dnsmessage.Question) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		typ:   q.Type,
+		class: q.Class,
+	}
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	message  *dnsmessage.Message
+	stored   time.Time
+	expire   time.Time
+	negative bool
+}
+
+// reply The cached message answering req, with the ttl counted down since it was stored.
+func (e *cacheEntry) reply(req *dnsmessage.Message, now time.Time) *dnsmessage.Message {
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	resp := &dnsmessage.Message{
+		Header:      e.message.Header,
+		Questions:   req.Questions,
+		Answers:     countDown(e.message.Answers, elapsed),
+		Authorities: countDown(e.message.Authorities, elapsed),
+		Additionals: countDown(e.message.Additionals, elapsed),
+	}
+	resp.ID = req.ID
+	resp.RecursionDesired = req.RecursionDesired
+	return resp
+}
+
+func countDown(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	list := make([]dnsmessage.Resource, len(rs))
+	copy(list, rs)
+	for i := range list {
+		if list[i].Header.TTL > elapsed {
+			list[i].Header.TTL -= elapsed
+		} else {
+			list[i].Header.TTL = 0
+		}
+	}
+	return list
+}
+
+// cache A ttl cache evicting the least recently used entry beyond size.
+type cache struct {
+	mux  sync.Mutex
+	size int
+	list *list.List
+	m    map[cacheKey]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size: size,
+		list: list.New(),
+		m:    make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *cache) get(key cacheKey, now time.Time) (*cacheEntry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	elem, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expire) {
+		c.list.Remove(elem)
+		delete(c.m, key)
+		return nil, false
+	}
+	c.list.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *cache) set(entry *cacheEntry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if elem, ok := c.m[entry.key]; ok {
+		elem.Value = entry
+		c.list.MoveToFront(elem)
+		return
+	}
+	c.m[entry.key] = c.list.PushFront(entry)
+	for c.list.Len() > c.size {
+		last := c.list.Back()
+		c.list.Remove(last)
+		delete(c.m, last.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *cache) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.list.Len()
+}
+
+func (c *cache) flush() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.list.Init()
+	c.m = make(map[cacheKey]*list.Element)
+}
@@ -57,7 +57,7 @@ func (c *Client) LookupIPContext(ctx context.Context, name string) ([]string, er
 	if err != nil {
 		return nil, err
 	}
-	if !resp.Response {
+	if resp == nil || !resp.Response {
 		return nil, errors.New("nil response")
 	}
 	if resp.RCode != dnsmessage.RCodeSuccess {
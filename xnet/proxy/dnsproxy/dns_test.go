@@ -1,8 +1,15 @@
 package dnsproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/peakedshout/go-pandorasbox/pcrypto"
+	"golang.org/x/net/dns/dnsmessage"
 	"net"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -36,3 +43,392 @@ func TestDNS(t *testing.T) {
 	}
 	fmt.Println(ips)
 }
+
+func TestResolver(t *testing.T) {
+	var queries atomic.Int32
+	up := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		queries.Add(1)
+		return testAnswer(message), nil
+	}
+	down := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		return nil, errors.New("down")
+	}
+	slow := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return testAnswer(message), nil
+		}
+	}
+	resolver, err := NewResolver(&ResolverConfig{
+		Upstreams: []ReqCb{down, up},
+		Hosts:     map[string][]net.IP{"Host.Test": {net.IPv4(10, 0, 0, 1), net.ParseIP("::1")}},
+		Blocks:    []string{"ads.test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := NewClient(resolver.Resolve)
+
+	for i := 0; i < 2; i++ {
+		ips, err := client.LookupIP("a.test")
+		if err != nil || len(ips) != 1 || ips[0] != "1.2.3.4" {
+			t.Fatal(ips, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err = client.LookupIP("none.test")
+		if err == nil || err.Error() != dnsmessage.RCodeNameError.String() {
+			t.Fatal(err)
+		}
+	}
+	ips, err := client.LookupIP("host.test")
+	if err != nil || len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Fatal(ips, err)
+	}
+	for _, name := range []string{"ads.test", "x.ads.test"} {
+		_, err = client.LookupIP(name)
+		if err == nil || err.Error() != dnsmessage.RCodeNameError.String() {
+			t.Fatal(name, err)
+		}
+	}
+	stats := resolver.Stats()
+	if queries.Load() != 2 || stats.Queries != 7 || stats.Hits != 1 || stats.NegativeHits != 1 || stats.Misses != 2 ||
+		stats.HostsHits != 1 || stats.Blocked != 2 || stats.UpstreamErrors != 2 || stats.Entries != 2 {
+		t.Fatal(queries.Load(), stats)
+	}
+	// the ttl counts down in the cache
+	resp, _ := resolver.Resolve(context.Background(), testQuery("a.test"))
+	if ttl := resp.Answers[0].Header.TTL; ttl > 300 || ttl < 299 {
+		t.Fatal(ttl)
+	}
+	resolver.Flush()
+	if resolver.Stats().Entries != 0 {
+		t.Fatal()
+	}
+
+	// the fast one of parallel upstreams answers
+	parallel, _ := NewResolver(&ResolverConfig{Upstreams: []ReqCb{slow, up}, Strategy: StrategyParallel, CacheSize: -1})
+	start := time.Now()
+	resp, err = parallel.Resolve(context.Background(), testQuery("a.test"))
+	if err != nil || len(resp.Answers) != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatal(resp, err)
+	}
+	if parallel.Stats().UpstreamErrors != 0 {
+		t.Fatal(parallel.Stats())
+	}
+	failed, _ := NewResolver(&ResolverConfig{Upstreams: []ReqCb{down, down}})
+	_, err = failed.Resolve(context.Background(), testQuery("a.test"))
+	if err == nil {
+		t.Fatal()
+	}
+	// an upstream answering nothing is an error of its own
+	none := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		return nil, nil
+	}
+	for _, strategy := range []Strategy{StrategyFailover, StrategyParallel} {
+		failed, _ = NewResolver(&ResolverConfig{Upstreams: []ReqCb{none}, Strategy: strategy, CacheSize: -1})
+		_, err = failed.Resolve(context.Background(), testQuery("a.test"))
+		if !errors.Is(err, ErrNoResponse) {
+			t.Fatal(err)
+		}
+		fallback, _ := NewResolver(&ResolverConfig{Upstreams: []ReqCb{none, up}, Strategy: strategy, CacheSize: -1})
+		resp, err = fallback.Resolve(context.Background(), testQuery("a.test"))
+		if err != nil || len(resp.Answers) != 1 {
+			t.Fatal(resp, err)
+		}
+	}
+}
+
+func TestUpstreamFunc(t *testing.T) {
+	// udp answers truncated, tcp answers in full
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pconn.Close()
+	server := NewServer(func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		resp := testAnswer(message)
+		resp.Answers = nil
+		resp.Truncated = true
+		return resp, nil
+	}, 0)
+	defer server.Close()
+	go server.Serve(pconn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		var m dnsmessage.Message
+		if m.Unpack(b) != nil {
+			return
+		}
+		pack, _ := testAnswer(&m).Pack()
+		_ = writeTCPMessage(conn, pack)
+	}()
+	rcb, err := UpstreamFunc(3*time.Second, "udp", pconn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rcb(context.Background(), testQuery("a.test"))
+	if err != nil || resp.Truncated || len(resp.Answers) != 1 {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestDoHDoT(t *testing.T) {
+	cfg, err := pcrypto.NewDefaultTlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		return testAnswer(message), nil
+	}, 0)
+	defer server.Close()
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ln
+	}
+	doh, plain, dot := listen(), listen(), listen()
+	go server.ServeDoH(doh, cfg, "")
+	go server.ServeDoH(plain, nil, "/custom")
+	go server.ServeDoT(dot, cfg)
+
+	var rcbs []ReqCb
+	for _, one := range []*DoHConfig{
+		{Host: doh.Addr().String(), TLS: cfg},
+		{Host: doh.Addr().String(), TLS: cfg, GET: true},
+		{Host: plain.Addr().String(), Path: "/custom", GET: true},
+	} {
+		rcb, err := DoHFunc(3*time.Second, one)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcbs = append(rcbs, rcb)
+	}
+	rcb, err := DoTFunc(3*time.Second, dot.Addr().String(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcbs = append(rcbs, rcb)
+	for i, one := range rcbs {
+		query := testQuery("a.test")
+		query.ID = 77
+		resp, err := one(context.Background(), query)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if resp.ID != 77 || len(resp.Answers) != 1 {
+			t.Fatal(i, resp)
+		}
+	}
+
+	// pipelined queries on one connection
+	conn, err := tls.Dial("tcp", dot.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, id := range []uint16{1, 2} {
+		query := testQuery("a.test")
+		query.ID = id
+		pack, _ := query.Pack()
+		err = writeTCPMessage(conn, pack)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		ids[m.ID] = true
+	}
+	if !ids[1] || !ids[2] {
+		t.Fatal(ids)
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	server := NewServer(func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		resp := testAnswer(testQuery("a.test"))
+		resp.ID = message.ID
+		resp.Questions = message.Questions
+		switch message.Questions[0].Name.String() {
+		case "slow.test.":
+			time.Sleep(300 * time.Millisecond)
+		case "big.test.":
+			for i := 0; i < 100; i++ {
+				resp.Answers = append(resp.Answers, resp.Answers[0])
+			}
+		}
+		return resp, nil
+	}, 0)
+	defer server.Close()
+	server.SetIdleTimeout(200 * time.Millisecond)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeListener(ln)
+	pconn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	go server.Serve(pconn)
+
+	// the big answer is truncated over udp and complete over tcp
+	udp, _ := DefaultFunc(3*time.Second, "udp", pconn.LocalAddr().String())
+	resp, err := udp(context.Background(), testQuery("big.test"))
+	if err != nil || !resp.Truncated || len(resp.Answers) != 0 {
+		t.Fatal(resp, err)
+	}
+	rcb, _ := UpstreamFunc(3*time.Second, "udp", pconn.LocalAddr().String())
+	resp, err = rcb(context.Background(), testQuery("big.test"))
+	if err != nil || len(resp.Answers) != 101 {
+		t.Fatal(resp, err)
+	}
+
+	// pipelined, the fast one first, the slow one outlives the idle timeout
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i, name := range []string{"slow.test", "a.test"} {
+		query := testQuery(name)
+		query.ID = uint16(i + 1)
+		pack, _ := query.Pack()
+		_ = writeTCPMessage(conn, pack)
+	}
+	for _, id := range []uint16{2, 1} {
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(b); err != nil || m.ID != id {
+			t.Fatal(m.ID, err)
+		}
+	}
+	// then the idle connection is closed
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+func testQuery(name string) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name + "."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+// testAnswer a.test is 1.2.3.4, the others do not exist.
+func testAnswer(message *dnsmessage.Message) *dnsmessage.Message {
+	resp := newReply(message, dnsmessage.RCodeSuccess)
+	q := message.Questions[0]
+	if q.Name.String() != "a.test." {
+		resp.RCode = dnsmessage.RCodeNameError
+		resp.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 600},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("admin.test."),
+				MinTTL: 30,
+			},
+		}}
+		return resp
+	}
+	resp.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+	}}
+	return resp
+}
+
+func TestFakeIP(t *testing.T) {
+	fake, err := NewFakeIP(&FakeIPConfig{
+		CIDR6: "fc00::/64",
+		Size:  2,
+		Skip: func(name string) bool {
+			return name == "real.test"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		return testAnswer(testQuery("a.test")), nil
+	}
+	client, _ := NewClient(ReqCb(fake.Wrap(next)))
+	ips, err := client.LookupIP("a.test")
+	if err != nil || len(ips) != 1 || ips[0] != "198.18.0.1" {
+		t.Fatal(ips, err)
+	}
+	ips, _ = client.LookupIP("b.test")
+	if ips[0] != "198.18.0.2" {
+		t.Fatal(ips)
+	}
+	ips, _ = client.LookupIP("real.test")
+	if ips[0] != "1.2.3.4" {
+		t.Fatal(ips)
+	}
+	resp, _ := fake.Wrap(next)(context.Background(), &dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("b.test."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET,
+	}}})
+	if ip := net.IP(resp.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]); ip.String() != "fc00::2" {
+		t.Fatal(ip)
+	}
+	for _, one := range [][2]string{{"fc00::2", "b.test"}, {"198.18.0.1", "a.test"}} {
+		if got, ok := fake.Lookup(net.ParseIP(one[0])); !ok || got != one[1] {
+			t.Fatal(one, got)
+		}
+	}
+	// a.test was used last, b.test gives its address to c.test
+	ip4, _ := fake.IP("c.test")
+	if ip4.String() != "198.18.0.2" {
+		t.Fatal(ip4)
+	}
+	if name, _ := fake.Lookup(ip4); name != "c.test" {
+		t.Fatal(name)
+	}
+	if _, ok := fake.Lookup(net.ParseIP("198.18.0.3")); ok || !fake.Contains(net.ParseIP("198.18.0.1")) || fake.Contains(net.ParseIP("10.0.0.1")) {
+		t.Fatal()
+	}
+	// only A and AAAA are faked
+	resp, _ = fake.Wrap(nil)(context.Background(), &dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name: dnsmessage.MustNewName("a.test."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET,
+	}}})
+	if resp.RCode != dnsmessage.RCodeRefused {
+		t.Fatal(resp.RCode)
+	}
+}
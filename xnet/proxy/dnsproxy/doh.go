@@ -0,0 +1,172 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DoHPath        = "/dns-query"
+	DoHContentType = "application/dns-message"
+)
+
+// DoHHandler The rfc8484 endpoint answering GET and POST queries by the RespCb of the server, to Set on a xhttp.Server.
+func (s *Server) DoHHandler() xhttp.Handler {
+	sctx := &serverCtx{s: s}
+	return func(ctx *xhttp.Context) error {
+		w, r := ctx.Raw()
+		var pack []byte
+		switch r.Method {
+		case http.MethodGet:
+			b, err := base64.RawURLEncoding.DecodeString(ctx.Query().Get("dns"))
+			if err != nil || len(b) == 0 {
+				http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+				return nil
+			}
+			pack = b
+		case http.MethodPost:
+			if ct := r.Header.Get("Content-Type"); ct != DoHContentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return nil
+			}
+			b, err := io.ReadAll(io.LimitReader(r.Body, 0xffff+1))
+			if err != nil {
+				return err
+			}
+			if len(b) > 0xffff {
+				http.Error(w, "dns message too long", http.StatusRequestEntityTooLarge)
+				return nil
+			}
+			pack = b
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
+		var message dnsmessage.Message
+		err := message.Unpack(pack)
+		if err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return nil
+		}
+		var resp []byte
+		sctx.handle(&message, func(pack []byte) {
+			resp = pack
+		})
+		if resp == nil {
+			http.Error(w, "dns query failed", http.StatusBadGateway)
+			return nil
+		}
+		w.Header().Set("Content-Type", DoHContentType)
+		if ttl, ok := minTTL(resp); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+		_, err = ctx.Write(resp)
+		return err
+	}
+}
+
+// ServeDoH Serve DoHHandler on path (default DoHPath), over tls when cfg is not nil.
+func (s *Server) ServeDoH(ln net.Listener, cfg *tls.Config, path string) error {
+	if path == "" {
+		path = DoHPath
+	}
+	hs := xhttp.NewServer(&xhttp.Config{Ctx: s.ctx, TlsCfg: cfg})
+	defer hs.Close()
+	hs.Set(path, s.DoHHandler())
+	return hs.AutoServe(ln)
+}
+
+// DoHConfig
+//
+//	The DoH upstream at https://Host/Path (default DoHPath), plain http when TLS is nil.
+//	Queries are POST by default, GET with id 0 is friendlier to http caches.
+type DoHConfig struct {
+	Host   string
+	Path   string
+	TLS    *tls.Config
+	Dialer xnetutil.Dialer
+	GET    bool
+}
+
+// DoHFunc The ReqCb querying a DoH server.
+func DoHFunc(timeout time.Duration, cfg *DoHConfig) (ReqCb, error) {
+	if cfg == nil || cfg.Host == "" {
+		return nil, errors.New("need doh host")
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	path := cfg.Path
+	if path == "" {
+		path = DoHPath
+	}
+	client := xhttp.NewClient(&xhttp.ClientConfig{
+		Dr:     cfg.Dialer,
+		TlsCfg: cfg.TLS,
+		Host:   cfg.Host,
+	})
+	return func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		query := *message
+		if cfg.GET {
+			query.ID = 0
+		}
+		pack, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		xctx, cl := context.WithTimeout(ctx, timeout)
+		defer cl()
+		header := http.Header{}
+		header.Set("Accept", DoHContentType)
+		var body io.Reader
+		if cfg.GET {
+			xctx = xhttp.SetArgsMethod(xctx, http.MethodGet)
+			xctx = xhttp.SetArgsQuery(xctx, url.Values{"dns": {base64.RawURLEncoding.EncodeToString(pack)}})
+		} else {
+			xctx = xhttp.SetArgsMethod(xctx, http.MethodPost)
+			header.Set("Content-Type", DoHContentType)
+			body = bytes.NewReader(pack)
+		}
+		xctx = xhttp.SetArgsHeader(xctx, header)
+		b, err := client.CallBytes(xctx, strings.TrimPrefix(path, "/"), body)
+		if err != nil {
+			return nil, err
+		}
+		var m dnsmessage.Message
+		err = m.Unpack(b)
+		if err != nil {
+			return nil, err
+		}
+		if m.ID != query.ID {
+			return nil, ErrMessageIdMismatch
+		}
+		m.ID = message.ID
+		return &m, nil
+	}, nil
+}
+
+// minTTL The lowest ttl of the answers of pack, for the freshness of a DoH response (rfc8484 5.1).
+func minTTL(pack []byte) (uint32, bool) {
+	var m dnsmessage.Message
+	if m.Unpack(pack) != nil || len(m.Answers) == 0 {
+		return 0, false
+	}
+	ttl := m.Answers[0].Header.TTL
+	for _, one := range m.Answers[1:] {
+		ttl = min(ttl, one.Header.TTL)
+	}
+	return ttl, true
+}
@@ -0,0 +1,38 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtls"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"time"
+)
+
+// ServeDoT Serve rfc7858 on ln, like ServeListener inside tls.
+func (s *Server) ServeDoT(ln net.Listener, cfg *tls.Config) error {
+	return s.serveListener(ln, xtls.TLSUpgrader(cfg, false))
+}
+
+// DoTFunc The ReqCb querying a DoT server at address, through dr when it is not nil.
+func DoTFunc(timeout time.Duration, address string, cfg *tls.Config, dr xnetutil.Dialer) (ReqCb, error) {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	if dr == nil {
+		dr = &net.Dialer{}
+	}
+	upgrader := xtls.TLSUpgrader(cfg, true)
+	return func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		xctx, cl := context.WithTimeout(ctx, timeout)
+		defer cl()
+		return exchangeStream(xctx, func(ctx context.Context) (net.Conn, error) {
+			conn, err := dr.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			return upgrader.UpgradeContext(ctx, conn)
+		}, message)
+	}, nil
+}
@@ -0,0 +1,233 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeIPConfig
+//
+//	A domain gets the same offset in both pools, AAAA is answered empty without CIDR6.
+//	The least recently used domain gives its address away when the pools or Size are exhausted.
+type FakeIPConfig struct {
+	CIDR4 string        // default "198.18.0.0/15"
+	CIDR6 string        // e.g. "fc00::/18"
+	Size  int           // default and at most the addresses of the smaller pool
+	TTL   time.Duration // of the answers, default 1s
+	// Skip The names resolved by the next RespCb as usual.
+	Skip func(name string) bool
+}
+
+// FakeIP
+//
+//	Answers A and AAAA with addresses of reserved pools and maps them back to the domains,
+//	so the proxies dial domains even for clients that only know the addresses.
+type FakeIP struct {
+	cfg  *FakeIPConfig
+	net4 *net.IPNet
+	net6 *net.IPNet
+	size int
+
+	mux    sync.Mutex
+	next   int
+	lru    *list.List
+	names  map[string]*list.Element
+	offset map[int]*list.Element
+}
+
+type fakeEntry struct {
+	name   string
+	offset int
+}
+
+func NewFakeIP(cfg *FakeIPConfig) (*FakeIP, error) {
+	if cfg == nil {
+		cfg = &FakeIPConfig{}
+	}
+	if cfg.CIDR4 == "" {
+		cfg.CIDR4 = "198.18.0.0/15"
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = time.Second
+	}
+	f := &FakeIP{
+		cfg:    cfg,
+		lru:    list.New(),
+		names:  make(map[string]*list.Element),
+		offset: make(map[int]*list.Element),
+	}
+	var err error
+	_, f.net4, err = net.ParseCIDR(cfg.CIDR4)
+	if err != nil {
+		return nil, err
+	}
+	if f.net4.IP.To4() == nil {
+		return nil, errors.New("fake ip CIDR4 is not ipv4")
+	}
+	f.size = poolSize(f.net4)
+	if cfg.CIDR6 != "" {
+		_, f.net6, err = net.ParseCIDR(cfg.CIDR6)
+		if err != nil {
+			return nil, err
+		}
+		if f.net6.IP.To4() != nil {
+			return nil, errors.New("fake ip CIDR6 is not ipv6")
+		}
+		f.size = min(f.size, poolSize(f.net6))
+	}
+	if cfg.Size > 0 {
+		f.size = min(f.size, cfg.Size)
+	}
+	if f.size <= 0 {
+		return nil, errors.New("fake ip pool too small")
+	}
+	return f, nil
+}
+
+// Wrap The RespCb answering A and AAAA by the pools and the other queries by next, refused without next.
+func (f *FakeIP) Wrap(next RespCb) RespCb {
+	return func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		if len(message.Questions) == 0 {
+			return nil, ErrNoQuestion
+		}
+		q := message.Questions[0]
+		name := fqdn(q.Name.String())
+		fake := q.Class == dnsmessage.ClassINET && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA)
+		if fake && (f.cfg.Skip == nil || !f.cfg.Skip(strings.TrimSuffix(name, "."))) {
+			return f.reply(message, name), nil
+		}
+		if next == nil {
+			return newReply(message, dnsmessage.RCodeRefused), nil
+		}
+		return next(ctx, message)
+	}
+}
+
+// Lookup The domain of a fake ip, without the trailing dot.
+func (f *FakeIP) Lookup(ip net.IP) (string, bool) {
+	offset, ok := f.offsetOf(ip)
+	if !ok {
+		return "", false
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	elem, ok := f.offset[offset]
+	if !ok {
+		return "", false
+	}
+	f.lru.MoveToFront(elem)
+	return strings.TrimSuffix(elem.Value.(*fakeEntry).name, "."), true
+}
+
+// Contains Whether ip is one the pools hand out, mapped or not.
+func (f *FakeIP) Contains(ip net.IP) bool {
+	_, ok := f.offsetOf(ip)
+	return ok
+}
+
+// IP The fake ips of a domain, allocating them when it has none.
+func (f *FakeIP) IP(name string) (ip4 net.IP, ip6 net.IP) {
+	offset := f.alloc(fqdn(name))
+	ip4 = addOffset(f.net4.IP, offset)
+	if f.net6 != nil {
+		ip6 = addOffset(f.net6.IP, offset)
+	}
+	return ip4, ip6
+}
+
+func (f *FakeIP) reply(message *dnsmessage.Message, name string) *dnsmessage.Message {
+	q := message.Questions[0]
+	resp := newReply(message, dnsmessage.RCodeSuccess)
+	ip4, ip6 := f.IP(name)
+	header := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+		TTL:   uint32(f.cfg.TTL / time.Second),
+	}
+	switch {
+	case q.Type == dnsmessage.TypeA:
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip4.To4())
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: body})
+	case ip6 != nil:
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip6)
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: body})
+	}
+	return resp
+}
+
+func (f *FakeIP) alloc(name string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if elem, ok := f.names[name]; ok {
+		f.lru.MoveToFront(elem)
+		return elem.Value.(*fakeEntry).offset
+	}
+	var offset int
+	if f.lru.Len() < f.size {
+		offset = f.next
+		f.next++
+	} else {
+		last := f.lru.Back()
+		old := last.Value.(*fakeEntry)
+		f.lru.Remove(last)
+		delete(f.names, old.name)
+		delete(f.offset, old.offset)
+		offset = old.offset
+	}
+	elem := f.lru.PushFront(&fakeEntry{name: name, offset: offset})
+	f.names[name] = elem
+	f.offset[offset] = elem
+	return offset
+}
+
+func (f *FakeIP) offsetOf(ip net.IP) (int, bool) {
+	ipNet := f.net6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, ipNet = ip4, f.net4
+	}
+	if ipNet == nil || !ipNet.Contains(ip) {
+		return 0, false
+	}
+	base := new(big.Int).SetBytes(ipNet.IP)
+	d := new(big.Int).Sub(new(big.Int).SetBytes(ip), base)
+	if !d.IsInt64() {
+		return 0, false
+	}
+	// the network address is skipped
+	offset := int(d.Int64()) - 1
+	if offset < 0 || offset >= f.size {
+		return 0, false
+	}
+	return offset, true
+}
+
+// poolSize The addresses of ipNet without the network and broadcast addresses, capped to fit an int.
+func poolSize(ipNet *net.IPNet) int {
+	ones, bits := ipNet.Mask.Size()
+	host := bits - ones
+	if host >= 31 {
+		return 1<<31 - 2
+	}
+	return 1<<host - 2
+}
+
+func addOffset(base net.IP, offset int) net.IP {
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+	n := new(big.Int).Add(new(big.Int).SetBytes(base), big.NewInt(int64(offset)+1))
+	b := n.Bytes()
+	ip := make(net.IP, len(base))
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
@@ -0,0 +1,372 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/tool/merror"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Strategy uint8
+
+const (
+	// StrategyFailover Query the upstreams in order until one answers.
+	StrategyFailover = Strategy(iota)
+	// StrategyParallel Query all upstreams at once and take the first answer.
+	StrategyParallel
+)
+
+var ErrNeedUpstream = errors.New("need dns upstream")
+
+var ErrNoQuestion = errors.New("dns message without question")
+
+var ErrNoResponse = errors.New("dns upstream without response")
+
+// ResolverConfig
+//
+//	Hosts maps a name to its addresses, answering A and AAAA without the upstreams.
+//	Blocks are names answered NXDOMAIN, together with their subdomains.
+//	Without a SOA to follow, negative answers are cached NegativeTTL.
+type ResolverConfig struct {
+	Upstreams []ReqCb
+	Strategy  Strategy
+	Timeout   time.Duration // of one upstream query, default 5s
+
+	CacheSize   int           // default 4096, negative disables the cache
+	MinTTL      time.Duration // the ttl of a cached answer is raised to it
+	MaxTTL      time.Duration // and cut to it, default 24h
+	NegativeTTL time.Duration // default 60s, also the cap of negative answers
+
+	Hosts    map[string][]net.IP
+	HostsTTL time.Duration // default 60s
+	Blocks   []string
+}
+
+// ResolverStats
+//
+//	Hits and NegativeHits are the queries answered from the cache, Misses went to the upstreams.
+type ResolverStats struct {
+	Queries        uint64
+	Hits           uint64
+	NegativeHits   uint64
+	Misses         uint64
+	HostsHits      uint64
+	Blocked        uint64
+	UpstreamErrors uint64
+	Entries        int
+}
+
+// Resolver
+//
+//	A caching dns forwarder, Resolve is a RespCb for Server and a ReqCb for Client.
+type Resolver struct {
+	cfg    *ResolverConfig
+	cache  *cache
+	hosts  map[string][]net.IP
+	blocks map[string]bool
+
+	queries        atomic.Uint64
+	hits           atomic.Uint64
+	negativeHits   atomic.Uint64
+	misses         atomic.Uint64
+	hostsHits      atomic.Uint64
+	blocked        atomic.Uint64
+	upstreamErrors atomic.Uint64
+}
+
+func NewResolver(cfg *ResolverConfig) (*Resolver, error) {
+	if cfg == nil || len(cfg.Upstreams) == 0 {
+		return nil, ErrNeedUpstream
+	}
+	for _, one := range cfg.Upstreams {
+		if one == nil {
+			return nil, errors.New("nil dns upstream")
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = 4096
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = 24 * time.Hour
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = 60 * time.Second
+	}
+	if cfg.HostsTTL <= 0 {
+		cfg.HostsTTL = 60 * time.Second
+	}
+	r := &Resolver{
+		cfg:    cfg,
+		hosts:  make(map[string][]net.IP),
+		blocks: make(map[string]bool),
+	}
+	if cfg.CacheSize > 0 {
+		r.cache = newCache(cfg.CacheSize)
+	}
+	for name, ips := range cfg.Hosts {
+		r.hosts[fqdn(name)] = ips
+	}
+	for _, name := range cfg.Blocks {
+		r.blocks[fqdn(name)] = true
+	}
+	return r, nil
+}
+
+// Resolve Answer message from the blocks, the hosts, the cache or the upstreams in turn.
+func (r *Resolver) Resolve(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(message.Questions) == 0 {
+		return nil, ErrNoQuestion
+	}
+	r.queries.Add(1)
+	q := message.Questions[0]
+	name := fqdn(q.Name.String())
+	if r.isBlocked(name) {
+		r.blocked.Add(1)
+		return newReply(message, dnsmessage.RCodeNameError), nil
+	}
+	if ips, ok := r.hosts[name]; ok && q.Class == dnsmessage.ClassINET && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		r.hostsHits.Add(1)
+		return r.hostsReply(message, ips), nil
+	}
+	key := newCacheKey(q)
+	if r.cache != nil {
+		if entry, ok := r.cache.get(key, time.Now()); ok {
+			if entry.negative {
+				r.negativeHits.Add(1)
+			} else {
+				r.hits.Add(1)
+			}
+			return entry.reply(message, time.Now()), nil
+		}
+	}
+	r.misses.Add(1)
+	resp, err := r.exchange(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil {
+		r.store(key, resp)
+	}
+	return resp, nil
+}
+
+// Stats The counters since the resolver was created.
+func (r *Resolver) Stats() ResolverStats {
+	stats := ResolverStats{
+		Queries:        r.queries.Load(),
+		Hits:           r.hits.Load(),
+		NegativeHits:   r.negativeHits.Load(),
+		Misses:         r.misses.Load(),
+		HostsHits:      r.hostsHits.Load(),
+		Blocked:        r.blocked.Load(),
+		UpstreamErrors: r.upstreamErrors.Load(),
+	}
+	if r.cache != nil {
+		stats.Entries = r.cache.len()
+	}
+	return stats
+}
+
+// Flush Drop the cached answers.
+func (r *Resolver) Flush() {
+	if r.cache != nil {
+		r.cache.flush()
+	}
+}
+
+func (r *Resolver) isBlocked(name string) bool {
+	if len(r.blocks) == 0 {
+		return false
+	}
+	for {
+		if r.blocks[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+func (r *Resolver) hostsReply(message *dnsmessage.Message, ips []net.IP) *dnsmessage.Message {
+	q := message.Questions[0]
+	resp := newReply(message, dnsmessage.RCodeSuccess)
+	resp.Authoritative = true
+	header := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+		TTL:   uint32(r.cfg.HostsTTL / time.Second),
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], ip4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: body})
+		} else if ip.To4() == nil && len(ip) == net.IPv6len && q.Type == dnsmessage.TypeAAAA {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: body})
+		}
+	}
+	return resp
+}
+
+// exchange Query the upstreams by Strategy, a SERVFAIL or REFUSED answer only counts when nothing else answers.
+func (r *Resolver) exchange(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+	type result struct {
+		index int
+		resp  *dnsmessage.Message
+		err   error
+	}
+	query := func(ctx context.Context, index int) result {
+		up := r.cfg.Upstreams[index]
+		xctx, cl := context.WithTimeout(ctx, r.cfg.Timeout)
+		defer cl()
+		resp, err := up(xctx, message)
+		if err == nil && (resp == nil || !resp.Response) {
+			err = ErrNoResponse
+		}
+		if err != nil && ctx.Err() == nil {
+			r.upstreamErrors.Add(1)
+		}
+		return result{index: index, resp: resp, err: err}
+	}
+	multiErr := merror.NewMultiErr("dns upstream err")
+	var fallback *dnsmessage.Message
+	take := func(res result) bool {
+		if res.err != nil {
+			multiErr.AddErr(strconv.Itoa(res.index), res.err)
+			return false
+		}
+		if res.resp.RCode == dnsmessage.RCodeServerFailure || res.resp.RCode == dnsmessage.RCodeRefused {
+			fallback = res.resp
+			return false
+		}
+		return true
+	}
+	switch r.cfg.Strategy {
+	case StrategyParallel:
+		xctx, cl := context.WithCancel(ctx)
+		defer cl()
+		ch := make(chan result, len(r.cfg.Upstreams))
+		for i := range r.cfg.Upstreams {
+			go func(i int) {
+				ch <- query(xctx, i)
+			}(i)
+		}
+		for range r.cfg.Upstreams {
+			res := <-ch
+			if take(res) {
+				return res.resp, nil
+			}
+		}
+	default:
+		for i := range r.cfg.Upstreams {
+			res := query(ctx, i)
+			if take(res) {
+				return res.resp, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, multiErr
+}
+
+// store Cache resp by the ttl of its answers, or of its SOA when negative (rfc2308).
+func (r *Resolver) store(key cacheKey, resp *dnsmessage.Message) {
+	if resp.Truncated {
+		return
+	}
+	entry := &cacheEntry{
+		key:    key,
+		stored: time.Now(),
+		message: &dnsmessage.Message{
+			Header:      resp.Header,
+			Answers:     resp.Answers,
+			Authorities: resp.Authorities,
+		},
+	}
+	// the ttl of OPT is its flags
+	for _, one := range resp.Additionals {
+		if one.Header.Type != dnsmessage.TypeOPT {
+			entry.message.Additionals = append(entry.message.Additionals, one)
+		}
+	}
+	var ttl time.Duration
+	switch {
+	case resp.RCode == dnsmessage.RCodeSuccess && len(resp.Answers) > 0:
+		ttl = r.cfg.MaxTTL
+		for _, one := range resp.Answers {
+			if d := time.Duration(one.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		if ttl < r.cfg.MinTTL {
+			ttl = r.cfg.MinTTL
+		}
+		if ttl > r.cfg.MaxTTL {
+			ttl = r.cfg.MaxTTL
+		}
+	case resp.RCode == dnsmessage.RCodeSuccess || resp.RCode == dnsmessage.RCodeNameError:
+		entry.negative = true
+		ttl = r.cfg.NegativeTTL
+		for _, one := range resp.Authorities {
+			soa, ok := one.Body.(*dnsmessage.SOAResource)
+			if !ok {
+				continue
+			}
+			d := time.Duration(min(one.Header.TTL, soa.MinTTL)) * time.Second
+			if d < ttl {
+				ttl = d
+			}
+		}
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry.expire = entry.stored.Add(ttl)
+	r.cache.set(entry)
+}
+
+func newReply(message *dnsmessage.Message, code dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 message.ID,
+			Response:           true,
+			OpCode:             message.OpCode,
+			RecursionDesired:   message.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              code,
+		},
+		Questions: message.Questions,
+	}
+}
+
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
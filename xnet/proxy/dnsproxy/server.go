@@ -14,8 +14,9 @@ func NewServer(reqCb RespCb, timeout time.Duration) *Server {
 
 func NewServerContext(ctx context.Context, reqCb RespCb, timeout time.Duration) *Server {
 	s := &Server{
-		timeout: timeout,
-		reqCb:   reqCb,
+		timeout:     timeout,
+		idleTimeout: DefaultIdleTimeout,
+		reqCb:       reqCb,
 	}
 	s.ctx, s.cancel = context.WithCancel(ctx)
 	return s
@@ -24,8 +25,13 @@ func NewServerContext(ctx context.Context, reqCb RespCb, timeout time.Duration)
 type RespCb func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error)
 
 type Server struct {
-	timeout time.Duration
-	reqCb   RespCb
+	timeout     time.Duration
+	idleTimeout time.Duration
+	reqCb       RespCb
+
+	// the ids of the queries to the RespCb, shared by all transports
+	uid uint16
+	mux sync.Mutex
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -37,8 +43,6 @@ func (s *Server) Serve(pconn net.PacketConn) error {
 	sctx := &serverCtx{
 		s:    s,
 		ponn: pconn,
-		uid:  0,
-		mux:  sync.Mutex{},
 	}
 	for {
 		n, addr, err := pconn.ReadFrom(buf)
@@ -62,18 +66,53 @@ func (s *Server) Close() error {
 type serverCtx struct {
 	s    *Server
 	ponn net.PacketConn
-	uid  uint16
-	mux  sync.Mutex
 }
 
 func (sctx *serverCtx) newId() uint16 {
-	sctx.mux.Lock()
-	defer sctx.mux.Unlock()
-	sctx.uid++
-	return sctx.uid
+	sctx.s.mux.Lock()
+	defer sctx.s.mux.Unlock()
+	sctx.s.uid++
+	return sctx.s.uid
 }
 
 func (sctx *serverCtx) handler(message *dnsmessage.Message, addr net.Addr) {
+	size := udpSize(message)
+	sctx.handle(message, func(pack []byte) {
+		if len(pack) > size {
+			pack = truncate(pack)
+		}
+		_, _ = sctx.ponn.WriteTo(pack, addr)
+	})
+}
+
+// udpSize The largest response the client takes over udp, 512 or its EDNS0 payload size (rfc6891 6.2.5).
+func udpSize(message *dnsmessage.Message) int {
+	for _, one := range message.Additionals {
+		if one.Header.Type == dnsmessage.TypeOPT && int(one.Header.Class) > 512 {
+			return int(one.Header.Class)
+		}
+	}
+	return 512
+}
+
+// truncate The header and question of pack with TC set, the client retries over tcp.
+func truncate(pack []byte) []byte {
+	var m dnsmessage.Message
+	err := m.Unpack(pack)
+	if err != nil {
+		return pack
+	}
+	m.Truncated = true
+	m.Answers, m.Authorities, m.Additionals = nil, nil, nil
+	b, err := m.Pack()
+	if err != nil {
+		return pack
+	}
+	return b
+}
+
+// handle Answer message by the RespCb under a new id, write gets the packed response with the id of message.
+func (sctx *serverCtx) handle(message *dnsmessage.Message, write func(pack []byte)) {
 	// server not need response
 	if message.Header.Response {
 		return
@@ -82,8 +121,11 @@ func (sctx *serverCtx) handler(message *dnsmessage.Message, addr net.Addr) {
 		nid := sctx.newId()
 		dt := newDnsTask(nid, func(message *dnsmessage.Message) {
 			message.ID = rid
-			pack, _ := message.Pack()
-			_, _ = sctx.ponn.WriteTo(pack, addr)
+			pack, err := message.Pack()
+			if err != nil {
+				return
+			}
+			write(pack)
 		})
 		ctx := sctx.s.ctx
 		var cancelFunc context.CancelFunc
@@ -0,0 +1,100 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdleTimeout How long a tcp connection without queries in flight waits for the next one.
+const DefaultIdleTimeout = 10 * time.Second
+
+// SetIdleTimeout The idle timeout of the tcp and DoT connections, zero keeps them until the client closes.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
+// ServeListener Serve dns over tcp (rfc7766) on ln, the queries of a connection may be pipelined and answered out of order.
+func (s *Server) ServeListener(ln net.Listener) error {
+	return s.serveListener(ln, nil)
+}
+
+func (s *Server) serveListener(ln net.Listener, upgrader xnetutil.Upgrader) error {
+	defer ln.Close()
+	ctxtool.GWaitFunc(s.ctx, func() {
+		_ = ln.Close()
+	})
+	sctx := &serverCtx{s: s}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if upgrader != nil {
+			uconn, err := upgrader.UpgradeContext(s.ctx, conn)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			conn = uconn
+		}
+		go sctx.serveStream(conn)
+	}
+}
+
+// serveStream Read the queries of conn until it closes or idles, the responses may be out of order.
+func (sctx *serverCtx) serveStream(conn net.Conn) {
+	defer conn.Close()
+	ctx, cl := context.WithCancel(sctx.s.ctx)
+	defer cl()
+	ctxtool.GWaitFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	var mux sync.Mutex
+	var pending atomic.Int32
+	write := func(pack []byte) {
+		mux.Lock()
+		defer mux.Unlock()
+		_ = writeTCPMessage(conn, pack)
+	}
+	idle := sctx.s.idleTimeout
+	reader := bufio.NewReader(conn)
+	for {
+		if idle > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		_, err := reader.Peek(1)
+		if err != nil {
+			// not idle while answering
+			if errors.Is(err, os.ErrDeadlineExceeded) && pending.Load() > 0 {
+				continue
+			}
+			return
+		}
+		if idle > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		b, err := readTCPMessage(reader)
+		if err != nil {
+			return
+		}
+		var message dnsmessage.Message
+		err = message.Unpack(b)
+		if err != nil {
+			return
+		}
+		pending.Add(1)
+		go func() {
+			defer pending.Add(-1)
+			sctx.handle(&message, write)
+		}()
+	}
+}
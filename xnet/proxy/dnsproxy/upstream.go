@@ -0,0 +1,118 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrMessageIdMismatch = errors.New("dns message id mismatch")
+
+// UpstreamFunc
+//
+//	The ReqCb querying a dns server, network is "udp" or "tcp" (or their 4/6 variants).
+//	A truncated udp response is queried again over tcp.
+func UpstreamFunc(timeout time.Duration, network, address string) (ReqCb, error) {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	tcpNetwork := strings.Replace(network, "udp", "tcp", 1)
+	tcpFn := func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		xctx, cl := context.WithTimeout(ctx, timeout)
+		defer cl()
+		return exchangeStream(xctx, func(ctx context.Context) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, tcpNetwork, address)
+		}, message)
+	}
+	if strings.HasPrefix(network, "tcp") {
+		_, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return tcpFn, nil
+	}
+	udpFn, err := DefaultFunc(timeout, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, message *dnsmessage.Message) (*dnsmessage.Message, error) {
+		resp, err := udpFn(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		if resp.ID != message.ID {
+			return nil, ErrMessageIdMismatch
+		}
+		if resp.Truncated {
+			return tcpFn(ctx, message)
+		}
+		return resp, nil
+	}, nil
+}
+
+// exchangeStream One query over a new stream connection, tcp or tls.
+func exchangeStream(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), message *dnsmessage.Message) (*dnsmessage.Message, error) {
+	pack, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctxtool.GWaitFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	err = writeTCPMessage(conn, pack)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		var m dnsmessage.Message
+		err = m.Unpack(b)
+		if err != nil {
+			return nil, err
+		}
+		if m.ID != message.ID {
+			continue
+		}
+		return &m, nil
+	}
+}
+
+// writeTCPMessage A dns message over tcp is prefixed by its 2-byte length (rfc1035 4.2.2).
+func writeTCPMessage(w io.Writer, pack []byte) error {
+	if len(pack) > 0xffff {
+		return errors.New("dns message too long")
+	}
+	b := make([]byte, 2+len(pack))
+	binary.BigEndian.PutUint16(b, uint16(len(pack)))
+	copy(b[2:], pack)
+	_, err := w.Write(b)
+	return err
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	_, err := io.ReadFull(r, l[:])
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,198 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrNetworkNotSupport = errors.New("network not support")
+
+var ErrProxyAuthRejected = errors.New("http proxy auth rejected")
+
+var ErrConnectFailed = func(status string) error {
+	code, _ := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	return &ConnectError{StatusCode: code, Status: status}
+}
+
+// ConnectError The status a proxy answered a CONNECT with.
+type ConnectError struct {
+	StatusCode int
+	Status     string
+}
+
+func (ce *ConnectError) Error() string {
+	return fmt.Sprintf("http proxy connect failed: %s", ce.Status)
+}
+
+// IsDestination Whether the proxy could not reach (502, 504) or was not allowed to reach (403) the destination.
+func (ce *ConnectError) IsDestination() bool {
+	switch ce.StatusCode {
+	case http.StatusForbidden, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// HTTPCONNECT A dialer that tunnels tcp through the http proxy at address with the CONNECT method.
+// The proxy is reached through forward when it is not nil, which can be another proxy dialer.
+func HTTPCONNECT(network string, address string, auth *BasicAuth, forward xnetutil.Dialer) (xnetutil.Dialer, error) {
+	return newConnectConfig(network, address, auth, nil, forward)
+}
+
+// HTTPSCONNECT Like HTTPCONNECT, with tls to the proxy itself.
+// The ServerName of tlsCfg defaults to the host of address.
+func HTTPSCONNECT(network string, address string, auth *BasicAuth, tlsCfg *tls.Config, forward xnetutil.Dialer) (xnetutil.Dialer, error) {
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	return newConnectConfig(network, address, auth, tlsCfg, forward)
+}
+
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (ba *BasicAuth) header() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(ba.Username+":"+ba.Password))
+}
+
+type connectConfig struct {
+	proxyNetwork string
+	proxyAddress string
+
+	forward xnetutil.Dialer
+	tlsCfg  *tls.Config
+
+	auth *BasicAuth
+}
+
+func newConnectConfig(network string, address string, auth *BasicAuth, tlsCfg *tls.Config, forward xnetutil.Dialer) (*connectConfig, error) {
+	if tlsCfg != nil && tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = host
+	}
+	return &connectConfig{
+		proxyNetwork: network,
+		proxyAddress: address,
+		forward:      forward,
+		tlsCfg:       tlsCfg,
+		auth:         auth,
+	}, nil
+}
+
+func (cc *connectConfig) Dial(network string, addr string) (net.Conn, error) {
+	return cc.DialContext(context.Background(), network, addr)
+}
+
+func (cc *connectConfig) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrNetworkNotSupport
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	xctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := cc.dialProxy(ctx, xctx)
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := cc.connect(ctx, conn, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return rconn, nil
+}
+
+func (cc *connectConfig) dialProxy(ctx, xctx context.Context) (conn net.Conn, err error) {
+	if cc.forward != nil {
+		conn, err = cc.forward.DialContext(ctx, cc.proxyNetwork, cc.proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dr := net.Dialer{}
+		conn, err = dr.DialContext(ctx, cc.proxyNetwork, cc.proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-xctx.Done():
+		}
+	}()
+	return conn, nil
+}
+
+func (cc *connectConfig) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if cc.tlsCfg != nil {
+		tconn := tls.Client(conn, cc.tlsCfg)
+		err := tconn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn = tconn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if cc.auth != nil {
+		req.Header.Set("Proxy-Authorization", cc.auth.header())
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusProxyAuthRequired, resp.StatusCode == http.StatusUnauthorized:
+		return nil, ErrProxyAuthRejected
+	default:
+		return nil, ErrConnectFailed(strings.TrimSpace(resp.Status))
+	}
+	if reader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn Keep what the target sent right after the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.reader.Read(b)
+}
@@ -0,0 +1,344 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders Headers of one connection, they are not passed on by a proxy (RFC 9110 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forward Send req to its host on a pooled connection and write the response back, false ends the client connection.
+func (s *Server) forward(conn net.Conn, req *http.Request) bool {
+	var err error
+	keep := !req.Close
+	// the body is read when the request is sent, so the client must not wait for the upstream to ask for it
+	if headerHasToken(req.Header, "Expect", "100-continue") {
+		req.Header.Del("Expect")
+		_, err = io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		if err != nil {
+			return false
+		}
+	}
+	delHopHeaders(req.Header)
+	key, ok := s.route(conn, req)
+	if !ok {
+		return false
+	}
+	resp, up, err := s.roundTrip(key, req)
+	if err != nil {
+		_ = s.writeResponse(conn, req, newResponse(req, dialStatus(err)))
+		return false
+	}
+	reuse := !resp.Close
+	delHopHeaders(resp.Header)
+	resp.Close = !keep
+	err = s.writeResponse(conn, req, resp)
+	_ = resp.Body.Close()
+	if err != nil || !reuse {
+		up.close()
+	} else {
+		s.pool.put(up)
+	}
+	return err == nil && keep
+}
+
+// roundTrip A request without body is sent again on a new connection when a pooled one turns out to be closed.
+func (s *Server) roundTrip(key *upstreamKey, req *http.Request) (*http.Response, *upstreamConn, error) {
+	for {
+		up := s.pool.get(key.poolKey())
+		reused := up != nil
+		if !reused {
+			rconn, err := s.dial(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			up = newUpstreamConn(key.poolKey(), rconn)
+		}
+		resp, err := up.roundTrip(req, s.responseTimeout())
+		if err == nil {
+			return resp, up, nil
+		}
+		up.close()
+		// a stalled upstream may still be working on the request, it is not sent twice
+		if !reused || (req.Body != nil && req.Body != http.NoBody) || dialStatus(err) == http.StatusGatewayTimeout {
+			return nil, nil, err
+		}
+	}
+}
+
+// upstreamKey Where and how an upstream connection is dialed.
+type upstreamKey struct {
+	host string
+	user string
+	dr   xnetutil.Dialer
+	tls  *tls.Config
+}
+
+// poolKey The dialer of a key only depends on its user and host, and its tls config on the server name.
+func (uk *upstreamKey) poolKey() string {
+	if uk.tls != nil {
+		return "https://" + uk.user + "@" + uk.host + "/" + uk.tls.ServerName
+	}
+	return uk.user + "@" + uk.host
+}
+
+type upstreamConn struct {
+	host   string
+	conn   net.Conn
+	reader *bufio.Reader
+	timer  *time.Timer
+}
+
+func newUpstreamConn(host string, conn net.Conn) *upstreamConn {
+	return &upstreamConn{
+		host:   host,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// roundTrip Send req and read its response, the headers must arrive within timeout.
+func (uc *upstreamConn) roundTrip(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	err := req.Write(uc.conn)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		_ = uc.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	for {
+		resp, err := http.ReadResponse(uc.reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			_ = uc.conn.SetReadDeadline(time.Time{})
+		}
+		// interim responses are not passed on, the client gets the final one
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (uc *upstreamConn) close() {
+	_ = uc.conn.Close()
+}
+
+// upstreamPool The unused upstream connections by host.
+type upstreamPool struct {
+	idleTimeout time.Duration
+	maxIdle     int
+
+	mux    sync.Mutex
+	idle   map[string][]*upstreamConn
+	closed bool
+}
+
+func newUpstreamPool(ctx context.Context, idleTimeout time.Duration, maxIdle int) *upstreamPool {
+	if idleTimeout <= 0 {
+		idleTimeout = 90 * time.Second
+	}
+	if maxIdle <= 0 {
+		maxIdle = 2
+	}
+	p := &upstreamPool{
+		idleTimeout: idleTimeout,
+		maxIdle:     maxIdle,
+		idle:        make(map[string][]*upstreamConn),
+	}
+	context.AfterFunc(ctx, p.close)
+	return p
+}
+
+func (p *upstreamPool) get(host string) *upstreamConn {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	list := p.idle[host]
+	for len(list) != 0 {
+		uc := list[len(list)-1]
+		list = list[:len(list)-1]
+		if uc.timer.Stop() {
+			p.idle[host] = list
+			return uc
+		}
+	}
+	delete(p.idle, host)
+	return nil
+}
+
+func (p *upstreamPool) put(uc *upstreamConn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.closed || len(p.idle[uc.host]) >= p.maxIdle {
+		uc.close()
+		return
+	}
+	uc.timer = time.AfterFunc(p.idleTimeout, func() {
+		p.remove(uc)
+		uc.close()
+	})
+	p.idle[uc.host] = append(p.idle[uc.host], uc)
+}
+
+func (p *upstreamPool) remove(uc *upstreamConn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	list := p.idle[uc.host]
+	for i, one := range list {
+		if one == uc {
+			p.idle[uc.host] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(p.idle[uc.host]) == 0 {
+		delete(p.idle, uc.host)
+	}
+}
+
+func (p *upstreamPool) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.closed = true
+	for _, list := range p.idle {
+		for _, uc := range list {
+			uc.timer.Stop()
+			uc.close()
+		}
+	}
+	p.idle = make(map[string][]*upstreamConn)
+}
+
+func newResponse(req *http.Request, code int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+}
+
+// responseTimeout The time an upstream has to send the response headers, 60s by default.
+func (s *Server) responseTimeout() time.Duration {
+	if s.cfg.ResponseHeaderTimeout == 0 {
+		return 60 * time.Second
+	}
+	return s.cfg.ResponseHeaderTimeout
+}
+
+// dialStatus 504 when the upstream did not answer in time, 502 otherwise.
+func dialStatus(err error) int {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// requestHost The host:port of req, the port defaults to 80.
+func requestHost(req *http.Request) (string, error) {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	_, _, err := net.SplitHostPort(host)
+	if err != nil {
+		if strings.Contains(err.Error(), "missing port in address") {
+			port := "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+			return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+		}
+		return "", err
+	}
+	return host, nil
+}
+
+// fakeIPHost host with the domain of its fake ip, the Host header of req follows.
+// A pool ip without a domain any more is not a host to dial.
+func fakeIPHost(cb func(ip net.IP) (string, bool), pool func(ip net.IP) bool, req *http.Request, host string) (string, bool) {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, true
+	}
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return host, true
+	}
+	domain, ok := cb(ip)
+	if !ok {
+		return host, pool == nil || !pool(ip)
+	}
+	if h, p, err := net.SplitHostPort(req.Host); err == nil && net.ParseIP(h).Equal(ip) {
+		req.Host = net.JoinHostPort(domain, p)
+	} else if net.ParseIP(strings.Trim(req.Host, "[]")).Equal(ip) {
+		req.Host = domain
+	}
+	return net.JoinHostPort(domain, port), true
+}
+
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// delHopHeaders Remove the hop-by-hop headers of h, including the ones named by its Connection header, except keep.
+func delHopHeaders(h http.Header, keep ...string) {
+	kept := make(map[string]bool, len(keep))
+	for _, one := range keep {
+		kept[textproto.CanonicalMIMEHeaderKey(one)] = true
+	}
+	for _, value := range h.Values("Connection") {
+		for _, one := range strings.Split(value, ",") {
+			key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(one))
+			if key != "" && !kept[key] {
+				h.Del(key)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		if !kept[key] {
+			h.Del(key)
+		}
+	}
+}
+
+func headerHasToken(h http.Header, key string, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, one := range strings.Split(value, ",") {
+			if equalFold(strings.TrimSpace(one), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
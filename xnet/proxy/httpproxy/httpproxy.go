@@ -2,8 +2,8 @@ package httpproxy
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
@@ -45,10 +45,36 @@ func ListenAndServe(network string, addr string, cfg *ServerConfig) error {
 
 type ReqAuthCb func(req *http.Request) bool
 
+// AccessCb Whether req may reach host (host:port), see AccessPolicy.
+type AccessCb func(req *http.Request, host string) bool
+
+// ForwardCb The dialer of the upstream connections of user to host (host:port), nil means ServerConfig.Forward.
+type ForwardCb func(user string, host string) xnetutil.Dialer
+
 type ServerConfig struct {
 	ReqAuthCb   ReqAuthCb
 	Forward     xnetutil.Dialer
 	DialTimeout time.Duration
+	// ResponseHeaderTimeout answers 504 when an upstream does not send the response headers in time, 60s by default, negative waits forever.
+	ResponseHeaderTimeout time.Duration
+	// AccessCb is checked before any upstream is dialed, 403 is answered when it denies.
+	AccessCb  AccessCb
+	ForwardCb ForwardCb
+	// ReqRewriteCb can change the request before it is sent, the hop-by-hop headers are already removed.
+	// For CONNECT and protocol upgrades it sees the request that opens the tunnel.
+	ReqRewriteCb func(req *http.Request)
+	// RespCb sees every response written to the client, including the ones of the proxy itself.
+	RespCb func(req *http.Request, resp *http.Response)
+	// IdleTimeout closes the pooled upstream connections that stay unused longer, 90s by default.
+	IdleTimeout time.Duration
+	// MaxIdleConnsPerHost is the number of unused upstream connections kept per host, 2 by default.
+	MaxIdleConnsPerHost int
+	// MITM intercepts the CONNECT tunnels when set.
+	MITM *MITMConfig
+	// FakeIPCb maps a fake ip of the request host back to its domain before AccessCb, e.g. dnsproxy.FakeIP.Lookup.
+	FakeIPCb func(ip net.IP) (string, bool)
+	// FakeIPPoolCb reports the ips of the fake pool, e.g. dnsproxy.FakeIP.Contains; 502 is answered for one FakeIPCb no longer maps.
+	FakeIPPoolCb func(ip net.IP) bool
 }
 
 func NewServer(cfg *ServerConfig) (*Server, error) {
@@ -65,7 +91,15 @@ func NewServerContext(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 	s := &Server{
 		cfg: cfg,
 	}
+	if cfg.MITM != nil {
+		m, err := newMitm(cfg.MITM)
+		if err != nil {
+			return nil, err
+		}
+		s.mitm = m
+	}
 	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.pool = newUpstreamPool(s.ctx, cfg.IdleTimeout, cfg.MaxIdleConnsPerHost)
 	return s, nil
 }
 
@@ -74,6 +108,9 @@ type Server struct {
 
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	pool *upstreamPool
+	mitm *mitm
 }
 
 func (s *Server) Serve(ln net.Listener) error {
@@ -90,6 +127,7 @@ func (s *Server) ListenAndServe(network string, addr string) error {
 
 func (s *Server) Close() error {
 	s.cancel()
+	s.pool.close()
 	return s.ctx.Err()
 }
 
@@ -106,87 +144,150 @@ func (s *Server) listen(ln net.Listener) error {
 
 func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
 	reader := bufio.NewReader(conn)
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		return
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		user, _, _ := ProxyBasicAuth(req)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+		if s.cfg.ReqAuthCb != nil && !s.cfg.ReqAuthCb(req) {
+			resp := newResponse(req, http.StatusProxyAuthRequired)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			_ = s.writeResponse(conn, req, resp)
+			return
+		}
+		if req.Method == http.MethodConnect || isUpgrade(req) {
+			s.tunnel(conn, reader, req)
+			return
+		}
+		if !s.forward(conn, req) {
+			return
+		}
 	}
+}
+
+type userKey struct{}
 
-	if s.cfg.ReqAuthCb != nil && !s.cfg.ReqAuthCb(req) {
-		resp := http.Response{
-			Status:     "401 Unauthorized",
-			StatusCode: http.StatusUnauthorized,
-			Proto:      req.Proto,
-			ProtoMajor: req.ProtoMajor,
-			ProtoMinor: req.ProtoMinor,
+// RequestUser The user name of the Proxy-Authorization header of req, it is verified when ReqAuthCb is set.
+func RequestUser(req *http.Request) string {
+	user, _ := req.Context().Value(userKey{}).(string)
+	return user
+}
+
+// route Rewrite req and check it against the access policy, the response is already written when false.
+func (s *Server) route(conn net.Conn, req *http.Request) (*upstreamKey, bool) {
+	if s.cfg.ReqRewriteCb != nil {
+		s.cfg.ReqRewriteCb(req)
+	}
+	host, err := requestHost(req)
+	if err != nil {
+		_ = s.writeResponse(conn, req, newResponse(req, http.StatusBadRequest))
+		return nil, false
+	}
+	if s.cfg.FakeIPCb != nil {
+		var ok bool
+		host, ok = fakeIPHost(s.cfg.FakeIPCb, s.cfg.FakeIPPoolCb, req, host)
+		if !ok {
+			_ = s.writeResponse(conn, req, newResponse(req, http.StatusBadGateway))
+			return nil, false
 		}
-		_ = resp.Write(conn)
-		return
 	}
+	if s.cfg.AccessCb != nil && !s.cfg.AccessCb(req, host) {
+		_ = s.writeResponse(conn, req, newResponse(req, http.StatusForbidden))
+		return nil, false
+	}
+	key := &upstreamKey{host: host, dr: s.cfg.Forward}
+	if req.URL.Scheme == "https" && req.Method != http.MethodConnect {
+		name, _, _ := net.SplitHostPort(host)
+		if req.TLS != nil && req.TLS.ServerName != "" {
+			name = req.TLS.ServerName
+		}
+		key.tls = s.mitm.upstreamTLS(name)
+	}
+	if s.cfg.ForwardCb != nil {
+		key.user = RequestUser(req)
+		if dr := s.cfg.ForwardCb(key.user, host); dr != nil {
+			key.dr = dr
+		}
+	}
+	return key, true
+}
+
+func (s *Server) writeResponse(conn net.Conn, req *http.Request, resp *http.Response) error {
+	if s.cfg.RespCb != nil {
+		s.cfg.RespCb(req, resp)
+	}
+	return resp.Write(conn)
+}
 
-	otherMethod := false
-	bs := new(bytes.Buffer)
+// tunnel Relay the connection as it is after the first request, for CONNECT and protocol upgrades.
+func (s *Server) tunnel(conn net.Conn, reader *bufio.Reader, req *http.Request) {
 	if req.Method != http.MethodConnect {
-		err = req.Write(bs)
-		if err != nil {
-			return
-		}
-		otherMethod = true
+		delHopHeaders(req.Header, "Connection", "Upgrade")
+	}
+	key, ok := s.route(conn, req)
+	if !ok {
+		return
+	}
+	if req.Method == http.MethodConnect && s.mitm != nil && s.mitm.intercept(req, key.host) {
+		s.intercept(conn, reader, req, key.host)
+		return
+	}
+	rconn, err := s.dial(key)
+	if err != nil {
+		_ = s.writeResponse(conn, req, newResponse(req, dialStatus(err)))
+		return
 	}
+	defer rconn.Close()
 
-	host := req.Host
-	_, _, err = net.SplitHostPort(host)
+	if req.Method == http.MethodConnect {
+		// https will
+		resp := newResponse(req, http.StatusOK)
+		resp.Status = "200 Connection Established"
+		resp.Close = false
+		err = s.writeResponse(conn, req, resp)
+	} else {
+		err = req.Write(rconn)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "missing port in address") {
-			host += ":80"
-		} else {
-			return
-		}
+		return
 	}
+
+	go func() {
+		_, _ = io.Copy(conn, rconn)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(rconn, reader)
+}
+
+func (s *Server) dial(key *upstreamKey) (net.Conn, error) {
 	ctx := s.ctx
 	if s.cfg.DialTimeout != 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, s.cfg.DialTimeout)
 		defer cancel()
 	}
-	var rconn net.Conn
-	if s.cfg.Forward != nil {
-		rconn, err = s.cfg.Forward.DialContext(s.ctx, "tcp", host)
-		if err != nil {
-			return
-		}
-	} else {
-		dr := &net.Dialer{}
-		rconn, err = dr.DialContext(s.ctx, "tcp", host)
-		if err != nil {
-			return
-		}
+	var dr xnetutil.Dialer = &net.Dialer{}
+	if key.dr != nil {
+		dr = key.dr
 	}
-	defer rconn.Close()
-
-	// http need last req
-	if otherMethod {
-		_, err = rconn.Write(bs.Bytes())
-		if err != nil {
-			return
-		}
-	} else {
-		// https will
-		resp := http.Response{
-			Status:     "200 Connection Established",
-			StatusCode: 200,
-			Proto:      req.Proto,
-			ProtoMajor: req.ProtoMajor,
-			ProtoMinor: req.ProtoMinor,
-		}
-		err = resp.Write(conn)
-		if err != nil {
-			return
-		}
+	conn, err := dr.DialContext(ctx, "tcp", key.host)
+	if err != nil || key.tls == nil {
+		return conn, err
 	}
-
-	go io.Copy(conn, rconn)
-	io.Copy(rconn, conn)
+	tconn := tls.Client(conn, key.tls)
+	err = tconn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tconn, nil
 }
 
 func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
@@ -1,11 +1,23 @@
 package httpproxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -45,3 +57,639 @@ func Test(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHTTPCONNECT(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	server, err := NewServer(&ServerConfig{ReqAuthCb: UserInfoAuth("test", "test123")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	tlsServer, err := NewServer(&ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsServer.Close()
+	tln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tlsServer.Serve(tls.NewListener(tln, pcrypto.MustNewDefaultTlsConfig()))
+
+	check := func(dr xnetutil.Dialer) {
+		conn, err := dr.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		b := []byte("hello http connect")
+		_, err = conn.Write(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(b))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, buf) {
+			t.Fatal(string(buf))
+		}
+	}
+
+	dr, err := HTTPCONNECT("tcp", ln.Addr().String(), &BasicAuth{Username: "test", Password: "test123"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dr)
+
+	// the tls proxy is reached through the first one
+	tdr, err := HTTPSCONNECT("tcp", tln.Addr().String(), nil, &tls.Config{InsecureSkipVerify: true}, dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tdr)
+
+	bad, err := HTTPCONNECT("tcp", ln.Addr().String(), &BasicAuth{Username: "test", Password: "bad"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bad.Dial("tcp", echo.Addr().String())
+	if !errors.Is(err, ErrProxyAuthRejected) {
+		t.Fatal(err)
+	}
+	_, err = dr.Dial("udp", echo.Addr().String())
+	if !errors.Is(err, ErrNetworkNotSupport) {
+		t.Fatal(err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	origin := func(name string) (*http.Server, string) {
+		server, addr, err := fasttool.Http(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s %s %s", name, r.RemoteAddr, r.Header.Get("X-Hop"), r.Header.Get("Proxy-Authorization"))
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server, strings.TrimPrefix(addr, "http://")
+	}
+	a, aAddr := origin("a")
+	defer a.Close()
+	b, bAddr := origin("b")
+	defer b.Close()
+
+	server, err := NewServer(&ServerConfig{ReqAuthCb: UserInfoAuth("test", "test123")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	get := func(host string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Proxy-Authorization", (&BasicAuth{Username: "test", Password: "test123"}).header())
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		err = req.WriteProxy(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	// keep-alive requests on one client connection go to their own host on pooled connections
+	var first string
+	for i := 0; i < 3; i++ {
+		for _, one := range []struct{ name, addr string }{{"a", aAddr}, {"b", bAddr}} {
+			resp, body := get(one.addr)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatal(resp.Status)
+			}
+			fields := strings.Split(body, " ")
+			if fields[0] != one.name || fields[2] != "" || fields[3] != "" {
+				t.Fatal(body)
+			}
+			if one.name == "a" {
+				if first == "" {
+					first = fields[1]
+				} else if first != fields[1] {
+					t.Fatal("upstream not reused", first, fields[1])
+				}
+			}
+		}
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+	resp, _ := get(closed.Addr().String())
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatal(resp.Status)
+	}
+
+	pc, err := url.Parse(fmt.Sprintf("http://test:bad@%s", ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pc)}}
+	resp, err = c.Get("http://" + aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatal(resp.Status)
+	}
+
+	slow, err := NewServer(&ServerConfig{
+		DialTimeout: 100 * time.Millisecond,
+		Forward: xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	sln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go slow.Serve(sln)
+	sc, err := url.Parse("http://" + sln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(sc)}}
+	resp, err = c.Get("http://" + aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal(resp.Status)
+	}
+
+	// an upstream that accepts the request but never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	stalled, err := NewServer(&ServerConfig{ResponseHeaderTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stalled.Serve(stln)
+	stu, err := url.Parse("http://" + stln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(stu)}, Timeout: 5 * time.Second}
+	resp, err = c.Get("http://" + silent.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal(resp.Status)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	origin := func() (*http.Server, string) {
+		server, addr, err := fasttool.Http(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.Header.Get("X-User"))
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server, strings.TrimPrefix(addr, "http://")
+	}
+	a, aAddr := origin()
+	defer a.Close()
+	b, bAddr := origin()
+	defer b.Close()
+	_, bPort, _ := net.SplitHostPort(bAddr)
+	port, _ := strconv.Atoi(bPort)
+
+	access, err := AccessPolicy(true,
+		&AccessRule{Deny: true, CIDRs: []string{"127.0.0.0/8"}, Ports: []int{port}},
+		&AccessRule{Deny: true, Hosts: []string{"*.example.com"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mux sync.Mutex
+	var dials int
+	var statuses []int
+	server, err := NewServer(&ServerConfig{
+		ReqAuthCb: func(req *http.Request) bool {
+			_, p, _ := ProxyBasicAuth(req)
+			return p == "pass"
+		},
+		AccessCb: access,
+		ForwardCb: func(user string, host string) xnetutil.Dialer {
+			if user != "counted" {
+				return nil
+			}
+			return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				mux.Lock()
+				dials++
+				mux.Unlock()
+				return new(net.Dialer).DialContext(ctx, network, addr)
+			})
+		},
+		ReqRewriteCb: func(req *http.Request) {
+			req.Header.Set("X-User", RequestUser(req))
+		},
+		RespCb: func(req *http.Request, resp *http.Response) {
+			mux.Lock()
+			statuses = append(statuses, resp.StatusCode)
+			mux.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	get := func(user string, addr string) (int, string) {
+		pu, err := url.Parse(fmt.Sprintf("http://%s:pass@%s", user, ln.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+		defer c.CloseIdleConnections()
+		resp, err := c.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	code, body := get("alice", aAddr)
+	if code != http.StatusOK || body != "alice" {
+		t.Fatal(code, body)
+	}
+	code, _ = get("alice", bAddr)
+	if code != http.StatusForbidden {
+		t.Fatal(code)
+	}
+	code, _ = get("alice", "www.example.com")
+	if code != http.StatusForbidden {
+		t.Fatal(code)
+	}
+	for i := 0; i < 2; i++ {
+		code, body = get("counted", aAddr)
+		if code != http.StatusOK || body != "counted" {
+			t.Fatal(code, body)
+		}
+	}
+	mux.Lock()
+	if dials != 1 {
+		t.Fatal("dials", dials)
+	}
+	mux.Unlock()
+
+	dr, err := HTTPCONNECT("tcp", ln.Addr().String(), &BasicAuth{Username: "alice", Password: "pass"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dr.Dial("tcp", bAddr)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial("tcp", aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	mux.Lock()
+	defer mux.Unlock()
+	want := []int{200, 403, 403, 200, 200, 403, 200}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Fatal(statuses)
+	}
+}
+
+func TestMITM(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "secret ", r.Header.Get("X-Mitm"))
+	})}
+	go origin.Serve(tls.NewListener(ln, pcrypto.MustNewDefaultTlsConfig()))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	target := "https://localhost:" + port + "/"
+
+	caCert, caKey, err := NewMITMCA("test ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		t.Fatal()
+	}
+	for _, ecdsa := range []bool{false, true} {
+		var mux sync.Mutex
+		var seen []string
+		server, err := NewServer(&ServerConfig{
+			MITM: &MITMConfig{
+				CACert:      caCert,
+				CAKey:       caKey,
+				ECDSA:       ecdsa,
+				UpstreamTLS: &tls.Config{InsecureSkipVerify: true},
+			},
+			ReqRewriteCb: func(req *http.Request) {
+				if req.Method != http.MethodConnect {
+					req.Header.Set("X-Mitm", req.URL.Scheme+" "+req.TLS.ServerName)
+				}
+			},
+			RespCb: func(req *http.Request, resp *http.Response) {
+				mux.Lock()
+				seen = append(seen, fmt.Sprintf("%s %d", req.Method, resp.StatusCode))
+				mux.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(pln)
+		pu, err := url.Parse("http://" + pln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu), TLSClientConfig: &tls.Config{RootCAs: pool}}}
+			resp, err := c.Get(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "secret https localhost" {
+				t.Fatal(string(body))
+			}
+			c.CloseIdleConnections()
+		}
+		if server.mitm.cacheLen() != 1 {
+			t.Fatal(server.mitm.cacheLen())
+		}
+		mux.Lock()
+		if fmt.Sprint(seen) != "[CONNECT 200 GET 200 CONNECT 200 GET 200]" {
+			t.Fatal(seen)
+		}
+		mux.Unlock()
+		_ = server.Close()
+		_ = pln.Close()
+	}
+}
+
+func TestMITMCache(t *testing.T) {
+	caCert, caKey, err := NewMITMCA("test ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMitm(&MITMConfig{CACert: caCert, CAKey: caKey, ECDSA: true, CacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := m.certificate("a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.test", "A.TEST", "c.test"} {
+		_, err = m.certificate(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.cacheLen() != 2 {
+		t.Fatal(m.cacheLen())
+	}
+	cert, err := m.certificate("a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert != a {
+		t.Fatal("recently used certificate evicted")
+	}
+	if _, ok := m.cached("b.test"); ok {
+		t.Fatal("least recently used certificate kept")
+	}
+
+	m, err = newMitm(&MITMConfig{CACert: caCert, CAKey: caKey, ECDSA: true, CacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.certificate("a.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.cacheLen() != 0 {
+		t.Fatal(m.cacheLen())
+	}
+}
+
+func TestMITMServerName(t *testing.T) {
+	caCert, caKey, err := NewMITMCA("test ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		t.Fatal()
+	}
+	server, err := NewServer(&ServerConfig{
+		MITM: &MITMConfig{CACert: caCert, CAKey: caKey, ECDSA: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	pln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pln.Close()
+	go server.Serve(pln)
+
+	tunnel := func(host string, serverName string) error {
+		conn, err := net.Dial("tcp", pln.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		tconn := tls.Client(&bufferedConn{Conn: conn, reader: reader}, &tls.Config{ServerName: serverName, RootCAs: pool})
+		return tconn.Handshake()
+	}
+	err = tunnel("localhost:443", "LOCALHOST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tunnel("localhost:443", "other.test")
+	if err == nil {
+		t.Fatal("mismatched sni accepted")
+	}
+	err = tunnel("127.0.0.1:443", "other.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.mitm.cacheLen() != 2 {
+		t.Fatal(server.mitm.cacheLen())
+	}
+}
+
+func TestFakeIPCb(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	hosts := make(chan string, 1)
+	server, err := NewServer(&ServerConfig{
+		AccessCb: func(req *http.Request, host string) bool {
+			hosts <- host
+			return true
+		},
+		FakeIPCb: func(ip net.IP) (string, bool) {
+			return "localhost", ip.Equal(net.IPv4(198, 18, 0, 1))
+		},
+		FakeIPPoolCb: func(ip net.IP) bool {
+			return ip.Mask(net.CIDRMask(15, 32)).Equal(net.IPv4(198, 18, 0, 0))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+
+	dr, err := HTTPCONNECT("tcp", ln.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial("tcp", "198.18.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if host := <-hosts; host != "localhost:"+port {
+		t.Fatal(host)
+	}
+	b := []byte("hello fake ip")
+	_, err = conn.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(b))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, buf) {
+		t.Fatal(string(buf))
+	}
+
+	// a pool ip without a domain is not dialed as it is
+	_, err = dr.Dial("tcp", "198.18.0.2:"+port)
+	var ce *ConnectError
+	if !errors.As(err, &ce) || ce.StatusCode != http.StatusBadGateway {
+		t.Fatal(err)
+	}
+	select {
+	case host := <-hosts:
+		t.Fatal(host)
+	default:
+	}
+}
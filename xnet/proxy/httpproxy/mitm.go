@@ -0,0 +1,261 @@
+package httpproxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/pcrypto/ecdsa"
+	"github.com/peakedshout/go-pandorasbox/pcrypto/rsa"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMITMServerNameMismatch = errors.New("mitm sni mismatches the connect host")
+
+// MITMConfig
+//
+//	Terminate CONNECT tunnels with a leaf certificate signed by the CA, minted for the SNI of the client and cached,
+//	then forward the decrypted requests over a new tls connection to the host.
+//	ReqRewriteCb and RespCb of ServerConfig see the decrypted requests and responses,
+//	their URL has the https scheme and their TLS field is the state of the client connection.
+//	Only for debugging traffic whose clients trust the CA.
+type MITMConfig struct {
+	// CACert and CAKey are the PEM encoded CA, see NewMITMCA.
+	CACert []byte
+	CAKey  []byte
+	// ECDSA mints P-256 leaf certificates instead of RSA 2048 ones, much cheaper to generate.
+	ECDSA bool
+	// CacheSize bounds the leaf certificates kept, the least recently used are dropped; default 1024, negative disables the cache.
+	CacheSize int
+	// InterceptCb chooses the tunnels to intercept, all of them when nil; the others are relayed as they are.
+	InterceptCb AccessCb
+	// UpstreamTLS is the tls config to the hosts, its ServerName is set per host.
+	UpstreamTLS *tls.Config
+}
+
+// NewMITMCA A self-signed PEM encoded CA for MITMConfig.
+func NewMITMCA(commonName string) (cert, key []byte, err error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return rsa.PCryptoRsaCert.GenRsaCert(2048, template)
+}
+
+type mitm struct {
+	cfg *MITMConfig
+
+	ca     *x509.Certificate
+	caDER  []byte
+	caKey  crypto.Signer
+	mux    sync.Mutex
+	size   int
+	list   *list.List
+	certs  map[string]*list.Element
+	minter sync.Mutex
+}
+
+type mitmCert struct {
+	name string
+	cert *tls.Certificate
+}
+
+func newMitm(cfg *MITMConfig) (*mitm, error) {
+	pair, err := tls.X509KeyPair(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !ca.IsCA {
+		return nil, errors.New("invalid mitm ca")
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = 1024
+	}
+	return &mitm{
+		cfg:   cfg,
+		ca:    ca,
+		caDER: pair.Certificate[0],
+		caKey: key,
+		size:  size,
+		list:  list.New(),
+		certs: make(map[string]*list.Element),
+	}, nil
+}
+
+func (m *mitm) intercept(req *http.Request, host string) bool {
+	return m.cfg.InterceptCb == nil || m.cfg.InterceptCb(req, host)
+}
+
+// certificate The leaf certificate of name, minted once while it stays in the cache.
+func (m *mitm) certificate(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(name)
+	if cert, ok := m.cached(name); ok {
+		return cert, nil
+	}
+	m.minter.Lock()
+	defer m.minter.Unlock()
+	if cert, ok := m.cached(name); ok {
+		return cert, nil
+	}
+	cert, err := m.mint(name)
+	if err != nil {
+		return nil, err
+	}
+	m.store(name, cert)
+	return cert, nil
+}
+
+func (m *mitm) cached(name string) (*tls.Certificate, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	elem, ok := m.certs[name]
+	if !ok {
+		return nil, false
+	}
+	m.list.MoveToFront(elem)
+	return elem.Value.(*mitmCert).cert, true
+}
+
+func (m *mitm) store(name string, cert *tls.Certificate) {
+	if m.size < 0 {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.certs[name] = m.list.PushFront(&mitmCert{name: name, cert: cert})
+	for m.list.Len() > m.size {
+		last := m.list.Back()
+		m.list.Remove(last)
+		delete(m.certs, last.Value.(*mitmCert).name)
+	}
+}
+
+func (m *mitm) cacheLen() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.list.Len()
+}
+
+func (m *mitm) mint(name string) (*tls.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if notAfter.After(m.ca.NotAfter) {
+		notAfter = m.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	var certPEM, keyPEM []byte
+	if m.cfg.ECDSA {
+		certPEM, keyPEM, err = ecdsa.PCryptoEcdsaCert.GenEcdsaCertWithParent(elliptic.P256(), template, m.ca, m.caKey)
+	} else {
+		certPEM, keyPEM, err = rsa.PCryptoRsaCert.GenRsaCertWithParent(2048, template, m.ca, m.caKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Certificate = append(cert.Certificate, m.caDER)
+	return &cert, nil
+}
+
+// upstreamTLS The tls config to serverName.
+func (m *mitm) upstreamTLS(serverName string) *tls.Config {
+	cfg := &tls.Config{}
+	if m != nil && m.cfg.UpstreamTLS != nil {
+		cfg = m.cfg.UpstreamTLS.Clone()
+	}
+	cfg.ServerName = serverName
+	return cfg
+}
+
+// intercept Answer the CONNECT req with a tls server and forward the requests in it to host.
+func (s *Server) intercept(conn net.Conn, reader *bufio.Reader, req *http.Request, host string) {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return
+	}
+	resp := newResponse(req, http.StatusOK)
+	resp.Status = "200 Connection Established"
+	resp.Close = false
+	err = s.writeResponse(conn, req, resp)
+	if err != nil {
+		return
+	}
+	tconn := tls.Server(&bufferedConn{Conn: conn, reader: reader}, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				return s.mitm.certificate(name)
+			}
+			// the requests are forwarded to the CONNECT host, a certificate for another name is never minted
+			if net.ParseIP(name) == nil && !strings.EqualFold(hello.ServerName, name) {
+				return nil, ErrMITMServerNameMismatch
+			}
+			return s.mitm.certificate(hello.ServerName)
+		},
+	})
+	ctx, cl := context.WithTimeout(s.ctx, 10*time.Second)
+	err = tconn.HandshakeContext(ctx)
+	cl()
+	if err != nil {
+		return
+	}
+	state := tconn.ConnectionState()
+	treader := bufio.NewReader(tconn)
+	for {
+		treq, err := http.ReadRequest(treader)
+		if err != nil {
+			return
+		}
+		treq = treq.WithContext(req.Context())
+		treq.URL.Scheme = "https"
+		treq.URL.Host = host
+		treq.TLS = &state
+		if !s.forward(tconn, treq) {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package httpproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AccessRule Matches a destination when each of its non-empty lists has a match.
+type AccessRule struct {
+	Deny bool
+	// Hosts are exact names or IPs, a leading "*." or "." matches the subdomains and "*" any host.
+	Hosts []string
+	Ports []int
+	// CIDRs only match the destinations given as an IP, names are not resolved.
+	CIDRs []string
+}
+
+// AccessPolicy An AccessCb from rules checked in order, the first matching rule decides and defaultAllow decides the rest.
+func AccessPolicy(defaultAllow bool, rules ...*AccessRule) (AccessCb, error) {
+	list := make([]*accessRule, 0, len(rules))
+	for _, rule := range rules {
+		ar := &accessRule{rule: rule}
+		for _, one := range rule.CIDRs {
+			_, ipNet, err := net.ParseCIDR(one)
+			if err != nil {
+				return nil, err
+			}
+			ar.nets = append(ar.nets, ipNet)
+		}
+		list = append(list, ar)
+	}
+	return func(req *http.Request, host string) bool {
+		name, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return false
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return false
+		}
+		for _, ar := range list {
+			if ar.match(name, p) {
+				return !ar.rule.Deny
+			}
+		}
+		return defaultAllow
+	}, nil
+}
+
+type accessRule struct {
+	rule *AccessRule
+	nets []*net.IPNet
+}
+
+func (ar *accessRule) match(host string, port int) bool {
+	if len(ar.rule.Hosts) != 0 && !matchHost(ar.rule.Hosts, host) {
+		return false
+	}
+	if len(ar.rule.Ports) != 0 && !matchPort(ar.rule.Ports, port) {
+		return false
+	}
+	if len(ar.nets) != 0 {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, one := range ar.nets {
+			if one.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchHost(list []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, one := range list {
+		one = strings.ToLower(one)
+		switch {
+		case one == "*":
+			return true
+		case strings.HasPrefix(one, "*."):
+			if strings.HasSuffix(host, one[1:]) {
+				return true
+			}
+		case strings.HasPrefix(one, "."):
+			if strings.HasSuffix(host, one) {
+				return true
+			}
+		case one == host:
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(list []int, port int) bool {
+	for _, one := range list {
+		if one == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xdummy"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNeedServerConfig = errors.New("need socks or http server config")
+
+func Serve(ln net.Listener, cfg *ServerConfig) error {
+	server, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	return server.Serve(ln)
+}
+
+func ListenAndServe(network string, addr string, cfg *ServerConfig) error {
+	server, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	return server.ListenAndServe(network, addr)
+}
+
+// ServerConfig
+//
+//	Socks and HTTP are the configs of the servers sharing the port, nil disables one of them.
+//	The first byte of a connection picks the server: 0x04 and 0x05 are socks4/4a and socks5,
+//	an upper case letter is the method of an http request, anything else is closed.
+type ServerConfig struct {
+	Socks *socks.ServerConfig
+	HTTP  *httpproxy.ServerConfig
+	// SniffTimeout Clients that send nothing in time are closed, default 10s.
+	SniffTimeout time.Duration
+}
+
+type Server struct {
+	cfg *ServerConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	socks   *socks.Server
+	socksCh chan net.Conn
+	http    *httpproxy.Server
+	httpCh  chan net.Conn
+
+	once sync.Once
+}
+
+func NewServer(cfg *ServerConfig) (*Server, error) {
+	return NewServerContext(context.Background(), cfg)
+}
+
+func NewServerContext(ctx context.Context, cfg *ServerConfig) (*Server, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if cfg == nil || (cfg.Socks == nil && cfg.HTTP == nil) {
+		return nil, ErrNeedServerConfig
+	}
+	if cfg.SniffTimeout <= 0 {
+		cfg.SniffTimeout = 10 * time.Second
+	}
+	s := &Server{
+		cfg: cfg,
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if cfg.Socks != nil {
+		server, err := socks.NewServerContext(s.ctx, cfg.Socks)
+		if err != nil {
+			s.cancel()
+			return nil, err
+		}
+		s.socks, s.socksCh = server, make(chan net.Conn)
+	}
+	if cfg.HTTP != nil {
+		server, err := httpproxy.NewServerContext(s.ctx, cfg.HTTP)
+		if err != nil {
+			s.cancel()
+			return nil, err
+		}
+		s.http, s.httpCh = server, make(chan net.Conn)
+	}
+	return s, nil
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	s.once.Do(s.start)
+	return s.listen(ln)
+}
+
+func (s *Server) ListenAndServe(network string, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	if s.socks != nil {
+		_ = s.socks.Close()
+	}
+	if s.http != nil {
+		_ = s.http.Close()
+	}
+	return s.ctx.Err()
+}
+
+// start The servers accept the sniffed connections from dummy listeners.
+func (s *Server) start() {
+	if s.socks != nil {
+		go s.socks.Serve(xdummy.NewDummyListener(s.ctx, s.socksCh))
+	}
+	if s.http != nil {
+		go s.http.Serve(xdummy.NewDummyListener(s.ctx, s.httpCh))
+	}
+}
+
+func (s *Server) listen(ln net.Listener) error {
+	defer ln.Close()
+	stop := context.AfterFunc(s.ctx, func() {
+		_ = ln.Close()
+	})
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.dispatch(conn)
+	}
+}
+
+// dispatch Peek the first byte of conn and hand it to its server.
+func (s *Server) dispatch(conn net.Conn) {
+	sc := &sniffConn{Conn: conn, reader: bufio.NewReader(conn)}
+	_ = conn.SetReadDeadline(time.Now().Add(s.cfg.SniffTimeout))
+	b, err := sc.reader.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	var ch chan net.Conn
+	switch {
+	case b[0] == 0x04 || b[0] == 0x05:
+		ch = s.socksCh
+	case b[0] >= 'A' && b[0] <= 'Z':
+		ch = s.httpCh
+	}
+	if ch == nil {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case ch <- sc:
+	case <-s.ctx.Done():
+		_ = conn.Close()
+	}
+}
+
+// sniffConn Reads the peeked bytes first.
+type sniffConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (sc *sniffConn) Read(b []byte) (int, error) {
+	return sc.reader.Read(b)
+}
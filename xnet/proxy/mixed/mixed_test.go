@@ -0,0 +1,152 @@
+package mixed
+
+import (
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	origin, originAddr, err := fasttool.Http(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "origin")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+
+	server, err := NewServer(&ServerConfig{
+		Socks: &socks.ServerConfig{
+			VersionSwitch: socks.DefaultSocksVersionSwitch,
+			CMDConfig:     socks.DefaultSocksCMDConfig,
+			Socks5AuthCb: socks.S5AuthCb{
+				Socks5AuthPASSWORD: func(conn net.Conn, auth socks.S5AuthPassword) net.Conn {
+					return auth.IsEqual2(conn, "user", "pass")
+				},
+			},
+		},
+		HTTP: &httpproxy.ServerConfig{
+			ReqAuthCb: httpproxy.UserInfoAuth("user", "pass"),
+		},
+		SniffTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	addr := ln.Addr().String()
+
+	s5, err := socks.SOCKS5CONNECTP("tcp", addr, &socks.S5AuthPassword{User: "user", Password: "pass"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s4, err := socks.SOCKS4CONNECT("tcp", addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := httpproxy.HTTPCONNECT("tcp", addr, &httpproxy.BasicAuth{Username: "user", Password: "pass"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dr := range map[string]xnetutil.Dialer{"socks5": s5, "socks4": s4, "http": hc} {
+		conn, err := dr.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = fasttool.EchoCheck(conn, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	// the auth of each server still applies
+	bad, _ := socks.SOCKS5CONNECTP("tcp", addr, &socks.S5AuthPassword{User: "user", Password: "bad"}, nil)
+	_, err = bad.Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal()
+	}
+
+	proxyURL, _ := url.Parse("http://user:pass@" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(originAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "origin" {
+		t.Fatal(string(body))
+	}
+
+	// silent and unknown clients are closed
+	for _, first := range [][]byte{nil, {0x16}} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != nil {
+			_, _ = conn.Write(first)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Fatal(first, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	_, err := NewServer(&ServerConfig{})
+	if err != ErrNeedServerConfig {
+		t.Fatal(err)
+	}
+	// only http
+	server, err := NewServer(&ServerConfig{HTTP: &httpproxy.ServerConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ln)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = server.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve not returned")
+	}
+}
@@ -0,0 +1,48 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"net/http"
+)
+
+// SocksCONNECTHandler The CMDCONNECTHandler of socks.CMDConfig that dials by the rules,
+// the user is socks.ContextUser and a rejected destination gets socks.ErrConnNotAllowed.
+func (r *Router) SocksCONNECTHandler() socks.CMDCONNECTHandler {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := r.DialContext(ctx, socks.ContextUser(ctx), "tcp", addr)
+		if errors.Is(err, ErrRejected) {
+			return nil, socks.ErrConnNotAllowed
+		}
+		return conn, err
+	}
+}
+
+// HTTPAccessCb The AccessCb of httpproxy.ServerConfig, rejected destinations are answered with 403.
+// The user is httpproxy.RequestUser.
+func (r *Router) HTTPAccessCb() httpproxy.AccessCb {
+	return func(req *http.Request, host string) bool {
+		action, err := r.Match(httpproxy.RequestUser(req), host)
+		return err == nil && action != ActionReject
+	}
+}
+
+// HTTPForwardCb The ForwardCb of httpproxy.ServerConfig that picks the dialer by the rules,
+// used with HTTPAccessCb. The upstream connections kept by the server for a user and host
+// are still used after the rules change until they are idle for ServerConfig.IdleTimeout.
+func (r *Router) HTTPForwardCb() httpproxy.ForwardCb {
+	return func(user string, host string) xnetutil.Dialer {
+		dr, err := r.Route(user, host)
+		if err != nil {
+			// a reject rule added since HTTPAccessCb was checked
+			return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return nil, err
+			})
+		}
+		return dr
+	}
+}
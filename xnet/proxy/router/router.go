@@ -0,0 +1,216 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peakedshout/go-pandorasbox/tool/hyaml"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrRejected = errors.New("rejected by router rule")
+
+var ErrUpstreamNotFound = func(name string) error { return fmt.Errorf("router upstream not found: %s", name) }
+
+// Router
+//
+//	Routes the connections of a user to their destination by the rules of a Config:
+//	dial directly, reject, or dial through a named upstream (e.g. a chained socks5 dialer).
+//	The rules can be replaced at any time (Update, Reload, Watch), connections already dialed are kept.
+//	Socks and httpproxy servers share a Router through SocksCONNECTHandler, HTTPAccessCb and HTTPForwardCb.
+type Router struct {
+	direct    xnetutil.Dialer
+	upstreams map[string]xnetutil.Dialer
+
+	rules atomic.Pointer[ruleSet]
+
+	mux     sync.Mutex
+	path    string
+	file    *hyaml.Config[Config]
+	modTime time.Time
+}
+
+type ruleSet struct {
+	rules []*rule
+	def   string
+}
+
+// NewRouter A Router of cfg, upstreams are the dialers named by the actions.
+func NewRouter(cfg *Config, upstreams map[string]xnetutil.Dialer) (*Router, error) {
+	r := newRouter(upstreams)
+	err := r.Update(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadRouter A Router of the yaml Config at path, which Reload and Watch read again.
+func LoadRouter(path string, upstreams map[string]xnetutil.Dialer) (*Router, error) {
+	r := newRouter(upstreams)
+	r.path = path
+	r.file = hyaml.Init[Config](path)
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newRouter(upstreams map[string]xnetutil.Dialer) *Router {
+	r := &Router{
+		direct:    &net.Dialer{},
+		upstreams: make(map[string]xnetutil.Dialer, len(upstreams)),
+	}
+	for name, dr := range upstreams {
+		r.upstreams[name] = dr
+	}
+	return r
+}
+
+// Update Replace the rules with cfg, the old ones are kept when cfg is invalid.
+func (r *Router) Update(cfg *Config) error {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	rs := &ruleSet{def: cfg.Default}
+	if rs.def == "" {
+		rs.def = ActionDirect
+	}
+	err := r.checkAction(rs.def)
+	if err != nil {
+		return err
+	}
+	for i, one := range cfg.Rules {
+		ru, err := newRule(one)
+		if err == nil {
+			err = r.checkAction(ru.action)
+		}
+		if err != nil {
+			return fmt.Errorf("router rule %d: %w", i, err)
+		}
+		rs.rules = append(rs.rules, ru)
+	}
+	r.rules.Store(rs)
+	return nil
+}
+
+// Reload Read the file of LoadRouter again, the old rules are kept when it is invalid.
+func (r *Router) Reload() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	// a broken file is reported once, Watch tries it again when it changes
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+	}
+	err := r.file.Update()
+	if err != nil {
+		return err
+	}
+	return r.Update(r.file.Config)
+}
+
+// Watch Reload the file of LoadRouter whenever its modification time changes, checked every interval (default 5s),
+// until ctx is done. errCb gets the errors of the reloads, it can be nil.
+func (r *Router) Watch(ctx context.Context, interval time.Duration, errCb func(error)) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !r.modified() {
+					continue
+				}
+				err := r.Reload()
+				if err != nil && errCb != nil {
+					errCb(err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Router) modified() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.file == nil {
+		return false
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(r.modTime)
+}
+
+func (r *Router) checkAction(action string) error {
+	switch action {
+	case ActionDirect, ActionReject:
+		return nil
+	}
+	if _, ok := r.upstreams[action]; !ok {
+		return ErrUpstreamNotFound(action)
+	}
+	return nil
+}
+
+// Match The action of the first rule matching user and addr (host:port), or the default one.
+func (r *Router) Match(user string, addr string) (string, error) {
+	t, err := newTarget(user, addr)
+	if err != nil {
+		return "", err
+	}
+	rs := r.rules.Load()
+	for _, one := range rs.rules {
+		if one.match(t) {
+			return one.action, nil
+		}
+	}
+	return rs.def, nil
+}
+
+// Route The dialer of the connections of user to addr (host:port), ErrRejected when a reject rule matches.
+func (r *Router) Route(user string, addr string) (xnetutil.Dialer, error) {
+	action, err := r.Match(user, addr)
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case ActionDirect:
+		return r.direct, nil
+	case ActionReject:
+		return nil, ErrRejected
+	default:
+		return r.upstreams[action], nil
+	}
+}
+
+// DialContext Dial addr for user by the rules.
+func (r *Router) DialContext(ctx context.Context, user string, network string, addr string) (net.Conn, error) {
+	dr, err := r.Route(user, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dr.DialContext(ctx, network, addr)
+}
+
+// Dialer The dialer that routes the connections of user.
+func (r *Router) Dialer(user string) xnetutil.Dialer {
+	return xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return r.DialContext(ctx, user, network, addr)
+	})
+}
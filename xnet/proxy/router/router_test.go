@@ -0,0 +1,278 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/httpproxy"
+	"github.com/peakedshout/go-pandorasbox/xnet/proxy/socks"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	up := xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return nil, errors.New("unused")
+	})
+	r, err := NewRouter(&Config{
+		Default: "up",
+		Rules: []*RuleConfig{
+			{Users: []string{"banned"}, Action: ActionReject},
+			{Domains: []string{"Exact.Example.com."}, Action: ActionDirect},
+			{Suffixes: []string{".corp.local"}, Ports: []string{"80", "8000-8999"}, Action: ActionDirect},
+			{Regexps: []string{`^ads?\d*\.`}, Action: ActionReject},
+			{CIDRs: []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}, Users: []string{"", "admin"}, Action: ActionDirect},
+		},
+	}, map[string]xnetutil.Dialer{"up": up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user, addr, action string
+	}{
+		{"banned", "exact.example.com:443", ActionReject},
+		{"", "exact.example.com:443", ActionDirect},
+		{"", "sub.exact.example.com:443", "up"},
+		{"", "corp.local:80", ActionDirect},
+		{"", "a.b.corp.local:8080", ActionDirect},
+		{"", "a.b.corp.local:443", "up"},
+		{"", "notcorp.local:80", "up"},
+		{"", "ad1.example.com:80", ActionReject},
+		{"", "bad.example.com:80", "up"},
+		{"", "10.1.2.3:22", ActionDirect},
+		{"admin", "192.168.1.1:22", ActionDirect},
+		{"other", "192.168.1.1:22", "up"},
+		{"", "192.168.1.2:22", "up"},
+		{"", "[fd00::1]:22", ActionDirect},
+		{"", "[::ffff:10.0.0.1]:22", ActionDirect},
+	}
+	for _, one := range cases {
+		action, err := r.Match(one.user, one.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != one.action {
+			t.Fatal(one.user, one.addr, action, one.action)
+		}
+	}
+	_, err = r.Route("banned", "exact.example.com:443")
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal(err)
+	}
+	_, err = r.Match("", "no-port")
+	if err == nil {
+		t.Fatal()
+	}
+
+	invalid := []*Config{
+		{Default: "missing"},
+		{Rules: []*RuleConfig{{Action: "missing"}}},
+		{Rules: []*RuleConfig{{Domains: []string{"a"}}}},
+		{Rules: []*RuleConfig{{Regexps: []string{"("}, Action: ActionDirect}}},
+		{Rules: []*RuleConfig{{CIDRs: []string{"10.0.0.0/33"}, Action: ActionDirect}}},
+		{Rules: []*RuleConfig{{Ports: []string{"9-8"}, Action: ActionDirect}}},
+		{Rules: []*RuleConfig{{Ports: []string{"65536"}, Action: ActionDirect}}},
+	}
+	for _, one := range invalid {
+		if r.Update(one) == nil {
+			t.Fatal(one)
+		}
+	}
+	// the rules are kept
+	action, _ := r.Match("banned", "a:1")
+	if action != ActionReject {
+		t.Fatal(action)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.yaml")
+	write := func(s string, mod time.Time) {
+		err := os.WriteFile(path, []byte(s), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, mod, mod)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(`
+default: reject
+rules:
+  - suffixes: [example.com]
+    ports: ["443"]
+    action: direct
+`, now.Add(-time.Hour))
+	r, err := LoadRouter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := func(addr string) string {
+		action, err := r.Match("", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return action
+	}
+	if match("www.example.com:443") != ActionDirect || match("www.example.com:80") != ActionReject {
+		t.Fatal()
+	}
+	ctx, cl := context.WithCancel(context.Background())
+	defer cl()
+	errs := make(chan error, 10)
+	r.Watch(ctx, 20*time.Millisecond, func(err error) {
+		errs <- err
+	})
+
+	write("default: [", now.Add(-time.Minute))
+	select {
+	case <-errs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no reload error")
+	}
+	if match("www.example.com:443") != ActionDirect {
+		t.Fatal()
+	}
+
+	write("default: direct\n", now)
+	deadline := time.Now().Add(3 * time.Second)
+	for match("www.example.com:80") != ActionDirect {
+		if time.Now().After(deadline) {
+			t.Fatal("not reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestProxy(t *testing.T) {
+	echo, err := fasttool.EchoTcpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	// the named upstream is a chained socks5 server
+	upstream, err := socks.NewServer(&socks.ServerConfig{
+		VersionSwitch: socks.DefaultSocksVersionSwitch,
+		CMDConfig:     socks.DefaultSocksCMDConfig,
+		Socks5AuthCb:  socks.S5AuthCb{Socks5AuthNOAUTH: socks.DefaultAuthConnCb},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go upstream.Serve(upLn)
+	chain, err := socks.SOCKS5CONNECTP("tcp", upLn.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chained atomic.Int32
+	r, err := NewRouter(&Config{
+		Rules: []*RuleConfig{
+			{Users: []string{"blocked"}, Action: ActionReject},
+			{Users: []string{"chained"}, CIDRs: []string{"127.0.0.0/8"}, Action: "chain"},
+		},
+	}, map[string]xnetutil.Dialer{
+		"chain": xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			chained.Add(1)
+			return chain.DialContext(ctx, network, addr)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socksServer, err := socks.NewServer(&socks.ServerConfig{
+		VersionSwitch: socks.DefaultSocksVersionSwitch,
+		CMDConfig: socks.CMDConfig{
+			SwitchCMDCONNECT:  true,
+			CMDCONNECTHandler: r.SocksCONNECTHandler(),
+		},
+		Socks5AuthCb: socks.S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth socks.S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, auth.User, "pass")
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksServer.Close()
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go socksServer.Serve(socksLn)
+
+	httpServer, err := httpproxy.NewServer(&httpproxy.ServerConfig{
+		ReqAuthCb: func(req *http.Request) bool {
+			_, p, _ := httpproxy.ProxyBasicAuth(req)
+			return p == "pass"
+		},
+		AccessCb:  r.HTTPAccessCb(),
+		ForwardCb: r.HTTPForwardCb(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpServer.Serve(httpLn)
+
+	dialers := map[string]func(user string) (xnetutil.Dialer, error){
+		"socks5": func(user string) (xnetutil.Dialer, error) {
+			return socks.SOCKS5CONNECTP("tcp", socksLn.Addr().String(), &socks.S5AuthPassword{User: user, Password: "pass"}, nil)
+		},
+		"http": func(user string) (xnetutil.Dialer, error) {
+			return httpproxy.HTTPCONNECT("tcp", httpLn.Addr().String(), &httpproxy.BasicAuth{Username: user, Password: "pass"}, nil)
+		},
+	}
+	for name, fn := range dialers {
+		for _, user := range []string{"direct", "chained", "blocked"} {
+			dr, err := fn(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := chained.Load()
+			conn, err := dr.Dial("tcp", echo.Addr().String())
+			if user == "blocked" {
+				if err == nil {
+					conn.Close()
+					t.Fatal(name, user)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(name, user, err)
+			}
+			err = fasttool.EchoCheck(conn, "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+			if (chained.Load() != before) != (user == "chained") {
+				t.Fatal(name, user, chained.Load())
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ActionDirect Dial the destination without upstream.
+	ActionDirect = "direct"
+	// ActionReject Refuse the destination.
+	ActionReject = "reject"
+)
+
+// Config
+//
+//	The rules are matched in order and the first one that matches decides the action,
+//	Default when none matches ("direct" when empty).
+//	An action is ActionDirect, ActionReject or the name of an upstream dialer given to the Router.
+type Config struct {
+	Default string        `json:"default" yaml:"default"`
+	Rules   []*RuleConfig `json:"rules" yaml:"rules"`
+}
+
+// RuleConfig
+//
+//	A rule matches when every condition it sets matches, a condition matches when one of its values does.
+//	Domains, Suffixes and Regexps match domain destinations and CIDRs ip destinations,
+//	together they are a single condition on the destination host (no name is resolved).
+//	Domains are exact names, Suffixes match the name and its subdomains, Regexps search the name (anchor them to match it whole),
+//	names are compared in lower case without the trailing dot.
+//	Ports are "443" or ranges like "8000-9000", Users are the authenticated users ("" for anonymous).
+type RuleConfig struct {
+	Domains  []string `json:"domains" yaml:"domains"`
+	Suffixes []string `json:"suffixes" yaml:"suffixes"`
+	Regexps  []string `json:"regexps" yaml:"regexps"`
+	CIDRs    []string `json:"cidrs" yaml:"cidrs"`
+	Ports    []string `json:"ports" yaml:"ports"`
+	Users    []string `json:"users" yaml:"users"`
+	Action   string   `json:"action" yaml:"action"`
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+type rule struct {
+	hostSet  bool
+	domains  map[string]struct{}
+	suffixes []string
+	regexps  []*regexp.Regexp
+	prefixes []netip.Prefix
+	ports    []portRange
+	users    map[string]struct{}
+	action   string
+}
+
+func newRule(cfg *RuleConfig) (*rule, error) {
+	if cfg == nil {
+		return nil, errors.New("nil rule")
+	}
+	if cfg.Action == "" {
+		return nil, errors.New("missing action")
+	}
+	r := &rule{
+		hostSet: len(cfg.Domains)+len(cfg.Suffixes)+len(cfg.Regexps)+len(cfg.CIDRs) != 0,
+		action:  cfg.Action,
+	}
+	if len(cfg.Domains) != 0 {
+		r.domains = make(map[string]struct{}, len(cfg.Domains))
+		for _, one := range cfg.Domains {
+			r.domains[normDomain(one)] = struct{}{}
+		}
+	}
+	for _, one := range cfg.Suffixes {
+		r.suffixes = append(r.suffixes, strings.TrimPrefix(normDomain(one), "."))
+	}
+	for _, one := range cfg.Regexps {
+		re, err := regexp.Compile(one)
+		if err != nil {
+			return nil, err
+		}
+		r.regexps = append(r.regexps, re)
+	}
+	for _, one := range cfg.CIDRs {
+		prefix, err := netip.ParsePrefix(one)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(one)
+			if err2 != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.prefixes = append(r.prefixes, prefix.Masked())
+	}
+	for _, one := range cfg.Ports {
+		pr, err := parsePortRange(one)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	if len(cfg.Users) != 0 {
+		r.users = make(map[string]struct{}, len(cfg.Users))
+		for _, one := range cfg.Users {
+			r.users[one] = struct{}{}
+		}
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	min, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	max := min
+	if isRange {
+		max, err = strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+		if err != nil || max < min {
+			return portRange{}, fmt.Errorf("invalid port: %s", s)
+		}
+	}
+	return portRange{min: uint16(min), max: uint16(max)}, nil
+}
+
+func normDomain(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+// target The destination of a connection.
+type target struct {
+	user   string
+	domain string
+	ip     netip.Addr
+	port   uint16
+}
+
+func newTarget(user string, addr string) (*target, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", port)
+	}
+	t := &target{user: user, port: uint16(p)}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		t.ip = ip.Unmap()
+	} else {
+		t.domain = normDomain(host)
+	}
+	return t, nil
+}
+
+func (r *rule) match(t *target) bool {
+	if r.hostSet && !r.matchHost(t) {
+		return false
+	}
+	if len(r.ports) != 0 && !r.matchPort(t.port) {
+		return false
+	}
+	if r.users != nil {
+		if _, ok := r.users[t.user]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) matchHost(t *target) bool {
+	if t.ip.IsValid() {
+		for _, one := range r.prefixes {
+			if one.Contains(t.ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := r.domains[t.domain]; ok {
+		return true
+	}
+	for _, one := range r.suffixes {
+		if t.domain == one || strings.HasSuffix(t.domain, "."+one) {
+			return true
+		}
+	}
+	for _, one := range r.regexps {
+		if one.MatchString(t.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(port uint16) bool {
+	for _, one := range r.ports {
+		if port >= one.min && port <= one.max {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+package socks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net"
+	"sync"
+)
+
+// S5AuthMethod
+//
+//	A socks5 auth method (rfc1928 3) with its sub-negotiation, for both ends.
+//	Code is its METHOD: GSSAPI 0x01, IANA ASSIGNED 0x03-0x7F or PRIVATE 0x80-0xFE.
+//	The returned conn carries the rest of the connection and can encapsulate it (see S5GSSAPIAuth),
+//	the user of AuthServer is the one of socks.ContextUser.
+//	Set in S5Auth.Socks5AuthMethods and S5AuthCb.Socks5AuthMethods.
+type S5AuthMethod interface {
+	Code() byte
+	AuthClient(conn net.Conn) (net.Conn, error)
+	AuthServer(conn net.Conn) (nconn net.Conn, user string, err error)
+}
+
+const (
+	s5HMACVER         = 0x01
+	s5HMACNonceLen    = 32
+	s5HMACRespSuccess = 0x00
+	s5HMACRespFailure = 0x01
+)
+
+// S5HMACAuth
+//
+//	A private method of token challenge/response:
+//	the server sends VER(1) NONCE(32), the client answers VER(1) ULEN(1) USER MLEN(1) MAC
+//	with MAC = HMAC(key of USER, NONCE | USER), and the server replies VER(1) STATUS(1), 0x00 is success.
+//	The client uses User and Key, the server Keys.
+type S5HMACAuth struct {
+	MethodCode byte // default 0x80
+	User       string
+	Key        []byte
+	Keys       func(user string) (key []byte, ok bool)
+	Hash       func() hash.Hash // default sha256
+}
+
+func (ha *S5HMACAuth) Code() byte {
+	if ha.MethodCode == 0 {
+		return socks5METHODCodePRIVATE
+	}
+	return ha.MethodCode
+}
+
+func (ha *S5HMACAuth) AuthClient(conn net.Conn) (net.Conn, error) {
+	buf := make([]byte, 1+s5HMACNonceLen)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != s5HMACVER || len(ha.User) > 255 {
+		return nil, ErrSocksMessageParsingFailure
+	}
+	mac := ha.mac(ha.Key, buf[1:], ha.User)
+	bs := new(bytes.Buffer)
+	bs.Write([]byte{s5HMACVER, byte(len(ha.User))})
+	bs.WriteString(ha.User)
+	bs.Write([]byte{byte(len(mac))})
+	bs.Write(mac)
+	_, err = conn.Write(bs.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != s5HMACVER {
+		return nil, ErrSocksMessageParsingFailure
+	}
+	if buf[1] != s5HMACRespSuccess {
+		return nil, ErrSocks5AuthRejected
+	}
+	return conn, nil
+}
+
+func (ha *S5HMACAuth) AuthServer(conn net.Conn) (net.Conn, string, error) {
+	nonce := make([]byte, s5HMACNonceLen)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = conn.Write(append([]byte{s5HMACVER}, nonce...))
+	if err != nil {
+		return nil, "", err
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, "", err
+	}
+	if buf[0] != s5HMACVER {
+		return nil, "", ErrSocksMessageParsingFailure
+	}
+	user, err := readN(conn, int(buf[1]))
+	if err != nil {
+		return nil, "", err
+	}
+	mac, err := readBytes(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	var key []byte
+	ok := ha.Keys != nil
+	if ok {
+		key, ok = ha.Keys(string(user))
+	}
+	if !ok || !hmac.Equal(mac, ha.mac(key, nonce, string(user))) {
+		_, _ = conn.Write([]byte{s5HMACVER, s5HMACRespFailure})
+		return nil, "", ErrSocks5AuthRejected
+	}
+	_, err = conn.Write([]byte{s5HMACVER, s5HMACRespSuccess})
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, string(user), nil
+}
+
+func (ha *S5HMACAuth) mac(key []byte, nonce []byte, user string) []byte {
+	fn := ha.Hash
+	if fn == nil {
+		fn = sha256.New
+	}
+	h := hmac.New(fn, key)
+	h.Write(nonce)
+	h.Write([]byte(user))
+	return h.Sum(nil)
+}
+
+const (
+	s5GSSAPIVER           = 0x01
+	s5GSSAPIMTYPContext   = 0x01
+	s5GSSAPIMTYPProtect   = 0x02
+	s5GSSAPIMTYPEncap     = 0x03
+	s5GSSAPIMTYPFailure   = 0xff
+	s5GSSAPIMaxPlainChunk = 16 * 1024
+
+	s5GSSAPIProtectIntegrity       = 0x01
+	s5GSSAPIProtectConfidentiality = 0x02
+	s5GSSAPIProtectSelective       = 0x03
+)
+
+// S5GSSAPIContext
+//
+//	One end of a GSS-API security context, e.g. a kerberos binding or a local stand-in.
+//	Step consumes the token of the other end (nil for the first call of the client)
+//	and returns the token to send, done when the context is established.
+//	Wrap and Unwrap protect the messages once it is (gss_wrap/gss_unwrap):
+//	conf asks Wrap for confidentiality besides integrity (conf_req_flag) and Unwrap tells whether a message had it (conf_state).
+//	Name is the authenticated name of the client on the server end.
+type S5GSSAPIContext interface {
+	Step(token []byte) (out []byte, done bool, err error)
+	Wrap(b []byte, conf bool) ([]byte, error)
+	Unwrap(b []byte) (out []byte, conf bool, err error)
+	Name() string
+}
+
+// S5GSSAPIAuth
+//
+//	The GSSAPI method (rfc1961) over a S5GSSAPIContext: the context tokens are exchanged in
+//	VER(1) MTYP(1) LEN(2) TOKEN messages, then the protection level is negotiated in wrapped tokens
+//	(the lower of both ends wins) and the rest of the connection is encapsulated per message,
+//	with confidentiality unless the level is integrity; a message below the level is rejected.
+type S5GSSAPIAuth struct {
+	NewContext func(server bool) (S5GSSAPIContext, error)
+	// Protection The highest protection level: 1 integrity, 2 confidentiality (default), 3 selective.
+	Protection byte
+}
+
+func (ga *S5GSSAPIAuth) Code() byte {
+	return socks5METHODCodeGSSAPI
+}
+
+func (ga *S5GSSAPIAuth) protection() byte {
+	if ga.Protection == 0 {
+		return s5GSSAPIProtectConfidentiality
+	}
+	return ga.Protection
+}
+
+func (ga *S5GSSAPIAuth) AuthClient(conn net.Conn) (net.Conn, error) {
+	gc, err := ga.NewContext(false)
+	if err != nil {
+		return nil, err
+	}
+	var in []byte
+	for {
+		out, done, err := gc.Step(in)
+		if err != nil {
+			_ = writeGSSAPIMsg(conn, s5GSSAPIMTYPFailure, nil)
+			return nil, err
+		}
+		if len(out) == 0 {
+			if done {
+				break
+			}
+			return nil, ErrSocks5GSSAPIMessage
+		}
+		err = writeGSSAPIMsg(conn, s5GSSAPIMTYPContext, out)
+		if err != nil {
+			return nil, err
+		}
+		in, err = readGSSAPIMsg(conn, s5GSSAPIMTYPContext)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			if len(in) != 0 {
+				return nil, ErrSocks5GSSAPIMessage
+			}
+			break
+		}
+	}
+	// the level messages only need integrity (rfc1961 4)
+	token, err := gc.Wrap([]byte{ga.protection()}, false)
+	if err != nil {
+		return nil, err
+	}
+	err = writeGSSAPIMsg(conn, s5GSSAPIMTYPProtect, token)
+	if err != nil {
+		return nil, err
+	}
+	token, err = readGSSAPIMsg(conn, s5GSSAPIMTYPProtect)
+	if err != nil {
+		return nil, err
+	}
+	level, _, err := gc.Unwrap(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(level) != 1 || level[0] == 0 || level[0] > ga.protection() {
+		return nil, ErrSocks5GSSAPIMessage
+	}
+	return newGSSAPIConn(conn, gc, level[0]), nil
+}
+
+func (ga *S5GSSAPIAuth) AuthServer(conn net.Conn) (net.Conn, string, error) {
+	gc, err := ga.NewContext(true)
+	if err != nil {
+		return nil, "", err
+	}
+	established := false
+	for {
+		mtyp, token, err := readGSSAPIMsgAny(conn)
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case mtyp == s5GSSAPIMTYPContext && !established:
+			out, done, err := gc.Step(token)
+			if err != nil {
+				_ = writeGSSAPIMsg(conn, s5GSSAPIMTYPFailure, nil)
+				return nil, "", ErrSocks5AuthRejected
+			}
+			established = done
+			err = writeGSSAPIMsg(conn, s5GSSAPIMTYPContext, out)
+			if err != nil {
+				return nil, "", err
+			}
+		case mtyp == s5GSSAPIMTYPProtect && established:
+			level, _, err := gc.Unwrap(token)
+			if err != nil || len(level) != 1 || level[0] == 0 || level[0] > s5GSSAPIProtectSelective {
+				_ = writeGSSAPIMsg(conn, s5GSSAPIMTYPFailure, nil)
+				return nil, "", ErrSocks5GSSAPIMessage
+			}
+			if level[0] > ga.protection() {
+				level[0] = ga.protection()
+			}
+			token, err = gc.Wrap(level, false)
+			if err != nil {
+				return nil, "", err
+			}
+			err = writeGSSAPIMsg(conn, s5GSSAPIMTYPProtect, token)
+			if err != nil {
+				return nil, "", err
+			}
+			return newGSSAPIConn(conn, gc, level[0]), gc.Name(), nil
+		case mtyp == s5GSSAPIMTYPFailure:
+			return nil, "", ErrSocks5AuthRejected
+		default:
+			_ = writeGSSAPIMsg(conn, s5GSSAPIMTYPFailure, nil)
+			return nil, "", ErrSocks5GSSAPIMessage
+		}
+	}
+}
+
+// gssapiConn The encapsulation of rfc1961 4, every write is sent as wrapped messages at the protection level.
+type gssapiConn struct {
+	net.Conn
+	gc    S5GSSAPIContext
+	level byte
+
+	rmux sync.Mutex
+	buf  []byte
+	wmux sync.Mutex
+}
+
+func newGSSAPIConn(conn net.Conn, gc S5GSSAPIContext, level byte) net.Conn {
+	return &gssapiConn{Conn: conn, gc: gc, level: level}
+}
+
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+	for len(c.buf) == 0 {
+		token, err := readGSSAPIMsg(c.Conn, s5GSSAPIMTYPEncap)
+		if err != nil {
+			return 0, err
+		}
+		var conf bool
+		c.buf, conf, err = c.gc.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+		if !conf && c.level == s5GSSAPIProtectConfidentiality {
+			c.buf = nil
+			return 0, ErrSocks5GSSAPIMessage
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(b []byte) (int, error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	n := 0
+	for n < len(b) {
+		end := n + s5GSSAPIMaxPlainChunk
+		if end > len(b) {
+			end = len(b)
+		}
+		// selective protection is sent confidential as a whole
+		token, err := c.gc.Wrap(b[n:end], c.level != s5GSSAPIProtectIntegrity)
+		if err != nil {
+			return n, err
+		}
+		err = writeGSSAPIMsg(c.Conn, s5GSSAPIMTYPEncap, token)
+		if err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+func writeGSSAPIMsg(w io.Writer, mtyp byte, token []byte) error {
+	if mtyp == s5GSSAPIMTYPFailure {
+		_, err := w.Write([]byte{s5GSSAPIVER, mtyp})
+		return err
+	}
+	if len(token) > 0xffff {
+		return ErrSocks5GSSAPIMessage
+	}
+	b := make([]byte, 4, 4+len(token))
+	b[0], b[1] = s5GSSAPIVER, mtyp
+	binary.BigEndian.PutUint16(b[2:], uint16(len(token)))
+	_, err := w.Write(append(b, token...))
+	return err
+}
+
+func readGSSAPIMsg(r io.Reader, mtyp byte) ([]byte, error) {
+	got, token, err := readGSSAPIMsgAny(r)
+	if err != nil {
+		return nil, err
+	}
+	if got == s5GSSAPIMTYPFailure {
+		return nil, ErrSocks5AuthRejected
+	}
+	if got != mtyp {
+		return nil, ErrSocks5GSSAPIMessage
+	}
+	return token, nil
+}
+
+func readGSSAPIMsgAny(r io.Reader) (byte, []byte, error) {
+	b := make([]byte, 2)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if b[0] != s5GSSAPIVER {
+		return 0, nil, ErrSocks5GSSAPIMessage
+	}
+	if b[1] == s5GSSAPIMTYPFailure {
+		return b[1], nil, nil
+	}
+	mtyp := b[1]
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	token, err := readN(r, int(binary.BigEndian.Uint16(b)))
+	if err != nil {
+		return 0, nil, err
+	}
+	return mtyp, token, nil
+}
+
+func readN(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
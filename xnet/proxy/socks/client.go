@@ -23,6 +23,12 @@ func SOCKS5UDPASSOCIATE(network string, address string, auth *S5Auth, forward xn
 	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, auth, forward, uforward, nil, udpCb)
 }
 
+// SOCKS5UDPASSOCIATEStream Like SOCKS5UDPASSOCIATE, the datagrams are framed over the control connection (UDP over TCP),
+// the server needs CMDConfig.SwitchCMDUDPASSOCIATEStream.
+func SOCKS5UDPASSOCIATEStream(network string, address string, auth *S5Auth, forward xnetutil.Dialer, udpCb UDPDataHandler) (xnetutil.PacketListenerConfig, error) {
+	return newSocks5Config(network, address, socks5CMDUDPASSOCIATEStream, auth, forward, nil, nil, udpCb)
+}
+
 func SOCKS5CONNECTP(network string, address string, auth *S5AuthPassword, forward xnetutil.Dialer) (xnetutil.Dialer, error) {
 	a := &S5Auth{
 		Socks5AuthNOAUTH:   DefaultAuthConnCb,
@@ -45,3 +51,11 @@ func SOCKS5UDPASSOCIATEP(network string, address string, auth *S5AuthPassword, f
 	}
 	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, a, forward, uforward, nil, udpCb)
 }
+
+func SOCKS5UDPASSOCIATEStreamP(network string, address string, auth *S5AuthPassword, forward xnetutil.Dialer, udpCb UDPDataHandler) (xnetutil.PacketListenerConfig, error) {
+	a := &S5Auth{
+		Socks5AuthNOAUTH:   DefaultAuthConnCb,
+		Socks5AuthPASSWORD: auth,
+	}
+	return newSocks5Config(network, address, socks5CMDUDPASSOCIATEStream, a, forward, nil, nil, udpCb)
+}
@@ -18,6 +18,17 @@ type S5Auth struct {
 	Socks5AuthPASSWORD *S5AuthPassword
 	Socks5AuthIANA     [125]func(conn net.Conn) net.Conn
 	Socks5AuthPRIVATE  [127]func(conn net.Conn) net.Conn
+	// Socks5AuthMethods replace the callbacks of their codes.
+	Socks5AuthMethods []S5AuthMethod
+}
+
+func (s5a *S5Auth) method(code byte) S5AuthMethod {
+	for _, one := range s5a.Socks5AuthMethods {
+		if one != nil && one.Code() == code {
+			return one
+		}
+	}
+	return nil
 }
 
 type socks5Config struct {
@@ -52,7 +63,7 @@ func (s5d *socks5Config) ListenPacket(network string, address string) (net.Packe
 }
 
 func (s5d *socks5Config) ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error) {
-	err := s5d.checkSocks5CMD(socks5CMDUDPASSOCIATE)
+	err := s5d.checkSocks5CMD(socks5CMDUDPASSOCIATE, socks5CMDUDPASSOCIATEStream)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +81,12 @@ func (s5d *socks5Config) ListenPacketContext(ctx context.Context, network string
 		_ = conn.Close()
 		return nil, err
 	}
-	pconn, err := s5d.udpSocks5(ctx, aconn, network, address)
+	var pconn net.PacketConn
+	if s5d.cmd == socks5CMDUDPASSOCIATEStream {
+		pconn, err = s5d.udpStreamSocks5(aconn, network, address)
+	} else {
+		pconn, err = s5d.udpSocks5(ctx, aconn, network, address)
+	}
 	if err != nil {
 		_ = aconn.Close()
 		return nil, err
@@ -224,6 +240,31 @@ func (s5d *socks5Config) udpSocks5(ctx context.Context, conn net.Conn, network s
 	return pc, nil
 }
 
+// udpStreamSocks5 The datagrams go over conn, no udp socket is needed.
+func (s5d *socks5Config) udpStreamSocks5(conn net.Conn, network string, addr string) (net.PacketConn, error) {
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s5d.getSocks5CMDBytes(s5d.cmd, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	rep, _, err := s5d.readSocks5CMDResp(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = getSocks5RespErr(rep)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5StreamPacketConn{Conn: conn, cb: s5d.udpCb}, nil
+}
+
 func (s5d *socks5Config) authSocks5(conn net.Conn) (net.Conn, error) {
 	b, err := s5d.getSocks5AuthBytes()
 	if err != nil {
@@ -241,6 +282,9 @@ func (s5d *socks5Config) authSocks5(conn net.Conn) (net.Conn, error) {
 	if buf[0] != socksVersion5 {
 		return nil, ErrSocksMessageParsingFailure
 	}
+	if method := s5d.auth.method(buf[1]); method != nil && buf[1] != socks5RETHODCodeRejected {
+		return method.AuthClient(conn)
+	}
 	if buf[1] == socks5METHODCodeNOAUTH {
 		if s5d.auth.Socks5AuthNOAUTH == nil {
 			return nil, ErrSocks5AuthRejected
@@ -325,30 +369,27 @@ func (s5d *socks5Config) getSocks5AuthBytes() ([]byte, error) {
 	if s5d.auth == nil {
 		return nil, ErrSocks5NeedMETHODSAuth
 	}
-	bs := new(bytes.Buffer)
-	bs.Write([]byte{socksVersion5, 0x00})
-	var l byte = 0x00
-	if s5d.auth.Socks5AuthNOAUTH != nil {
-		bs.Write([]byte{socks5METHODCodeNOAUTH})
-		l++
-	}
-	if s5d.auth.Socks5AuthGSSAPI != nil {
-		bs.Write([]byte{socks5METHODCodeGSSAPI})
-		l++
+	var codes [socks5RETHODCodeRejected]bool
+	codes[socks5METHODCodeNOAUTH] = s5d.auth.Socks5AuthNOAUTH != nil
+	codes[socks5METHODCodeGSSAPI] = s5d.auth.Socks5AuthGSSAPI != nil
+	codes[socks5METHODCodePASSWORD] = s5d.auth.Socks5AuthPASSWORD != nil
+	for i, one := range s5d.auth.Socks5AuthIANA {
+		codes[socks5METHODCodeIANA+i] = one != nil
 	}
-	if s5d.auth.Socks5AuthPASSWORD != nil {
-		bs.Write([]byte{socks5METHODCodePASSWORD})
-		l++
+	for i, one := range s5d.auth.Socks5AuthPRIVATE {
+		codes[socks5METHODCodePRIVATE+i] = one != nil
 	}
-	for i, one := range s5d.auth.Socks5AuthIANA {
-		if one != nil {
-			bs.Write([]byte{byte(socks5METHODCodeIANA + i)})
-			l++
+	for _, one := range s5d.auth.Socks5AuthMethods {
+		if one != nil && one.Code() != socks5RETHODCodeRejected {
+			codes[one.Code()] = true
 		}
 	}
-	for i, one := range s5d.auth.Socks5AuthPRIVATE {
-		if one != nil {
-			bs.Write([]byte{byte(socks5METHODCodePRIVATE + i)})
+	bs := new(bytes.Buffer)
+	bs.Write([]byte{socksVersion5, 0x00})
+	var l byte = 0x00
+	for code, ok := range codes {
+		if ok {
+			bs.Write([]byte{byte(code)})
 			l++
 		}
 	}
@@ -50,6 +50,8 @@ const (
 	socks5CMDCONNECT      = 0x01
 	socks5CMDBIND         = 0x02
 	socks5CMDUDPASSOCIATE = 0x03
+	// socks5CMDUDPASSOCIATEStream A private command, UDP ASSOCIATE with the datagrams framed over the control connection.
+	socks5CMDUDPASSOCIATEStream = 0x80
 )
 
 const (
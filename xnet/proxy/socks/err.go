@@ -23,10 +23,55 @@ var ErrSocks4UserIdInvalid = errors.New("socks4 user-id invalid")
 var ErrSocks5NOACCEPTABLEMETHODS = errors.New("socks5 NO ACCEPTABLE METHODS")
 var ErrSocks5NeedMETHODSAuth = errors.New("socks5 need METHODS auth")
 var ErrSocks5AuthRejected = errors.New("socks5 Auth Rejected")
+var ErrSocks5GSSAPIMessage = errors.New("socks5 GSSAPI message invalid")
+var ErrSocks5AuthMethodCode = func(code byte) error { return fmt.Errorf("socks5 auth method code invalid: %#x", code) }
 var ErrSocks5UDPASSOCIATEDataUnmarshalFailure = errors.New("socks5 UDP ASSOCIATE data unmarshal failure")
 
+// ErrConnNotAllowed A CMDCONNECTHandler returns it to refuse addr, socks5 replies "connection not allowed by ruleset".
+var ErrConnNotAllowed = errors.New("connection not allowed by ruleset")
+
+var ErrUserConnLimit = errors.New("too many connections of the user")
+
+var ErrFakeIPUnmapped = errors.New("fake ip without a domain")
+
+var ErrTransparentNoDst = errors.New("no original destination of the transparent connection")
+
 var ErrSocks4NotSupportIPv6 = errors.New("socks4 not support IPv6")
 
+var ErrSocks4RejectedFailed = errors.New("request rejected or failed")
+var ErrSocks4RejectedClientIdentd = errors.New("request rejected becasue SOCKS server cannot connect to identd on the client")
+var ErrSocks4RejectedDifferentUserId = errors.New("request rejected because the client program and identd report different user-ids")
+
+var ErrSocks5GeneralFailure = errors.New("general SOCKS server failure")
+var ErrSocks5NetworkUnreachable = errors.New("network unreachable")
+var ErrSocks5HostUnreachable = errors.New("host unreachable")
+var ErrSocks5ConnRefused = errors.New("connection refused")
+var ErrSocks5TTLExpired = errors.New("TTL expired")
+var ErrSocks5CMDNotSupported = errors.New("command not supported")
+var ErrSocks5AddrTypeNotSupported = errors.New("address type not supported")
+
+// ErrRelayConnectFailed The relay could not connect the address.
+var ErrRelayConnectFailed = errors.New("relay connect failed")
+
+// IsDestinationErr Whether err is the reply of a proxy that could not reach or was not allowed to reach the destination,
+// as opposed to a failure of the proxy itself.
+func IsDestinationErr(err error) bool {
+	for _, one := range []error{
+		ErrSocks4RejectedFailed,
+		ErrSocks5NetworkUnreachable,
+		ErrSocks5HostUnreachable,
+		ErrSocks5ConnRefused,
+		ErrSocks5TTLExpired,
+		ErrConnNotAllowed,
+		ErrRelayConnectFailed,
+	} {
+		if errors.Is(err, one) {
+			return true
+		}
+	}
+	return false
+}
+
 var ErrAddrInvalid = func(addr string, err ...string) error { return fmt.Errorf("addr invalid: %s - %v", addr, err) }
 
 func getSocks4RespErr(cd byte) error {
@@ -34,11 +79,11 @@ func getSocks4RespErr(cd byte) error {
 	case socks4RespCodeGranted:
 		return nil
 	case socks4RespCodeRejectedFailed:
-		return errors.New("request rejected or failed")
+		return ErrSocks4RejectedFailed
 	case socks4RespCodeRejectedClientIdentd:
-		return errors.New("request rejected becasue SOCKS server cannot connect to identd on the client")
+		return ErrSocks4RejectedClientIdentd
 	case socks4RespCodeRejectedDifferentUserId:
-		return errors.New("request rejected because the client program and identd report different user-ids")
+		return ErrSocks4RejectedDifferentUserId
 	default:
 		return ErrSocksMessageParsingFailure
 	}
@@ -48,21 +93,21 @@ func getSocks5RespErr(rep byte) error {
 	case socks5CMDRespSuccess:
 		return nil
 	case socks5CMDRespFailure:
-		return errors.New("general SOCKS server failure")
+		return ErrSocks5GeneralFailure
 	case socks5CMDRespConnNotAllowed:
-		return errors.New("connection not allowed by ruleset")
+		return ErrConnNotAllowed
 	case socks5CMDRespNetworkUnreachable:
-		return errors.New("network unreachable")
+		return ErrSocks5NetworkUnreachable
 	case socks5CMDRespHostUnreachable:
-		return errors.New("host unreachable")
+		return ErrSocks5HostUnreachable
 	case socks5CMDRespConnRefused:
-		return errors.New("connection refused")
+		return ErrSocks5ConnRefused
 	case socks5CMDRespTTLExpired:
-		return errors.New("TTL expired")
+		return ErrSocks5TTLExpired
 	case socks5CMDRespCMDNotSupported:
-		return errors.New("command not supported")
+		return ErrSocks5CMDNotSupported
 	case socks5CMDRespAddNotSupported:
-		return errors.New("address type not supported")
+		return ErrSocks5AddrTypeNotSupported
 	default:
 		return ErrSocksMessageParsingFailure
 	}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -15,6 +16,19 @@ type CMDBINDHandler = func(ctx context.Context, ch chan<- net.Conn, raddr string
 
 type CMDCMDUDPASSOCIATEHandler = func(ctx context.Context, addr net.Addr) (net.PacketConn, error)
 
+type userKey struct{}
+
+type relayKey struct{}
+
+type fakeIPKey struct{}
+
+// ContextUser The user authenticated on the connection a handler serves,
+// the socks5 username or the socks4 user-id, empty without auth.
+func ContextUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
 var DefaultCMDCONNECTHandler CMDCONNECTHandler = func(ctx context.Context, addr string) (net.Conn, error) {
 	dr := net.Dialer{}
 	conn, err := dr.DialContext(ctx, "tcp", addr)
@@ -70,19 +84,30 @@ var DefaultCMDCMDUDPASSOCIATEHandler CMDCMDUDPASSOCIATEHandler = func(ctx contex
 type udpConn struct {
 	net.PacketConn
 	mux     sync.Mutex
-	m       map[net.Addr]net.PacketConn
+	m       map[string]net.PacketConn
 	laddr   net.Addr
 	ctx     context.Context
 	cancel  context.CancelFunc
 	timeout time.Duration
 	cb      UDPDataHandler
+	relay   *relay
+	fakeIP  *fakeIP
+	fakes   map[string]*fakeUdpAddr // fake address -> its domain
+}
+
+// fakeUdpAddr The domain of a fake address and where it resolved to, it is resolved again after expire.
+type fakeUdpAddr struct {
+	domain string
+	raddr  *net.UDPAddr
+	err    error
+	expire time.Time
 }
 
 func newUdpConn(ctx context.Context, pconn net.PacketConn, laddr net.Addr) net.PacketConn {
 	uc := &udpConn{
 		PacketConn: pconn,
 		mux:        sync.Mutex{},
-		m:          make(map[net.Addr]net.PacketConn),
+		m:          make(map[string]net.PacketConn),
 		laddr:      laddr,
 		timeout:    30 * time.Second,
 	}
@@ -93,6 +118,21 @@ func newUdpConn(ctx context.Context, pconn net.PacketConn, laddr net.Addr) net.P
 			uc.timeout = t
 		}
 	}
+	value = ctx.Value(fakeIPKey{})
+	if value != nil {
+		fi, ok := value.(*fakeIP)
+		if ok {
+			uc.fakeIP = fi
+			uc.fakes = make(map[string]*fakeUdpAddr)
+		}
+	}
+	value = ctx.Value(relayKey{})
+	if value != nil {
+		r, ok := value.(*relay)
+		if ok {
+			uc.relay = r
+		}
+	}
 	value = ctx.Value(udpHandlerKey)
 	if value != nil {
 		u, ok := value.(UDPDataHandler)
@@ -124,11 +164,16 @@ func (u *udpConn) ReadFrom(p []byte) (a int, b net.Addr, c error) {
 				continue
 			}
 		}
-
 		uaddr := &udpAddr{
 			laddr: raddr,
 			raddr: xaddr,
 		}
+		if u.fakeIP != nil {
+			err = u.unfake(uaddr, xaddr)
+			if err != nil {
+				continue
+			}
+		}
 
 		return copy(p, data), uaddr, nil
 	}
@@ -139,9 +184,14 @@ func (u *udpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if !ok {
 		return 0, errors.New("invalid net.Addr")
 	}
+	// a fake address has a socket of its own, so the replies go back as from it
+	key := uaddr.laddr.String()
+	if uaddr.fake != nil {
+		key += "|" + uaddr.fake.String()
+	}
 	u.mux.Lock()
 	defer u.mux.Unlock()
-	pconn, ok := u.m[uaddr.laddr]
+	pconn, ok := u.m[key]
 	for {
 		if !ok {
 			listenConfig := net.ListenConfig{}
@@ -149,8 +199,8 @@ func (u *udpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			if err != nil {
 				return 0, err
 			}
-			u.m[uaddr.laddr] = pconn
-			go u.subRead(pconn, uaddr.laddr)
+			u.m[key] = pconn
+			go u.subRead(pconn, key, uaddr.laddr, uaddr.fake)
 		}
 		err = pconn.SetDeadline(time.Now().Add(u.timeout))
 		if err != nil {
@@ -167,6 +217,38 @@ func (u *udpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return pconn.WriteTo(p, uaddr.raddr)
 }
 
+// unfake Send uaddr to the domain of a fake ip instead, it is resolved once per fake address for the udp timeout.
+func (u *udpConn) unfake(uaddr *udpAddr, addr *net.UDPAddr) error {
+	key := addr.String()
+	u.mux.Lock()
+	fa, ok := u.fakes[key]
+	u.mux.Unlock()
+	if !ok || time.Now().After(fa.expire) {
+		name, ok := u.fakeIP.lookup(addr.IP)
+		if !ok && (u.fakeIP.pool == nil || !u.fakeIP.pool(addr.IP)) {
+			return nil
+		}
+		fa = &fakeUdpAddr{
+			domain: net.JoinHostPort(name, strconv.Itoa(addr.Port)),
+			expire: time.Now().Add(u.timeout),
+		}
+		if ok {
+			fa.raddr, fa.err = net.ResolveUDPAddr("udp", fa.domain)
+		} else {
+			// the pool ip lost its domain, the datagram is dropped rather than sent to the fake ip
+			fa.err = ErrFakeIPUnmapped
+		}
+		u.mux.Lock()
+		u.fakes[key] = fa
+		u.mux.Unlock()
+	}
+	if fa.err != nil {
+		return fa.err
+	}
+	uaddr.raddr, uaddr.domain, uaddr.fake = fa.raddr, fa.domain, addr
+	return nil
+}
+
 func (u *udpConn) Close() error {
 	u.cancel()
 	u.mux.Lock()
@@ -177,14 +259,14 @@ func (u *udpConn) Close() error {
 	return u.PacketConn.Close()
 }
 
-func (u *udpConn) subRead(pconn net.PacketConn, laddr net.Addr) {
+func (u *udpConn) subRead(pconn net.PacketConn, key string, laddr net.Addr, fake net.Addr) {
 	defer func() {
 		pconn.Close()
 		u.mux.Lock()
 		defer u.mux.Unlock()
-		xconn, ok := u.m[laddr]
+		xconn, ok := u.m[key]
 		if ok && xconn == pconn {
-			delete(u.m, laddr)
+			delete(u.m, key)
 		}
 	}()
 	buf := make([]byte, defaultUdpBufferSize)
@@ -204,22 +286,35 @@ func (u *udpConn) subRead(pconn net.PacketConn, laddr net.Addr) {
 				continue
 			}
 		}
+		if fake != nil {
+			addr = fake
+		}
 		data = marshalSocks5UDPASSOCIATEData(buf[:n], addr)
 		_, err = u.PacketConn.WriteTo(data, laddr)
 		if err != nil {
 			return
 		}
+		if u.relay != nil {
+			u.relay.write(n)
+		}
 	}
 }
 
+// udpAddr A datagram of laddr to raddr, domain is the host:port a fake ip stands for.
 type udpAddr struct {
 	laddr, raddr net.Addr
+	domain       string
+	fake         net.Addr
 }
 
 func (u *udpAddr) Network() string {
 	return u.raddr.Network()
 }
 
+// String The domain of a fake ip if there is one.
 func (u *udpAddr) String() string {
+	if u.domain != "" {
+		return u.domain
+	}
 	return u.raddr.String()
 }
@@ -3,8 +3,10 @@ package socks
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
 	"io"
 	"net"
 	"sync"
@@ -53,7 +55,7 @@ func RelayCMDCONNECTHandler(cb func(ctx context.Context) (net.Conn, error)) CMDC
 		}
 		if b[0] != 0xff {
 			_ = rwc.Close()
-			return nil, io.ErrClosedPipe
+			return nil, ErrRelayConnectFailed
 		}
 		return rwc, nil
 	}
@@ -136,6 +138,85 @@ func RelayCMDCMDUDPASSOCIATE(cb func(ctx context.Context) (net.Conn, error)) CMD
 	}
 }
 
+// RelayPacketListenerConfig The datagrams over the relay streams of cb (UDP over TCP), e.g. the streams of an xrpc session served by RelayServe.
+func RelayPacketListenerConfig(cb func(ctx context.Context) (net.Conn, error)) xnetutil.PacketListenerConfig {
+	return &relayPacketListenerConfig{cb: cb}
+}
+
+type relayPacketListenerConfig struct {
+	cb func(ctx context.Context) (net.Conn, error)
+}
+
+func (rplc *relayPacketListenerConfig) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return rplc.ListenPacketContext(context.Background(), network, address)
+}
+
+func (rplc *relayPacketListenerConfig) ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, ErrNetworkNotSupport
+	}
+	rwc, err := rplc.cb(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rwc.Write([]byte{relayCMDUDPASSOCIATE})
+	if err != nil {
+		_ = rwc.Close()
+		return nil, err
+	}
+	b := make([]byte, 1)
+	_, err = io.ReadFull(rwc, b)
+	if err != nil {
+		_ = rwc.Close()
+		return nil, err
+	}
+	if b[0] != 0xff {
+		_ = rwc.Close()
+		return nil, io.ErrClosedPipe
+	}
+	return &relayPacketConn{Conn: rwc, laddr: rwc.LocalAddr().String()}, nil
+}
+
+// relayPacketConn The client side of RelayPacketListenerConfig.
+type relayPacketConn struct {
+	net.Conn
+	laddr string
+}
+
+func (rpc *relayPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	bs := new(bytes.Buffer)
+	bs.Write(makeStrBytes(rpc.laddr))
+	bs.Write(makeStrBytes(addr.String()))
+	bs.Write(makeData(p))
+	_, err = rpc.Conn.Write(bs.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (rpc *relayPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	_, err = readStr(rpc.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	raddr, err := readStr(rpc.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	b, err := readData(rpc.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	xaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, b), xaddr, nil
+}
+
 func newRelayUdpConn(pconn net.PacketConn, rwc io.ReadWriteCloser, laddr net.Addr) *relayUdpConn {
 	ruc := &relayUdpConn{
 		PacketConn: pconn,
@@ -192,8 +273,12 @@ func (ruc *relayUdpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	bs := new(bytes.Buffer)
 	bs.Write(makeStrBytes(uaddr.laddr.String()))
 	bs.Write(makeStrBytes(uaddr.raddr.String()))
-	bs.Write(p)
-	return ruc.rwc.Write(bs.Bytes())
+	bs.Write(makeData(p))
+	_, err = ruc.rwc.Write(bs.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func (ruc *relayUdpConn) Close() error {
@@ -212,7 +297,7 @@ func (ruc *relayUdpConn) async() {
 		if err != nil {
 			return
 		}
-		b, err := readBytes(ruc.rwc)
+		b, err := readData(ruc.rwc)
 		if err != nil {
 			return
 		}
@@ -248,6 +333,8 @@ func relayServeCMDCONNECT(rwc io.ReadWriteCloser) error {
 	conn, err := dr.DialContext(ctx, "tcp", addr)
 	cl()
 	if err != nil {
+		// the client tells a failed connect from a broken relay
+		_, _ = rwc.Write([]byte{0x00})
 		return err
 	}
 	defer conn.Close()
@@ -336,7 +423,7 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 		if err != nil {
 			return err
 		}
-		data, err := readBytes(rwc)
+		data, err := readData(rwc)
 		if err != nil {
 			return err
 		}
@@ -354,7 +441,7 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 					break
 				}
 				m[laddr] = packetConn
-				go func() {
+				go func(packetConn net.PacketConn) {
 					defer func() {
 						_ = packetConn.Close()
 						mux.Lock()
@@ -377,13 +464,13 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 						bs := new(bytes.Buffer)
 						bs.Write(makeStrBytes(laddr))
 						bs.Write(makeStrBytes(addr.String()))
-						bs.Write(makeBytes(buf[:n]))
+						bs.Write(makeData(buf[:n]))
 						_, err = rwc.Write(bs.Bytes())
 						if err != nil {
 							return
 						}
 					}
-				}()
+				}(packetConn)
 			}
 			err = packetConn.SetDeadline(time.Now().Add(uTimeout))
 			if err != nil {
@@ -394,6 +481,7 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 				}
 				break
 			}
+			break
 		}
 		mux.Unlock()
 		if err != nil {
@@ -411,6 +499,11 @@ func makeBytes(b []byte) []byte {
 	return append([]byte{byte(len(b))}, b...)
 }
 
+// makeData A datagram of the relay prefixed by its 2-byte length.
+func makeData(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
 func readStr(r io.Reader) (string, error) {
 	b := make([]byte, 1)
 	_, err := io.ReadFull(r, b)
@@ -438,3 +531,17 @@ func readBytes(r io.Reader) ([]byte, error) {
 	}
 	return b, nil
 }
+
+func readData(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	b = make([]byte, binary.BigEndian.Uint16(b))
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
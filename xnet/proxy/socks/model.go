@@ -70,6 +70,13 @@ type ServerConfig struct {
 	DialTimeout  time.Duration //This is the time to dial
 	BindTimeout  time.Duration //default 5s
 	UdpTimeout   time.Duration //default 30s
+	// UserLimitCb The caps of the user authenticated on a connection, asked for every relay, nil means no caps.
+	UserLimitCb func(user string) *UserLimit
+	// FakeIPCb Maps a fake ip of CONNECT and UDP ASSOCIATE destinations back to its domain, e.g. dnsproxy.FakeIP.Lookup.
+	FakeIPCb func(ip net.IP) (string, bool)
+	// FakeIPPoolCb Whether ip is in the fake pool, e.g. dnsproxy.FakeIP.Contains;
+	// a pool ip FakeIPCb no longer maps (its domain was evicted) is refused instead of dialed as it is.
+	FakeIPPoolCb func(ip net.IP) bool
 }
 
 type CMDConfig struct {
@@ -80,6 +87,9 @@ type CMDConfig struct {
 	SwitchCMDUDPASSOCIATE     bool
 	CMDCMDUDPASSOCIATEHandler CMDCMDUDPASSOCIATEHandler
 	UDPDataHandler            UDPDataHandler
+	// SwitchCMDUDPASSOCIATEStream Opt-in UDP over TCP (see SOCKS5UDPASSOCIATEStream) by the UDP ASSOCIATE handler,
+	// for clients without a udp path to the server.
+	SwitchCMDUDPASSOCIATEStream bool
 }
 
 type VersionSwitch struct {
@@ -138,8 +148,12 @@ type S5AuthCb struct {
 	Socks5AuthIANA             [125]func(conn net.Conn) net.Conn
 	Socks5AuthPRIVATEPriority  [127]int8
 	Socks5AuthPRIVATE          [127]func(conn net.Conn) net.Conn
+	// Socks5AuthMethodsPriority is index-aligned with Socks5AuthMethods, a method replaces the callback of its code.
+	Socks5AuthMethodsPriority []int8
+	Socks5AuthMethods         []S5AuthMethod
 
 	socks5AuthPriority []byte
+	socks5AuthMethods  map[byte]S5AuthMethod
 }
 
 type S5AuthPassword struct {
@@ -16,6 +16,8 @@ type Server struct {
 
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	usage usage
 }
 
 func NewServer(cfg *ServerConfig) (*Server, error) {
@@ -43,6 +45,10 @@ func NewServerContext(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 	}
 	s := &Server{
 		cfg: cfg,
+		usage: usage{
+			users:  make(map[string]*userUsage),
+			relays: make(map[uint64]*relay),
+		},
 	}
 	err := s.handleSock5AuthPriority()
 	if err != nil {
@@ -92,6 +98,7 @@ func (s *Server) handleConn(conn net.Conn) {
 		Conn: conn,
 	}
 	defer sc.Close()
+	defer s.release(sc)
 	ctx, cl := context.WithCancel(s.ctx)
 	defer cl()
 	ctxtool.GWaitFunc(ctx, func() {
@@ -130,41 +137,109 @@ func (s *Server) handleSock5AuthPriority() error {
 		code     byte
 	}
 	var sl []*unit
-	if s.cfg.Socks5AuthCb.Socks5AuthNOAUTH != nil {
-		sl = append(sl, &unit{priority: s.cfg.Socks5AuthCb.Socks5AuthNOAUTHPriority, code: socks5METHODCodeNOAUTH})
-	}
-	if s.cfg.Socks5AuthCb.Socks5AuthGSSAPI != nil {
-		sl = append(sl, &unit{priority: s.cfg.Socks5AuthCb.Socks5AuthGSSAPIPriority, code: socks5METHODCodeGSSAPI})
+	methods := make(map[byte]S5AuthMethod)
+	for i, one := range s.cfg.Socks5AuthCb.Socks5AuthMethods {
+		if one == nil {
+			continue
+		}
+		if one.Code() == socks5RETHODCodeRejected {
+			return ErrSocks5AuthMethodCode(one.Code())
+		}
+		var priority int8
+		if i < len(s.cfg.Socks5AuthCb.Socks5AuthMethodsPriority) {
+			priority = s.cfg.Socks5AuthCb.Socks5AuthMethodsPriority[i]
+		}
+		methods[one.Code()] = one
+		sl = append(sl, &unit{priority: priority, code: one.Code()})
 	}
-	if s.cfg.Socks5AuthCb.Socks5AuthPASSWORD != nil {
-		sl = append(sl, &unit{priority: s.cfg.Socks5AuthCb.Socks5AuthPASSWORDPriority, code: socks5METHODCodePASSWORD})
+	legacy := func(cb bool, priority int8, code byte) {
+		if _, ok := methods[code]; cb && !ok {
+			sl = append(sl, &unit{priority: priority, code: code})
+		}
 	}
+	legacy(s.cfg.Socks5AuthCb.Socks5AuthNOAUTH != nil, s.cfg.Socks5AuthCb.Socks5AuthNOAUTHPriority, socks5METHODCodeNOAUTH)
+	legacy(s.cfg.Socks5AuthCb.Socks5AuthGSSAPI != nil, s.cfg.Socks5AuthCb.Socks5AuthGSSAPIPriority, socks5METHODCodeGSSAPI)
+	legacy(s.cfg.Socks5AuthCb.Socks5AuthPASSWORD != nil, s.cfg.Socks5AuthCb.Socks5AuthPASSWORDPriority, socks5METHODCodePASSWORD)
 	for i, one := range s.cfg.Socks5AuthCb.Socks5AuthIANA {
-		if one != nil {
-			sl = append(sl, &unit{priority: s.cfg.Socks5AuthCb.Socks5AuthIANAPriority[i], code: byte(socks5METHODCodeIANA + i)})
-		}
+		legacy(one != nil, s.cfg.Socks5AuthCb.Socks5AuthIANAPriority[i], byte(socks5METHODCodeIANA+i))
 	}
 	for i, one := range s.cfg.Socks5AuthCb.Socks5AuthPRIVATE {
-		if one != nil {
-			sl = append(sl, &unit{priority: s.cfg.Socks5AuthCb.Socks5AuthPRIVATEPriority[i], code: byte(socks5METHODCodePRIVATE + i)})
-		}
+		legacy(one != nil, s.cfg.Socks5AuthCb.Socks5AuthPRIVATEPriority[i], byte(socks5METHODCodePRIVATE+i))
 	}
 	if len(sl) == 0 {
 		return ErrSocks5NeedMETHODSAuth
 	}
 	sort.Slice(sl, func(i, j int) bool {
-		return sl[i].priority < sl[j].priority
+		if sl[i].priority != sl[j].priority {
+			return sl[i].priority < sl[j].priority
+		}
+		return sl[i].code < sl[j].code
 	})
+	s.cfg.Socks5AuthCb.socks5AuthMethods = methods
+	s.cfg.Socks5AuthCb.socks5AuthPriority = nil
 	for _, one := range sl {
 		s.cfg.Socks5AuthCb.socks5AuthPriority = append(s.cfg.Socks5AuthCb.socks5AuthPriority, one.code)
 	}
 	return nil
 }
 
+// handlerCtx The context of the handlers of conn.
+func (s *Server) handlerCtx(conn *serverConn) context.Context {
+	ctx := context.WithValue(s.ctx, userKey{}, conn.user)
+	if conn.relay != nil {
+		ctx = context.WithValue(ctx, relayKey{}, conn.relay)
+	}
+	return ctx
+}
+
+// fakeIP The fake ip callbacks of ServerConfig.
+type fakeIP struct {
+	lookup func(ip net.IP) (string, bool)
+	pool   func(ip net.IP) bool
+}
+
+// fakeIP nil without FakeIPCb.
+func (s *Server) fakeIP() *fakeIP {
+	if s.cfg.FakeIPCb == nil {
+		return nil
+	}
+	return &fakeIP{lookup: s.cfg.FakeIPCb, pool: s.cfg.FakeIPPoolCb}
+}
+
+// fakeIPAddr addr with the domain of its fake ip.
+func (s *Server) fakeIPAddr(addr string) (string, error) {
+	fi := s.fakeIP()
+	if fi == nil {
+		return addr, nil
+	}
+	return fi.addr(addr)
+}
+
+// addr addr with the domain of its fake ip, ErrFakeIPUnmapped for a pool ip without one.
+func (fi *fakeIP) addr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr, nil
+	}
+	if name, ok := fi.lookup(ip); ok {
+		return net.JoinHostPort(name, port), nil
+	}
+	if fi.pool != nil && fi.pool(ip) {
+		return "", ErrFakeIPUnmapped
+	}
+	return addr, nil
+}
+
 type serverConn struct {
 	net.Conn
 	copyConn net.Conn
 	udpConn  net.PacketConn
+	user     string
+	relay    *relay
 }
 
 func (c *serverConn) Close() error {
@@ -178,29 +253,39 @@ func (c *serverConn) Close() error {
 }
 
 func (c *serverConn) ioCopy() {
+	var client net.Conn = c.Conn
+	if c.relay != nil {
+		client = &relayConn{Conn: c.Conn, relay: c.relay}
+	}
 	copyBuffer := io.Discard
 	if c.udpConn != nil {
 		defer c.udpConn.Close()
-		go func() {
-			buf := make([]byte, 32*1024)
-			for {
-				n, addr, err := c.udpConn.ReadFrom(buf)
-				if err != nil {
-					return
-				}
-				_, err = c.udpConn.WriteTo(buf[:n], addr)
-				if err != nil {
-					return
-				}
-			}
-		}()
+		go c.udpCopy()
 	}
 	if c.copyConn != nil {
 		defer c.copyConn.Close()
-		go io.Copy(c.Conn, c.copyConn)
+		go io.Copy(client, c.copyConn)
 		copyBuffer = c.copyConn
 	}
-	_, _ = io.Copy(copyBuffer, c.Conn)
+	_, _ = io.Copy(copyBuffer, client)
+}
+
+// udpCopy Relay the datagrams of udpConn until it is closed.
+func (c *serverConn) udpCopy() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, addr, err := c.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if c.relay != nil {
+			c.relay.read(n)
+		}
+		_, err = c.udpConn.WriteTo(buf[:n], addr)
+		if err != nil {
+			return
+		}
+	}
 }
 
 func (c *serverConn) writeSocks4Resp(code byte, addr net.Addr) error {
@@ -36,6 +36,7 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 		nconn, code := s.cfg.Socks4AuthCb.Socks4UserIdAuth(conn.Conn, userId)
 		if code == socks4RespCodeGranted {
 			conn.Conn = nconn
+			conn.user = string(userId)
 		} else if code == socks4RespCodeRejectedClientIdentd || code == socks4RespCodeRejectedDifferentUserId {
 			otherCode = byte(code)
 			return ErrSocks4UserIdInvalid
@@ -86,10 +87,18 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 }
 
 func (s *Server) handleSocks4CDCONNECT(conn *serverConn, addr string) error {
+	addr, err := s.fakeIPAddr(addr)
+	if err != nil {
+		return err
+	}
+	err = s.acquire(conn, RelayCONNECT, addr)
+	if err != nil {
+		return err
+	}
 	var handler CMDCONNECTHandler
-	ctx := s.ctx
+	ctx := s.handlerCtx(conn)
 	if s.cfg.DialTimeout != 0 {
-		tmpctx, cancel := context.WithTimeout(s.ctx, s.cfg.DialTimeout)
+		tmpctx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
 		defer cancel()
 		ctx = tmpctx
 	}
@@ -107,6 +116,10 @@ func (s *Server) handleSocks4CDCONNECT(conn *serverConn, addr string) error {
 }
 
 func (s *Server) handleSocks4CDBIND(conn *serverConn, addr string) error {
+	err := s.acquire(conn, RelayBIND, addr)
+	if err != nil {
+		return err
+	}
 	var handler CMDBINDHandler
 	if s.cfg.CMDConfig.CMDBINDHandler != nil {
 		handler = s.cfg.CMDConfig.CMDBINDHandler
@@ -114,7 +127,7 @@ func (s *Server) handleSocks4CDBIND(conn *serverConn, addr string) error {
 		handler = DefaultCMDBINDHandler
 	}
 	ch := make(chan net.Conn)
-	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.BindTimeout)
+	ctx, cancel := context.WithTimeout(s.handlerCtx(conn), s.cfg.BindTimeout)
 	defer cancel()
 	laddr, err := handler(ctx, ch, addr)
 	if err != nil {
@@ -2,6 +2,7 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -31,40 +32,32 @@ func (s *Server) handleSocks5Auth(conn *serverConn, methods []byte) (err error)
 	for _, one := range methods {
 		m[one] = true
 	}
-	var method byte = socks5RETHODCodeRejected
 	var methodCode byte = socks5RETHODCodeRejected
 	for _, one := range s.cfg.Socks5AuthCb.socks5AuthPriority {
-		if method != 0xFF {
+		if m[one] {
+			methodCode = one
 			break
 		}
-		switch one {
-		case socks5METHODCodeNOAUTH, socks5METHODCodeGSSAPI, socks5METHODCodePASSWORD:
-			if m[one] {
-				method = one
-				methodCode = one
-			}
-		case socks5METHODCodeIANA:
-			for i := one; i < socks5METHODCodePRIVATE; i++ {
-				if m[i] {
-					method = one
-					methodCode = i
-					break
-				}
-			}
-		case socks5METHODCodePRIVATE:
-			for i := one; i < socks5RETHODCodeRejected; i++ {
-				if m[i] {
-					method = one
-					methodCode = i
-					break
-				}
-			}
-		}
 	}
 	err = conn.writeSocks5AuthResp(methodCode)
 	if err != nil {
 		return err
 	}
+	if method, ok := s.cfg.Socks5AuthCb.socks5AuthMethods[methodCode]; ok {
+		nconn, user, err := method.AuthServer(conn.Conn)
+		if err != nil {
+			return err
+		}
+		conn.Conn = nconn
+		conn.user = user
+		return nil
+	}
+	method := methodCode
+	if methodCode >= socks5METHODCodeIANA && methodCode < socks5METHODCodePRIVATE {
+		method = socks5METHODCodeIANA
+	} else if methodCode >= socks5METHODCodePRIVATE && methodCode < socks5RETHODCodeRejected {
+		method = socks5METHODCodePRIVATE
+	}
 	switch method {
 	case socks5METHODCodeNOAUTH:
 		if nconn := s.cfg.Socks5AuthCb.Socks5AuthNOAUTH(conn.Conn); nconn != nil {
@@ -113,6 +106,7 @@ func (s *Server) handleSocks5Auth(conn *serverConn, methods []byte) (err error)
 				return err
 			}
 			conn.Conn = nconn
+			conn.user = user
 			return nil
 		} else {
 			_ = conn.writeSocks5AuthPasswordResp(false)
@@ -174,6 +168,12 @@ func (s *Server) handleSocks5CMD(conn *serverConn) (err error) {
 			return ErrSocks5CMDNotSupport
 		}
 		return s.handleSocks5CMDUDPASSOCIATE(conn, addr)
+	case socks5CMDUDPASSOCIATEStream:
+		if !s.cfg.CMDConfig.SwitchCMDUDPASSOCIATE || !s.cfg.CMDConfig.SwitchCMDUDPASSOCIATEStream {
+			_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
+			return ErrSocks5CMDNotSupport
+		}
+		return s.handleSocks5CMDUDPASSOCIATEStream(conn, addr)
 	default:
 		_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
 		return ErrSocksMessageParsingFailure
@@ -181,10 +181,20 @@ func (s *Server) handleSocks5CMD(conn *serverConn) (err error) {
 }
 
 func (s *Server) handleSocks5CMDCONNECT(conn *serverConn, addr string) error {
+	addr, err := s.fakeIPAddr(addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespHostUnreachable, conn.LocalAddr())
+		return err
+	}
+	err = s.acquire(conn, RelayCONNECT, addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespConnNotAllowed, conn.LocalAddr())
+		return err
+	}
 	var handler CMDCONNECTHandler
-	ctx := s.ctx
+	ctx := s.handlerCtx(conn)
 	if s.cfg.DialTimeout != 0 {
-		tmpctx, cancel := context.WithTimeout(s.ctx, s.cfg.DialTimeout)
+		tmpctx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
 		defer cancel()
 		ctx = tmpctx
 	}
@@ -195,7 +205,11 @@ func (s *Server) handleSocks5CMDCONNECT(conn *serverConn, addr string) error {
 	}
 	cc, err := handler(ctx, addr)
 	if err != nil {
-		_ = conn.writeSocks5CMDResp(socks5CMDRespNetworkUnreachable, conn.LocalAddr())
+		if errors.Is(err, ErrConnNotAllowed) {
+			_ = conn.writeSocks5CMDResp(socks5CMDRespConnNotAllowed, conn.LocalAddr())
+		} else {
+			_ = conn.writeSocks5CMDResp(socks5CMDRespNetworkUnreachable, conn.LocalAddr())
+		}
 		return err
 	}
 	conn.copyConn = cc
@@ -203,6 +217,11 @@ func (s *Server) handleSocks5CMDCONNECT(conn *serverConn, addr string) error {
 }
 
 func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
+	err := s.acquire(conn, RelayBIND, addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespConnNotAllowed, conn.LocalAddr())
+		return err
+	}
 	var handler CMDBINDHandler
 	if s.cfg.CMDConfig.CMDBINDHandler != nil {
 		handler = s.cfg.CMDConfig.CMDBINDHandler
@@ -210,7 +229,7 @@ func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
 		handler = DefaultCMDBINDHandler
 	}
 	ch := make(chan net.Conn)
-	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.BindTimeout)
+	ctx, cancel := context.WithTimeout(s.handlerCtx(conn), s.cfg.BindTimeout)
 	defer cancel()
 	laddr, err := handler(ctx, ch, addr)
 	if err != nil {
@@ -237,6 +256,11 @@ func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
 }
 
 func (s *Server) handleSocks5CMDUDPASSOCIATE(conn *serverConn, addr string) error {
+	err := s.acquire(conn, RelayUDPASSOCIATE, addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespConnNotAllowed, conn.LocalAddr())
+		return err
+	}
 	var checkAddr net.Addr
 	rhost, rport, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -259,14 +283,17 @@ func (s *Server) handleSocks5CMDUDPASSOCIATE(conn *serverConn, addr string) erro
 	}
 
 	var handler CMDCMDUDPASSOCIATEHandler
-	if s.cfg.CMDConfig.CMDBINDHandler != nil {
+	if s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler != nil {
 		handler = s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler
 	} else {
 		handler = DefaultCMDCMDUDPASSOCIATEHandler
 	}
-	ctx := s.ctx
+	ctx := s.handlerCtx(conn)
 	if s.cfg.UdpTimeout != 0 {
-		ctx = context.WithValue(s.ctx, udpTimeoutKey, s.cfg.UdpTimeout)
+		ctx = context.WithValue(ctx, udpTimeoutKey, s.cfg.UdpTimeout)
+	}
+	if fi := s.fakeIP(); fi != nil {
+		ctx = context.WithValue(ctx, fakeIPKey{}, fi)
 	}
 	pconn, err := handler(ctx, checkAddr)
 	if err != nil {
@@ -1,7 +1,9 @@
 package socks
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/xnet/fasttool"
@@ -12,6 +14,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -793,3 +796,590 @@ func TestSOCKS4BINDRelay(t *testing.T) {
 		testConn(t, conn, uuid.NewIdn(4096))
 	}
 }
+
+type testGSSAPIContext struct {
+	server bool
+	step   int
+}
+
+func (c *testGSSAPIContext) Step(token []byte) ([]byte, bool, error) {
+	c.step++
+	switch {
+	case !c.server && c.step == 1 && token == nil:
+		return []byte("init"), false, nil
+	case !c.server && c.step == 2 && string(token) == "accept":
+		return nil, true, nil
+	case c.server && c.step == 1 && string(token) == "init":
+		return []byte("accept"), true, nil
+	default:
+		return nil, false, errors.New("unexpected token")
+	}
+}
+
+// Wrap A confidential message is masked, an integrity one is sent as it is.
+func (c *testGSSAPIContext) Wrap(b []byte, conf bool) ([]byte, error) {
+	if !conf {
+		return append([]byte{0x00}, b...), nil
+	}
+	out := []byte{0x5a}
+	for _, one := range b {
+		out = append(out, one^0x5a)
+	}
+	return out, nil
+}
+
+func (c *testGSSAPIContext) Unwrap(b []byte) ([]byte, bool, error) {
+	if len(b) == 0 || (b[0] != 0x5a && b[0] != 0x00) {
+		return nil, false, errors.New("invalid token")
+	}
+	if b[0] == 0x00 {
+		return b[1:], false, nil
+	}
+	out := make([]byte, 0, len(b)-1)
+	for _, one := range b[1:] {
+		out = append(out, one^0x5a)
+	}
+	return out, true, nil
+}
+
+func (c *testGSSAPIContext) Name() string {
+	if c.server {
+		return "bob@REALM"
+	}
+	return ""
+}
+
+func TestSOCKS5AuthMethods(t *testing.T) {
+	gssapi := &S5GSSAPIAuth{NewContext: func(server bool) (S5GSSAPIContext, error) {
+		return &testGSSAPIContext{server: server}, nil
+	}}
+	users := make(chan string, 10)
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				users <- ContextUser(ctx)
+				return DefaultCMDCONNECTHandler(ctx, addr)
+			},
+		},
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthMethods: []S5AuthMethod{
+				gssapi,
+				&S5HMACAuth{Keys: func(user string) ([]byte, bool) {
+					return []byte("secret-" + user), user == "alice"
+				}},
+			},
+		},
+	}
+	cfg.Socks5AuthCb.Socks5AuthPRIVATE[1] = DefaultAuthConnCb
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+	ln := testListen(t)
+	defer ln.Close()
+
+	private := &S5Auth{}
+	private.Socks5AuthPRIVATE[1] = DefaultAuthConnCb
+	cases := []struct {
+		auth *S5Auth
+		user string
+		ok   bool
+	}{
+		{&S5Auth{Socks5AuthMethods: []S5AuthMethod{&S5HMACAuth{User: "alice", Key: []byte("secret-alice")}}}, "alice", true},
+		{&S5Auth{Socks5AuthMethods: []S5AuthMethod{&S5HMACAuth{User: "alice", Key: []byte("wrong")}}}, "", false},
+		{&S5Auth{Socks5AuthMethods: []S5AuthMethod{&S5HMACAuth{User: "eve", Key: []byte("secret-eve")}}}, "", false},
+		{&S5Auth{Socks5AuthMethods: []S5AuthMethod{gssapi}}, "bob@REALM", true},
+		{private, "", true},
+	}
+	for i, one := range cases {
+		dr, err := SOCKS5CONNECT("tcp", listen.Addr().String(), one.auth, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial("tcp", ln.Addr().String())
+		if !one.ok {
+			if err == nil {
+				t.Fatal(i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		// bigger than one encapsulated message
+		testConn(t, conn, uuid.NewIdn(40*1024))
+		_ = conn.Close()
+		if user := <-users; user != one.user {
+			t.Fatal(i, user)
+		}
+	}
+}
+
+func TestSOCKS5GSSAPIProtection(t *testing.T) {
+	auth := func(level byte) *S5GSSAPIAuth {
+		return &S5GSSAPIAuth{Protection: level, NewContext: func(server bool) (S5GSSAPIContext, error) {
+			return &testGSSAPIContext{server: server}, nil
+		}}
+	}
+	cases := []struct {
+		client, server, level byte
+	}{
+		{0, 0, 2},
+		{1, 2, 1},
+		{2, 1, 1},
+		{3, 3, 3},
+	}
+	for i, one := range cases {
+		c1, c2 := net.Pipe()
+		errs := make(chan error, 1)
+		var sconn net.Conn
+		go func() {
+			var err error
+			sconn, _, err = auth(one.server).AuthServer(c2)
+			errs <- err
+		}()
+		cconn, err := auth(one.client).AuthClient(c1)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if err = <-errs; err != nil {
+			t.Fatal(i, err)
+		}
+		if cconn.(*gssapiConn).level != one.level || sconn.(*gssapiConn).level != one.level {
+			t.Fatal(i, cconn.(*gssapiConn).level, sconn.(*gssapiConn).level)
+		}
+		// the plain text is on the wire only under integrity protection
+		go func() {
+			_, _ = cconn.Write([]byte("hello"))
+		}()
+		mtyp, token, err := readGSSAPIMsgAny(c2)
+		if err != nil || mtyp != s5GSSAPIMTYPEncap {
+			t.Fatal(i, mtyp, err)
+		}
+		if bytes.Contains(token, []byte("hello")) != (one.level == 1) {
+			t.Fatal(i, token)
+		}
+		_ = c1.Close()
+		_ = c2.Close()
+	}
+
+	// a confidentiality connection rejects a message with integrity only
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := newGSSAPIConn(c1, &testGSSAPIContext{}, s5GSSAPIProtectConfidentiality)
+	go func() {
+		_ = writeGSSAPIMsg(c2, s5GSSAPIMTYPEncap, []byte("\x00hello"))
+	}()
+	_, err := conn.Read(make([]byte, 5))
+	if !errors.Is(err, ErrSocks5GSSAPIMessage) {
+		t.Fatal(err)
+	}
+}
+
+func TestUserUsage(t *testing.T) {
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return conn
+			},
+		},
+		UserLimitCb: func(user string) *UserLimit {
+			switch user {
+			case "alice":
+				return &UserLimit{MaxConns: 1}
+			case "bob":
+				return &UserLimit{Bandwidth: 64 * 1024}
+			default:
+				return nil
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+	ln := testListen(t)
+	defer ln.Close()
+
+	alice, err := SOCKS5CONNECTP("tcp", listen.Addr().String(), &S5AuthPassword{User: "alice", Password: "x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := alice.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, "hello")
+	// the second relay of alice is over the cap
+	_, err = alice.Dial("tcp", ln.Addr().String())
+	if err == nil {
+		t.Fatal()
+	}
+	relays := server.Relays()
+	if len(relays) != 1 || relays[0].User != "alice" || relays[0].Cmd != RelayCONNECT ||
+		relays[0].Destination != ln.Addr().String() || relays[0].Source != conn.LocalAddr().String() || relays[0].Read != 5 {
+		t.Fatal(relays)
+	}
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	stats, ok := server.User("alice")
+	if !ok || stats.Conns != 0 || stats.Read != 5 || stats.Write != 5 || len(server.Relays()) != 0 {
+		t.Fatal(stats, server.Relays())
+	}
+
+	// bob may send 64KB per second after a burst of 64KB
+	bob, err := SOCKS5CONNECTP("tcp", listen.Addr().String(), &S5AuthPassword{User: "bob", Password: "x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = bob.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	testConn(t, conn, uuid.NewIdn(128*1024))
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Fatal(d)
+	}
+	_ = conn.Close()
+	users := server.Users()
+	if len(users) != 2 || users[1].User != "bob" || users[1].Read != 128*1024 {
+		t.Fatal(users)
+	}
+}
+
+func TestFakeIPCb(t *testing.T) {
+	addrs := make(chan string, 2)
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				addrs <- addr
+				return DefaultCMDCONNECTHandler(ctx, addr)
+			},
+		},
+		Socks5AuthCb: S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		FakeIPCb: func(ip net.IP) (string, bool) {
+			return "localhost", ip.Equal(net.IPv4(198, 18, 0, 1))
+		},
+		FakeIPPoolCb: func(ip net.IP) bool {
+			return ip.Mask(net.CIDRMask(15, 32)).Equal(net.IPv4(198, 18, 0, 0))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+	ln := testListen(t)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	s5, _ := SOCKS5CONNECTP("tcp", listen.Addr().String(), nil, nil)
+	s4, _ := SOCKS4CONNECT("tcp", listen.Addr().String(), nil, nil)
+	for _, dr := range []interface {
+		Dial(network string, addr string) (net.Conn, error)
+	}{s5, s4} {
+		conn, err := dr.Dial("tcp", "198.18.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConn(t, conn, "hello")
+		_ = conn.Close()
+		if addr := <-addrs; addr != "localhost:"+port {
+			t.Fatal(addr)
+		}
+		// a pool ip without a domain is refused, not dialed as it is
+		_, err = dr.Dial("tcp", "198.18.0.2:"+port)
+		if err == nil {
+			t.Fatal()
+		}
+		select {
+		case addr := <-addrs:
+			t.Fatal(addr)
+		default:
+		}
+	}
+}
+
+// testAddrUDPConn The destinations the association writes to, as the handler sees them.
+type testAddrUDPConn struct {
+	net.PacketConn
+	addrs chan string
+}
+
+func (a *testAddrUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case a.addrs <- addr.String():
+	default:
+	}
+	return a.PacketConn.WriteTo(p, addr)
+}
+
+func TestFakeIPCbUDPASSOCIATE(t *testing.T) {
+	echo := testLPConn(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	var lookups atomic.Int32
+	addrs := make(chan string, 16)
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDUDPASSOCIATE: true,
+			CMDCMDUDPASSOCIATEHandler: func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
+				pconn, err := DefaultCMDCMDUDPASSOCIATEHandler(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &testAddrUDPConn{PacketConn: pconn, addrs: addrs}, nil
+			},
+		},
+		Socks5AuthCb: S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		// two fake ips of two domains that resolve to the same address
+		FakeIPCb: func(ip net.IP) (string, bool) {
+			lookups.Add(1)
+			switch {
+			case ip.Equal(net.IPv4(198, 18, 0, 1)):
+				return "127.0.0.1", true
+			case ip.Equal(net.IPv4(198, 18, 0, 2)):
+				return "localhost", true
+			default:
+				return "", false
+			}
+		},
+		FakeIPPoolCb: func(ip net.IP) bool {
+			return ip.Mask(net.CIDRMask(15, 32)).Equal(net.IPv4(198, 18, 0, 0))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+
+	ucfg, err := SOCKS5UDPASSOCIATEP("tcp", listen.Addr().String(), nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pconn, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	fake1, _ := net.ResolveUDPAddr("udp", "198.18.0.1:"+port)
+	fake2, _ := net.ResolveUDPAddr("udp", "198.18.0.2:"+port)
+	for i := 0; i < 3; i++ {
+		// the replies go back as from the fake ip each datagram was sent to
+		testPConn(t, pconn, fake1, "hello fake udp 1")
+		if addr := <-addrs; addr != "127.0.0.1:"+port {
+			t.Fatal(addr)
+		}
+		testPConn(t, pconn, fake2, "hello fake udp 2")
+		if addr := <-addrs; addr != "localhost:"+port {
+			t.Fatal(addr)
+		}
+	}
+	// a fake address is looked up once
+	if n := lookups.Load(); n != 2 {
+		t.Fatal(n)
+	}
+	// a pool ip without a domain is dropped, not sent to as it is
+	fake3, _ := net.ResolveUDPAddr("udp", "198.18.0.3:"+port)
+	_, err = pconn.WriteTo([]byte("hello unmapped"), fake3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case addr := <-addrs:
+		t.Fatal(addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := lookups.Load(); n != 3 {
+		t.Fatal(n)
+	}
+}
+
+// testEchoUDPConn Every destination of the association echoes.
+type testEchoUDPConn struct {
+	net.PacketConn
+}
+
+func (e *testEchoUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	uaddr := addr.(*udpAddr)
+	return e.PacketConn.(*udpConn).PacketConn.WriteTo(marshalSocks5UDPASSOCIATEData(p, uaddr.raddr), uaddr.laddr)
+}
+
+func TestTransparent(t *testing.T) {
+	ln, err := ListenTransparent("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("transparent listener:", err)
+	}
+	defer ln.Close()
+	pln, err := ListenTransparentPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("transparent listener:", err)
+	}
+	defer pln.Close()
+	echo := testListen(t)
+	defer echo.Close()
+
+	addrs := make(chan string, 1)
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				addrs <- addr
+				return DefaultCMDCONNECTHandler(ctx, echo.Addr().String())
+			},
+			SwitchCMDUDPASSOCIATE: true,
+			CMDCMDUDPASSOCIATEHandler: func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
+				pconn, err := DefaultCMDCMDUDPASSOCIATEHandler(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &testEchoUDPConn{PacketConn: pconn}, nil
+			},
+		},
+		Socks5AuthCb: S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.ServeTransparent(ln)
+	go server.ServeTransparentPacket(pln)
+
+	// without iptables the original destination of a TPROXY listener is itself
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, "hello transparent")
+	if addr := <-addrs; addr != ln.Addr().String() {
+		t.Fatal(addr)
+	}
+
+	uconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	_, err = uconn.WriteTo([]byte("hello transparent udp"), pln.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = uconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, from, err := uconn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello transparent udp" || from.String() != pln.LocalAddr().String() {
+		t.Fatal(string(buf[:n]), from)
+	}
+	var udp bool
+	for _, one := range server.Relays() {
+		if one.Cmd == RelayUDPASSOCIATE && one.Source == uconn.LocalAddr().String() {
+			udp = true
+		}
+	}
+	if !udp {
+		t.Fatal(server.Relays())
+	}
+}
+
+func TestSOCKS5UDPASSOCIATEStream(t *testing.T) {
+	echo := testLPConn(t)
+	defer echo.Close()
+	eaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: echo.LocalAddr().(*net.UDPAddr).Port}
+	relay := testRelayServer(t)
+	defer relay.Close()
+	open := func(ctx context.Context) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "tcp", relay.Addr().String())
+	}
+	large := string(make([]byte, 1200))
+
+	// over the relay directly
+	rpconn, err := RelayPacketListenerConfig(open).ListenPacket("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPConn(t, rpconn, eaddr, "hello relay udp")
+	testPConn(t, rpconn, eaddr, large)
+	_ = rpconn.Close()
+
+	for _, handler := range []CMDCMDUDPASSOCIATEHandler{nil, RelayCMDCMDUDPASSOCIATE(open)} {
+		cfg := &ServerConfig{
+			VersionSwitch: DefaultSocksVersionSwitch,
+			CMDConfig: CMDConfig{
+				SwitchCMDUDPASSOCIATE:       true,
+				CMDCMDUDPASSOCIATEHandler:   handler,
+				SwitchCMDUDPASSOCIATEStream: true,
+			},
+			Socks5AuthCb: S5AuthCb{Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			}},
+		}
+		server, err := NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(listen)
+
+		plc, err := SOCKS5UDPASSOCIATEStreamP("tcp", listen.Addr().String(), &S5AuthPassword{User: "test", Password: "test123"}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pconn, err := plc.ListenPacket("udp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPConn(t, pconn, eaddr, "hello udp over tcp")
+		testPConn(t, pconn, eaddr, large)
+		_ = pconn.Close()
+
+		// the plain UDP ASSOCIATE client is not affected
+		cfg.CMDConfig.SwitchCMDUDPASSOCIATEStream = false
+		_, err = plc.ListenPacket("udp", "")
+		if err == nil {
+			t.Fatal("stream mode is opt-in")
+		}
+		_ = server.Close()
+		_ = listen.Close()
+	}
+}
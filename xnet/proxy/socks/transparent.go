@@ -0,0 +1,305 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"github.com/peakedshout/go-pandorasbox/control"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ListenTransparent A tcp listener for iptables TPROXY, needs CAP_NET_ADMIN (linux only).
+// REDIRECT works with any listener.
+func ListenTransparent(network string, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: control.TransparentControl}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// ListenTransparentPacket A udp listener for iptables TPROXY, its datagrams carry their original destinations.
+func ListenTransparentPacket(network string, address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: control.TransparentControl}
+	pconn, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return pconn.(*net.UDPConn), nil
+}
+
+// ServeTransparent
+//
+//	Relay the tcp connections iptables redirected to ln by the CONNECT handler of CMDConfig,
+//	the original destination is SO_ORIGINAL_DST (REDIRECT) or the local address (TPROXY, see ListenTransparent).
+func (s *Server) ServeTransparent(ln net.Listener) error {
+	if ctxtool.Disable(s.ctx) {
+		return s.ctx.Err()
+	}
+	if !s.cfg.CMDConfig.SwitchCMDCONNECT {
+		return ErrMeaninglessServiceCmd
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	ctxtool.GWaitFunc(ctx, func() {
+		_ = ln.Close()
+	})
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleTransparentConn(conn)
+	}
+}
+
+// ServeTransparentPacket
+//
+//	Relay the udp datagrams iptables TPROXY sent to pconn (see ListenTransparentPacket) by the UDP ASSOCIATE handler of CMDConfig,
+//	one association per client until it is idle for UdpTimeout. Replies are sent from their sources with IP_TRANSPARENT.
+func (s *Server) ServeTransparentPacket(pconn *net.UDPConn) error {
+	if ctxtool.Disable(s.ctx) {
+		return s.ctx.Err()
+	}
+	if !s.cfg.CMDConfig.SwitchCMDUDPASSOCIATE {
+		return ErrMeaninglessServiceCmd
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	ctxtool.GWaitFunc(ctx, func() {
+		_ = pconn.Close()
+	})
+	var mux sync.Mutex
+	sessions := make(map[netip.AddrPort]*transparentSession)
+	buf := make([]byte, 32*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, raddr, err := pconn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			return err
+		}
+		dst, err := control.ParseOrigDstAddr(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		raddr = netip.AddrPortFrom(raddr.Addr().Unmap(), raddr.Port())
+		mux.Lock()
+		ts, ok := sessions[raddr]
+		if !ok {
+			ts, err = s.newTransparentSession(ctx, raddr, func() {
+				mux.Lock()
+				defer mux.Unlock()
+				delete(sessions, raddr)
+			})
+			if err != nil {
+				mux.Unlock()
+				continue
+			}
+			sessions[raddr] = ts
+		}
+		mux.Unlock()
+		ts.send(buf[:n], dst)
+	}
+}
+
+func (s *Server) handleTransparentConn(conn net.Conn) {
+	sc := &serverConn{
+		Conn: conn,
+	}
+	defer sc.Close()
+	defer s.release(sc)
+	ctx, cl := context.WithCancel(s.ctx)
+	defer cl()
+	ctxtool.GWaitFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	addr, err := transparentDst(conn)
+	if err != nil {
+		return
+	}
+	addr, err = s.fakeIPAddr(addr)
+	if err != nil {
+		return
+	}
+	err = s.acquire(sc, RelayCONNECT, addr)
+	if err != nil {
+		return
+	}
+	handler := DefaultCMDCONNECTHandler
+	if s.cfg.CMDConfig.CMDCONNECTHandler != nil {
+		handler = s.cfg.CMDConfig.CMDCONNECTHandler
+	}
+	hctx := s.handlerCtx(sc)
+	if s.cfg.DialTimeout != 0 {
+		tmpctx, cancel := context.WithTimeout(hctx, s.cfg.DialTimeout)
+		defer cancel()
+		hctx = tmpctx
+	}
+	cc, err := handler(hctx, addr)
+	if err != nil {
+		return
+	}
+	sc.copyConn = cc
+	sc.ioCopy()
+}
+
+// transparentDst The original destination of conn, SO_ORIGINAL_DST differs from the local address after REDIRECT
+// and a TPROXY connection is accepted on it.
+func transparentDst(conn net.Conn) (string, error) {
+	sconn, ok := conn.(syscall.Conn)
+	if !ok {
+		return "", ErrTransparentNoDst
+	}
+	rc, err := sconn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var dst netip.AddrPort
+	var derr error
+	var tproxy bool
+	err = rc.Control(func(fd uintptr) {
+		dst, derr = control.OriginalDst(control.FdPtr(fd))
+		tproxy = control.IsTransparent(control.FdPtr(fd))
+	})
+	if err != nil {
+		return "", err
+	}
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	if derr == nil && dst != local {
+		return dst.String(), nil
+	}
+	if tproxy {
+		return local.String(), nil
+	}
+	return "", ErrTransparentNoDst
+}
+
+// transparentSession The UDP ASSOCIATE of a transparent udp client, its datagrams go through loop.
+type transparentSession struct {
+	sc     *serverConn
+	loop   *udpLoop
+	client *net.UDPAddr
+	ctx    context.Context
+
+	timeout time.Duration
+	last    atomic.Int64
+
+	mux     sync.Mutex
+	replies map[string]net.PacketConn
+}
+
+func (s *Server) newTransparentSession(ctx context.Context, client netip.AddrPort, done func()) (*transparentSession, error) {
+	lconn, err := net.ListenUDP("udp", loopbackAddr(nil))
+	if err != nil {
+		return nil, err
+	}
+	ts := &transparentSession{
+		client:  net.UDPAddrFromAddrPort(client),
+		ctx:     ctx,
+		timeout: s.cfg.UdpTimeout,
+		replies: make(map[string]net.PacketConn),
+	}
+	ts.loop = &udpLoop{UDPConn: lconn, client: ts.client}
+	ts.sc = &serverConn{Conn: ts.loop}
+	err = s.acquire(ts.sc, RelayUDPASSOCIATE, client.String())
+	if err != nil {
+		_ = lconn.Close()
+		return nil, err
+	}
+	handler := DefaultCMDCMDUDPASSOCIATEHandler
+	if s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler != nil {
+		handler = s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler
+	}
+	hctx := context.WithValue(s.handlerCtx(ts.sc), udpTimeoutKey, s.cfg.UdpTimeout)
+	if fi := s.fakeIP(); fi != nil {
+		hctx = context.WithValue(hctx, fakeIPKey{}, fi)
+	}
+	pconn, err := handler(hctx, lconn.LocalAddr())
+	if err != nil {
+		s.release(ts.sc)
+		_ = lconn.Close()
+		return nil, err
+	}
+	ts.sc.udpConn = pconn
+	ts.loop.relay = loopbackAddr(pconn.LocalAddr())
+	ts.touch()
+	go ts.sc.udpCopy()
+	go func() {
+		defer done()
+		defer s.release(ts.sc)
+		defer ts.close()
+		ts.serve()
+	}()
+	return ts, nil
+}
+
+func (ts *transparentSession) send(b []byte, dst netip.AddrPort) {
+	ts.touch()
+	_, _ = ts.loop.Write(marshalSocks5UDPASSOCIATEData(b, net.UDPAddrFromAddrPort(dst)))
+}
+
+// serve Send the replies of the handler to the client until the session is idle for timeout.
+func (ts *transparentSession) serve() {
+	stop := context.AfterFunc(ts.ctx, func() {
+		_ = ts.loop.Close()
+	})
+	defer stop()
+	buf := make([]byte, 32*1024)
+	for {
+		_ = ts.loop.SetReadDeadline(time.Now().Add(ts.timeout))
+		n, err := ts.loop.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, ts.last.Load())) < ts.timeout {
+				continue
+			}
+			return
+		}
+		data, from, err := unmarshalSocks5UDPASSOCIATEData2(buf[:n])
+		if err != nil {
+			continue
+		}
+		ts.touch()
+		rconn, err := ts.reply(from)
+		if err != nil {
+			continue
+		}
+		_, _ = rconn.WriteTo(data, ts.client)
+	}
+}
+
+// reply The socket bound to from, the replies reach the client from the address it sent to.
+func (ts *transparentSession) reply(from *net.UDPAddr) (net.PacketConn, error) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	key := from.String()
+	if rconn, ok := ts.replies[key]; ok {
+		return rconn, nil
+	}
+	lc := net.ListenConfig{Control: control.TransparentControl}
+	rconn, err := lc.ListenPacket(ts.ctx, "udp", key)
+	if err != nil {
+		return nil, err
+	}
+	ts.replies[key] = rconn
+	return rconn, nil
+}
+
+func (ts *transparentSession) touch() {
+	ts.last.Store(time.Now().UnixNano())
+}
+
+func (ts *transparentSession) close() {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	for _, rconn := range ts.replies {
+		_ = rconn.Close()
+	}
+	_ = ts.sc.Close()
+}
@@ -0,0 +1,196 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+func (s *Server) handleSocks5CMDUDPASSOCIATEStream(conn *serverConn, addr string) error {
+	err := s.acquire(conn, RelayUDPASSOCIATE, addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespConnNotAllowed, conn.LocalAddr())
+		return err
+	}
+	lconn, err := net.ListenUDP("udp", loopbackAddr(nil))
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(socks5CMDRespFailure, conn.LocalAddr())
+		return err
+	}
+	var handler CMDCMDUDPASSOCIATEHandler
+	if s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler != nil {
+		handler = s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler
+	} else {
+		handler = DefaultCMDCMDUDPASSOCIATEHandler
+	}
+	// the relay counts the stream, not the datagrams again
+	ctx := context.WithValue(s.handlerCtx(&serverConn{user: conn.user}), udpTimeoutKey, s.cfg.UdpTimeout)
+	if fi := s.fakeIP(); fi != nil {
+		ctx = context.WithValue(ctx, fakeIPKey{}, fi)
+	}
+	pconn, err := handler(ctx, lconn.LocalAddr())
+	if err != nil {
+		_ = lconn.Close()
+		_ = conn.writeSocks5CMDResp(socks5CMDRespHostUnreachable, conn.LocalAddr())
+		return err
+	}
+	go (&serverConn{udpConn: pconn}).udpCopy()
+	conn.copyConn = &udpStreamConn{
+		udpLoop: &udpLoop{UDPConn: lconn, relay: loopbackAddr(pconn.LocalAddr()), client: conn.RemoteAddr()},
+		pconn:   pconn,
+	}
+	return conn.writeSocks5CMDResp(socks5CMDRespSuccess, conn.LocalAddr())
+}
+
+// udpLoop The socks5 udp client side of an association served in process, its RemoteAddr is the client it stands for.
+type udpLoop struct {
+	*net.UDPConn
+	relay  *net.UDPAddr
+	client net.Addr
+}
+
+func (l *udpLoop) Read(p []byte) (int, error) {
+	for {
+		n, addr, err := l.UDPConn.ReadFromUDP(p)
+		if err != nil {
+			return 0, err
+		}
+		if addr.Port == l.relay.Port {
+			return n, nil
+		}
+	}
+}
+
+func (l *udpLoop) Write(p []byte) (int, error) {
+	return l.UDPConn.WriteToUDP(p, l.relay)
+}
+
+func (l *udpLoop) RemoteAddr() net.Addr {
+	return l.client
+}
+
+// loopbackAddr addr with the loopback ip when it is unspecified.
+func loopbackAddr(addr net.Addr) *net.UDPAddr {
+	uaddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if addr == nil {
+		return uaddr
+	}
+	xaddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return uaddr
+	}
+	if xaddr.IP != nil && !xaddr.IP.IsUnspecified() {
+		uaddr.IP = xaddr.IP
+	}
+	uaddr.Port = xaddr.Port
+	return uaddr
+}
+
+// udpStreamConn The datagrams of a udpLoop as the stream of the client, see writeUDPFrame.
+type udpStreamConn struct {
+	*udpLoop
+	pconn net.PacketConn
+	rbuf  []byte
+	wbuf  []byte
+}
+
+func (u *udpStreamConn) Read(p []byte) (int, error) {
+	if len(u.rbuf) == 0 {
+		buf := make([]byte, 2+defaultUdpBufferSize)
+		n, err := u.udpLoop.Read(buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		u.rbuf = buf[:2+n]
+	}
+	n := copy(p, u.rbuf)
+	u.rbuf = u.rbuf[n:]
+	return n, nil
+}
+
+func (u *udpStreamConn) Write(p []byte) (int, error) {
+	u.wbuf = append(u.wbuf, p...)
+	for len(u.wbuf) >= 2 {
+		l := int(binary.BigEndian.Uint16(u.wbuf))
+		if len(u.wbuf) < 2+l {
+			break
+		}
+		_, err := u.udpLoop.Write(u.wbuf[2 : 2+l])
+		if err != nil {
+			return 0, err
+		}
+		u.wbuf = u.wbuf[2+l:]
+	}
+	return len(p), nil
+}
+
+func (u *udpStreamConn) Close() error {
+	_ = u.pconn.Close()
+	return u.udpLoop.Close()
+}
+
+// writeUDPFrame A datagram over the stream is its socks5 udp request prefixed by the 2-byte length.
+func writeUDPFrame(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return errors.New("udp frame too long")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(b)), uint16(len(b))), b...))
+	return err
+}
+
+func readUDPFrame(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	_, err := io.ReadFull(r, l[:])
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// socks5StreamPacketConn The client side of SOCKS5UDPASSOCIATEStream.
+type socks5StreamPacketConn struct {
+	net.Conn
+	cb UDPDataHandler
+}
+
+func (s5pc *socks5StreamPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if s5pc.cb != nil {
+		p, err = s5pc.cb.Encode(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = writeUDPFrame(s5pc.Conn, marshalSocks5UDPASSOCIATEData(p, addr))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s5pc *socks5StreamPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		b, err := readUDPFrame(s5pc.Conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, xaddr, err := unmarshalSocks5UDPASSOCIATEData2(b)
+		if err != nil {
+			continue
+		}
+		if s5pc.cb != nil {
+			data, err = s5pc.cb.Decode(data)
+			if err != nil {
+				continue
+			}
+		}
+		return copy(p, data), xaddr, nil
+	}
+}
@@ -0,0 +1,286 @@
+package socks
+
+import (
+	"context"
+	"github.com/peakedshout/go-pandorasbox/tool/bio"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RelayCONNECT      = "connect"
+	RelayBIND         = "bind"
+	RelayUDPASSOCIATE = "udp associate"
+)
+
+// UserLimit
+//
+//	The caps of a user, zero means no cap.
+//	Bandwidth is shared by all relays of the user, in bytes per second of each direction.
+type UserLimit struct {
+	MaxConns  int   `json:"maxConns" yaml:"maxConns"`
+	Bandwidth int64 `json:"bandwidth" yaml:"bandwidth"`
+}
+
+// UserStats
+//
+//	The usage of a user since the server started, Read is from the client and Write is to the client.
+//	Users without auth are counted as "".
+type UserStats struct {
+	User  string
+	Conns int
+	Read  uint64
+	Write uint64
+}
+
+// RelayInfo
+//
+//	An active relay, ReadSpeed and WriteSpeed are bytes per second since the previous Relays call.
+type RelayInfo struct {
+	Id          uint64
+	User        string
+	Cmd         string
+	Source      string
+	Destination string
+	Start       time.Time
+	Read        uint64
+	Write       uint64
+	ReadSpeed   float64
+	WriteSpeed  float64
+}
+
+// Users The usage of every user who connected, sorted by name.
+func (s *Server) Users() []UserStats {
+	s.usage.mux.Lock()
+	defer s.usage.mux.Unlock()
+	list := make([]UserStats, 0, len(s.usage.users))
+	for name, one := range s.usage.users {
+		r, w := one.counter.Get()
+		list = append(list, UserStats{User: name, Conns: one.conns, Read: r, Write: w})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].User < list[j].User
+	})
+	return list
+}
+
+// User The usage of one user.
+func (s *Server) User(name string) (UserStats, bool) {
+	s.usage.mux.Lock()
+	defer s.usage.mux.Unlock()
+	one, ok := s.usage.users[name]
+	if !ok {
+		return UserStats{}, false
+	}
+	r, w := one.counter.Get()
+	return UserStats{User: name, Conns: one.conns, Read: r, Write: w}, true
+}
+
+// Relays The active relays, sorted by start.
+func (s *Server) Relays() []RelayInfo {
+	s.usage.mux.Lock()
+	list := make([]*relay, 0, len(s.usage.relays))
+	for _, one := range s.usage.relays {
+		list = append(list, one)
+	}
+	s.usage.mux.Unlock()
+	infos := make([]RelayInfo, 0, len(list))
+	for _, one := range list {
+		infos = append(infos, one.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+type usage struct {
+	mux    sync.Mutex
+	id     uint64
+	users  map[string]*userUsage
+	relays map[uint64]*relay
+}
+
+type userUsage struct {
+	counter *bio.IOCounter
+	conns   int
+	rBucket *bucket
+	wBucket *bucket
+}
+
+// acquire Register the relay of conn, checking the caps of its user first.
+func (s *Server) acquire(conn *serverConn, cmd string, addr string) error {
+	var limit UserLimit
+	if s.cfg.UserLimitCb != nil {
+		if l := s.cfg.UserLimitCb(conn.user); l != nil {
+			limit = *l
+		}
+	}
+	s.usage.mux.Lock()
+	defer s.usage.mux.Unlock()
+	u, ok := s.usage.users[conn.user]
+	if !ok {
+		u = &userUsage{
+			counter: bio.NewIOCounter(0, 0),
+			rBucket: &bucket{},
+			wBucket: &bucket{},
+		}
+		s.usage.users[conn.user] = u
+	}
+	if limit.MaxConns > 0 && u.conns >= limit.MaxConns {
+		return ErrUserConnLimit
+	}
+	u.conns++
+	u.rBucket.setRate(limit.Bandwidth)
+	u.wBucket.setRate(limit.Bandwidth)
+	s.usage.id++
+	r := &relay{
+		id:      s.usage.id,
+		user:    conn.user,
+		cmd:     cmd,
+		src:     conn.RemoteAddr().String(),
+		dst:     addr,
+		start:   time.Now(),
+		counter: bio.NewIOCounter(0, 0),
+		speed:   xnetutil.NewSpeedometer(2),
+		owner:   u,
+	}
+	r.ctx, r.cancel = context.WithCancel(s.ctx)
+	r.speed.Set(0, 0)
+	s.usage.relays[r.id] = r
+	conn.relay = r
+	return nil
+}
+
+// release Unregister the relay of conn.
+func (s *Server) release(conn *serverConn) {
+	if conn.relay == nil {
+		return
+	}
+	conn.relay.cancel()
+	s.usage.mux.Lock()
+	defer s.usage.mux.Unlock()
+	delete(s.usage.relays, conn.relay.id)
+	conn.relay.owner.conns--
+}
+
+type relay struct {
+	id    uint64
+	user  string
+	cmd   string
+	src   string
+	dst   string
+	start time.Time
+
+	counter *bio.IOCounter
+	speed   *xnetutil.Speedometer
+	owner   *userUsage
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// read Count n bytes from the client, waiting for the bandwidth of the user.
+func (r *relay) read(n int) {
+	r.counter.Add(n, 0)
+	r.owner.counter.Add(n, 0)
+	r.owner.rBucket.wait(r.ctx, n)
+}
+
+// write Count n bytes to the client, waiting for the bandwidth of the user.
+func (r *relay) write(n int) {
+	r.counter.Add(0, n)
+	r.owner.counter.Add(0, n)
+	r.owner.wBucket.wait(r.ctx, n)
+}
+
+func (r *relay) info() RelayInfo {
+	rn, wn := r.counter.Get()
+	r.speed.Set(rn, wn)
+	speed := r.speed.Speed()
+	return RelayInfo{
+		Id:          r.id,
+		User:        r.user,
+		Cmd:         r.cmd,
+		Source:      r.src,
+		Destination: r.dst,
+		Start:       r.start,
+		Read:        rn,
+		Write:       wn,
+		ReadSpeed:   speed[0],
+		WriteSpeed:  speed[1],
+	}
+}
+
+// relayConn The client side of a relay.
+type relayConn struct {
+	net.Conn
+	relay *relay
+}
+
+func (c *relayConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.relay.read(n)
+	}
+	return n, err
+}
+
+func (c *relayConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.relay.write(n)
+	}
+	return n, err
+}
+
+// bucket A token bucket holding up to one second of rate, no limit when rate is zero.
+type bucket struct {
+	mux    sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.rate != rate {
+		b.rate = rate
+		b.tokens = float64(rate)
+		b.last = time.Now()
+	}
+}
+
+// wait Take n tokens, sleeping off the debt.
+func (b *bucket) wait(ctx context.Context, n int) {
+	b.mux.Lock()
+	if b.rate <= 0 {
+		b.mux.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mux.Unlock()
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
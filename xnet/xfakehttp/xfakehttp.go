@@ -4,26 +4,82 @@ import (
 	"context"
 	"crypto/tls"
 	"github.com/peakedshout/go-pandorasbox/xnet/conn/fakehttpconn"
+	"github.com/peakedshout/go-pandorasbox/xnet/xneterr"
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xquic"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtls"
 	"net"
 )
 
+const (
+	CarrierHttp1 = "http/1.1"
+	CarrierHttp2 = "h2"
+	CarrierHttp3 = "h3"
+)
+
 func XUpgrader(cfg *tls.Config, isClient bool) xnetutil.Upgrader {
 	return FakeHttpUpgrader(cfg, isClient)
 }
 
 func FakeHttpUpgrader(cfg *tls.Config, isClient bool) xnetutil.Upgrader {
+	return FakeHttpUpgraderWithConfig(cfg, isClient, nil)
+}
+
+// FakeHttpUpgraderWithConfig The path, host, headers and padding are set by fhCfg.
+func FakeHttpUpgraderWithConfig(cfg *tls.Config, isClient bool, fhCfg *fakehttpconn.Config) xnetutil.Upgrader {
+	return newFakeHttpUpgrader(CarrierHttp1, cfg, isClient, fhCfg)
+}
+
+// FakeHttp2Upgrader A long-lived grpc call over h2, cfg is required and fhCfg can be nil.
+func FakeHttp2Upgrader(cfg *tls.Config, isClient bool, fhCfg *fakehttpconn.Config) xnetutil.Upgrader {
+	return newFakeHttpUpgrader(CarrierHttp2, cfg, isClient, fhCfg)
+}
+
+// FakeHttp3Upgrader An h3 request stream, it upgrades the quic conn or stream of xquic only, fhCfg can be nil.
+func FakeHttp3Upgrader(isClient bool, fhCfg *fakehttpconn.Config) xnetutil.Upgrader {
+	return newFakeHttpUpgrader(CarrierHttp3, nil, isClient, fhCfg)
+}
+
+// FakeHttpUpgraderWithOptions The upgrader of carrier (CarrierHttp1, CarrierHttp2 or CarrierHttp3)
+// with the Host, Path, Header and Padding of opts, and its tls part for https and h2 (see xtls.ApplyOptions).
+func FakeHttpUpgraderWithOptions(carrier string, cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions) (xnetutil.Upgrader, error) {
+	switch carrier {
+	case CarrierHttp1, CarrierHttp2, CarrierHttp3:
+	default:
+		return nil, xneterr.ErrNetworkIsInvalid.Errorf(carrier)
+	}
+	cfg, err := xtls.ApplyOptions(cfg, isClient, opts)
+	if err != nil {
+		return nil, err
+	}
+	var fhCfg *fakehttpconn.Config
+	if opts != nil {
+		fhCfg = &fakehttpconn.Config{
+			Path:    opts.Path,
+			Host:    opts.Host,
+			Header:  opts.Header,
+			Padding: opts.Padding,
+		}
+	}
+	return newFakeHttpUpgrader(carrier, cfg, isClient, fhCfg), nil
+}
+
+func newFakeHttpUpgrader(carrier string, cfg *tls.Config, isClient bool, fhCfg *fakehttpconn.Config) *fakeHttpUpgrader {
 	return &fakeHttpUpgrader{
+		carrier:  carrier,
 		cfg:      cfg,
 		isClient: isClient,
+		fhCfg:    fhCfg,
 	}
 }
 
 var FakeHttpConnTmp *fakehttpconn.FakeHttpConn
 
 type fakeHttpUpgrader struct {
+	carrier  string
 	cfg      *tls.Config
 	isClient bool
+	fhCfg    *fakehttpconn.Config
 }
 
 func (f *fakeHttpUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
@@ -31,9 +87,26 @@ func (f *fakeHttpUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
 }
 
 func (f *fakeHttpUpgrader) UpgradeContext(ctx context.Context, conn net.Conn) (net.Conn, error) {
-	if f.isClient {
-		return fakehttpconn.Client(conn, f.cfg), nil
-	} else {
-		return fakehttpconn.Server(conn, f.cfg), nil
+	switch f.carrier {
+	case CarrierHttp2:
+		if f.isClient {
+			return fakehttpconn.Http2Client(conn, f.cfg, f.fhCfg), nil
+		}
+		return fakehttpconn.Http2Server(conn, f.cfg, f.fhCfg), nil
+	case CarrierHttp3:
+		_, err := xnetutil.TypeCheck(conn, xquic.QuicConnTmp, xquic.QuicStreamConnTmp)
+		if err != nil {
+			return nil, err
+		}
+		if f.isClient {
+			return fakehttpconn.Http3Client(conn, f.fhCfg), nil
+		}
+		return fakehttpconn.Http3Server(conn, f.fhCfg), nil
+	default:
+		if f.isClient {
+			return fakehttpconn.ClientWithConfig(conn, f.cfg, f.fhCfg), nil
+		} else {
+			return fakehttpconn.ServerWithConfig(conn, f.cfg, f.fhCfg), nil
+		}
 	}
 }
@@ -3,7 +3,9 @@ package xneterr
 import "github.com/peakedshout/go-pandorasbox/uerror"
 
 var (
-	ErrConnTypeIsInvalid = uerror.NewErrorCode(7100, 1000, "conn type invalid: conn is not %v")
-	ErrNetworkIsInvalid  = uerror.NewErrorCode(7100, 1001, "network invalid: %v")
-	ErrNilTlsConfig      = uerror.NewErrorCode(7100, 1002, "%v nil tls config")
+	ErrConnTypeIsInvalid    = uerror.NewErrorCode(7100, 1000, "conn type invalid: conn is not %v")
+	ErrNetworkIsInvalid     = uerror.NewErrorCode(7100, 1001, "network invalid: %v")
+	ErrNilTlsConfig         = uerror.NewErrorCode(7100, 1002, "%v nil tls config")
+	ErrOptionsIsInvalid     = uerror.NewErrorCode(7100, 1003, "upgrade options invalid: %v")
+	ErrFingerprintIsInvalid = uerror.NewErrorCode(7100, 1004, "fingerprint invalid: %v")
 )
@@ -3,7 +3,12 @@ package xnetutil
 import (
 	"context"
 	"github.com/peakedshout/go-pandorasbox/tool/gpool"
+	"github.com/peakedshout/go-pandorasbox/xnet/xneterr"
+	"golang.org/x/net/http/httpguts"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -17,6 +22,52 @@ type Upgrader interface {
 	UpgradeContext(ctx context.Context, conn net.Conn) (net.Conn, error)
 }
 
+// UpgradeOptions
+//
+//	How the tls, websocket and fake http upgraders look on the wire, zero fields keep their defaults.
+//	The ServerName and Fingerprint are of the client, the others apply to the server as well where they make sense.
+type UpgradeOptions struct {
+	ServerName  string      // tls SNI, independent of Host
+	ALPN        []string    // tls NextProtos
+	Fingerprint string      // a ClientHello preset of xtls, such as "chrome", sent by the tls network only
+	Host        string      // the http Host header (:authority)
+	Path        string      // the http request path
+	Header      http.Header // extra http headers
+	Padding     int         // up to Padding random bytes per write of the http, h2 and h3 upgraders
+}
+
+// Check The fields that would make a bad handshake, nil opts is valid.
+func (opts *UpgradeOptions) Check() error {
+	if opts == nil {
+		return nil
+	}
+	for _, proto := range opts.ALPN {
+		if len(proto) == 0 || len(proto) > 255 {
+			return xneterr.ErrOptionsIsInvalid.Errorf("alpn " + proto)
+		}
+	}
+	if opts.Host != "" && !httpguts.ValidHostHeader(opts.Host) {
+		return xneterr.ErrOptionsIsInvalid.Errorf("host " + opts.Host)
+	}
+	if opts.Path != "" && (!strings.HasPrefix(opts.Path, "/") || strings.ContainsAny(opts.Path, " \r\n")) {
+		return xneterr.ErrOptionsIsInvalid.Errorf("path " + opts.Path)
+	}
+	if opts.Padding < 0 {
+		return xneterr.ErrOptionsIsInvalid.Errorf("padding " + strconv.Itoa(opts.Padding))
+	}
+	for k, vs := range opts.Header {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return xneterr.ErrOptionsIsInvalid.Errorf("header " + k)
+		}
+		for _, v := range vs {
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return xneterr.ErrOptionsIsInvalid.Errorf("header " + k)
+			}
+		}
+	}
+	return nil
+}
+
 func EmptyUpgrader() Upgrader {
 	return &emptyUpgrader{}
 }
@@ -19,6 +19,10 @@ func DialContext(ctx context.Context, network string, addr string) (conn net.Con
 	return _defaultDialer.DialContext(ctx, network, addr)
 }
 
+func DialSession(ctx context.Context, network string, addr string) (*quicconn.QuicSession, error) {
+	return _defaultDialer.DialSession(ctx, network, addr)
+}
+
 func NewDialer(c net.PacketConn, tlsCfg *tls.Config) *QuicDialer {
 	if tlsCfg == nil {
 		tlsCfg = _defaultQuicTlsConfg
@@ -41,31 +45,33 @@ func (qd *QuicDialer) Dial(network string, addr string) (conn net.Conn, err erro
 }
 
 func (qd *QuicDialer) DialContext(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+	session, err := qd.DialSession(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return session.Conn(), nil
+}
+
+// DialSession The session of a dialed quic connection, its main stream is the conn DialContext returns.
+func (qd *QuicDialer) DialSession(ctx context.Context, network string, addr string) (*quicconn.QuicSession, error) {
 	var connection quic.Connection
 	if qd.c == nil {
-		connection, err = quic.DialAddr(ctx, addr, qd.tlsCfg, nil)
+		var err error
+		connection, err = quic.DialAddr(ctx, addr, qd.tlsCfg, _defaultQuicConfig)
 		if err != nil {
-			return
+			return nil, err
 		}
 	} else {
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
 			return nil, err
 		}
-		connection, err = quic.Dial(ctx, qd.c, udpAddr, qd.tlsCfg, nil)
+		connection, err = quic.Dial(ctx, qd.c, udpAddr, qd.tlsCfg, _defaultQuicConfig)
 		if err != nil {
 			return nil, err
 		}
 	}
-	conn = quicconn.NewConn(true, connection)
-	value := ctx.Value(XQuicPreHandShake)
-	if value != nil {
-		err = conn.SetWriteDeadline(time.Time{})
-		if err != nil {
-			return nil, err
-		}
-	}
-	return conn, nil
+	return preHandShake(ctx, quicconn.NewSession(true, connection))
 }
 
 func NewQuicTransportDialer(tr *quic.Transport, tlsCfg *tls.Config) *QuicTransportDialer {
@@ -88,23 +94,24 @@ func (qtdr *QuicTransportDialer) Dial(network string, addr string) (net.Conn, er
 }
 
 func (qtdr *QuicTransportDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	session, err := qtdr.DialSession(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	connection, err := qtdr.tr.Dial(ctx, udpAddr, qtdr.tlsCfg, nil)
+	return session.Conn(), nil
+}
+
+// DialSession The session of a dialed quic connection, its main stream is the conn DialContext returns.
+func (qtdr *QuicTransportDialer) DialSession(ctx context.Context, network string, addr string) (*quicconn.QuicSession, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, err
 	}
-	conn := quicconn.NewConn(true, connection)
-	value := ctx.Value(XQuicPreHandShake)
-	if value != nil {
-		err = conn.SetWriteDeadline(time.Time{})
-		if err != nil {
-			return nil, err
-		}
+	connection, err := qtdr.tr.Dial(ctx, udpAddr, qtdr.tlsCfg, _defaultQuicConfig)
+	if err != nil {
+		return nil, err
 	}
-	return conn, nil
+	return preHandShake(ctx, quicconn.NewSession(true, connection))
 }
 
 func (qtdr *QuicTransportDialer) Close() error {
@@ -114,3 +121,14 @@ func (qtdr *QuicTransportDialer) Close() error {
 func (qtdr *QuicTransportDialer) Transport() *quic.Transport {
 	return qtdr.tr
 }
+
+// preHandShake Authenticate the main stream before returning, if ctx has XQuicPreHandShake.
+func preHandShake(ctx context.Context, session *quicconn.QuicSession) (*quicconn.QuicSession, error) {
+	if ctx.Value(XQuicPreHandShake) != nil {
+		err := session.Conn().SetWriteDeadline(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
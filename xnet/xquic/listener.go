@@ -18,6 +18,10 @@ func ListenContext(ctx context.Context, network, addr string) (ln net.Listener,
 	return _defaultListenConfig.ListenContext(ctx, network, addr)
 }
 
+func ListenSession(ctx context.Context, network, addr string) (*QuicSessionListener, error) {
+	return _defaultListenConfig.ListenSession(ctx, network, addr)
+}
+
 func NewQuicListenConfig(c net.PacketConn, tlsCfg *tls.Config) *QuicListenConfig {
 	if tlsCfg == nil {
 		tlsCfg = _defaultQuicTlsConfg
@@ -51,24 +55,30 @@ func (qc *QuicListenConfig) Listen(network string, address string) (net.Listener
 
 // ListenContext if exist c will be not use address and network
 func (qc *QuicListenConfig) ListenContext(ctx context.Context, network string, addr string) (ln net.Listener, err error) {
-	var listen *quic.Listener
+	listen, err := qc.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &quicListener{ln: listen, ctx: ctx}, nil
+}
+
+// ListenSession The sessions of the accepted quic connections, if exist c will be not use address and network
+func (qc *QuicListenConfig) ListenSession(ctx context.Context, network string, addr string) (*QuicSessionListener, error) {
+	listen, err := qc.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &QuicSessionListener{ln: listen, ctx: ctx}, nil
+}
+
+func (qc *QuicListenConfig) listen(addr string) (*quic.Listener, error) {
 	if qc.c != nil {
-		listen, err = quic.Listen(qc.c, qc.tlsCfg, nil)
-		if err != nil {
-			return nil, err
-		}
+		return quic.Listen(qc.c, qc.tlsCfg, _defaultQuicConfig)
 	} else if qc.tr != nil {
-		listen, err = qc.tr.Listen(qc.tlsCfg, nil)
-		if err != nil {
-			return nil, err
-		}
+		return qc.tr.Listen(qc.tlsCfg, _defaultQuicConfig)
 	} else {
-		listen, err = quic.ListenAddr(addr, qc.tlsCfg, nil)
-		if err != nil {
-			return nil, err
-		}
+		return quic.ListenAddr(addr, qc.tlsCfg, _defaultQuicConfig)
 	}
-	return &quicListener{ln: listen, ctx: ctx}, nil
 }
 
 type quicListener struct {
@@ -91,3 +101,25 @@ func (ql *quicListener) Close() error {
 func (ql *quicListener) Addr() net.Addr {
 	return ql.ln.Addr()
 }
+
+// QuicSessionListener As the net.Listener of QuicListenConfig, but it accepts whole sessions.
+type QuicSessionListener struct {
+	ctx context.Context
+	ln  *quic.Listener
+}
+
+func (qsl *QuicSessionListener) Accept() (*quicconn.QuicSession, error) {
+	connection, err := qsl.ln.Accept(qsl.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicconn.NewSession(false, connection), nil
+}
+
+func (qsl *QuicSessionListener) Close() error {
+	return qsl.ln.Close()
+}
+
+func (qsl *QuicSessionListener) Addr() net.Addr {
+	return qsl.ln.Addr()
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/xnet/conn/quicconn"
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/quic-go/quic-go"
 	"net"
 )
 
@@ -19,8 +20,13 @@ func QuicUpgrader() xnetutil.Upgrader {
 
 var _defaultQuicTlsConfg = pcrypto.MustNewDefaultTlsConfig()
 
+// _defaultQuicConfig The datagrams of a QuicSession (RFC 9221) are enabled on both sides.
+var _defaultQuicConfig = &quic.Config{EnableDatagrams: true}
+
 var QuicConnTmp *quicconn.QuicConn
 
+var QuicStreamConnTmp *quicconn.QuicStreamConn
+
 type quicUpgrader struct{}
 
 func (q *quicUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
@@ -3,13 +3,16 @@ package xquic
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/xnet/conn/packetconn"
 	"github.com/peakedshout/go-pandorasbox/xnet/conn/quicconn"
 	"github.com/peakedshout/go-pandorasbox/xnet/xudp"
 	"github.com/quic-go/quic-go"
+	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestLD(t *testing.T) {
@@ -226,3 +229,162 @@ func TestTD2(t *testing.T) {
 		}
 	}
 }
+
+func TestSession(t *testing.T) {
+	ln, err := ListenSession(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		session, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer session.Close()
+		go func() {
+			pc, err := session.PacketConn()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer pc.Close()
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, err = pc.WriteTo(buf[:n], addr)
+				if err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			conn, err := session.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					_, err = conn.Write(buf[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	session, err := DialSession(context.Background(), "udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := session.OpenStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(uuid.NewIdn(1024))
+		buf := make([]byte, 1024)
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatal("data fatal")
+		}
+		conn.Close()
+	}
+	pc, err := session.PacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	data := []byte(uuid.NewIdn(512))
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		_, err = pc.WriteTo(data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pc.SetReadDeadline(time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			// a datagram may be lost
+			continue
+		}
+		if !bytes.Equal(data, buf[:n]) {
+			t.Fatal("data fatal")
+		}
+	}
+	err = pc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pc.ReadFrom(buf)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionConn(t *testing.T) {
+	listen, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		stream, err := conn.(*quicconn.QuicConn).Session().AcceptStream(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer stream.Close()
+		_, _ = io.Copy(stream, stream)
+	}()
+	conn, err := Dial("udp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := conn.(*quicconn.QuicConn).Session().OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	data := []byte(uuid.NewIdn(1024))
+	buf := make([]byte, 1024)
+	_, err = stream.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(stream, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatal("data fatal")
+	}
+}
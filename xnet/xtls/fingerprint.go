@@ -0,0 +1,97 @@
+package xtls
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/peakedshout/go-pandorasbox/xnet/xneterr"
+	utls "github.com/refraction-networking/utls"
+	"net"
+)
+
+// The ClientHello presets of UpgradeOptions.Fingerprint.
+// FingerprintGo is the ClientHello of crypto/tls, the others are sent through uTLS as the browser sends them.
+const (
+	FingerprintGo      = "go"
+	FingerprintChrome  = "chrome"
+	FingerprintFirefox = "firefox"
+	FingerprintSafari  = "safari"
+	FingerprintIOS     = "ios"
+	FingerprintEdge    = "edge"
+)
+
+var fingerprints = map[string]*utls.ClientHelloID{
+	FingerprintGo:      nil,
+	FingerprintChrome:  &utls.HelloChrome_Auto,
+	FingerprintFirefox: &utls.HelloFirefox_Auto,
+	FingerprintSafari:  &utls.HelloSafari_Auto,
+	FingerprintIOS:     &utls.HelloIOS_Auto,
+	FingerprintEdge:    &utls.HelloEdge_Auto,
+}
+
+// fingerprintID The uTLS ClientHello of name, nil for crypto/tls.
+func fingerprintID(name string) (*utls.ClientHelloID, error) {
+	if name == "" {
+		return nil, nil
+	}
+	id, ok := fingerprints[name]
+	if !ok {
+		return nil, xneterr.ErrFingerprintIsInvalid.Errorf(name)
+	}
+	return id, nil
+}
+
+// utlsUpgrader The client of tlsUpgrader that sends the ClientHello of id.
+type utlsUpgrader struct {
+	cfg *utls.Config
+	id  utls.ClientHelloID
+}
+
+func (u *utlsUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
+	return u.UpgradeContext(context.Background(), conn)
+}
+
+func (u *utlsUpgrader) UpgradeContext(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	// the spec holds the state of one handshake, so every conn gets its own
+	spec, err := utls.UTLSIdToSpec(u.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.cfg.NextProtos) != 0 {
+		// the preset offers h2 and http/1.1, the protocols of the config are what the conn speaks
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = append([]string(nil), u.cfg.NextProtos...)
+			}
+		}
+	}
+	uconn := utls.UClient(conn, u.cfg.Clone(), utls.HelloCustom)
+	err = uconn.ApplyPreset(&spec)
+	if err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// utlsConfig The client part of cfg that uTLS can use, the cipher suites, curves and versions are of the preset.
+func utlsConfig(cfg *tls.Config) *utls.Config {
+	ucfg := &utls.Config{
+		Rand:                  cfg.Rand,
+		Time:                  cfg.Time,
+		RootCAs:               cfg.RootCAs,
+		NextProtos:            cfg.NextProtos,
+		ServerName:            cfg.ServerName,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+		VerifyPeerCertificate: cfg.VerifyPeerCertificate,
+		KeyLogWriter:          cfg.KeyLogWriter,
+	}
+	for _, c := range cfg.Certificates {
+		ucfg.Certificates = append(ucfg.Certificates, utls.Certificate{
+			Certificate:                 c.Certificate,
+			PrivateKey:                  c.PrivateKey,
+			OCSPStaple:                  c.OCSPStaple,
+			SignedCertificateTimestamps: c.SignedCertificateTimestamps,
+			Leaf:                        c.Leaf,
+		})
+	}
+	return ucfg
+}
@@ -18,6 +18,22 @@ func TLSUpgrader(cfg *tls.Config, isClient bool) xnetutil.Upgrader {
 	}
 }
 
+// TLSUpgraderWithOptions TLSUpgrader with the SNI and ALPN of opts, see ApplyOptions.
+// The client sends the ClientHello of opts.Fingerprint through uTLS unless it is empty or FingerprintGo.
+func TLSUpgraderWithOptions(cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions) (xnetutil.Upgrader, error) {
+	cfg, err := ApplyOptions(cfg, isClient, opts)
+	if err != nil {
+		return nil, err
+	}
+	if isClient && cfg != nil && opts != nil {
+		id, _ := fingerprintID(opts.Fingerprint)
+		if id != nil {
+			return &utlsUpgrader{cfg: utlsConfig(cfg), id: *id}, nil
+		}
+	}
+	return TLSUpgrader(cfg, isClient), nil
+}
+
 var TLSConnTmp *tls.Conn
 
 type tlsUpgrader struct {
@@ -36,3 +52,35 @@ func (t *tlsUpgrader) UpgradeContext(ctx context.Context, conn net.Conn) (net.Co
 		return tls.Server(conn, t.cfg), nil
 	}
 }
+
+// ApplyOptions
+//
+//	A copy of cfg with the tls part of opts, cfg is returned as it is if either of them is nil.
+//	The ServerName is only set on the client. Invalid opts are an error whether cfg is nil or not,
+//	an unknown Fingerprint included.
+func ApplyOptions(cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions) (*tls.Config, error) {
+	err := opts.Check()
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		_, err = fingerprintID(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg == nil || opts == nil {
+		return cfg, nil
+	}
+	cfg = cfg.Clone()
+	if len(opts.ALPN) != 0 {
+		cfg.NextProtos = append([]string(nil), opts.ALPN...)
+	}
+	if !isClient {
+		return cfg, nil
+	}
+	if opts.ServerName != "" {
+		cfg.ServerName = opts.ServerName
+	}
+	return cfg, nil
+}
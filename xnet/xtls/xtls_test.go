@@ -0,0 +1,135 @@
+package xtls
+
+import (
+	"crypto/tls"
+	"github.com/peakedshout/go-pandorasbox/pcrypto"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestApplyOptions(t *testing.T) {
+	cfg := &tls.Config{ServerName: "a.com", NextProtos: []string{"x"}}
+	opts := &xnetutil.UpgradeOptions{ServerName: "b.com", ALPN: []string{"h2", "http/1.1"}}
+	ccfg, err := ApplyOptions(cfg, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ccfg.ServerName != "b.com" || len(ccfg.NextProtos) != 2 || ccfg.NextProtos[0] != "h2" {
+		t.Fatal("client options fatal")
+	}
+	if cfg.ServerName != "a.com" || len(cfg.NextProtos) != 1 {
+		t.Fatal("cfg is changed")
+	}
+	scfg, err := ApplyOptions(cfg, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scfg.ServerName != "a.com" || len(scfg.NextProtos) != 2 {
+		t.Fatal("server options fatal")
+	}
+	ncfg, err := ApplyOptions(cfg, true, nil)
+	if err != nil || ncfg != cfg {
+		t.Fatal("nil options fatal")
+	}
+	ncfg, err = ApplyOptions(nil, true, opts)
+	if err != nil || ncfg != nil {
+		t.Fatal("nil cfg fatal")
+	}
+	for _, bad := range []*xnetutil.UpgradeOptions{
+		{ALPN: []string{""}},
+		{Fingerprint: "netscape"},
+		{Host: "a b"},
+		{Path: "ws"},
+		{Path: "/a\r\nb"},
+		{Header: http.Header{"X Token": []string{"t"}}},
+		{Header: http.Header{"X-Token": []string{"t\r\n"}}},
+	} {
+		_, err = ApplyOptions(nil, true, bad)
+		if err == nil {
+			t.Fatal("expected an error", bad)
+		}
+		_, err = TLSUpgraderWithOptions(cfg, true, bad)
+		if err == nil {
+			t.Fatal("expected an error", bad)
+		}
+	}
+}
+
+func TestTLSUpgraderFingerprint(t *testing.T) {
+	cfg := pcrypto.MustNewDefaultTlsConfig()
+	scfg := cfg.Clone()
+	scfg.NextProtos = []string{"x", "h2"}
+	hello := make(chan *tls.ClientHelloInfo, 1)
+	scfg.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		hello <- info
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sconn := tls.Server(conn, scfg)
+				_, _ = io.Copy(sconn, sconn)
+			}()
+		}
+	}()
+	handshake := func(fingerprint string) *tls.ClientHelloInfo {
+		opts := &xnetutil.UpgradeOptions{ServerName: "a.com", ALPN: []string{"x"}, Fingerprint: fingerprint}
+		upgrader, err := TLSUpgraderWithOptions(cfg, true, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		uconn, err := upgrader.Upgrade(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = uconn.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(fingerprint, err)
+		}
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(uconn, buf)
+		if err != nil || string(buf) != "hello" {
+			t.Fatal(fingerprint, err)
+		}
+		info := <-hello
+		if info.ServerName != "a.com" || !slices.Equal(info.SupportedProtos, []string{"x"}) {
+			t.Fatal(fingerprint, info.ServerName, info.SupportedProtos)
+		}
+		return info
+	}
+	std := handshake("")
+	gohello := handshake(FingerprintGo)
+	if !slices.Equal(std.CipherSuites, gohello.CipherSuites) {
+		t.Fatal("go fingerprint is not crypto/tls")
+	}
+	for _, fingerprint := range []string{FingerprintChrome, FingerprintFirefox, FingerprintSafari, FingerprintIOS, FingerprintEdge} {
+		info := handshake(fingerprint)
+		if slices.Equal(info.CipherSuites, std.CipherSuites) && slices.Equal(info.Extensions, std.Extensions) {
+			t.Fatal(fingerprint, "sends the crypto/tls ClientHello")
+		}
+	}
+	chrome := handshake(FingerprintChrome)
+	// chrome greases its cipher suites, crypto/tls never does
+	if chrome.CipherSuites[0]&0x0f0f != 0x0a0a {
+		t.Fatal("chrome ClientHello without grease", chrome.CipherSuites)
+	}
+}
@@ -31,6 +31,7 @@ const (
 const (
 	ArgsQuery  = "xhttp-query"
 	ArgsHeader = "xhttp-header"
+	ArgsMethod = "xhttp-method"
 )
 
 type Config struct {
@@ -385,7 +386,7 @@ func (c *Client) call(ctx context.Context, name string, data any) (*http.Respons
 			r = bs
 		}
 	}
-	req, err := http.NewRequestWithContext(ctx, "", c.getUrl(ctx, name), r)
+	req, err := http.NewRequestWithContext(ctx, getArgsMethod(ctx), c.getUrl(ctx, name), r)
 	if err != nil {
 		return nil, err
 	}
@@ -427,6 +428,15 @@ func getArgsHeader(ctx context.Context) http.Header {
 	return nil
 }
 
+func getArgsMethod(ctx context.Context) string {
+	value := ctx.Value(ArgsMethod)
+	if value == nil {
+		return ""
+	}
+	method, _ := value.(string)
+	return method
+}
+
 func SetArgsQuery(ctx context.Context, values url.Values) context.Context {
 	return context.WithValue(ctx, ArgsQuery, values)
 }
@@ -434,3 +444,7 @@ func SetArgsQuery(ctx context.Context, values url.Values) context.Context {
 func SetArgsHeader(ctx context.Context, header http.Header) context.Context {
 	return context.WithValue(ctx, ArgsHeader, header)
 }
+
+func SetArgsMethod(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, ArgsMethod, method)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"github.com/peakedshout/go-pandorasbox/xnet/conn/websocketconn"
 	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtls"
 	"net"
 )
 
@@ -13,10 +14,34 @@ func XUpgrader(cfg *tls.Config, isClient bool) xnetutil.Upgrader {
 }
 
 func WebsocketUpgrader(cfg *tls.Config, isClient bool) xnetutil.Upgrader {
+	return WebsocketUpgraderWithConfig(cfg, isClient, nil)
+}
+
+// WebsocketUpgraderWithConfig The subprotocols, extra headers and permessage-deflate are negotiated by wsCfg.
+func WebsocketUpgraderWithConfig(cfg *tls.Config, isClient bool, wsCfg *websocketconn.Config) xnetutil.Upgrader {
 	return &websocketUpgrader{
 		cfg:      cfg,
 		isClient: isClient,
+		wsCfg:    wsCfg,
+	}
+}
+
+// WebsocketUpgraderWithOptions WebsocketUpgrader with the Host, Path and Header of opts,
+// and its tls part for wss (see xtls.ApplyOptions).
+func WebsocketUpgraderWithOptions(cfg *tls.Config, isClient bool, opts *xnetutil.UpgradeOptions) (xnetutil.Upgrader, error) {
+	cfg, err := xtls.ApplyOptions(cfg, isClient, opts)
+	if err != nil {
+		return nil, err
+	}
+	var wsCfg *websocketconn.Config
+	if opts != nil {
+		wsCfg = &websocketconn.Config{
+			Header: opts.Header,
+			Host:   opts.Host,
+			Path:   opts.Path,
+		}
 	}
+	return WebsocketUpgraderWithConfig(cfg, isClient, wsCfg), nil
 }
 
 var WebsocketConnTmp *websocketconn.WebsocketConn
@@ -24,6 +49,7 @@ var WebsocketConnTmp *websocketconn.WebsocketConn
 type websocketUpgrader struct {
 	cfg      *tls.Config
 	isClient bool
+	wsCfg    *websocketconn.Config
 }
 
 func (w *websocketUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
@@ -32,8 +58,8 @@ func (w *websocketUpgrader) Upgrade(conn net.Conn) (net.Conn, error) {
 
 func (w *websocketUpgrader) UpgradeContext(ctx context.Context, conn net.Conn) (net.Conn, error) {
 	if w.isClient {
-		return websocketconn.Client(conn, w.cfg), nil
+		return websocketconn.ClientWithConfig(conn, w.cfg, w.wsCfg), nil
 	} else {
-		return websocketconn.Server(conn, w.cfg), nil
+		return websocketconn.ServerWithConfig(conn, w.cfg, w.wsCfg), nil
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/pcrypto/aesgcm"
+	"github.com/peakedshout/go-pandorasbox/protocol"
 	"github.com/peakedshout/go-pandorasbox/protocol/cfcprotocol"
 	"github.com/peakedshout/go-pandorasbox/tool/expired"
 	"github.com/peakedshout/go-pandorasbox/tool/hjson"
@@ -41,8 +42,12 @@ type ClientConfig struct {
 	CryptoList               []*CryptoConfig
 	Upgrader                 xnetutil.Upgrader
 	CacheTime                time.Duration
+	XMsgHook                 xmsg.Hook
 	ShareDialFunc            ShareDialFunc
 	ShareStreamConfigList    []*ShareStreamConfig
+	// ResumeTime asks the server for a resumable session, which survives the loss of its connection for that time.
+	// Sessions from DialContext dial again by themselves, any session can be moved with ClientSession.Resume.
+	ResumeTime time.Duration
 }
 
 func NewClient(cc *ClientConfig) *Client {
@@ -77,6 +82,8 @@ func NewClient(cc *ClientConfig) *Client {
 	} else {
 		c.crypto = []*CryptoConfig{{Crypto: pcrypto.CryptoPlaintext}}
 	}
+	c.xMsgHook = cc.XMsgHook
+	c.resumeTime = cc.ResumeTime
 	if cc.CacheTime > 1*time.Second {
 		c.cacheTime = cc.CacheTime
 		c.cache = expired.NewTODO(expired.Init(c.ctx, 1))
@@ -107,8 +114,11 @@ type Client struct {
 	sessMap   tmap.SyncMap[string, *ClientSession]
 	cacheTime time.Duration
 	cache     *expired.TODO
+	xMsgHook  xmsg.Hook
 
 	share *shareManager
+
+	resumeTime time.Duration
 }
 
 func (c *Client) Context() context.Context {
@@ -136,7 +146,9 @@ func (c *Client) DialContext(ctx context.Context, dr xnetutil.Dialer, network st
 			_ = conn.Close()
 		}
 	}()
-	cs, err := c.handleConn(ctxs, conn)
+	cs, err := c.handleConn(ctxs, conn, func(ctx context.Context) (net.Conn, error) {
+		return dr.DialContext(ctx, network, addr)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +165,7 @@ func (c *Client) WithConn(ctx context.Context, conn net.Conn) (*ClientSession, e
 	c.mux.Unlock()
 	tmpCtx, tmpCl := context.WithCancel(ctx)
 	defer tmpCl()
-	cs, err := c.handleConn(tmpCtx, conn)
+	cs, err := c.handleConn(tmpCtx, conn, nil)
 	if err != nil {
 		c.wg.Done()
 		_ = conn.Close()
@@ -217,10 +229,67 @@ func (c *Client) RpcCallback(ctx context.Context, fn func(ctx context.Context, f
 	return c.share.rpcCallBack(ctx, fn)
 }
 
-func (c *Client) handleConn(ctx context.Context, conn net.Conn) (*ClientSession, error) {
+func (c *Client) handleConn(ctx context.Context, conn net.Conn, redial func(ctx context.Context) (net.Conn, error)) (*ClientSession, error) {
+	auth := GetSessionAuthInfo(ctx)
+	authInfo := make(AuthInfo, len(c.sessionAuthInfo)+len(auth)+4)
+	for key, value := range c.sessionAuthInfo {
+		authInfo[key] = value
+	}
+	for key, value := range auth {
+		authInfo[key] = value
+	}
+	resumeAuth := authInfo.Clone()
+	if c.resumeTime > 0 {
+		authInfo.Set(ResumeToken, hjson.MustMarshalStr(""))
+	}
+	conn, cp, authInfo, err := c.handshake(ctx, conn, authInfo)
+	if err != nil {
+		return nil, err
+	}
+	sc := xmsg.SessionConfig{
+		RWC:      conn,
+		Protocol: cp,
+		KeepLive: c.keepLive,
+		Ctx:      SetSessionAuthInfo(c.ctx, authInfo),
+		Flag:     xmsg.FlagOne,
+		Hook:     c.xMsgHook,
+	}
+	token, _ := GetAuthInfo[string](authInfo, ResumeToken)
+	resumable := c.resumeTime > 0 && token != ""
+	cs := &ClientSession{
+		c:         c,
+		rpcMap:    make(map[uint32]chan *xmsg.XMsg),
+		streamMap: make(map[uint32]*clientStream),
+		cacheMap:  make(map[uint32]*clientStream),
+	}
+	if resumable {
+		sc.ResumeTime = c.resumeTime
+		sc.OnSuspend = func(rs *xmsg.RawSession) {
+			cs.autoResume()
+		}
+		cs.seqs = newSeqSet()
+		cs.resumeToken = token
+		cs.resumeAuth = resumeAuth
+		cs.redial = redial
+	}
+	session := xmsg.NewSession(sc)
+	_ = conn.SetDeadline(time.Time{})
+	authInfo.Set(SessionId, hjson.MustMarshalStr(session.Id()))
+	cs.xsess = session
+	cs.peer = newPeerServer(c).newSession(session, resumable)
+	go cs.handleXMsg()
+	c.sessMap.Store(cs.Id(), cs)
+	return cs, nil
+}
+
+// handshake Select the crypto and exchange the session auth info on conn, which is closed if ctx is done before the end.
+func (c *Client) handshake(ctx context.Context, conn net.Conn, authInfo AuthInfo) (net.Conn, protocol.Protocol, AuthInfo, error) {
 	var err error
+	var mux sync.Mutex
 	k := true
 	ctxtool.GWaitFunc(ctx, func() {
+		mux.Lock()
+		defer mux.Unlock()
 		if k {
 			_ = conn.Close()
 		}
@@ -229,7 +298,7 @@ func (c *Client) handleConn(ctx context.Context, conn net.Conn) (*ClientSession,
 	if c.upgrader != nil {
 		conn, err = c.upgrader.UpgradeContext(ctx, conn)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 	}
 	if c.switchNetworkSpeedTicker {
@@ -237,48 +306,23 @@ func (c *Client) handleConn(ctx context.Context, conn net.Conn) (*ClientSession,
 	}
 	pCrypto, err := c.handleSelectCrypto(conn)
 	if err != nil {
-		return nil, err
-	}
-	sc := xmsg.SessionConfig{
-		RWC:      conn,
-		Protocol: cfcprotocol.NewCFCProtocol(pCrypto),
-		KeepLive: c.keepLive,
-		Ctx:      c.ctx,
-		Flag:     xmsg.FlagOne,
-	}
-	auth := GetSessionAuthInfo(ctx)
-	authInfo := make(AuthInfo, len(c.sessionAuthInfo)+len(auth)+4)
-	for key, value := range c.sessionAuthInfo {
-		authInfo[key] = value
-	}
-	for key, value := range auth {
-		authInfo[key] = value
+		return nil, nil, nil, err
 	}
+	cp := cfcprotocol.NewCFCProtocol(pCrypto)
 	authInfo.connSet(false, conn)
-	err = sc.Protocol.Encode(conn, authInfo)
+	err = cp.Encode(conn, authInfo)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	err = sc.Protocol.Decode(conn, &authInfo)
+	err = cp.Decode(conn, &authInfo)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	authInfo.connSet(false, conn)
-	sc.Ctx = SetSessionAuthInfo(c.ctx, authInfo)
-	session := xmsg.NewSession(sc)
-	_ = conn.SetDeadline(time.Time{})
-	authInfo.Set(SessionId, hjson.MustMarshalStr(session.Id()))
-	cs := &ClientSession{
-		c:         c,
-		xsess:     session,
-		rpcMap:    make(map[uint32]chan *xmsg.XMsg),
-		streamMap: make(map[uint32]*clientStream),
-		cacheMap:  make(map[uint32]*clientStream),
-	}
-	go cs.handleXMsg()
+	mux.Lock()
 	k = false
-	c.sessMap.Store(cs.Id(), cs)
-	return cs, nil
+	mux.Unlock()
+	return conn, cp, authInfo, nil
 }
 
 func (c *Client) handleSelectCrypto(conn net.Conn) (pcrypto.PCrypto, error) {
@@ -342,6 +386,13 @@ type ClientSession struct {
 	mux     sync.Mutex
 	disable bool
 	wg      sync.WaitGroup
+
+	seqs        *seqSet
+	peer        *serverSession
+	resumeMux   sync.Mutex
+	resumeToken string
+	resumeAuth  AuthInfo
+	redial      func(ctx context.Context) (net.Conn, error)
 }
 
 func (cs *ClientSession) Context() context.Context {
@@ -381,13 +432,14 @@ func (cs *ClientSession) Rpc(ctx context.Context, header string, send, recv any)
 	cs.wg.Add(1)
 	defer cs.wg.Done()
 	cs.mux.Unlock()
-	id, _, err := cs.xsess.SendXMsg(header, 0, optRpcReq, send)
-	if err != nil {
-		return err
-	}
+	id := cs.xsess.GetXMsgId()
 	ch := make(chan *xmsg.XMsg, 1)
 	cs.setRpc(id, ch)
 	defer cs.delRpc(id)
+	_, _, err := cs.xsess.SendXMsg(header, id, optRpcReq, send)
+	if err != nil {
+		return err
+	}
 	select {
 	case xMsg := <-ch:
 		if xMsg.Opt() == optRpcFailed {
@@ -519,6 +571,81 @@ func (cs *ClientSession) ReverseRpc(ctx context.Context, header string, data any
 	}
 }
 
+// Resume
+//
+//	Move a resumable session to conn, for example after the network changed.
+//	The session auth info is sent again with the resumption token, and the stream messages the server
+//	did not receive are sent again on conn.
+func (cs *ClientSession) Resume(ctx context.Context, conn net.Conn) error {
+	return cs.resume(ctx, conn, false)
+}
+
+func (cs *ClientSession) resume(ctx context.Context, conn net.Conn, onlySuspended bool) error {
+	cs.resumeMux.Lock()
+	defer cs.resumeMux.Unlock()
+	if cs.seqs == nil {
+		_ = conn.Close()
+		return ErrSessionNotResumable
+	}
+	if cs.xsess.Context().Err() != nil {
+		_ = conn.Close()
+		return ErrClientSessionClosed
+	}
+	if onlySuspended && !cs.xsess.Suspended() {
+		_ = conn.Close()
+		return nil
+	}
+	authInfo := cs.resumeAuth.Clone()
+	authInfo.Set(ResumeToken, hjson.MustMarshalStr(cs.resumeToken))
+	authInfo.Set(ResumeAcks, marshalResumeAcks(cs.seqs.acks()))
+	authInfo.Set(ResumePeerAcks, marshalResumeAcks(cs.peer.seqs.acks()))
+	ctx, cl := ctxtool.ContextsWithCancel(cs.xsess.Context(), ctx)
+	defer cl()
+	raw := conn
+	conn, cp, authInfo, err := cs.c.handshake(ctx, conn, authInfo)
+	if err != nil {
+		_ = raw.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	acks := seqAcks{cs.seqs, unmarshalResumeAcks(authInfo, ResumeAcks)}
+	peerAcks := seqAcks{cs.peer.seqs, unmarshalResumeAcks(authInfo, ResumePeerAcks)}
+	err = resumeSeqs(cs.xsess, conn, cp, acks, peerAcks)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+// autoResume Dial again until the session is resumed or expires.
+func (cs *ClientSession) autoResume() {
+	if cs.redial == nil {
+		return
+	}
+	ctx := cs.xsess.Context()
+	delay := 100 * time.Millisecond
+	for cs.xsess.Suspended() && ctx.Err() == nil {
+		tCtx, tCl := context.WithTimeout(ctx, cs.c.handshakeTimeout)
+		conn, err := cs.redial(tCtx)
+		if err == nil {
+			err = cs.resume(tCtx, conn, true)
+		}
+		tCl()
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
 func (cs *ClientSession) Id() string {
 	return cs.xsess.Id()
 }
@@ -592,16 +719,22 @@ func (cs *ClientSession) handleXMsg() {
 		if err != nil {
 			return
 		}
-		switch xMsg.Opt() {
-		case optRpcResp, optRpcFailed:
-			cs.handleRpc(xMsg)
-		case optStreamOpen, optStreamPing,
-			optStreamOpenRecv, optStreamOpenSend, optStreamOpenRRpc,
-			optStreamRecv, optStreamClose, optStreamFailed:
-			cs.handleStream(xMsg, n)
-		default:
+		if cs.peer != nil && isPeerCall(xMsg) {
+			cs.peer.s.handleOne(cs.peer, xMsg, n)
 			continue
 		}
+		cs.handleOne(xMsg, n)
+	}
+}
+
+func (cs *ClientSession) handleOne(xMsg *xmsg.XMsg, n int) {
+	switch xMsg.Opt() {
+	case optRpcResp, optRpcFailed:
+		cs.handleRpc(xMsg)
+	case optStreamOpen, optStreamPing,
+		optStreamOpenRecv, optStreamOpenSend, optStreamOpenRRpc,
+		optStreamRecv, optStreamClose, optStreamFailed:
+		cs.handleStream(xMsg, n)
 	}
 }
 
@@ -648,6 +781,9 @@ func (cs *ClientSession) handleStream(xMsg *xmsg.XMsg, r int) {
 			default:
 			}
 		case optStreamPing:
+			if s.seq != nil {
+				s.seq.ack(xMsg)
+			}
 			select {
 			case <-cs.xsess.Context().Done():
 				_ = s.Close()
@@ -655,6 +791,16 @@ func (cs *ClientSession) handleStream(xMsg *xmsg.XMsg, r int) {
 			case s.ping <- struct{}{}:
 			}
 		case optStreamRecv:
+			if s.seq != nil {
+				ok, err := s.seq.accept(xMsg)
+				if err != nil {
+					_ = s.close(err)
+					return
+				}
+				if !ok {
+					return
+				}
+			}
 			select {
 			case <-cs.xsess.Context().Done():
 				_ = s.Close()
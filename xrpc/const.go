@@ -18,6 +18,10 @@ const (
 
 	SessionId = "sessionId"
 
+	ResumeToken    = "resumeToken"
+	ResumeAcks     = "resumeAcks"
+	ResumePeerAcks = "resumePeerAcks"
+
 	AuthUserName = "username"
 	AuthPassword = "password"
 )
@@ -9,6 +9,9 @@ var (
 	ErrServerRunning       = xerror.New("server running")
 	ErrClientSessionClosed = xerror.New("client session closed")
 	ErrClientClosed        = xerror.New("client closed")
+	ErrSessionNotResumable = xerror.New("session not resumable")
+	ErrSessionNotFound     = xerror.New("session not found: %s")
+	ErrPeerRoute           = xerror.New("peer route: the handlers of a server session belong to its server")
 
 	ErrClientNilShareDialMethod      = xerror.New("client nil share dial method")
 	ErrClientShareDialRpcFailed      = xerror.New("client share dial rpc failed: %w")
@@ -18,7 +21,17 @@ var (
 
 	ErrStreamClosed        = xerror.New("stream closed")
 	ErrStreamInvalidAction = xerror.New("stream invalid action")
+	ErrStreamOutOfSequence = xerror.New("stream out of sequence: got %d after %d")
 	ErrInvalidCall         = xerror.New("invalid call: %v")
 
 	ErrAuthVerificationFailed = xerror.New("auth verification failed")
+
+	ErrInvalidRecord   = xerror.New("invalid record: %v")
+	ErrReplayExhausted = xerror.New("replay exhausted: %s")
+
+	ErrGatewayClosed           = xerror.New("gateway closed")
+	ErrGatewayDial             = xerror.New("gateway dial failed: %w")
+	ErrGatewayHandshake        = xerror.New("gateway handshake failed: %w")
+	ErrGatewayBadBody          = xerror.New("gateway bad body: %v")
+	ErrGatewayMethodNotAllowed = xerror.New("gateway method not allowed: %s")
 )
@@ -0,0 +1,518 @@
+package xrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xnet/xtool/xhttp"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// GatewayErrorTrailer carries the error that ended a chunked json stream.
+	GatewayErrorTrailer = "Xrpc-Error"
+
+	gatewayContentJson   = "application/json"
+	gatewayContentNdJson = "application/x-ndjson"
+	gatewayContentSSE    = "text/event-stream"
+)
+
+type GatewayConfig struct {
+	Ctx    context.Context
+	TlsCfg *tls.Config
+	Prefix string
+	// Client is used to build the xrpc client that dials Network/Addr through Dialer.
+	Client  *ClientConfig
+	Dialer  xnetutil.Dialer
+	Network string
+	Addr    string
+	// Routes are the xrpc routes exposed over http, Server.RouteList is a good source. Reverse rpc routes are ignored.
+	Routes map[Method][]string
+	// SessionHeaders and StreamHeaders map http header names to auth info keys.
+	// Http basic auth always goes to AuthUserName and AuthPassword of the session auth info.
+	SessionHeaders map[string]string
+	StreamHeaders  map[string]string
+	// ErrorStatus overrides the http status of an error, return 0 to keep the default one.
+	ErrorStatus func(err error) int
+}
+
+// Gateway
+//
+//	Expose xrpc routes to http clients that cannot speak xrpc.
+//	Rpc routes are POST endpoints taking and returning one json value.
+//	MethodRecvStream routes take a sequence of json values in the body and return one json value.
+//	MethodSendStream and MethodStream routes answer with Server-Sent Events when the client accepts text/event-stream,
+//	and with chunked json lines otherwise. MethodSendStream takes at most one json value as the init data,
+//	MethodStream sends every json value of the body to the stream.
+//	Every distinct session auth info gets its own xrpc session, which is reused until it is closed.
+type Gateway struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	hs *xhttp.Server
+	c  *Client
+
+	dr      xnetutil.Dialer
+	network string
+	addr    string
+
+	sessionHeaders map[string]string
+	streamHeaders  map[string]string
+	errorStatus    func(err error) int
+
+	mux     sync.Mutex
+	sessMap map[string]*gatewaySession
+}
+
+type gatewaySession struct {
+	mux sync.Mutex
+	cs  *ClientSession
+}
+
+func NewGateway(gc *GatewayConfig) *Gateway {
+	ctx := gc.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	g := &Gateway{
+		dr:             gc.Dialer,
+		network:        gc.Network,
+		addr:           gc.Addr,
+		sessionHeaders: gc.SessionHeaders,
+		streamHeaders:  gc.StreamHeaders,
+		errorStatus:    gc.ErrorStatus,
+		sessMap:        make(map[string]*gatewaySession),
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	if g.dr == nil {
+		g.dr = new(net.Dialer)
+	}
+	var cc ClientConfig
+	if gc.Client != nil {
+		cc = *gc.Client
+	}
+	cc.Ctx = g.ctx
+	g.c = NewClient(&cc)
+	g.hs = xhttp.NewServer(&xhttp.Config{
+		Ctx:    g.ctx,
+		TlsCfg: gc.TlsCfg,
+		Prefix: gc.Prefix,
+	})
+	for method, list := range gc.Routes {
+		for _, header := range list {
+			header := header
+			switch method {
+			case MethodRpc:
+				g.hs.Set(header, g.wrap(header, g.handleRpc))
+			case MethodStream:
+				g.hs.Set(header, g.wrap(header, g.handleStream))
+			case MethodSendStream:
+				g.hs.Set(header, g.wrap(header, g.handleRecvStream))
+			case MethodRecvStream:
+				g.hs.Set(header, g.wrap(header, g.handleSendStream))
+			}
+		}
+	}
+	ctxtool.GWaitFunc(g.ctx, func() {
+		_ = g.Close()
+	})
+	return g
+}
+
+// AutoServe if had tls config will be used
+func (g *Gateway) AutoServe(ln net.Listener) error {
+	return g.hs.AutoServe(ln)
+}
+
+func (g *Gateway) Serve(ln net.Listener) error {
+	return g.hs.Serve(ln)
+}
+
+func (g *Gateway) Close() error {
+	g.cancel()
+	err := g.hs.Close()
+	g.mux.Lock()
+	list := make([]*gatewaySession, 0, len(g.sessMap))
+	for _, gs := range g.sessMap {
+		list = append(list, gs)
+	}
+	g.sessMap = make(map[string]*gatewaySession)
+	g.mux.Unlock()
+	for _, gs := range list {
+		gs.mux.Lock()
+		if gs.cs != nil {
+			_ = gs.cs.Close()
+		}
+		gs.mux.Unlock()
+	}
+	_ = g.c.Close()
+	return err
+}
+
+func (g *Gateway) Context() context.Context {
+	return g.ctx
+}
+
+type gatewayHandler func(w http.ResponseWriter, r *http.Request, cs *ClientSession, header string) error
+
+func (g *Gateway) wrap(header string, handler gatewayHandler) xhttp.Handler {
+	return func(ctx *xhttp.Context) error {
+		w, r := ctx.Raw()
+		cs, err := g.session(r)
+		if err == nil {
+			err = handler(w, r, cs, header)
+		}
+		if err != nil {
+			g.writeError(w, err)
+		}
+		return nil
+	}
+}
+
+func (g *Gateway) session(r *http.Request) (*ClientSession, error) {
+	info := make(AuthInfo)
+	if u, p, ok := r.BasicAuth(); ok {
+		info.Set(AuthUserName, u)
+		info.Set(AuthPassword, p)
+	}
+	for name, key := range g.sessionHeaders {
+		if v := r.Header.Get(name); v != "" {
+			info.Set(key, v)
+		}
+	}
+	key := string(mustMarshalAuthInfo(info))
+	g.mux.Lock()
+	if g.ctx.Err() != nil {
+		g.mux.Unlock()
+		return nil, ErrGatewayClosed
+	}
+	gs, ok := g.sessMap[key]
+	if !ok {
+		gs = new(gatewaySession)
+		g.sessMap[key] = gs
+	}
+	g.mux.Unlock()
+	gs.mux.Lock()
+	defer gs.mux.Unlock()
+	if gs.cs != nil && gs.cs.Context().Err() == nil {
+		return gs.cs, nil
+	}
+	conn, err := g.dr.DialContext(r.Context(), g.network, g.addr)
+	if err != nil {
+		return nil, ErrGatewayDial.Errorf(err)
+	}
+	cs, err := g.c.WithConn(SetSessionAuthInfo(r.Context(), info), conn)
+	if err != nil {
+		return nil, ErrGatewayHandshake.Errorf(err)
+	}
+	gs.cs = cs
+	ctxtool.GWaitFunc(cs.Context(), func() {
+		g.mux.Lock()
+		defer g.mux.Unlock()
+		if g.sessMap[key] == gs {
+			delete(g.sessMap, key)
+		}
+	})
+	return cs, nil
+}
+
+func (g *Gateway) streamContext(r *http.Request) context.Context {
+	info := make(AuthInfo)
+	for name, key := range g.streamHeaders {
+		if v := r.Header.Get(name); v != "" {
+			info.Set(key, v)
+		}
+	}
+	return SetStreamAuthInfo(r.Context(), info)
+}
+
+func (g *Gateway) handleRpc(w http.ResponseWriter, r *http.Request, cs *ClientSession, header string) error {
+	if r.Method != http.MethodPost {
+		return ErrGatewayMethodNotAllowed.Errorf(r.Method)
+	}
+	list, err := readGatewayBody(r, 1)
+	if err != nil {
+		return err
+	}
+	var send any
+	if len(list) != 0 {
+		send = list[0]
+	}
+	var recv xmsg.RawPayload
+	err = cs.Rpc(r.Context(), header, send, &recv)
+	if err != nil {
+		return err
+	}
+	b, err := gatewayJson(recv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", gatewayContentJson)
+	_, _ = w.Write(append(b, '\n'))
+	return nil
+}
+
+// handleSendStream The http client sends, the xrpc server receives.
+func (g *Gateway) handleSendStream(w http.ResponseWriter, r *http.Request, cs *ClientSession, header string) error {
+	if r.Method != http.MethodPost {
+		return ErrGatewayMethodNotAllowed.Errorf(r.Method)
+	}
+	list, err := readGatewayBody(r, -1)
+	if err != nil {
+		return err
+	}
+	stream, err := cs.SendStream(g.streamContext(r), header)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if len(list) == 0 {
+		err = stream.Send(nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, one := range list {
+		err = stream.Send(one)
+		if err != nil {
+			return err
+		}
+	}
+	var recv xmsg.RawPayload
+	err = stream.Bind(&recv)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		return err
+	}
+	b, err := gatewayJson(recv)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", gatewayContentJson)
+	_, _ = w.Write(append(b, '\n'))
+	return nil
+}
+
+// handleRecvStream The xrpc server sends, the http client receives.
+func (g *Gateway) handleRecvStream(w http.ResponseWriter, r *http.Request, cs *ClientSession, header string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return ErrGatewayMethodNotAllowed.Errorf(r.Method)
+	}
+	list, err := readGatewayBody(r, 1)
+	if err != nil {
+		return err
+	}
+	var data any
+	if len(list) != 0 {
+		data = list[0]
+	}
+	stream, err := cs.RecvStream(g.streamContext(r), header, data)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return g.pipe(w, r, stream.Recv)
+}
+
+func (g *Gateway) handleStream(w http.ResponseWriter, r *http.Request, cs *ClientSession, header string) error {
+	if r.Method != http.MethodPost {
+		return ErrGatewayMethodNotAllowed.Errorf(r.Method)
+	}
+	stream, err := cs.Stream(g.streamContext(r), header)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	// open it first so that a refused stream still gets a proper status
+	err = stream.Send(nil)
+	if err != nil {
+		return err
+	}
+	_ = http.NewResponseController(w).EnableFullDuplex()
+	go func() {
+		dec := json.NewDecoder(r.Body)
+		for {
+			var one json.RawMessage
+			err := dec.Decode(&one)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					_ = stream.Close()
+				}
+				return
+			}
+			err = stream.Send(one)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return g.pipe(w, r, stream.Recv)
+}
+
+func (g *Gateway) pipe(w http.ResponseWriter, r *http.Request, recv func(out any) error) error {
+	sse := strings.Contains(r.Header.Get("Accept"), gatewayContentSSE)
+	rc := http.NewResponseController(w)
+	started := false
+	for {
+		var payload xmsg.RawPayload
+		err := recv(&payload)
+		if err == nil {
+			var b []byte
+			b, err = gatewayJson(payload)
+			if err == nil {
+				if !started {
+					started = true
+					if sse {
+						w.Header().Set("Content-Type", gatewayContentSSE)
+						w.Header().Set("Cache-Control", "no-cache")
+					} else {
+						w.Header().Set("Content-Type", gatewayContentNdJson)
+					}
+					w.WriteHeader(http.StatusOK)
+				}
+				if sse {
+					_, err = w.Write([]byte("data: " + string(b) + "\n\n"))
+				} else {
+					_, err = w.Write(append(b, '\n'))
+				}
+				if err == nil {
+					err = rc.Flush()
+				}
+				if err == nil {
+					continue
+				}
+				return nil
+			}
+		}
+		if r.Context().Err() != nil {
+			err = r.Context().Err()
+		} else if errors.Is(err, ErrStreamClosed) || errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		if !started {
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return err
+		}
+		if err != nil {
+			if sse {
+				b, _ := json.Marshal(err.Error())
+				_, _ = w.Write([]byte("event: error\ndata: " + string(b) + "\n\n"))
+			} else {
+				w.Header().Set(http.TrailerPrefix+GatewayErrorTrailer, err.Error())
+			}
+		}
+		return nil
+	}
+}
+
+func (g *Gateway) writeError(w http.ResponseWriter, err error) {
+	status := 0
+	if g.errorStatus != nil {
+		status = g.errorStatus(err)
+	}
+	if status == 0 {
+		status = GatewayStatus(err)
+	}
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", gatewayContentJson)
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
+
+// GatewayStatus The default http status of an error returned by the gateway.
+func GatewayStatus(err error) int {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, ErrGatewayBadBody):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrGatewayMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrGatewayHandshake):
+		// the server drops the connection when it refuses the session auth info
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return http.StatusUnauthorized
+		}
+		return http.StatusBadGateway
+	case errors.Is(err, ErrGatewayDial), errors.Is(err, ErrClientSessionClosed), errors.Is(err, ErrClientClosed):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrGatewayClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		// the http client went away
+		return 499
+	// errors from the server only keep their text
+	case msg == ErrAuthVerificationFailed.Error():
+		return http.StatusUnauthorized
+	case strings.HasPrefix(msg, ErrInvalidCall.Errorf("").Error()):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readGatewayBody Read up to limit json values from the body, a negative limit means no limit.
+func readGatewayBody(r *http.Request, limit int) ([]json.RawMessage, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	dec := json.NewDecoder(r.Body)
+	var list []json.RawMessage
+	for limit < 0 || len(list) < limit {
+		var one json.RawMessage
+		err := dec.Decode(&one)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, ErrGatewayBadBody.Errorf(err)
+		}
+		list = append(list, one)
+	}
+	if limit >= 0 && dec.More() {
+		return nil, ErrGatewayBadBody.Errorf("too many values")
+	}
+	return list, nil
+}
+
+// gatewayJson Turn a payload into json whatever way it was marshaled, raw bytes become a base64 string.
+func gatewayJson(payload xmsg.RawPayload) ([]byte, error) {
+	if len(payload) == 0 {
+		return []byte("null"), nil
+	}
+	xMsg, err := xmsg.NewXMsg("", xmsg.FlagZero, 0, 0, payload)
+	if err != nil {
+		return nil, err
+	}
+	var nb xmsg.NoBytes
+	err = xMsg.Unmarshal(&nb)
+	if err == nil {
+		return nb, nil
+	}
+	if !errors.Is(err, xmsg.ErrDataOutputTypeInvalid) {
+		return nil, err
+	}
+	var str string
+	if xMsg.Unmarshal(&str) == nil {
+		return json.Marshal(str)
+	}
+	var b []byte
+	err = xMsg.Unmarshal(&b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
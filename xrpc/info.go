@@ -190,7 +190,7 @@ func (a AuthInfo) Clone() AuthInfo {
 	for k, v := range a {
 		m[k] = v
 	}
-	return a
+	return m
 }
 
 func (a AuthInfo) connSet(s bool, conn net.Conn) AuthInfo {
@@ -0,0 +1,135 @@
+package xrpc
+
+import (
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+)
+
+// peer mode
+//
+//	Both ends of a session can open calls, and the xmsg flag of a message tells which end opened its call:
+//	the end that opens a call writes FlagOne (SendXMsg) and the end that answers writes FlagZero (RecvXMsg),
+//	so the ids of both ends never meet.
+//	A ClientSession serves the handlers added to it the way a Server does,
+//	and Server.PeerSession opens rpc and streams toward a session with the ClientSession api.
+
+// isPeerCall A message of a call opened by the other end.
+func isPeerCall(xMsg *xmsg.XMsg) bool {
+	return xMsg.Flag() == xmsg.FlagOne
+}
+
+// newPeerServer The Server that serves the calls opened by the server on the sessions of c.
+func newPeerServer(c *Client) *Server {
+	return &Server{
+		ctx:        c.ctx,
+		streamPing: c.streamPing,
+		cacheTime:  c.cacheTime,
+		cache:      c.cache,
+		rpcRoute:   make(map[string]RpcHandler),
+		ssRoute:    make(map[string]StreamHandler),
+		rsRoute:    make(map[string]SendStreamHandler),
+		srRoute:    make(map[string]RecvStreamHandler),
+		rrRoute:    make(map[string]ReverseRpcHandler),
+	}
+}
+
+// newPeerClient The Client that opens the calls of s toward its sessions.
+func newPeerClient(s *Server) *Client {
+	return &Client{
+		ctx:              s.ctx,
+		handshakeTimeout: s.handshakeTimeout,
+		streamPing:       s.streamPing,
+		cacheTime:        s.cacheTime,
+		cache:            s.cache,
+	}
+}
+
+// newSession Must be paired with a Close.
+func (s *Server) newSession(rs *xmsg.RawSession, resumable bool) *serverSession {
+	ss := &serverSession{
+		s:          s,
+		RawSession: rs,
+		cacheMap:   make(map[uint32]*serverStream),
+		streamMap:  make(map[uint32]*serverStream),
+	}
+	if resumable {
+		ss.seqs = newSeqSet()
+	}
+	if s.peer != nil {
+		ss.peer = s.peer.newSession(rs, resumable)
+	}
+	return ss
+}
+
+// newSession Must be paired with a Close, rs can be set later.
+func (c *Client) newSession(rs *xmsg.RawSession, resumable bool) *ClientSession {
+	c.wg.Add(1)
+	cs := &ClientSession{
+		c:         c,
+		xsess:     rs,
+		rpcMap:    make(map[uint32]chan *xmsg.XMsg),
+		streamMap: make(map[uint32]*clientStream),
+		cacheMap:  make(map[uint32]*clientStream),
+	}
+	if resumable {
+		cs.seqs = newSeqSet()
+	}
+	return cs
+}
+
+// PeerSession The session sid as a ClientSession, to open rpc and streams toward the handlers of its client.
+func (s *Server) PeerSession(sid string) (*ClientSession, error) {
+	ss, ok := s.sessMap.Load(sid)
+	if !ok {
+		return nil, ErrSessionNotFound.Errorf(sid)
+	}
+	return ss.peer, nil
+}
+
+func (cs *ClientSession) MustAddHandler(header string, handler any) {
+	if cs.peer == nil {
+		panic(ErrPeerRoute)
+	}
+	cs.peer.s.MustAddHandler(header, handler)
+}
+
+func (cs *ClientSession) AddRpcHandler(header string, handler RpcHandler) error {
+	if cs.peer == nil {
+		return ErrPeerRoute
+	}
+	return cs.peer.s.AddRpcHandler(header, handler)
+}
+
+func (cs *ClientSession) AddStreamHandler(header string, handler StreamHandler) error {
+	if cs.peer == nil {
+		return ErrPeerRoute
+	}
+	return cs.peer.s.AddStreamHandler(header, handler)
+}
+
+func (cs *ClientSession) AddSendStreamHandler(header string, handler SendStreamHandler) error {
+	if cs.peer == nil {
+		return ErrPeerRoute
+	}
+	return cs.peer.s.AddSendStreamHandler(header, handler)
+}
+
+func (cs *ClientSession) AddRecvStreamHandler(header string, handler RecvStreamHandler) error {
+	if cs.peer == nil {
+		return ErrPeerRoute
+	}
+	return cs.peer.s.AddRecvStreamHandler(header, handler)
+}
+
+func (cs *ClientSession) AddReverseRpcHandler(header string, handler ReverseRpcHandler) error {
+	if cs.peer == nil {
+		return ErrPeerRoute
+	}
+	return cs.peer.s.AddReverseRpcHandler(header, handler)
+}
+
+func (cs *ClientSession) RouteList() map[Method][]string {
+	if cs.peer == nil {
+		return new(Server).RouteList()
+	}
+	return cs.peer.s.RouteList()
+}
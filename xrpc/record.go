@@ -0,0 +1,402 @@
+package xrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"io"
+	"sync"
+	"time"
+)
+
+// record file layout
+//
+//	magic | version | start unix nano (8 bytes big endian) | record...
+//	record: kind | uvarint session index | uvarint nano since start | body
+//	open body: session id | auth info json
+//	xmsg body: dir | opt | uvarint id | header | payload
+//	every string or bytes field is prefixed by its uvarint length.
+const (
+	recordMagic   = "XRPCREC"
+	recordVersion = 1
+)
+
+type RecordKind uint8
+
+const (
+	RecordSessionOpen RecordKind = iota + 1
+	RecordSessionClose
+	RecordXMsg
+)
+
+func (k RecordKind) String() string {
+	switch k {
+	case RecordSessionOpen:
+		return "sessionOpen"
+	case RecordSessionClose:
+		return "sessionClose"
+	case RecordXMsg:
+		return "xMsg"
+	default:
+		return "unknown"
+	}
+}
+
+// Record
+//
+//	One entry of a record file. Dir is seen from the server,
+//	so DirectionRead is what the client sent and DirectionWrite is what the server answered.
+type Record struct {
+	Kind     RecordKind
+	Time     time.Time
+	Session  string
+	AuthInfo AuthInfo // RecordSessionOpen only
+	Dir      xmsg.Direction
+	Header   string
+	Id       uint32
+	Opt      xmsg.OptType
+	Payload  []byte
+}
+
+// Bind Unmarshal the payload of a RecordXMsg, with the same rules as xmsg.XMsg.Unmarshal.
+func (r *Record) Bind(out any) error {
+	xMsg, err := xmsg.NewXMsg(r.Header, xmsg.FlagZero, r.Id, r.Opt, nil)
+	if err != nil {
+		return err
+	}
+	xMsg.SetPayload(r.Payload)
+	return xMsg.Unmarshal(out)
+}
+
+// RedactKeys Build a redaction callback that removes the given keys, such as AuthPassword.
+func RedactKeys(keys ...string) func(info AuthInfo) AuthInfo {
+	return func(info AuthInfo) AuthInfo {
+		for _, key := range keys {
+			delete(info, key)
+		}
+		return info
+	}
+}
+
+type RecorderConfig struct {
+	// Redact is called with a copy of every session and stream AuthInfo before it is written.
+	Redact func(info AuthInfo) AuthInfo
+}
+
+// Recorder
+//
+//	Set it as ServerConfig.Recorder to write every decrypted xrpc message of the server to w.
+//	Session keep-alive traffic is not recorded. Recording stops at the first write error, see Err.
+type Recorder struct {
+	mux    sync.Mutex
+	w      io.Writer
+	start  time.Time
+	redact func(info AuthInfo) AuthInfo
+	index  map[string]uint64
+	next   uint64
+	err    error
+}
+
+func NewRecorder(w io.Writer, cfg *RecorderConfig) (*Recorder, error) {
+	if cfg == nil {
+		cfg = new(RecorderConfig)
+	}
+	r := &Recorder{
+		w:      w,
+		start:  time.Now(),
+		redact: cfg.Redact,
+		index:  make(map[string]uint64),
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(recordMagic)
+	buf.WriteByte(recordVersion)
+	_ = binary.Write(buf, binary.BigEndian, r.start.UnixNano())
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Err The error that stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.err
+}
+
+func (r *Recorder) openSession(sid string, info AuthInfo) {
+	info = r.redactInfo(info)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	idx := r.next
+	r.next++
+	r.index[sid] = idx
+	buf := r.newRecord(RecordSessionOpen, idx)
+	writeRecordBytes(buf, []byte(sid))
+	writeRecordBytes(buf, mustMarshalAuthInfo(info))
+	r.write(buf)
+}
+
+func (r *Recorder) closeSession(sid string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	idx, ok := r.index[sid]
+	if !ok {
+		return
+	}
+	delete(r.index, sid)
+	r.write(r.newRecord(RecordSessionClose, idx))
+}
+
+func (r *Recorder) hook(rs *xmsg.RawSession, dir xmsg.Direction, xMsg *xmsg.XMsg) (*xmsg.XMsg, error) {
+	if !isXrpcOpt(xMsg.Opt()) {
+		return xMsg, nil
+	}
+	// the calls the server opens in peer mode are not part of the replay
+	if isPeerCall(xMsg) == (dir == xmsg.DirectionWrite) {
+		return xMsg, nil
+	}
+	payload := xMsg.Payload()
+	if dir == xmsg.DirectionRead && isStreamOpenOpt(xMsg.Opt()) && r.redact != nil {
+		payload = r.redactStreamPayload(xMsg, payload)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	idx, ok := r.index[rs.Id()]
+	if !ok {
+		return xMsg, nil
+	}
+	buf := r.newRecord(RecordXMsg, idx)
+	buf.WriteByte(byte(dir))
+	buf.WriteByte(byte(xMsg.Opt()))
+	writeRecordUvarint(buf, uint64(xMsg.Id()))
+	writeRecordBytes(buf, []byte(xMsg.Header()))
+	writeRecordBytes(buf, payload)
+	r.write(buf)
+	return xMsg, nil
+}
+
+func (r *Recorder) redactStreamPayload(xMsg *xmsg.XMsg, payload []byte) []byte {
+	var info streamHandshakeInfo
+	if xMsg.Unmarshal(&info) != nil {
+		return payload
+	}
+	info.AuthInfo = r.redactInfo(info.AuthInfo)
+	tmp, err := xmsg.NewXMsg(xMsg.Header(), xMsg.Flag(), xMsg.Id(), xMsg.Opt(), info)
+	if err != nil {
+		return payload
+	}
+	return tmp.Payload()
+}
+
+func (r *Recorder) redactInfo(info AuthInfo) AuthInfo {
+	info = info.Clone()
+	if r.redact != nil {
+		info = r.redact(info)
+	}
+	return info
+}
+
+func (r *Recorder) newRecord(kind RecordKind, idx uint64) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(kind))
+	writeRecordUvarint(buf, idx)
+	writeRecordUvarint(buf, uint64(time.Since(r.start)))
+	return buf
+}
+
+func (r *Recorder) write(buf *bytes.Buffer) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = r.w.Write(buf.Bytes())
+}
+
+// RecordReader Read back the records written by a Recorder.
+type RecordReader struct {
+	r     *bufio.Reader
+	start time.Time
+	index map[uint64]string
+}
+
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	rr := &RecordReader{
+		r:     bufio.NewReader(r),
+		index: make(map[uint64]string),
+	}
+	head := make([]byte, len(recordMagic)+1+8)
+	_, err := io.ReadFull(rr.r, head)
+	if err != nil {
+		return nil, ErrInvalidRecord.Errorf(err)
+	}
+	if string(head[:len(recordMagic)]) != recordMagic || head[len(recordMagic)] != recordVersion {
+		return nil, ErrInvalidRecord.Errorf("bad magic or version")
+	}
+	rr.start = time.Unix(0, int64(binary.BigEndian.Uint64(head[len(recordMagic)+1:])))
+	return rr, nil
+}
+
+// Next The next record, io.EOF at the end of the file.
+func (rr *RecordReader) Next() (*Record, error) {
+	kind, err := rr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, rr.unexpected(err)
+	}
+	d, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, rr.unexpected(err)
+	}
+	rec := &Record{
+		Kind: RecordKind(kind),
+		Time: rr.start.Add(time.Duration(d)),
+	}
+	switch rec.Kind {
+	case RecordSessionOpen:
+		sid, err := rr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		info, err := rr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(info, &rec.AuthInfo)
+		if err != nil {
+			return nil, ErrInvalidRecord.Errorf(err)
+		}
+		rec.Session = string(sid)
+		rr.index[idx] = rec.Session
+	case RecordSessionClose:
+		rec.Session = rr.index[idx]
+		delete(rr.index, idx)
+	case RecordXMsg:
+		rec.Session = rr.index[idx]
+		dir, err := rr.r.ReadByte()
+		if err != nil {
+			return nil, rr.unexpected(err)
+		}
+		opt, err := rr.r.ReadByte()
+		if err != nil {
+			return nil, rr.unexpected(err)
+		}
+		id, err := binary.ReadUvarint(rr.r)
+		if err != nil {
+			return nil, rr.unexpected(err)
+		}
+		header, err := rr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := rr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		rec.Dir = xmsg.Direction(dir)
+		rec.Opt = xmsg.OptType(opt)
+		rec.Id = uint32(id)
+		rec.Header = string(header)
+		rec.Payload = payload
+	default:
+		return nil, ErrInvalidRecord.Errorf("unknown record kind")
+	}
+	return rec, nil
+}
+
+func (rr *RecordReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, rr.unexpected(err)
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(rr.r, b)
+	if err != nil {
+		return nil, rr.unexpected(err)
+	}
+	return b, nil
+}
+
+func (rr *RecordReader) unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return ErrInvalidRecord.Errorf(err)
+}
+
+// ReadRecords Read a whole record file.
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	rr, err := NewRecordReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Record
+	for {
+		rec, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return list, nil
+			}
+			return list, err
+		}
+		list = append(list, rec)
+	}
+}
+
+func writeRecordUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func writeRecordBytes(buf *bytes.Buffer, b []byte) {
+	writeRecordUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func mustMarshalAuthInfo(info AuthInfo) []byte {
+	if info == nil {
+		info = make(AuthInfo)
+	}
+	b, _ := json.Marshal(info)
+	return b
+}
+
+func isXrpcOpt(opt xmsg.OptType) bool {
+	return opt >= optRpcReq && opt <= optStreamOpenRRpc
+}
+
+func isStreamOpenOpt(opt xmsg.OptType) bool {
+	switch opt {
+	case optStreamOpen, optStreamOpenSend, optStreamOpenRecv, optStreamOpenRRpc:
+		return true
+	default:
+		return false
+	}
+}
+
+// joinHooks Chain two hooks, inner sees messages as xrpc reads and writes them, outer as they are on the wire.
+func joinHooks(inner, outer xmsg.Hook) xmsg.Hook {
+	if inner == nil {
+		return outer
+	}
+	if outer == nil {
+		return inner
+	}
+	return func(rs *xmsg.RawSession, dir xmsg.Direction, xMsg *xmsg.XMsg) (*xmsg.XMsg, error) {
+		first, second := outer, inner
+		if dir == xmsg.DirectionWrite {
+			first, second = inner, outer
+		}
+		xMsg, err := first(rs, dir, xMsg)
+		if err != nil || xMsg == nil {
+			return xMsg, err
+		}
+		return second(rs, dir, xMsg)
+	}
+}
@@ -0,0 +1,498 @@
+package xrpc
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
+	"sync"
+	"time"
+)
+
+type ReplayConfig struct {
+	// Sessions and Routes select what is replayed, empty means everything.
+	Sessions []string
+	Routes   []string
+	// SessionAuthInfo and StreamAuthInfo rebuild the recorded (and maybe redacted) auth info before it is sent again.
+	SessionAuthInfo func(sid string, info AuthInfo) AuthInfo
+	StreamAuthInfo  func(sid string, info AuthInfo) AuthInfo
+	// KeepTiming waits the recorded gap between two messages instead of sending them back to back.
+	KeepTiming bool
+}
+
+// Replayer
+//
+//	Drive a real server with the recorded client traffic (ReplayClient),
+//	or a real client with the recorded server traffic (ReplayServer).
+type Replayer struct {
+	cfg      ReplayConfig
+	records  []*Record
+	sessions []string
+	authMap  map[string]AuthInfo
+}
+
+func NewReplayer(r io.Reader, cfg *ReplayConfig) (*Replayer, error) {
+	list, err := ReadRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayerWithRecords(list, cfg), nil
+}
+
+func NewReplayerWithRecords(list []*Record, cfg *ReplayConfig) *Replayer {
+	rp := &Replayer{
+		authMap: make(map[string]AuthInfo),
+	}
+	if cfg != nil {
+		rp.cfg = *cfg
+	}
+	sm := make(map[string]bool, len(rp.cfg.Sessions))
+	for _, one := range rp.cfg.Sessions {
+		sm[one] = true
+	}
+	rm := make(map[string]bool, len(rp.cfg.Routes))
+	for _, one := range rp.cfg.Routes {
+		rm[one] = true
+	}
+	for _, rec := range list {
+		if len(sm) != 0 && !sm[rec.Session] {
+			continue
+		}
+		switch rec.Kind {
+		case RecordSessionOpen:
+			rp.sessions = append(rp.sessions, rec.Session)
+			rp.authMap[rec.Session] = rec.AuthInfo
+		case RecordXMsg:
+			if len(rm) != 0 && !rm[rec.Header] {
+				continue
+			}
+		}
+		rp.records = append(rp.records, rec)
+	}
+	return rp
+}
+
+// Records The records left after filtering.
+func (rp *Replayer) Records() []*Record {
+	return rp.records
+}
+
+// Sessions The recorded session ids left after filtering, in the order they were opened.
+func (rp *Replayer) Sessions() []string {
+	return rp.sessions
+}
+
+// ReplayClient
+//
+//	Dial every selected session again with a new Client built from cc and resend what the recorded client sent.
+//	It returns what the server answered, with the recorded session ids and message ids so that it can be compared
+//	with Records, once everything that was answered in the record is answered again or ctx is done.
+func (rp *Replayer) ReplayClient(ctx context.Context, cc *ClientConfig, dr xnetutil.Dialer, network string, addr string) ([]*Record, error) {
+	var cfg ClientConfig
+	if cc != nil {
+		cfg = *cc
+	}
+	tracker := &replayTracker{sessMap: make(map[string]*replaySession)}
+	cfg.XMsgHook = joinHooks(tracker.hook, cfg.XMsgHook)
+	c := NewClient(&cfg)
+	defer c.Close()
+	for _, sid := range rp.sessions {
+		err := rp.replayClientSession(ctx, c, tracker, sid, dr, network, addr)
+		if err != nil {
+			return tracker.result(), err
+		}
+	}
+	return tracker.result(), nil
+}
+
+func (rp *Replayer) replayClientSession(ctx context.Context, c *Client, tracker *replayTracker, sid string, dr xnetutil.Dialer, network string, addr string) error {
+	info := rp.authMap[sid].Clone()
+	if rp.cfg.SessionAuthInfo != nil {
+		info = rp.cfg.SessionAuthInfo(sid, info)
+	}
+	conn, err := dr.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	cs, err := c.WithConn(SetSessionAuthInfo(ctx, info), conn)
+	if err != nil {
+		return err
+	}
+	defer cs.Close()
+	answered := make(map[uint32]bool)
+	for _, rec := range rp.records {
+		if rec.Session == sid && rec.Kind == RecordXMsg && rec.Dir == xmsg.DirectionWrite && isTerminalOpt(rec.Opt) {
+			answered[rec.Id] = true
+		}
+	}
+	rs := tracker.add(cs.xsess.Id(), sid)
+	var last time.Time
+	for _, rec := range rp.records {
+		if rec.Session != sid || rec.Kind != RecordXMsg || rec.Dir != xmsg.DirectionRead {
+			continue
+		}
+		if rp.cfg.KeepTiming && !last.IsZero() {
+			err = sleepContext(ctx, rec.Time.Sub(last))
+			if err != nil {
+				return err
+			}
+		}
+		last = rec.Time
+		payload := rec.Payload
+		if isStreamOpenOpt(rec.Opt) && rp.cfg.StreamAuthInfo != nil {
+			payload = rp.rebuildStreamPayload(sid, rec)
+		}
+		id := rs.liveId(rec.Id, cs.xsess.GetXMsgId, answered[rec.Id] && (rec.Opt == optRpcReq || isStreamOpenOpt(rec.Opt)))
+		_, _, err = cs.xsess.SendXMsg(rec.Header, id, rec.Opt, xmsg.RawPayload(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return rs.wait(ctx, cs.Context())
+}
+
+func (rp *Replayer) rebuildStreamPayload(sid string, rec *Record) []byte {
+	var info streamHandshakeInfo
+	if rec.Bind(&info) != nil {
+		return rec.Payload
+	}
+	if info.AuthInfo == nil {
+		info.AuthInfo = make(AuthInfo)
+	}
+	info.AuthInfo = rp.cfg.StreamAuthInfo(sid, info.AuthInfo)
+	xMsg, err := xmsg.NewXMsg(rec.Header, xmsg.FlagZero, rec.Id, rec.Opt, info)
+	if err != nil {
+		return rec.Payload
+	}
+	return xMsg.Payload()
+}
+
+// ReplayServer
+//
+//	Build a Server that answers every recorded rpc and stream route with what the recorded server answered,
+//	in the recorded order per route, and fails with ErrReplayExhausted afterward. Reverse rpc routes are not replayed.
+//	Serve it and point the client under test at it.
+func (rp *Replayer) ReplayServer(sc *ServerConfig) *Server {
+	s := NewServer(sc)
+	m := rp.exchanges()
+	q := &replayQueue{m: m}
+	for key := range m {
+		key := key
+		switch key.opt {
+		case optRpcReq:
+			_ = s.AddRpcHandler(key.header, func(ctx Rpc) (any, error) {
+				ex := q.pop(key)
+				if ex == nil {
+					return nil, ErrReplayExhausted.Errorf(key.header)
+				}
+				return ex.rpcResult()
+			})
+		case optStreamOpen:
+			_ = s.AddStreamHandler(key.header, func(ctx Stream) error {
+				ex := q.pop(key)
+				if ex == nil {
+					return ErrReplayExhausted.Errorf(key.header)
+				}
+				go func() {
+					for ctx.Recv(nil) == nil {
+					}
+				}()
+				return ex.play(ctx.Context(), rp.cfg.KeepTiming, ctx.Send)
+			})
+		case optStreamOpenSend:
+			_ = s.AddSendStreamHandler(key.header, func(ctx SendStream) error {
+				ex := q.pop(key)
+				if ex == nil {
+					return ErrReplayExhausted.Errorf(key.header)
+				}
+				return ex.play(ctx.Context(), rp.cfg.KeepTiming, ctx.Send)
+			})
+		case optStreamOpenRecv:
+			_ = s.AddRecvStreamHandler(key.header, func(ctx RecvStream) (any, error) {
+				ex := q.pop(key)
+				if ex == nil {
+					return nil, ErrReplayExhausted.Errorf(key.header)
+				}
+				for i := 0; i < ex.sends; i++ {
+					err := ctx.Recv(nil)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return ex.recvResult(ctx.Context())
+			})
+		}
+	}
+	return s
+}
+
+func (rp *Replayer) exchanges() map[replayKey][]*replayExchange {
+	type sessId struct {
+		sid string
+		id  uint32
+	}
+	open := make(map[sessId]*replayExchange)
+	m := make(map[replayKey][]*replayExchange)
+	for _, rec := range rp.records {
+		if rec.Kind != RecordXMsg {
+			continue
+		}
+		key := sessId{sid: rec.Session, id: rec.Id}
+		ex := open[key]
+		if rec.Dir == xmsg.DirectionRead {
+			switch {
+			case rec.Opt == optRpcReq || isStreamOpenOpt(rec.Opt):
+				ex = &replayExchange{open: rec}
+				open[key] = ex
+				rk := replayKey{header: rec.Header, opt: rec.Opt}
+				m[rk] = append(m[rk], ex)
+			case ex == nil:
+			case rec.Opt == optStreamSend:
+				ex.sends++
+			case rec.Opt == optStreamClose || rec.Opt == optStreamFailed:
+				if !ex.terminated {
+					ex.clientClosed = true
+				}
+			}
+			continue
+		}
+		if ex == nil {
+			continue
+		}
+		switch rec.Opt {
+		case optRpcResp, optRpcFailed, optStreamRecv, optStreamClose, optStreamFailed:
+			ex.answer = append(ex.answer, rec)
+			if isTerminalOpt(rec.Opt) {
+				ex.terminated = true
+			}
+		}
+	}
+	return m
+}
+
+type replayKey struct {
+	header string
+	opt    xmsg.OptType
+}
+
+type replayQueue struct {
+	mux sync.Mutex
+	m   map[replayKey][]*replayExchange
+}
+
+func (q *replayQueue) pop(key replayKey) *replayExchange {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	list := q.m[key]
+	if len(list) == 0 {
+		return nil
+	}
+	q.m[key] = list[1:]
+	return list[0]
+}
+
+type replayExchange struct {
+	open         *Record
+	sends        int
+	answer       []*Record
+	terminated   bool
+	clientClosed bool
+}
+
+func (ex *replayExchange) rpcResult() (any, error) {
+	for _, rec := range ex.answer {
+		switch rec.Opt {
+		case optRpcResp:
+			return xmsg.RawPayload(rec.Payload), nil
+		case optRpcFailed:
+			return nil, recordError(rec)
+		}
+	}
+	return nil, ErrReplayExhausted.Errorf(ex.open.Header)
+}
+
+func (ex *replayExchange) recvResult(ctx context.Context) (any, error) {
+	for _, rec := range ex.answer {
+		switch rec.Opt {
+		case optStreamRecv:
+			return xmsg.RawPayload(rec.Payload), nil
+		case optStreamFailed:
+			return nil, recordError(rec)
+		}
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (ex *replayExchange) play(ctx context.Context, keepTiming bool, send func(data any) error) error {
+	last := ex.open.Time
+	for _, rec := range ex.answer {
+		if keepTiming {
+			err := sleepContext(ctx, rec.Time.Sub(last))
+			if err != nil {
+				return err
+			}
+			last = rec.Time
+		}
+		switch rec.Opt {
+		case optStreamRecv:
+			err := send(xmsg.RawPayload(rec.Payload))
+			if err != nil {
+				return err
+			}
+		case optStreamFailed:
+			return recordError(rec)
+		case optStreamClose:
+			if ex.clientClosed {
+				<-ctx.Done()
+			}
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+type replayTracker struct {
+	mux     sync.Mutex
+	sessMap map[string]*replaySession
+	list    []*Record
+}
+
+type replaySession struct {
+	sid     string
+	mux     sync.Mutex
+	ids     map[uint32]uint32 // recorded id -> live id
+	back    map[uint32]uint32 // live id -> recorded id
+	pending map[uint32]bool
+	notify  chan struct{}
+}
+
+func (rt *replayTracker) add(live string, sid string) *replaySession {
+	rs := &replaySession{
+		sid:     sid,
+		ids:     make(map[uint32]uint32),
+		back:    make(map[uint32]uint32),
+		pending: make(map[uint32]bool),
+		notify:  make(chan struct{}, 1),
+	}
+	rt.mux.Lock()
+	rt.sessMap[live] = rs
+	rt.mux.Unlock()
+	return rs
+}
+
+func (rt *replayTracker) hook(sess *xmsg.RawSession, dir xmsg.Direction, xMsg *xmsg.XMsg) (*xmsg.XMsg, error) {
+	if dir != xmsg.DirectionRead || !isXrpcOpt(xMsg.Opt()) {
+		return xMsg, nil
+	}
+	rt.mux.Lock()
+	rs, ok := rt.sessMap[sess.Id()]
+	rt.mux.Unlock()
+	if !ok {
+		return xMsg, nil
+	}
+	id, ok := rs.answer(xMsg.Id(), isTerminalOpt(xMsg.Opt()))
+	if !ok {
+		return xMsg, nil
+	}
+	rt.mux.Lock()
+	rt.list = append(rt.list, &Record{
+		Kind:    RecordXMsg,
+		Time:    time.Now(),
+		Session: rs.sid,
+		Dir:     xmsg.DirectionWrite,
+		Header:  xMsg.Header(),
+		Id:      id,
+		Opt:     xMsg.Opt(),
+		Payload: append([]byte(nil), xMsg.Payload()...),
+	})
+	rt.mux.Unlock()
+	return xMsg, nil
+}
+
+func (rt *replayTracker) result() []*Record {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	return append([]*Record(nil), rt.list...)
+}
+
+func (rs *replaySession) liveId(id uint32, gen func() uint32, wait bool) uint32 {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	live, ok := rs.ids[id]
+	if !ok {
+		live = gen()
+		rs.ids[id] = live
+		rs.back[live] = id
+	}
+	if wait {
+		rs.pending[live] = true
+	}
+	return live
+}
+
+func (rs *replaySession) answer(live uint32, terminal bool) (uint32, bool) {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	id, ok := rs.back[live]
+	if ok && terminal && rs.pending[live] {
+		delete(rs.pending, live)
+		select {
+		case rs.notify <- struct{}{}:
+		default:
+		}
+	}
+	return id, ok
+}
+
+func (rs *replaySession) wait(ctx context.Context, sctx context.Context) error {
+	for {
+		rs.mux.Lock()
+		n := len(rs.pending)
+		rs.mux.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-rs.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sctx.Done():
+			return ErrClientSessionClosed
+		}
+	}
+}
+
+func recordError(rec *Record) error {
+	var str string
+	err := rec.Bind(&str)
+	if err == nil {
+		err = errors.New(str)
+	}
+	return err
+}
+
+func isTerminalOpt(opt xmsg.OptType) bool {
+	switch opt {
+	case optRpcResp, optRpcFailed, optStreamClose, optStreamFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
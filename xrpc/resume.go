@@ -0,0 +1,228 @@
+package xrpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/protocol"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"io"
+	"sync"
+)
+
+// resumable sessions
+//
+//	The server hands out ResumeToken at handshake when both ends have a ResumeTime.
+//	A new connection that carries the token, along with the usual session auth info, is bound to the suspended session.
+//	Both ends exchange ResumeAcks, the last sequence number they received per stream opened by the client,
+//	and ResumePeerAcks, the same for the streams opened by the server in peer mode,
+//	then resend the stream messages the other end did not get, in order.
+//	Stream data messages are prefixed by their uvarint sequence number, and stream pings carry the last one received.
+//	Rpc calls in flight while the session is suspended are not resent.
+
+type seqWriteFunc func(opt xmsg.OptType, data any) (int, error)
+
+type seqMsg struct {
+	seq     uint64
+	opt     xmsg.OptType
+	payload []byte
+}
+
+// streamSeq The sequence state of one stream.
+type streamSeq struct {
+	mux     sync.Mutex
+	write   seqWriteFunc
+	sent    uint64
+	recv    uint64
+	unacked []seqMsg
+	final   *seqMsg
+	done    bool
+}
+
+// send Number and keep data before writing it, a write lost to a suspended session is left to the retransmission.
+func (sq *streamSeq) send(opt xmsg.OptType, data any) (int, error) {
+	xMsg, err := xmsg.NewXMsg("", xmsg.FlagZero, 0, opt, data)
+	if err != nil {
+		return 0, err
+	}
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	sq.sent++
+	payload := binary.AppendUvarint(nil, sq.sent)
+	payload = append(payload, xMsg.Payload()...)
+	sq.unacked = append(sq.unacked, seqMsg{seq: sq.sent, opt: opt, payload: payload})
+	n, err := sq.write(opt, xmsg.RawPayload(payload))
+	if errors.Is(err, xmsg.ErrSessionSuspended) {
+		return n, nil
+	}
+	return n, err
+}
+
+// finish Write the close or failed message, it is kept for the retransmission if the session is suspended.
+func (sq *streamSeq) finish(opt xmsg.OptType, data any) (int, bool) {
+	xMsg, err := xmsg.NewXMsg("", xmsg.FlagZero, 0, opt, data)
+	if err != nil {
+		return 0, true
+	}
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	sq.done = true
+	n, err := sq.write(opt, xmsg.RawPayload(xMsg.Payload()))
+	if errors.Is(err, xmsg.ErrSessionSuspended) {
+		sq.final = &seqMsg{opt: opt, payload: xMsg.Payload()}
+		return n, false
+	}
+	return n, true
+}
+
+// accept Check the sequence number of a received data message and strip it, false means it must be dropped.
+func (sq *streamSeq) accept(xMsg *xmsg.XMsg) (bool, error) {
+	payload := xMsg.Payload()
+	seq, k := binary.Uvarint(payload)
+	if k <= 0 {
+		return false, ErrStreamOutOfSequence.Errorf(0, sq.lastRecv())
+	}
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	if seq <= sq.recv {
+		return false, nil
+	}
+	if seq != sq.recv+1 {
+		return false, ErrStreamOutOfSequence.Errorf(seq, sq.recv)
+	}
+	sq.recv = seq
+	xMsg.SetPayload(payload[k:])
+	return true, nil
+}
+
+func (sq *streamSeq) lastRecv() uint64 {
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	return sq.recv
+}
+
+// ack Forget what the other end has received, from a stream ping.
+func (sq *streamSeq) ack(xMsg *xmsg.XMsg) {
+	var seq uint64
+	if xMsg.NilData() || xMsg.Unmarshal(&seq) != nil {
+		return
+	}
+	sq.mux.Lock()
+	defer sq.mux.Unlock()
+	sq.trim(seq)
+}
+
+func (sq *streamSeq) trim(seq uint64) {
+	i := 0
+	for i < len(sq.unacked) && sq.unacked[i].seq <= seq {
+		i++
+	}
+	sq.unacked = sq.unacked[i:]
+}
+
+// resend Must hold mux.
+func (sq *streamSeq) resend(seq uint64) error {
+	sq.trim(seq)
+	for _, one := range sq.unacked {
+		_, err := sq.write(one.opt, xmsg.RawPayload(one.payload))
+		if err != nil {
+			return err
+		}
+	}
+	if sq.final != nil {
+		_, err := sq.write(sq.final.opt, xmsg.RawPayload(sq.final.payload))
+		if err != nil {
+			return err
+		}
+		sq.final = nil
+	}
+	return nil
+}
+
+// seqSet The streams of a resumable session.
+type seqSet struct {
+	mux sync.Mutex
+	m   map[uint32]*streamSeq
+}
+
+func newSeqSet() *seqSet {
+	return &seqSet{m: make(map[uint32]*streamSeq)}
+}
+
+func (set *seqSet) add(id uint32, write seqWriteFunc) *streamSeq {
+	sq := &streamSeq{write: write}
+	set.mux.Lock()
+	defer set.mux.Unlock()
+	set.m[id] = sq
+	return sq
+}
+
+func (set *seqSet) del(id uint32, sq *streamSeq) {
+	set.mux.Lock()
+	defer set.mux.Unlock()
+	if set.m[id] == sq {
+		delete(set.m, id)
+	}
+}
+
+func (set *seqSet) acks() map[uint32]uint64 {
+	set.mux.Lock()
+	defer set.mux.Unlock()
+	m := make(map[uint32]uint64, len(set.m))
+	for id, sq := range set.m {
+		m[id] = sq.lastRecv()
+	}
+	return m
+}
+
+// seqAcks A seqSet with what the other end received of it.
+type seqAcks struct {
+	set  *seqSet
+	acks map[uint32]uint64
+}
+
+// resumeSeqs Reattach rs to rwc and resend what the other end did not ack, no stream can write in between.
+func resumeSeqs(rs *xmsg.RawSession, rwc io.ReadWriteCloser, cp protocol.Protocol, list ...seqAcks) error {
+	ms := make([]map[uint32]*streamSeq, len(list))
+	for i, one := range list {
+		one.set.mux.Lock()
+		ms[i] = make(map[uint32]*streamSeq, len(one.set.m))
+		for id, sq := range one.set.m {
+			ms[i][id] = sq
+		}
+		one.set.mux.Unlock()
+	}
+	for _, m := range ms {
+		for _, sq := range m {
+			sq.mux.Lock()
+			defer sq.mux.Unlock()
+		}
+	}
+	err := rs.Reattach(rwc, cp)
+	if err != nil {
+		return err
+	}
+	for i, m := range ms {
+		for id, sq := range m {
+			err = sq.resend(list[i].acks[id])
+			if err != nil {
+				return err
+			}
+			if sq.final == nil && sq.done {
+				list[i].set.del(id, sq)
+			}
+		}
+	}
+	return nil
+}
+
+func marshalResumeAcks(acks map[uint32]uint64) string {
+	b, _ := json.Marshal(acks)
+	return string(b)
+}
+
+func unmarshalResumeAcks(info AuthInfo, key string) map[uint32]uint64 {
+	var acks map[uint32]uint64
+	_ = json.Unmarshal([]byte(info.Get(key)), &acks)
+	return acks
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/pcrypto"
 	"github.com/peakedshout/go-pandorasbox/pcrypto/aesgcm"
+	"github.com/peakedshout/go-pandorasbox/protocol"
 	"github.com/peakedshout/go-pandorasbox/protocol/cfcprotocol"
 	"github.com/peakedshout/go-pandorasbox/tool/expired"
 	"github.com/peakedshout/go-pandorasbox/tool/hjson"
@@ -45,6 +46,10 @@ type ServerConfig struct {
 	CryptoList               []*CryptoConfig
 	Upgrader                 xnetutil.Upgrader
 	CacheTime                time.Duration
+	XMsgHook                 xmsg.Hook
+	Recorder                 *Recorder
+	// ResumeTime lets a client that also has one reattach its session with a new connection within that time.
+	ResumeTime time.Duration
 }
 
 func NewServer(sc *ServerConfig) *Server {
@@ -79,15 +84,22 @@ func NewServer(sc *ServerConfig) *Server {
 	} else {
 		s.crypto = []*CryptoConfig{{Crypto: pcrypto.CryptoPlaintext}}
 	}
+	s.xMsgHook = sc.XMsgHook
+	if sc.Recorder != nil {
+		s.recorder = sc.Recorder
+		s.xMsgHook = joinHooks(s.recorder.hook, s.xMsgHook)
+	}
 	if sc.CacheTime > 1*time.Second {
 		s.cacheTime = sc.CacheTime
 		s.cache = expired.NewTODO(expired.Init(s.ctx, 1))
 	}
+	s.resumeTime = sc.ResumeTime
 	s.rpcRoute = make(map[string]RpcHandler)
 	s.ssRoute = make(map[string]StreamHandler)
 	s.rsRoute = make(map[string]SendStreamHandler)
 	s.srRoute = make(map[string]RecvStreamHandler)
 	s.rrRoute = make(map[string]ReverseRpcHandler)
+	s.peer = newPeerClient(s)
 	return s
 }
 
@@ -110,6 +122,7 @@ type Server struct {
 	rsRoute  map[string]SendStreamHandler
 	srRoute  map[string]RecvStreamHandler
 	rrRoute  map[string]ReverseRpcHandler
+	routeMux sync.RWMutex
 
 	running bool
 	closer  sync.Once
@@ -120,6 +133,13 @@ type Server struct {
 	sessMap   tmap.SyncMap[string, *serverSession]
 	cacheTime time.Duration
 	cache     *expired.TODO
+	xMsgHook  xmsg.Hook
+	recorder  *Recorder
+
+	resumeTime time.Duration
+	resumeMap  tmap.SyncMap[string, *serverSession]
+
+	peer *Client
 }
 
 func (s *Server) MustAddHandler(header string, handler any) {
@@ -200,7 +220,9 @@ func (s *Server) AddRpcHandler(header string, handler RpcHandler) error {
 		return ErrServerRunning
 	}
 	s.mux.Unlock()
+	s.routeMux.Lock()
 	s.rpcRoute[header] = handler
+	s.routeMux.Unlock()
 	return nil
 }
 
@@ -215,7 +237,9 @@ func (s *Server) AddStreamHandler(header string, handler StreamHandler) error {
 		return ErrServerRunning
 	}
 	s.mux.Unlock()
+	s.routeMux.Lock()
 	s.ssRoute[header] = handler
+	s.routeMux.Unlock()
 	return nil
 }
 
@@ -230,7 +254,9 @@ func (s *Server) AddSendStreamHandler(header string, handler SendStreamHandler)
 		return ErrServerRunning
 	}
 	s.mux.Unlock()
+	s.routeMux.Lock()
 	s.rsRoute[header] = handler
+	s.routeMux.Unlock()
 	return nil
 }
 
@@ -245,7 +271,9 @@ func (s *Server) AddRecvStreamHandler(header string, handler RecvStreamHandler)
 		return ErrServerRunning
 	}
 	s.mux.Unlock()
+	s.routeMux.Lock()
 	s.srRoute[header] = handler
+	s.routeMux.Unlock()
 	return nil
 }
 
@@ -260,7 +288,9 @@ func (s *Server) AddReverseRpcHandler(header string, handler ReverseRpcHandler)
 		return ErrServerRunning
 	}
 	s.mux.Unlock()
+	s.routeMux.Lock()
 	s.rrRoute[header] = handler
+	s.routeMux.Unlock()
 	return nil
 }
 
@@ -313,6 +343,8 @@ func (s *Server) RouteList() map[Method][]string {
 		MethodRecvStream: {},
 		MethodReverseRpc: {},
 	}
+	s.routeMux.RLock()
+	defer s.routeMux.RUnlock()
 	for k := range s.rpcRoute {
 		m[MethodRpc] = append(m[MethodRpc], k)
 	}
@@ -333,7 +365,12 @@ func (s *Server) RouteList() map[Method][]string {
 
 func (s *Server) serveConn(conn net.Conn) {
 	_ = conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
-	defer conn.Close()
+	keep := false
+	defer func() {
+		if !keep {
+			_ = conn.Close()
+		}
+	}()
 	if s.upgrader != nil {
 		var err error
 		conn, err = s.upgrader.UpgradeContext(s.ctx, conn)
@@ -354,6 +391,7 @@ func (s *Server) serveConn(conn net.Conn) {
 		KeepLive: s.keepLive,
 		Ctx:      s.ctx,
 		Flag:     xmsg.FlagOne,
+		Hook:     s.xMsgHook,
 	}
 	var authInfo AuthInfo
 	err = sc.Protocol.Decode(conn, &authInfo)
@@ -361,36 +399,50 @@ func (s *Server) serveConn(conn net.Conn) {
 		return
 	}
 	authInfo.connSet(true, conn)
+	info := make(AuthInfo)
 	if s.sessionAuthCb != nil {
-		info, err := s.sessionAuthCb(authInfo)
+		info, err = s.sessionAuthCb(authInfo)
 		if err != nil {
 			return
 		}
 		if info == nil {
 			info = make(AuthInfo)
 		}
-		info.connSet(true, conn)
-		err = sc.Protocol.Encode(conn, info)
-		if err != nil {
-			return
-		}
-	} else {
-		err = sc.Protocol.Encode(conn, make(AuthInfo).connSet(true, conn))
-		if err != nil {
-			return
-		}
+	}
+	info.connSet(true, conn)
+	var token string
+	resumable := false
+	if s.resumeTime > 0 {
+		_, resumable = authInfo[ResumeToken]
+		token, _ = GetAuthInfo[string](authInfo, ResumeToken)
+	}
+	if token != "" {
+		keep = s.resumeConn(conn, sc.Protocol, token, authInfo, info)
+		return
+	}
+	if resumable {
+		token = uuid.NewIdn(32)
+		info.Set(ResumeToken, hjson.MustMarshalStr(token))
+		sc.ResumeTime = s.resumeTime
+	}
+	err = sc.Protocol.Encode(conn, info)
+	if err != nil {
+		return
 	}
 	sc.Ctx = SetSessionAuthInfo(s.ctx, authInfo.connSet(true, conn))
 	session := xmsg.NewSession(sc)
 	_ = conn.SetDeadline(time.Time{})
 	authInfo.Set(SessionId, hjson.MustMarshalStr(session.Id()))
-	ss := &serverSession{
-		s:          s,
-		RawSession: session,
-		cacheMap:   make(map[uint32]*serverStream),
-		streamMap:  make(map[uint32]*serverStream),
-	}
+	ss := s.newSession(session, resumable)
 	s.sessMap.Store(ss.Id(), ss)
+	if resumable {
+		s.resumeMap.Store(token, ss)
+		defer s.resumeMap.Delete(token)
+	}
+	if s.recorder != nil {
+		s.recorder.openSession(ss.Id(), authInfo)
+		defer s.recorder.closeSession(ss.Id())
+	}
 	if s.cache == nil {
 		defer s.sessMap.Delete(ss.Id())
 	} else {
@@ -401,6 +453,71 @@ func (s *Server) serveConn(conn net.Conn) {
 	s.handleXMsg(ss)
 }
 
+// resumeConn Bind conn to the session of token after the session auth callback accepted it again.
+func (s *Server) resumeConn(conn net.Conn, cp protocol.Protocol, token string, authInfo AuthInfo, info AuthInfo) bool {
+	ss, ok := s.resumeMap.Load(token)
+	if !ok || ss.Context().Err() != nil {
+		return false
+	}
+	// the token alone does not move a session to another identity
+	if !sameIdentity(GetSessionAuthInfo(ss.Context()), authInfo) {
+		return false
+	}
+	acks := unmarshalResumeAcks(authInfo, ResumeAcks)
+	peerAcks := unmarshalResumeAcks(authInfo, ResumePeerAcks)
+	// the old connection may look alive if the client moved away without closing it
+	ss.Suspend()
+	info.Set(ResumeToken, hjson.MustMarshalStr(token))
+	info.Set(ResumeAcks, marshalResumeAcks(ss.seqs.acks()))
+	info.Set(ResumePeerAcks, marshalResumeAcks(ss.peer.seqs.acks()))
+	err := cp.Encode(conn, info)
+	if err != nil {
+		return false
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return resumeSeqs(ss.RawSession, conn, cp, seqAcks{ss.seqs, acks}, seqAcks{ss.peer.seqs, peerAcks}) == nil
+}
+
+// sameIdentity Whether a and b carry the same auth info, apart from what is set per connection.
+func sameIdentity(a, b AuthInfo) bool {
+	count := func(info AuthInfo) int {
+		n := 0
+		for k := range info {
+			if !connAuthKeys[k] {
+				n++
+			}
+		}
+		return n
+	}
+	if count(a) != count(b) {
+		return false
+	}
+	for k, v := range a {
+		if connAuthKeys[k] {
+			continue
+		}
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+var connAuthKeys = map[string]bool{
+	RemotePubNetwork: true,
+	RemotePubAddress: true,
+	LocalPubNetwork:  true,
+	LocalPubAddress:  true,
+	RemotePriNetwork: true,
+	RemotePriAddress: true,
+	LocalPriNetwork:  true,
+	LocalPriAddress:  true,
+	SessionId:        true,
+	ResumeToken:      true,
+	ResumeAcks:       true,
+	ResumePeerAcks:   true,
+}
+
 func (s *Server) handleSelectCrypto(conn net.Conn) (pcrypto.PCrypto, error) {
 	var cryptoNameList []string
 	err := cfcprotocol.CFCPlaintext.Decode(conn, &cryptoNameList)
@@ -451,35 +568,54 @@ func (s *Server) handleSelectCrypto(conn net.Conn) (pcrypto.PCrypto, error) {
 }
 
 func (s *Server) handleXMsg(session *serverSession) {
-	defer session.Close()
+	defer func() {
+		_ = session.Close()
+		if session.peer != nil {
+			_ = session.peer.Close()
+		}
+	}()
 	for {
 		xMsg, n, err := session.ReadXMsg()
 		if err != nil {
 			return
 		}
-		switch xMsg.Opt() {
-		case optRpcReq:
-			s.handleRpc(session, xMsg)
-		case optStreamOpen:
-			s.handleOpenStream(session, xMsg, n)
-		case optStreamOpenRecv:
-			s.handleOpenStreamRecv(session, xMsg, n)
-		case optStreamOpenSend:
-			s.handleOpenStreamSend(session, xMsg, n)
-		case optStreamOpenRRpc:
-			s.handleRRpc(session, xMsg, n)
-		case optStreamClose, optStreamFailed:
-			s.handleCloseStream(session, xMsg, n)
-		case optStreamSend, optStreamPing:
-			s.handleSendStream(session, xMsg, n)
-		default:
+		if session.peer != nil && !isPeerCall(xMsg) {
+			session.peer.handleOne(xMsg, n)
 			continue
 		}
+		s.handleOne(session, xMsg, n)
+	}
+}
+
+func (s *Server) handleOne(session *serverSession, xMsg *xmsg.XMsg, n int) {
+	switch xMsg.Opt() {
+	case optRpcReq:
+		s.handleRpc(session, xMsg)
+	case optStreamOpen:
+		s.handleOpenStream(session, xMsg, n)
+	case optStreamOpenRecv:
+		s.handleOpenStreamRecv(session, xMsg, n)
+	case optStreamOpenSend:
+		s.handleOpenStreamSend(session, xMsg, n)
+	case optStreamOpenRRpc:
+		s.handleRRpc(session, xMsg, n)
+	case optStreamClose, optStreamFailed:
+		s.handleCloseStream(session, xMsg, n)
+	case optStreamSend, optStreamPing:
+		s.handleSendStream(session, xMsg, n)
 	}
 }
 
+// getRoute The routes of a peer ClientSession can be added while it serves.
+func getRoute[T any](s *Server, m map[string]T, header string) (T, bool) {
+	s.routeMux.RLock()
+	defer s.routeMux.RUnlock()
+	h, ok := m[header]
+	return h, ok
+}
+
 func (s *Server) handleRpc(session *serverSession, xMsg *xmsg.XMsg) {
-	handler, ok := s.rpcRoute[xMsg.Header()]
+	handler, ok := getRoute(s, s.rpcRoute, xMsg.Header())
 	if !ok {
 		_, _, _ = session.RecvXMsg(xMsg.Header(), xMsg.Id(), optRpcFailed, ErrInvalidCall.Errorf(xMsg.Header()))
 		return
@@ -505,7 +641,7 @@ func (s *Server) handleRpc(session *serverSession, xMsg *xmsg.XMsg) {
 }
 
 func (s *Server) handleOpenStream(session *serverSession, xMsg *xmsg.XMsg, r int) {
-	handler, ok := s.ssRoute[xMsg.Header()]
+	handler, ok := getRoute(s, s.ssRoute, xMsg.Header())
 	if !ok {
 		_, _, _ = session.RecvXMsg(xMsg.Header(), xMsg.Id(), optStreamFailed, ErrInvalidCall.Errorf(xMsg.Header()))
 		return
@@ -524,7 +660,7 @@ func (s *Server) handleOpenStream(session *serverSession, xMsg *xmsg.XMsg, r int
 }
 
 func (s *Server) handleOpenStreamSend(session *serverSession, xMsg *xmsg.XMsg, r int) {
-	handler, ok := s.rsRoute[xMsg.Header()]
+	handler, ok := getRoute(s, s.rsRoute, xMsg.Header())
 	if !ok {
 		_, _, _ = session.RecvXMsg(xMsg.Header(), xMsg.Id(), optStreamFailed, ErrInvalidCall.Errorf(xMsg.Header()))
 		return
@@ -546,7 +682,7 @@ func (s *Server) handleOpenStreamSend(session *serverSession, xMsg *xmsg.XMsg, r
 }
 
 func (s *Server) handleOpenStreamRecv(session *serverSession, xMsg *xmsg.XMsg, r int) {
-	handler, ok := s.srRoute[xMsg.Header()]
+	handler, ok := getRoute(s, s.srRoute, xMsg.Header())
 	if !ok {
 		_, _, _ = session.RecvXMsg(xMsg.Header(), xMsg.Id(), optStreamFailed, ErrInvalidCall.Errorf(xMsg.Header()))
 		return
@@ -569,7 +705,7 @@ func (s *Server) handleOpenStreamRecv(session *serverSession, xMsg *xmsg.XMsg, r
 }
 
 func (s *Server) handleRRpc(session *serverSession, xMsg *xmsg.XMsg, r int) {
-	handler, ok := s.rrRoute[xMsg.Header()]
+	handler, ok := getRoute(s, s.rrRoute, xMsg.Header())
 	if !ok {
 		_, _, _ = session.RecvXMsg(xMsg.Header(), xMsg.Id(), optStreamFailed, ErrInvalidCall.Errorf(xMsg.Header()))
 		return
@@ -609,6 +745,16 @@ func (s *Server) handleSendStream(session *serverSession, xMsg *xmsg.XMsg, r int
 		if sc.st != typeStreamFullDuplex && sc.st != typeStreamSimplexRecv {
 			return
 		}
+		if sc.seq != nil {
+			ok, err := sc.seq.accept(xMsg)
+			if err != nil {
+				_ = sc.close(err)
+				return
+			}
+			if !ok {
+				return
+			}
+		}
 		select {
 		case <-session.Context().Done():
 			_ = sc.close(ErrStreamClosed)
@@ -616,6 +762,9 @@ func (s *Server) handleSendStream(session *serverSession, xMsg *xmsg.XMsg, r int
 		case sc.read <- xMsg:
 		}
 	case optStreamPing:
+		if sc.seq != nil {
+			sc.seq.ack(xMsg)
+		}
 		select {
 		case <-session.Context().Done():
 			sc.close(ErrStreamClosed)
@@ -668,6 +817,8 @@ type serverSession struct {
 	cacheMap map[uint32]*serverStream
 
 	streamMap map[uint32]*serverStream
+	seqs      *seqSet
+	peer      *ClientSession
 }
 
 func (ss *serverSession) GetDelay() time.Duration {
@@ -725,6 +876,12 @@ func (ss *serverSession) newStream(xMsg *xmsg.XMsg, opt xmsg.OptType, r int) (*s
 		stream.read <- xMsg
 	}
 
+	if ss.seqs != nil {
+		stream.seq = ss.seqs.add(stream.id, func(opt xmsg.OptType, data any) (int, error) {
+			_, n, err := ss.RecvXMsg(stream.header, stream.id, opt, data)
+			return n, err
+		})
+	}
 	streamCtx := SetStreamAuthInfo(ss.Context(), info.AuthInfo)
 	stream.ctx, stream.cl = context.WithCancelCause(streamCtx)
 	ss.ssMux.Lock()
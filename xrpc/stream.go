@@ -33,6 +33,7 @@ type serverStream struct {
 	st         typeStream
 	monitor    xnetutil.Monitor
 	activeTime atomic.Pointer[time.Time]
+	seq        *streamSeq
 }
 
 func (ss *serverStream) Id() string {
@@ -120,11 +121,19 @@ func (ss *serverStream) GetDelay() time.Duration {
 func (ss *serverStream) keepPing(pt time.Duration) {
 	defer func() {
 		err := ss.ctx.Err()
+		opt, data := optStreamClose, any(nil)
+		if err != nil && !errors.Is(err, ErrStreamClosed) {
+			opt, data = optStreamFailed, err
+		}
 		var n int
-		if err == nil || errors.Is(err, ErrStreamClosed) {
-			_, n, _ = ss.sess.RecvXMsg(ss.header, ss.id, optStreamClose, nil)
+		if ss.seq != nil {
+			var done bool
+			n, done = ss.seq.finish(opt, data)
+			if done {
+				ss.sess.seqs.del(ss.id, ss.seq)
+			}
 		} else {
-			_, n, _ = ss.sess.RecvXMsg(ss.header, ss.id, optStreamFailed, err)
+			_, n, _ = ss.sess.RecvXMsg(ss.header, ss.id, opt, data)
 		}
 		ss.monitor.AddCount(0, n)
 	}()
@@ -140,11 +149,15 @@ func (ss *serverStream) keepPing(pt time.Duration) {
 			//if t != nil && t.Sub(time.Now()) > 30*time.Second {
 			//	return
 			//}
-			_, n, err := ss.sess.RecvXMsg(ss.header, ss.id, optStreamPing, nil)
+			var ack any
+			if ss.seq != nil {
+				ack = ss.seq.lastRecv()
+			}
+			_, n, err := ss.sess.RecvXMsg(ss.header, ss.id, optStreamPing, ack)
 			ss.monitor.AddCount(0, n)
 			ss.monitor.RecordSpeed()
 			ss.monitor.RecordDelay(ss.GetDelay())
-			if err != nil {
+			if err != nil && !errors.Is(err, xmsg.ErrSessionSuspended) {
 				return
 			}
 			timePing.Reset(pt)
@@ -154,6 +167,10 @@ func (ss *serverStream) keepPing(pt time.Duration) {
 			}
 			timeout.Reset(pt * 4)
 		case <-timeout.C:
+			if ss.sess.Suspended() {
+				timeout.Reset(pt * 4)
+				continue
+			}
 			return
 		case <-ss.ctx.Done():
 			return
@@ -191,7 +208,13 @@ func (ss *serverStream) rawSend(data any) error {
 		return ErrStreamClosed
 	}
 	ss.mux.Unlock()
-	_, n, err := ss.sess.RecvXMsg(ss.header, ss.id, optStreamRecv, data)
+	var n int
+	var err error
+	if ss.seq != nil {
+		n, err = ss.seq.send(optStreamRecv, data)
+	} else {
+		_, n, err = ss.sess.RecvXMsg(ss.header, ss.id, optStreamRecv, data)
+	}
 	ss.monitor.AddCount(0, n)
 	if err == nil {
 		t := time.Now()
@@ -217,6 +240,7 @@ type clientStream struct {
 	initialize sync.Once
 	initCh     chan error
 	activeTime atomic.Pointer[time.Time]
+	seq        *streamSeq
 }
 
 func (cs *clientStream) Id() string {
@@ -268,7 +292,12 @@ func (cs *clientStream) Send(data any) error {
 		}
 		return nil
 	}
-	_, n, err := cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamSend, data)
+	var n int
+	if cs.seq != nil {
+		n, err = cs.seq.send(optStreamSend, data)
+	} else {
+		_, n, err = cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamSend, data)
+	}
 	cs.monitor.AddCount(0, n)
 	if err == nil {
 		t := time.Now()
@@ -336,6 +365,13 @@ func (cs *clientStream) toInit(data any) (bool, error) {
 		var n int
 		cs.sess.streamMux.Lock()
 		cs.id = cs.sess.xsess.GetXMsgId()
+		if cs.sess.seqs != nil {
+			id := cs.id
+			cs.seq = cs.sess.seqs.add(id, func(opt xmsg.OptType, data any) (int, error) {
+				_, n, err := cs.sess.xsess.SendXMsg(cs.header, id, opt, data)
+				return n, err
+			})
+		}
 		cs.sess.streamMap[cs.id] = cs
 		cs.sess.streamMux.Unlock()
 		cs.id, n, err = cs.sess.xsess.SendXMsg(cs.header, cs.id, cs.opt, send)
@@ -344,6 +380,9 @@ func (cs *clientStream) toInit(data any) (bool, error) {
 			cs.sess.streamMux.Lock()
 			delete(cs.sess.streamMap, cs.id)
 			cs.sess.streamMux.Unlock()
+			if cs.seq != nil {
+				cs.sess.seqs.del(cs.id, cs.seq)
+			}
 			_ = cs.Close()
 			return
 		}
@@ -392,11 +431,19 @@ func (cs *clientStream) close(err error) error {
 func (cs *clientStream) keepPing(pt time.Duration) {
 	defer func() {
 		err := cs.ctx.Err()
+		opt, data := optStreamClose, any(nil)
+		if err != nil && !errors.Is(err, ErrStreamClosed) {
+			opt, data = optStreamFailed, err
+		}
 		var n int
-		if err == nil || errors.Is(err, ErrStreamClosed) {
-			_, n, _ = cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamClose, nil)
+		if cs.seq != nil {
+			var done bool
+			n, done = cs.seq.finish(opt, data)
+			if done {
+				cs.sess.seqs.del(cs.id, cs.seq)
+			}
 		} else {
-			_, n, _ = cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamFailed, err)
+			_, n, _ = cs.sess.xsess.SendXMsg(cs.header, cs.id, opt, data)
 		}
 		cs.monitor.AddCount(0, n)
 	}()
@@ -417,11 +464,15 @@ func (cs *clientStream) keepPing(pt time.Duration) {
 			//if t != nil && t.Sub(time.Now()) > 30*time.Second {
 			//	return
 			//}
-			_, n, err := cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamPing, nil)
+			var ack any
+			if cs.seq != nil {
+				ack = cs.seq.lastRecv()
+			}
+			_, n, err := cs.sess.xsess.SendXMsg(cs.header, cs.id, optStreamPing, ack)
 			cs.monitor.AddCount(0, n)
 			cs.monitor.RecordSpeed()
 			cs.monitor.RecordDelay(cs.sess.GetDelay())
-			if err != nil {
+			if err != nil && !errors.Is(err, xmsg.ErrSessionSuspended) {
 				return
 			}
 			timePing.Reset(pt)
@@ -431,6 +482,10 @@ func (cs *clientStream) keepPing(pt time.Duration) {
 			}
 			timeout.Reset(pt * 4)
 		case <-timeout.C:
+			if cs.sess.xsess.Suspended() {
+				timeout.Reset(pt * 4)
+				continue
+			}
 			return
 		case <-cs.ctx.Done():
 			return
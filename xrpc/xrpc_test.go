@@ -1,14 +1,22 @@
 package xrpc
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/peakedshout/go-pandorasbox/ccw/ctxtool"
 	"github.com/peakedshout/go-pandorasbox/tool/uuid"
 	"github.com/peakedshout/go-pandorasbox/tool/xpprof"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"io"
 	"net"
+	"net/http"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -998,3 +1006,677 @@ func TestClientShareReverseRpc(t *testing.T) {
 	})
 	wg.Wait()
 }
+
+func newRecordTestServer(ctx context.Context, rec *Recorder) *Server {
+	server := NewServer(&ServerConfig{
+		Ctx:                 ctx,
+		SessionAuthCallback: UPAuthCallback("user", "pass"),
+		Recorder:            rec,
+	})
+	server.MustAddRpcHandler("echo", func(ctx Rpc) (any, error) {
+		var str string
+		err := ctx.Bind(&str)
+		if err != nil {
+			return nil, err
+		}
+		if str == "bad" {
+			return nil, errors.New("bad request")
+		}
+		return str, nil
+	})
+	server.MustAddStreamHandler("stream", func(ctx Stream) error {
+		for {
+			var str string
+			err := ctx.Recv(&str)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send(str + "!")
+			if err != nil {
+				return err
+			}
+		}
+	})
+	return server
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	buf := new(bytes.Buffer)
+	rec, err := NewRecorder(buf, &RecorderConfig{Redact: RedactKeys(AuthPassword)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newRecordTestServer(ctx, rec)
+	listen, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+	client := NewClient(&ClientConfig{SessionAuthInfo: BuildUPAuth("user", "pass")})
+	sess, err := client.DialContext(ctx, new(net.Dialer), listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var str string
+	err = sess.Rpc(ctx, "echo", "hello", &str)
+	if err != nil || str != "hello" {
+		t.Fatal(err, str)
+	}
+	err = sess.Rpc(ctx, "echo", "bad", &str)
+	if err == nil || err.Error() != "bad request" {
+		t.Fatal(err)
+	}
+	stream, err := sess.Stream(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, one := range []string{"a", "b"} {
+		err = stream.Send(one)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stream.Recv(&str)
+		if err != nil || str != one+"!" {
+			t.Fatal(err, str)
+		}
+	}
+	_ = stream.Close()
+	time.Sleep(500 * time.Millisecond)
+	_ = sess.Close()
+	_ = client.Close()
+	_ = server.Close()
+	time.Sleep(500 * time.Millisecond)
+	if rec.Err() != nil {
+		t.Fatal(rec.Err())
+	}
+
+	list, err := ReadRecords(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) < 2 || list[0].Kind != RecordSessionOpen || list[len(list)-1].Kind != RecordSessionClose {
+		t.Fatal(list)
+	}
+	if list[0].AuthInfo.Get(AuthUserName) != "user" || list[0].AuthInfo.Get(AuthPassword) != "" {
+		t.Fatal(list[0].AuthInfo)
+	}
+	sid := list[0].Session
+
+	rp, err := NewReplayer(bytes.NewReader(buf.Bytes()), &ReplayConfig{
+		Sessions: []string{sid},
+		Routes:   []string{"echo"},
+		SessionAuthInfo: func(sid string, info AuthInfo) AuthInfo {
+			info.Set(AuthPassword, "pass")
+			return info
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, one := range rp.Records() {
+		if one.Kind == RecordXMsg && one.Header != "echo" {
+			t.Fatal(one.Header)
+		}
+	}
+
+	server2 := newRecordTestServer(ctx, nil)
+	defer server2.Close()
+	listen2, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen2.Close()
+	go server2.Serve(listen2)
+	answer, err := rp.ReplayClient(ctx, nil, new(net.Dialer), listen2.Addr().Network(), listen2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) != 2 {
+		t.Fatal(answer)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].Id < answer[j].Id
+	})
+	if answer[0].Opt != optRpcResp || answer[1].Opt != optRpcFailed {
+		t.Fatal(answer[0].Opt, answer[1].Opt)
+	}
+	if answer[0].Bind(&str) != nil || str != "hello" {
+		t.Fatal(str)
+	}
+
+	rp, err = NewReplayer(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server3 := rp.ReplayServer(&ServerConfig{Ctx: ctx})
+	defer server3.Close()
+	listen3, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen3.Close()
+	go server3.Serve(listen3)
+	client3 := NewClient(&ClientConfig{})
+	defer client3.Close()
+	sess3, err := client3.DialContext(ctx, new(net.Dialer), listen3.Addr().Network(), listen3.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess3.Close()
+	err = sess3.Rpc(ctx, "echo", "anything", &str)
+	if err != nil || str != "hello" {
+		t.Fatal(err, str)
+	}
+	err = sess3.Rpc(ctx, "echo", "anything", &str)
+	if err == nil || err.Error() != "bad request" {
+		t.Fatal(err)
+	}
+	err = sess3.Rpc(ctx, "echo", "anything", &str)
+	if !errors.Is(err, ErrReplayExhausted) && (err == nil || err.Error() != ErrReplayExhausted.Errorf("echo").Error()) {
+		t.Fatal(err)
+	}
+	stream3, err := sess3.Stream(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream3.Close()
+	err = stream3.Send("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, one := range []string{"a!", "b!"} {
+		err = stream3.Recv(&str)
+		if err != nil || str != one {
+			t.Fatal(err, str)
+		}
+	}
+	var dirs []xmsg.Direction
+	for _, one := range list {
+		if one.Kind == RecordXMsg {
+			dirs = append(dirs, one.Dir)
+		}
+	}
+	if len(dirs) == 0 || dirs[0] != xmsg.DirectionRead {
+		t.Fatal(dirs)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	server := NewServer(&ServerConfig{Ctx: ctx, SessionAuthCallback: UPAuthCallback("user", "pass")})
+	defer server.Close()
+	server.MustAddRpcHandler("echo", func(ctx Rpc) (any, error) {
+		var str string
+		err := ctx.Bind(&str)
+		if err != nil {
+			return nil, err
+		}
+		if str == "bad" {
+			return nil, errors.New("bad request")
+		}
+		return str, nil
+	})
+	server.MustAddSendStreamHandler("count", func(ctx SendStream) error {
+		var n int
+		err := ctx.Bind(&n)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			err = ctx.Send(map[string]int{"i": i})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	server.MustAddRecvStreamHandler("sum", func(ctx RecvStream) (any, error) {
+		sum := 0
+		for i := 0; i < 3; i++ {
+			var n int
+			err := ctx.Recv(&n)
+			if err != nil {
+				return nil, err
+			}
+			sum += n
+		}
+		return sum, nil
+	})
+	server.MustAddStreamHandler("upper", func(ctx Stream) error {
+		for i := 0; i < 2; i++ {
+			var str string
+			err := ctx.Recv(&str)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send(strings.ToUpper(str))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+
+	gw := NewGateway(&GatewayConfig{
+		Ctx:     ctx,
+		Prefix:  "api",
+		Network: listen.Addr().Network(),
+		Addr:    listen.Addr().String(),
+		Routes:  server.RouteList(),
+	})
+	defer gw.Close()
+	hln, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hln.Close()
+	go gw.Serve(hln)
+	base := "http://" + hln.Addr().String() + "/api/"
+
+	do := func(method, route, accept, body, pass string) (int, string, http.Header) {
+		req, err := http.NewRequestWithContext(ctx, method, base+route, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", pass)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b), resp.Trailer
+	}
+
+	code, body, _ := do(http.MethodPost, "echo", "", `"hello"`, "pass")
+	if code != http.StatusOK || body != "\"hello\"\n" {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "echo", "", `"bad"`, "pass")
+	if code != http.StatusInternalServerError || !strings.Contains(body, "bad request") {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "echo", "", `"hello"`, "wrong")
+	if code != http.StatusUnauthorized {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodGet, "echo", "", "", "pass")
+	if code != http.StatusMethodNotAllowed {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "echo", "", `{`, "pass")
+	if code != http.StatusBadRequest {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "count", "text/event-stream", `2`, "pass")
+	if code != http.StatusOK || body != "data: {\"i\":0}\n\ndata: {\"i\":1}\n\n" {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "count", "", `2`, "pass")
+	if code != http.StatusOK || body != "{\"i\":0}\n{\"i\":1}\n" {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "sum", "", `1 2 3`, "pass")
+	if code != http.StatusOK || body != "6\n" {
+		t.Fatal(code, body)
+	}
+	code, body, _ = do(http.MethodPost, "upper", "", `"a" "b"`, "pass")
+	if code != http.StatusOK || body != "\"A\"\n\"B\"\n" {
+		t.Fatal(code, body)
+	}
+	if GatewayStatus(ErrInvalidCall.Errorf("x")) != http.StatusNotFound {
+		t.Fatal()
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	server := NewServer(&ServerConfig{Ctx: ctx, ResumeTime: 5 * time.Second, SessionAuthCallback: func(info AuthInfo) (AuthInfo, error) {
+		if info.Get(AuthUserName) == "other" {
+			return UPAuthCallback("other", "pass")(info)
+		}
+		return UPAuthCallback("user", "pass")(info)
+	}})
+	defer server.Close()
+	server.MustAddStreamHandler("echo", func(ctx Stream) error {
+		for {
+			var n int
+			err := ctx.Recv(&n)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send(n)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	server.MustAddRpcHandler("ping", func(ctx Rpc) (any, error) {
+		return "pong", nil
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+
+	var mux sync.Mutex
+	var conns []net.Conn
+	dr := xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+		if err == nil {
+			mux.Lock()
+			conns = append(conns, conn)
+			mux.Unlock()
+		}
+		return conn, err
+	})
+	lastConn := func() net.Conn {
+		mux.Lock()
+		defer mux.Unlock()
+		return conns[len(conns)-1]
+	}
+	client := NewClient(&ClientConfig{Ctx: ctx, ResumeTime: 5 * time.Second, SessionAuthInfo: BuildUPAuth("user", "pass")})
+	defer client.Close()
+	sess, err := client.DialContext(ctx, dr, listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stream, err := sess.Stream(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	next := 0
+	check := func(until int) {
+		for ; next < until; next++ {
+			var n int
+			err := stream.Recv(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != next {
+				t.Fatal(n, next)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		err = stream.Send(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(5)
+	// the transport dies, the session dials again by itself
+	_ = lastConn().Close()
+	for i := 10; i < 20; i++ {
+		err = stream.Send(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(20)
+	mux.Lock()
+	n := len(conns)
+	mux.Unlock()
+	if n < 2 {
+		t.Fatal(n)
+	}
+
+	// move to a new connection while the old one still works
+	conn, err := dr.DialContext(ctx, listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Resume(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 20; i < 30; i++ {
+		err = stream.Send(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(30)
+	var str string
+	err = sess.Rpc(ctx, "ping", nil, &str)
+	if err != nil || str != "pong" {
+		t.Fatal(err, str)
+	}
+
+	// a session without a resumption token can not be moved
+	client2 := NewClient(&ClientConfig{Ctx: ctx, SessionAuthInfo: BuildUPAuth("user", "pass")})
+	defer client2.Close()
+	sess2, err := client2.DialContext(ctx, new(net.Dialer), listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess2.Close()
+	conn, err = net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess2.Resume(ctx, conn)
+	if !errors.Is(err, ErrSessionNotResumable) {
+		t.Fatal(err)
+	}
+
+	// another user can not take the session over with its token
+	client3 := NewClient(&ClientConfig{Ctx: ctx, ResumeTime: 5 * time.Second, SessionAuthInfo: BuildUPAuth("other", "pass")})
+	defer client3.Close()
+	sess3, err := client3.DialContext(ctx, new(net.Dialer), listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess3.Close()
+	sess3.resumeToken = sess.resumeToken
+	conn, err = net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess3.Resume(ctx, conn)
+	if err == nil {
+		t.Fatal("resumed by another identity")
+	}
+	for i := 30; i < 40; i++ {
+		err = stream.Send(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(40)
+}
+
+func TestPeerSession(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cl()
+	server := NewServer(&ServerConfig{Ctx: ctx})
+	defer server.Close()
+	server.MustAddRpcHandler("double", func(ctx Rpc) (any, error) {
+		var n int
+		err := ctx.Bind(&n)
+		if err != nil {
+			return nil, err
+		}
+		sid, err := GetSessionAuthInfoT[string](ctx.Context(), SessionId)
+		if err != nil {
+			return nil, err
+		}
+		peer, err := server.PeerSession(sid)
+		if err != nil {
+			return nil, err
+		}
+		var m int
+		err = peer.Rpc(ctx.Context(), "add", n, &m)
+		if err != nil {
+			return nil, err
+		}
+		return m * 2, nil
+	})
+	server.MustAddRpcHandler("sid", func(ctx Rpc) (any, error) {
+		return GetSessionAuthInfoT[string](ctx.Context(), SessionId)
+	})
+	server.MustAddStreamHandler("echo", func(ctx Stream) error {
+		for {
+			var s string
+			err := ctx.Recv(&s)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send("server:" + s)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go server.Serve(listen)
+
+	client := NewClient(&ClientConfig{Ctx: ctx})
+	defer client.Close()
+	sess, err := client.DialContext(ctx, new(net.Dialer), listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	sess.MustAddHandler("add", func(ctx Rpc) (any, error) {
+		var n int
+		err := ctx.Bind(&n)
+		return n + 1, err
+	})
+	sess.MustAddHandler("echo", func(ctx Stream) error {
+		for {
+			var s string
+			err := ctx.Recv(&s)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send("client:" + s)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	sess.MustAddHandler("count", func(ctx SendStream) error {
+		var n int
+		err := ctx.Bind(&n)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			err = ctx.Send(i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if len(sess.RouteList()[MethodRpc]) != 1 {
+		t.Fatal(sess.RouteList())
+	}
+
+	// the server calls back into the client while the client waits on the same id
+	var n int
+	err = sess.Rpc(ctx, "double", 1, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatal(n)
+	}
+
+	var sid string
+	err = sess.Rpc(ctx, "sid", nil, &sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.PeerSession(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.PeerSession("unknown")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatal(err)
+	}
+	err = peer.Rpc(ctx, "none", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid call") {
+		t.Fatal(err)
+	}
+	if !errors.Is(peer.AddRpcHandler("add", nil), ErrPeerRoute) {
+		t.Fatal()
+	}
+
+	// streams with the same header and ids in both directions
+	echo := func(open func(ctx context.Context, header string) (Stream, error), prefix string) error {
+		stream, err := open(ctx, "echo")
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		for i := 0; i < 100; i++ {
+			s := strconv.Itoa(i)
+			err = stream.Send(s)
+			if err != nil {
+				return err
+			}
+			var got string
+			err = stream.Recv(&got)
+			if err != nil {
+				return err
+			}
+			if got != prefix+s {
+				return fmt.Errorf("got %q want %q", got, prefix+s)
+			}
+		}
+		return nil
+	}
+	errCh := make(chan error, 2)
+	go func() { errCh <- echo(sess.Stream, "server:") }()
+	go func() { errCh <- echo(peer.Stream, "client:") }()
+	for i := 0; i < 2; i++ {
+		err = <-errCh
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rStream, err := peer.RecvStream(ctx, "count", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rStream.Close()
+	for i := 0; i < 10; i++ {
+		var got int
+		err = rStream.Recv(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != i {
+			t.Fatal(got, i)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package xrpctest
+
+import "github.com/peakedshout/go-pandorasbox/tool/xerror"
+
+var (
+	ErrInjectedReset = xerror.New("xrpctest: injected reset")
+)
@@ -0,0 +1,210 @@
+package xrpctest
+
+import (
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type faultKind uint8
+
+const (
+	faultLatency faultKind = iota
+	faultDrop
+	faultReset
+)
+
+type faultRule struct {
+	kind  faultKind
+	match Matcher
+	delay time.Duration
+	rate  float64 // probability of applying to a matched message, 1 means always
+	n     int     // remaining applications, -1 means unlimited
+}
+
+// Faults
+//
+//	Faults are evaluated against every message at the moment it is written, by whichever side writes it,
+//	so each message is affected once. Rules are checked in the order they were added:
+//	latencies add up, a drop or a reset stops the message from being sent.
+type Faults struct {
+	mux         sync.Mutex
+	rules       []*faultRule
+	handlerErrs map[string]error
+	rand        *rand.Rand
+}
+
+func newFaults() *Faults {
+	return &Faults{
+		handlerErrs: make(map[string]error),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Seed Make DropRate reproducible.
+func (f *Faults) Seed(seed int64) *Faults {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.rand = rand.New(rand.NewSource(seed))
+	return f
+}
+
+// Latency Delay every matched message by d before it is written.
+func (f *Faults) Latency(match Matcher, d time.Duration) *Faults {
+	return f.add(&faultRule{kind: faultLatency, match: match, delay: d, rate: 1, n: -1})
+}
+
+// Drop Silently drop the next n matched messages, n <= 0 drops all of them.
+func (f *Faults) Drop(match Matcher, n int) *Faults {
+	if n <= 0 {
+		n = -1
+	}
+	return f.add(&faultRule{kind: faultDrop, match: match, rate: 1, n: n})
+}
+
+// DropRate Drop each matched message with probability p.
+func (f *Faults) DropRate(match Matcher, p float64) *Faults {
+	return f.add(&faultRule{kind: faultDrop, match: match, rate: p, n: -1})
+}
+
+// Reset Close the underlying connection of the session writing the next matched message, instead of sending it.
+func (f *Faults) Reset(match Matcher) *Faults {
+	return f.add(&faultRule{kind: faultReset, match: match, rate: 1, n: 1})
+}
+
+// HandlerError Make the handler registered through Harness.Handle for header fail with err, a nil err restores it.
+func (f *Faults) HandlerError(header string, err error) *Faults {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err == nil {
+		delete(f.handlerErrs, header)
+	} else {
+		f.handlerErrs[header] = err
+	}
+	return f
+}
+
+// Clear Remove every fault, including handler errors.
+func (f *Faults) Clear() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.rules = nil
+	f.handlerErrs = make(map[string]error)
+}
+
+func (f *Faults) add(r *faultRule) *Faults {
+	if r.match == nil {
+		r.match = MatchAny()
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.rules = append(f.rules, r)
+	return f
+}
+
+func (f *Faults) apply(rs *xmsg.RawSession, m *Message) error {
+	var delay time.Duration
+	var drop, reset bool
+	f.mux.Lock()
+	for _, r := range f.rules {
+		if r.n == 0 || !r.match(m) {
+			continue
+		}
+		if r.rate < 1 && f.rand.Float64() >= r.rate {
+			continue
+		}
+		if r.n > 0 {
+			r.n--
+		}
+		switch r.kind {
+		case faultLatency:
+			delay += r.delay
+		case faultDrop:
+			drop = true
+		case faultReset:
+			reset = true
+		}
+	}
+	f.mux.Unlock()
+	if reset {
+		m.Dropped = true
+		_ = rs.Close()
+		return ErrInjectedReset
+	}
+	if drop {
+		m.Dropped = true
+		return nil
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-rs.Context().Done():
+			return rs.Context().Err()
+		}
+	}
+	return nil
+}
+
+func (f *Faults) handlerError(header string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.handlerErrs[header]
+}
+
+func (f *Faults) wrapHandler(header string, handler any) any {
+	switch fn := handler.(type) {
+	case func(ctx xrpc.Rpc) (any, error):
+		handler = xrpc.RpcHandler(fn)
+	case func(ctx xrpc.Stream) error:
+		handler = xrpc.StreamHandler(fn)
+	case func(ctx xrpc.SendStream) error:
+		handler = xrpc.SendStreamHandler(fn)
+	case func(ctx xrpc.RecvStream) (any, error):
+		handler = xrpc.RecvStreamHandler(fn)
+	case func(ctx xrpc.ReverseRpc) error:
+		handler = xrpc.ReverseRpcHandler(fn)
+	}
+	switch fn := handler.(type) {
+	case xrpc.RpcHandler:
+		return xrpc.RpcHandler(func(ctx xrpc.Rpc) (any, error) {
+			if err := f.handlerError(header); err != nil {
+				return nil, err
+			}
+			return fn(ctx)
+		})
+	case xrpc.StreamHandler:
+		return xrpc.StreamHandler(func(ctx xrpc.Stream) error {
+			if err := f.handlerError(header); err != nil {
+				return err
+			}
+			return fn(ctx)
+		})
+	case xrpc.SendStreamHandler:
+		return xrpc.SendStreamHandler(func(ctx xrpc.SendStream) error {
+			if err := f.handlerError(header); err != nil {
+				return err
+			}
+			return fn(ctx)
+		})
+	case xrpc.RecvStreamHandler:
+		return xrpc.RecvStreamHandler(func(ctx xrpc.RecvStream) (any, error) {
+			if err := f.handlerError(header); err != nil {
+				return nil, err
+			}
+			return fn(ctx)
+		})
+	case xrpc.ReverseRpcHandler:
+		return xrpc.ReverseRpcHandler(func(ctx xrpc.ReverseRpc) error {
+			if err := f.handlerError(header); err != nil {
+				return err
+			}
+			return fn(ctx)
+		})
+	default:
+		return handler
+	}
+}
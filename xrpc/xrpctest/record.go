@@ -0,0 +1,140 @@
+package xrpctest
+
+import (
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"sync"
+	"time"
+)
+
+// Message A copy of one XMsg seen by either end of the harness.
+type Message struct {
+	Time    time.Time
+	Side    Side
+	Dir     xmsg.Direction
+	Session string
+	Header  string
+	Id      uint32
+	Opt     xmsg.OptType
+	Payload []byte
+	// Dropped is set when the message was written but dropped by an injected fault.
+	Dropped bool
+}
+
+func newMessage(side Side, dir xmsg.Direction, sid string, xMsg *xmsg.XMsg) Message {
+	return Message{
+		Time:    time.Now(),
+		Side:    side,
+		Dir:     dir,
+		Session: sid,
+		Header:  xMsg.Header(),
+		Id:      xMsg.Id(),
+		Opt:     xMsg.Opt(),
+		Payload: append([]byte(nil), xMsg.Payload()...),
+	}
+}
+
+// Bind Unmarshal the payload, with the same rules as xmsg.XMsg.Unmarshal.
+func (m *Message) Bind(out any) error {
+	xMsg, err := xmsg.NewXMsg(m.Header, xmsg.FlagZero, m.Id, m.Opt, nil)
+	if err != nil {
+		return err
+	}
+	xMsg.SetPayload(m.Payload)
+	return xMsg.Unmarshal(out)
+}
+
+// Matcher Select messages for faults and queries.
+type Matcher func(m *Message) bool
+
+func MatchAny() Matcher {
+	return func(m *Message) bool {
+		return true
+	}
+}
+
+func MatchHeader(header string) Matcher {
+	return func(m *Message) bool {
+		return m.Header == header
+	}
+}
+
+func MatchOpt(opt xmsg.OptType) Matcher {
+	return func(m *Message) bool {
+		return m.Opt == opt
+	}
+}
+
+// MatchSide Messages observed by side, combined with MatchDir(xmsg.DirectionWrite) it selects what that side sent.
+func MatchSide(side Side) Matcher {
+	return func(m *Message) bool {
+		return m.Side == side
+	}
+}
+
+func MatchDir(dir xmsg.Direction) Matcher {
+	return func(m *Message) bool {
+		return m.Dir == dir
+	}
+}
+
+func MatchAll(ms ...Matcher) Matcher {
+	return func(m *Message) bool {
+		for _, one := range ms {
+			if !one(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+type Recorder struct {
+	mux  sync.Mutex
+	list []Message
+	stop bool
+}
+
+func newRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Messages Recorded messages in observation order, a nil match returns all of them.
+func (r *Recorder) Messages(match Matcher) []Message {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	list := make([]Message, 0, len(r.list))
+	for i := range r.list {
+		if match == nil || match(&r.list[i]) {
+			list = append(list, r.list[i])
+		}
+	}
+	return list
+}
+
+func (r *Recorder) Reset() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.list = nil
+}
+
+// Pause Stop recording until Resume, messages still flow.
+func (r *Recorder) Pause() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.stop = true
+}
+
+func (r *Recorder) Resume() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.stop = false
+}
+
+func (r *Recorder) record(m Message) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stop {
+		return
+	}
+	r.list = append(r.list, m)
+}
@@ -0,0 +1,217 @@
+package xrpctest
+
+import (
+	"context"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xnet/xdummy"
+	"github.com/peakedshout/go-pandorasbox/xnet/xnetutil"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"net"
+	"sync"
+)
+
+// Side Which end of the in-memory connection observed a message.
+type Side uint8
+
+const (
+	SideClient Side = iota
+	SideServer
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideServer:
+		return "server"
+	default:
+		return "unknown"
+	}
+}
+
+type Config struct {
+	Ctx context.Context
+	// Server and Client are copied, so the same config can be reused between harnesses.
+	// Their XMsgHook still runs, after fault injection and recording.
+	Server *xrpc.ServerConfig
+	Client *xrpc.ClientConfig
+}
+
+// Harness
+//
+//	A Server and a Client wired together through xdummy connections.
+//	Register handlers with Handle (or directly on Server) before calling Start.
+type Harness struct {
+	Server *xrpc.Server
+	Client *xrpc.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	ln     net.Listener
+	dr     xnetutil.Dialer
+
+	faults   *Faults
+	recorder *Recorder
+
+	connMux sync.Mutex
+	connMap map[net.Conn]struct{}
+
+	starter sync.Once
+	closer  sync.Once
+}
+
+func NewHarness(cfg *Config) *Harness {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+	ctx := cfg.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h := &Harness{
+		faults:   newFaults(),
+		recorder: newRecorder(),
+		connMap:  make(map[net.Conn]struct{}),
+	}
+	h.ctx, h.cancel = context.WithCancel(ctx)
+	ln, dr := xdummy.NewDummyListenDialer(h.ctx)
+	h.ln = ln
+	h.dr = xnetutil.NewCallBackDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dr.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return h.track(conn), nil
+	})
+
+	var sc xrpc.ServerConfig
+	if cfg.Server != nil {
+		sc = *cfg.Server
+	}
+	if sc.Ctx == nil {
+		sc.Ctx = h.ctx
+	}
+	sc.XMsgHook = h.hook(SideServer, sc.XMsgHook)
+
+	var cc xrpc.ClientConfig
+	if cfg.Client != nil {
+		cc = *cfg.Client
+	}
+	if cc.Ctx == nil {
+		cc.Ctx = h.ctx
+	}
+	cc.XMsgHook = h.hook(SideClient, cc.XMsgHook)
+	if cc.ShareDialFunc == nil {
+		cc.ShareDialFunc = func(ctx context.Context) (net.Conn, error) {
+			return h.dr.DialContext(ctx, "dummy", "dummy")
+		}
+	}
+
+	h.Server = xrpc.NewServer(&sc)
+	h.Client = xrpc.NewClient(&cc)
+	return h
+}
+
+// Handle Same as Server.MustAddHandler, but the handler can be failed with Faults.HandlerError.
+func (h *Harness) Handle(header string, handler any) {
+	h.Server.MustAddHandler(header, h.faults.wrapHandler(header, handler))
+}
+
+// Start Serve the in-memory listener, handlers can no longer be added afterward.
+func (h *Harness) Start() {
+	h.starter.Do(func() {
+		go h.Server.Serve(h.ln)
+	})
+}
+
+// Dial Open a new client session to the server, the harness is started if it is not yet.
+func (h *Harness) Dial(ctx context.Context) (*xrpc.ClientSession, error) {
+	h.Start()
+	return h.Client.DialContext(ctx, h.dr, "dummy", "dummy")
+}
+
+// Dialer The in-memory dialer reaching the server, for use with Client.WithConn or other clients.
+func (h *Harness) Dialer() xnetutil.Dialer {
+	return h.dr
+}
+
+func (h *Harness) Faults() *Faults {
+	return h.faults
+}
+
+func (h *Harness) Recorder() *Recorder {
+	return h.recorder
+}
+
+// Messages Shortcut of Recorder().Messages.
+func (h *Harness) Messages(match Matcher) []Message {
+	return h.recorder.Messages(match)
+}
+
+// ResetConns Close every in-memory connection dialed so far, as if the network dropped them.
+func (h *Harness) ResetConns() {
+	h.connMux.Lock()
+	list := make([]net.Conn, 0, len(h.connMap))
+	for conn := range h.connMap {
+		list = append(list, conn)
+	}
+	h.connMux.Unlock()
+	for _, conn := range list {
+		_ = conn.Close()
+	}
+}
+
+func (h *Harness) Context() context.Context {
+	return h.ctx
+}
+
+func (h *Harness) Close() error {
+	h.closer.Do(func() {
+		h.ResetConns()
+		_ = h.Client.Close()
+		_ = h.Server.Close()
+		h.cancel()
+		_ = h.ln.Close()
+	})
+	return nil
+}
+
+func (h *Harness) hook(side Side, next xmsg.Hook) xmsg.Hook {
+	return func(rs *xmsg.RawSession, dir xmsg.Direction, xMsg *xmsg.XMsg) (*xmsg.XMsg, error) {
+		m := newMessage(side, dir, rs.Id(), xMsg)
+		var err error
+		if dir == xmsg.DirectionWrite {
+			err = h.faults.apply(rs, &m)
+		}
+		h.recorder.record(m)
+		if err != nil {
+			return nil, err
+		}
+		if m.Dropped {
+			return nil, nil
+		}
+		if next != nil {
+			return next(rs, dir, xMsg)
+		}
+		return xMsg, nil
+	}
+}
+
+func (h *Harness) track(conn net.Conn) net.Conn {
+	h.connMux.Lock()
+	h.connMap[conn] = struct{}{}
+	h.connMux.Unlock()
+	return &trackConn{Conn: conn, h: h}
+}
+
+type trackConn struct {
+	net.Conn
+	h *Harness
+}
+
+func (tc *trackConn) Close() error {
+	tc.h.connMux.Lock()
+	delete(tc.h.connMap, tc.Conn)
+	tc.h.connMux.Unlock()
+	return tc.Conn.Close()
+}
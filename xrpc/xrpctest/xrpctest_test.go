@@ -0,0 +1,219 @@
+package xrpctest
+
+import (
+	"context"
+	"errors"
+	"github.com/peakedshout/go-pandorasbox/xmsg"
+	"github.com/peakedshout/go-pandorasbox/xrpc"
+	"testing"
+	"time"
+)
+
+func newEchoHarness(t *testing.T) *Harness {
+	h := NewHarness(nil)
+	h.Handle("echo", func(ctx xrpc.Rpc) (any, error) {
+		var str string
+		err := ctx.Bind(&str)
+		if err != nil {
+			return nil, err
+		}
+		return str, nil
+	})
+	h.Handle("stream", func(ctx xrpc.Stream) error {
+		for {
+			var str string
+			err := ctx.Recv(&str)
+			if err != nil {
+				return err
+			}
+			err = ctx.Send(str)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	h.Start()
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+	return h
+}
+
+func TestHarness(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	h := newEchoHarness(t)
+	sess, err := h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var str string
+	err = sess.Rpc(ctx, "echo", "hello", &str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "hello" {
+		t.Fatal(str)
+	}
+	stream, err := sess.Stream(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	err = stream.Send("world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Recv(&str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "world" {
+		t.Fatal(str)
+	}
+	err = h.Client.Rpc(ctx, "echo", "share", &str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "share" {
+		t.Fatal(str)
+	}
+
+	sent := h.Messages(MatchAll(MatchHeader("echo"), MatchSide(SideClient), MatchDir(xmsg.DirectionWrite)))
+	if len(sent) != 2 {
+		t.Fatal(len(sent))
+	}
+	err = sent[0].Bind(&str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "hello" {
+		t.Fatal(str)
+	}
+	got := h.Messages(MatchAll(MatchHeader("echo"), MatchSide(SideServer), MatchDir(xmsg.DirectionRead)))
+	if len(got) != 2 {
+		t.Fatal(len(got))
+	}
+}
+
+func TestFaultsDrop(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	h := newEchoHarness(t)
+	sess, err := h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	h.Faults().Drop(MatchAll(MatchHeader("echo"), MatchSide(SideServer)), 1)
+	tCtx, tCl := context.WithTimeout(ctx, 500*time.Millisecond)
+	err = sess.Rpc(tCtx, "echo", "lost", nil)
+	tCl()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	var str string
+	err = sess.Rpc(ctx, "echo", "found", &str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != "found" {
+		t.Fatal(str)
+	}
+	dropped := h.Messages(func(m *Message) bool {
+		return m.Dropped
+	})
+	if len(dropped) != 1 || dropped[0].Side != SideServer {
+		t.Fatal(dropped)
+	}
+}
+
+func TestFaultsLatency(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	h := newEchoHarness(t)
+	sess, err := h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	h.Faults().Latency(MatchHeader("echo"), 200*time.Millisecond)
+	now := time.Now()
+	err = sess.Rpc(ctx, "echo", "slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(now); d < 400*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func TestFaultsReset(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	h := newEchoHarness(t)
+	sess, err := h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	h.Faults().Reset(MatchAll(MatchHeader("echo"), MatchSide(SideServer)))
+	err = sess.Rpc(ctx, "echo", "reset", nil)
+	if err == nil {
+		t.Fatal()
+	}
+	select {
+	case <-sess.Context().Done():
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	sess, err = h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	err = sess.Rpc(ctx, "echo", "again", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ResetConns()
+	select {
+	case <-sess.Context().Done():
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestFaultsHandlerError(t *testing.T) {
+	ctx, cl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cl()
+	h := newEchoHarness(t)
+	sess, err := h.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	h.Faults().HandlerError("echo", errors.New("boom")).HandlerError("stream", errors.New("boom"))
+	err = sess.Rpc(ctx, "echo", "x", nil)
+	if err == nil || err.Error() != "boom" {
+		t.Fatal(err)
+	}
+	stream, err := sess.Stream(ctx, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Recv(nil)
+	if err == nil {
+		t.Fatal()
+	}
+	h.Faults().Clear()
+	err = sess.Rpc(ctx, "echo", "x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}